@@ -7,7 +7,7 @@ import (
 	"os/exec"
 	"strings"
 
-	"github.com/lima-vm/lima/pkg/osutil"
+	"github.com/lima-vm/lima/pkg/limayaml"
 	"github.com/lima-vm/lima/pkg/sshutil"
 	"github.com/lima-vm/lima/pkg/store"
 	"github.com/sirupsen/logrus"
@@ -46,11 +46,8 @@ func copyAction(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	u, err := osutil.LimaUser(false)
-	if err != nil {
-		return err
-	}
 	instDirs := make(map[string]string)
+	instUsers := make(map[string]string)
 	scpArgs := []string{}
 	debug, err := cmd.Flags().GetBool("debug")
 	if err != nil {
@@ -80,8 +77,17 @@ func copyAction(cmd *cobra.Command, args []string) error {
 			if inst.Status == store.StatusStopped {
 				return fmt.Errorf("instance %q is stopped, run `limactl start %s` to start the instance", instName, instName)
 			}
-			scpArgs = append(scpArgs, fmt.Sprintf("scp://%s@127.0.0.1:%d/%s", u.Username, inst.SSHLocalPort, path[1]))
+			y, err := inst.LoadYAML()
+			if err != nil {
+				return err
+			}
+			username, _, err := limayaml.GuestUser(y, false)
+			if err != nil {
+				return err
+			}
+			scpArgs = append(scpArgs, fmt.Sprintf("scp://%s@127.0.0.1:%d/%s", username, inst.SSHLocalPort, path[1]))
 			instDirs[instName] = inst.Dir
+			instUsers[instName] = username
 		default:
 			return fmt.Errorf("path %q contains multiple colons", arg)
 		}
@@ -92,8 +98,8 @@ func copyAction(cmd *cobra.Command, args []string) error {
 		// Only one (instance) host is involved; we can use the instance-specific
 		// arguments such as ControlPath.  This is preferred as we can multiplex
 		// sessions without re-authenticating (MaxSessions permitting).
-		for _, instDir := range instDirs {
-			sshArgs, err = sshutil.SSHArgs(instDir, false)
+		for instName, instDir := range instDirs {
+			sshArgs, err = sshutil.SSHArgs(instDir, instUsers[instName], false)
 			if err != nil {
 				return err
 			}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/alessio/shellescape"
+	"github.com/lima-vm/lima/pkg/limayaml"
 	"github.com/lima-vm/lima/pkg/sshutil"
 	"github.com/lima-vm/lima/pkg/store"
 	"github.com/mattn/go-isatty"
@@ -118,7 +119,11 @@ func shellAction(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	sshArgs, err := sshutil.SSHArgs(inst.Dir, *y.SSH.LoadDotSSHPubKeys)
+	username, _, err := limayaml.GuestUser(y, false)
+	if err != nil {
+		return err
+	}
+	sshArgs, err := sshutil.SSHArgs(inst.Dir, username, *y.SSH.LoadDotSSHPubKeys)
 	if err != nil {
 		return err
 	}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"os"
 
-	"github.com/lima-vm/lima/pkg/store"
+	"github.com/lima-vm/lima/pkg/cidata"
+	"github.com/lima-vm/lima/pkg/limayaml"
 	"github.com/spf13/cobra"
 
 	"github.com/sirupsen/logrus"
@@ -21,13 +23,23 @@ func newValidateCommand() *cobra.Command {
 
 func validateAction(cmd *cobra.Command, args []string) error {
 	for _, f := range args {
-		_, err := store.LoadYAMLByFilePath(f)
+		// Not loaded with store.LoadYAMLByFilePath, as it stops at limayaml.Validate,
+		// while cidata.ValidateForGenerate reports the problems of limayaml.Validate along with its own ones
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		y, err := limayaml.Load(b, f)
 		if err != nil {
 			return fmt.Errorf("failed to load YAML file %q: %w", f, err)
 		}
-		if _, err := instNameFromYAMLPath(f); err != nil {
+		instName, err := instNameFromYAMLPath(f)
+		if err != nil {
 			return err
 		}
+		if err := cidata.ValidateForGenerate(y, instName); err != nil {
+			return fmt.Errorf("failed to validate YAML file %q: %w", f, err)
+		}
 		logrus.Infof("%q: OK", f)
 	}
 
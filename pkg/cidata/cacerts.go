@@ -0,0 +1,83 @@
+package cidata
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lima-vm/lima/pkg/localpathutil"
+)
+
+// caCertsDir is the directory of the CA certificates in the cidata ISO.
+// boot/08-ca-certs.sh installs them into the system trust store of the guest.
+const caCertsDir = "ca-certs"
+
+// isInlinePEM returns whether an entry of `caCerts` is an inline PEM rather than a file path.
+func isInlinePEM(entry string) bool {
+	return strings.Contains(entry, "-----BEGIN ")
+}
+
+// loadCACerts reads the entries of `caCerts`, which are either file paths or inline PEM,
+// and returns the certificates of each entry as PEM.
+// An entry is rejected unless it only has certificates that are valid at now.
+func loadCACerts(entries []string, now time.Time) ([][]byte, error) {
+	var res [][]byte
+	for i, entry := range entries {
+		name := fmt.Sprintf("caCerts[%d]", i)
+		data := []byte(entry)
+		if !isInlinePEM(entry) {
+			name += fmt.Sprintf(" (%q)", entry)
+			expanded, err := localpathutil.Expand(entry)
+			if err != nil {
+				return nil, fmt.Errorf("failed to expand %s: %w", name, err)
+			}
+			data, err = os.ReadFile(expanded)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+		}
+		b, err := parseCACerts(data, now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		res = append(res, b)
+	}
+	return res, nil
+}
+
+// parseCACerts parses the PEM certificates in data, and returns them re-encoded without any text around them.
+func parseCACerts(data []byte, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("expected a \"CERTIFICATE\" PEM block, got %q", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the certificate: %w", err)
+		}
+		if now.After(cert.NotAfter) {
+			return nil, fmt.Errorf("certificate %q expired at %s", cert.Subject, cert.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(cert.NotBefore) {
+			return nil, fmt.Errorf("certificate %q is not valid until %s", cert.Subject, cert.NotBefore.Format(time.RFC3339))
+		}
+		if err := pem.Encode(&buf, &pem.Block{Type: block.Type, Bytes: block.Bytes}); err != nil {
+			return nil, err
+		}
+	}
+	if buf.Len() == 0 {
+		return nil, errors.New("no PEM certificate was found")
+	}
+	return buf.Bytes(), nil
+}
@@ -9,6 +9,13 @@ WARNING() {
 	echo "LIMA| WARNING: $*"
 }
 
+if [ -e "${LIMA_CIDATA_MNT}"/manifest.txt ] && command -v sha256sum >/dev/null 2>&1; then
+	if ! (cd "${LIMA_CIDATA_MNT}" && sha256sum -c manifest.txt >/dev/null); then
+		WARNING "${LIMA_CIDATA_MNT} is corrupt (see manifest.txt)"
+		exit 1
+	fi
+fi
+
 # shellcheck disable=SC2163
 while read -r line; do export "$line"; done <"${LIMA_CIDATA_MNT}"/lima.env
 
@@ -36,6 +43,17 @@ if [ -e /etc/environment ]; then
 fi
 cat "${LIMA_CIDATA_MNT}/etc_environment" >>/etc/environment
 
+if [ -d "${LIMA_CIDATA_MNT}"/provision.dependency ]; then
+	for f in "${LIMA_CIDATA_MNT}"/provision.dependency/*; do
+		INFO "Executing $f"
+		if ! "$f"; then
+			WARNING "Failed to execute $f, skipping the other provision scripts"
+			INFO "Exiting with code 1"
+			exit 1
+		fi
+	done
+fi
+
 if [ -d "${LIMA_CIDATA_MNT}"/provision.system ]; then
 	for f in "${LIMA_CIDATA_MNT}"/provision.system/*; do
 		INFO "Executing $f"
@@ -0,0 +1,45 @@
+#!/bin/sh
+set -eux
+
+# Install the CA certificates of `caCerts` into the system trust store
+if [ -d /etc/pki/ca-trust/source/anchors ]; then
+	# Fedora, RHEL, CentOS
+	ANCHORS=/etc/pki/ca-trust/source/anchors
+	UPDATE=update-ca-trust
+elif [ -d /etc/ca-certificates/trust-source/anchors ]; then
+	# Arch Linux
+	ANCHORS=/etc/ca-certificates/trust-source/anchors
+	UPDATE=update-ca-trust
+elif [ -d /etc/pki/trust/anchors ]; then
+	# openSUSE
+	ANCHORS=/etc/pki/trust/anchors
+	UPDATE=update-ca-certificates
+else
+	# Debian, Ubuntu, Alpine
+	ANCHORS=/usr/local/share/ca-certificates
+	UPDATE=update-ca-certificates
+fi
+
+# Remove the certificates installed on the previous boot, as they may have been removed from `caCerts`
+INSTALLED=0
+for f in "${ANCHORS}"/lima-ca-*.crt; do
+	[ -e "${f}" ] || continue
+	rm -f "${f}"
+	INSTALLED=1
+done
+
+if [ -d "${LIMA_CIDATA_MNT}/ca-certs" ]; then
+	mkdir -p "${ANCHORS}"
+	for f in "${LIMA_CIDATA_MNT}"/ca-certs/*.crt; do
+		install -m 644 "${f}" "${ANCHORS}/lima-ca-$(basename "${f}")"
+		INSTALLED=1
+	done
+fi
+
+if [ "${INSTALLED}" = 1 ]; then
+	if command -v "${UPDATE}" >/dev/null 2>&1; then
+		"${UPDATE}"
+	else
+		echo >&2 "${UPDATE} is not installed, the CA certificates are not trusted yet"
+	fi
+fi
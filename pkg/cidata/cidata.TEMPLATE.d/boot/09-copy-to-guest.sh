@@ -0,0 +1,17 @@
+#!/bin/sh
+set -eux
+
+# Copy the files of `copyToGuest` on the first boot.
+# Existing files are left untouched, so that the changes made in the guest are not overwritten on restart.
+# NOTE: Busybox sh does not support `for ((i=0;i<$N;i++))` form
+for i in $(seq 0 $((LIMA_CIDATA_COPY_TO_GUEST - 1))); do
+	destvar="LIMA_CIDATA_COPY_TO_GUEST_${i}_DESTINATION"
+	dest="$(eval echo \$"$destvar")"
+	modevar="LIMA_CIDATA_COPY_TO_GUEST_${i}_MODE"
+	mode="$(eval echo \$"$modevar")"
+	if [ -e "${dest}" ]; then
+		continue
+	fi
+	mkdir -p "$(dirname "${dest}")"
+	install -m "${mode}" "${LIMA_CIDATA_MNT}/copy/$(printf '%08d' "${i}")" "${dest}"
+done
@@ -9,7 +9,11 @@ fi
 command -v systemctl >/dev/null 2>&1 || exit 0
 
 if [ ! -x /usr/local/bin/nerdctl ]; then
-	tar Cxzf /usr/local "${LIMA_CIDATA_MNT}"/nerdctl-full.tgz
+	if [ -e "${LIMA_CIDATA_MNT}"/nerdctl-full.txz ]; then
+		tar CxJf /usr/local "${LIMA_CIDATA_MNT}"/nerdctl-full.txz
+	else
+		tar Cxzf /usr/local "${LIMA_CIDATA_MNT}"/nerdctl-full.tgz
+	fi
 fi
 
 if [ "${LIMA_CIDATA_CONTAINERD_SYSTEM}" = 1 ]; then
@@ -1,17 +1,24 @@
 package cidata
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/lima-vm/lima/pkg/downloader"
 	"github.com/lima-vm/lima/pkg/iso9660util"
 	"github.com/lima-vm/lima/pkg/limayaml"
@@ -20,15 +27,52 @@ import (
 	qemu "github.com/lima-vm/lima/pkg/qemu/const"
 	"github.com/lima-vm/lima/pkg/sshutil"
 	"github.com/lima-vm/lima/pkg/store/filenames"
+	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
 )
 
-func setupEnv(y *limayaml.LimaYAML) (map[string]string, error) {
+var (
+	// ErrNoSSHKey is returned when no usable SSH public key was found for the guest user.
+	ErrNoSSHKey = errors.New("no usable SSH key was found, run `ssh-keygen`")
+	// ErrNoContainerdArchive is returned when containerd is enabled but lima.yaml has no archive for the arch.
+	ErrNoContainerdArchive = errors.New("no containerd archive was provided")
+	// ErrUnknownProvisionMode is returned for a provision script with an unsupported mode.
+	ErrUnknownProvisionMode = errors.New("unknown provision mode")
+	// ErrGuestAgentDigestMismatch is returned when the guest agent binary does not match $LIMA_GUESTAGENT_<ARCH>_DIGEST.
+	ErrGuestAgentDigestMismatch = errors.New("the guest agent binary does not match the expected digest")
+	// ErrGuestAgentNotFound is returned when none of the default locations has the guest agent binary.
+	ErrGuestAgentNotFound = errors.New("guest agent binary not found")
+)
+
+// BuildEnv returns the environment variables of the guest, in the following order of precedence:
+//
+// - the proxy variables of the limactl process environment
+// - the env.* settings of lima.yaml
+// - the envFiles of lima.yaml, the later files taking precedence over the earlier ones
+// - the proxy settings of the host system
+//
+// The lowercase and uppercase variants of the proxy variables are set to the same value,
+// the lowercase one taking precedence when both are set.
+// The no_proxy variables are not overridden, but merged: the guest gets the union of all the exclusions.
+// The messages about overridden values are logged in a fixed order, and the variables
+// are written to the guest sorted by name.
+func BuildEnv(y *limayaml.LimaYAML) (map[string]string, error) {
 	// Start with the proxy variables from the system settings.
 	env, err := osutil.ProxySettings()
 	if err != nil {
 		return env, err
 	}
+	noProxy := noProxyValues(env)
+	fileEnv, err := loadEnvFiles(y.EnvFiles)
+	if err != nil {
+		return env, err
+	}
+	noProxy = append(noProxy, noProxyValues(fileEnv)...)
+	noProxy = append(noProxy, noProxyValues(y.Env)...)
+	// envFiles override system settings without giving a warning
+	for name, value := range fileEnv {
+		env[name] = value
+	}
 	// env.* settings from lima.yaml override system settings without giving a warning
 	for name, value := range y.Env {
 		env[name] = value
@@ -39,8 +83,13 @@ func setupEnv(y *limayaml.LimaYAML) (map[string]string, error) {
 	for i, name := range lowerVars {
 		upperVars[i] = strings.ToUpper(name)
 	}
+	processEnv := make(map[string]string)
 	for _, name := range append(lowerVars, upperVars...) {
 		if value, ok := os.LookupEnv(name); ok {
+			processEnv[name] = value
+			if strings.EqualFold(name, "no_proxy") {
+				continue
+			}
 			if _, ok := env[name]; ok && value != env[name] {
 				logrus.Infof("Overriding %q value %q with %q from limactl process environment",
 					name, env[name], value)
@@ -51,6 +100,10 @@ func setupEnv(y *limayaml.LimaYAML) (map[string]string, error) {
 	// Make sure uppercase variants have the same value as lowercase ones.
 	// If both are set, the lowercase variant value takes precedence.
 	for _, lowerName := range lowerVars {
+		if lowerName == "no_proxy" {
+			// merged below
+			continue
+		}
 		upperName := strings.ToUpper(lowerName)
 		if _, ok := env[lowerName]; ok {
 			if _, ok := env[upperName]; ok && env[lowerName] != env[upperName] {
@@ -62,197 +115,1126 @@ func setupEnv(y *limayaml.LimaYAML) (map[string]string, error) {
 			env[lowerName] = env[upperName]
 		}
 	}
+	noProxy = append(noProxy, noProxyValues(processEnv)...)
+	if len(noProxy) > 0 {
+		merged := mergeNoProxy(noProxy)
+		env["no_proxy"] = merged
+		env["NO_PROXY"] = merged
+	}
 	return env, nil
 }
 
-func GenerateISO9660(instDir, name string, y *limayaml.LimaYAML, udpDNSLocalPort int) error {
-	if err := limayaml.Validate(*y, false); err != nil {
-		return err
+// noProxyValues returns the values of no_proxy and NO_PROXY in env, if set.
+func noProxyValues(env map[string]string) []string {
+	var res []string
+	for _, name := range []string{"no_proxy", "NO_PROXY"} {
+		if value, ok := env[name]; ok {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
+// mergeNoProxy returns the union of the comma-separated lists of values, in order of first appearance.
+func mergeNoProxy(values []string) string {
+	var entries []string
+	seen := make(map[string]struct{})
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if _, ok := seen[entry]; ok {
+				continue
+			}
+			seen[entry] = struct{}{}
+			entries = append(entries, entry)
+		}
 	}
-	u, err := osutil.LimaUser(true)
+	return strings.Join(entries, ",")
+}
+
+// Plan is the content of the cidata ISO that GenerateISO9660 would write.
+type Plan struct {
+	// Args are the arguments of the templates, including the mounts, the networks, the env, and the DNS addresses.
+	Args TemplateArgs
+	// Paths are the paths of the files in the ISO.
+	// The name of the containerd archive is guessed from its location, as its compression is only known after downloading it.
+	Paths []string
+	// GuestAgentBinary is the path of the guest agent binary on the host.
+	GuestAgentBinary string
+	// ContainerdArchives are the candidates for the containerd archive, tried in order. Empty when containerd is disabled.
+	ContainerdArchives []limayaml.File
+}
+
+// GenerateISO9660Plan returns the content of the cidata ISO that GenerateISO9660 would write,
+// without downloading the containerd archive and without writing the ISO.
+func GenerateISO9660Plan(instDir, name string, y *limayaml.LimaYAML, udpDNSLocalPort, tcpDNSLocalPort int) (*Plan, error) {
+	if err := ValidateForGenerate(y, name); err != nil {
+		return nil, err
+	}
+	args, err := BuildTemplateArgs(instDir, name, y, udpDNSLocalPort, tcpDNSLocalPort)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	layout, err := configLayout(args, y)
+	if err != nil {
+		return nil, err
+	}
+	guestAgentPath, err := guestAgentBinaryPath(y.Arch)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		Args:             args,
+		GuestAgentBinary: guestAgentPath,
+	}
+	for _, f := range layout {
+		plan.Paths = append(plan.Paths, f.Path)
+	}
+	plan.Paths = append(plan.Paths, guestAgentFile)
+	if args.Containerd.System || args.Containerd.User {
+		for _, f := range y.Containerd.Archives {
+			if f.Arch == y.Arch {
+				plan.ContainerdArchives = append(plan.ContainerdArchives, f)
+			}
+		}
+		if len(plan.ContainerdArchives) == 0 {
+			return nil, fmt.Errorf("%w for arch %q", ErrNoContainerdArchive, y.Arch)
+		}
+		name := containerdArchiveGzipFile
+		if loc := plan.ContainerdArchives[0].Location; strings.HasSuffix(loc, ".tar.xz") || strings.HasSuffix(loc, ".txz") {
+			name = containerdArchiveXzFile
+		}
+		plan.Paths = append(plan.Paths, name)
+	}
+	plan.Paths = append(plan.Paths, manifestFile)
+	return plan, nil
+}
+
+// GenerateResult is the result of GenerateISO9660.
+type GenerateResult struct {
+	// Rewritten is true if the ISO was (re)written, false if the existing ISO was left untouched.
+	Rewritten bool
+	// Size is the size of the ISO in bytes.
+	Size int64
+	// ContainerdArchiveStatus is downloader.StatusDownloaded or downloader.StatusUsedCache when the containerd archive
+	// was embedded into the ISO, otherwise downloader.StatusUnknown.
+	ContainerdArchiveStatus downloader.Status
+	// DNSAddresses are the DNS addresses configured in the guest.
+	DNSAddresses []string
+}
+
+// GenerateISO9660 writes the cidata ISO of the instance.
+//
+// The ISO is left untouched when the digest of its content, stored next to it, is unchanged.
+// The digest covers the rendered templates, except the instance ID, the provision scripts, the guest agent binary,
+// and the locations and the digests of the containerd archives.
+func GenerateISO9660(instDir, name string, y *limayaml.LimaYAML, udpDNSLocalPort, tcpDNSLocalPort int, opts ...Opt) (*GenerateResult, error) {
+	return GenerateISO9660Context(context.Background(), instDir, name, y, udpDNSLocalPort, tcpDNSLocalPort, opts...)
+}
+
+// GenerateISO9660Context is like GenerateISO9660, but aborts downloading the containerd archive when ctx is done.
+// The existing ISO is left untouched when aborted.
+func GenerateISO9660Context(ctx context.Context, instDir, name string, y *limayaml.LimaYAML, udpDNSLocalPort, tcpDNSLocalPort int, opts ...Opt) (*GenerateResult, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateForGenerate(y, name); err != nil {
+		return nil, err
+	}
+	w, err := SeedWriter(y.CIData.Filesystem)
+	if err != nil {
+		return nil, err
+	}
+	args, err := BuildTemplateArgs(instDir, name, y, udpDNSLocalPort, tcpDNSLocalPort)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := configLayout(args, y)
+	if err != nil {
+		return nil, err
+	}
+	guestAgentPath, err := guestAgentBinaryPath(y.Arch)
+	if err != nil {
+		return nil, err
+	}
+	// The binary is opened once, and rewound after verifying and hashing it, before it is written to the ISO
+	guestAgentBinary, err := openGuestAgentBinary(guestAgentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer guestAgentBinary.Close()
+	if err := verifyGuestAgentBinary(guestAgentBinary, guestAgentPath, y.Arch); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Using the guest agent binary %q", guestAgentPath)
+	withContainerd := args.Containerd.System || args.Containerd.User
+
+	layout, err = bufferLayout(layout)
+	if err != nil {
+		return nil, err
+	}
+	var archives []limayaml.File
+	if withContainerd {
+		archives = y.Containerd.Archives
+	}
+	// The digest ignores the instance ID, which changes on every boot unless cidata.stableInstanceID is set,
+	// so that an ISO with an otherwise unchanged content is kept, along with its instance ID.
+	digestArgs := args
+	digestArgs.IID = "iid"
+	digestLayout, err := configLayout(digestArgs, y)
+	if err != nil {
+		return nil, err
+	}
+	digestLayout, err = bufferLayout(digestLayout)
+	if err != nil {
+		return nil, err
+	}
+	dgst, err := layoutDigest(y.CIData.Filesystem, digestLayout, guestAgentBinary, archives)
+	if err != nil {
+		return nil, err
+	}
+	isoPath := filepath.Join(instDir, filenames.CIDataISO)
+	digestPath := filepath.Join(instDir, filenames.CIDataISODigest)
+	res := &GenerateResult{
+		DNSAddresses: args.DNSAddresses,
+	}
+	if isoUpToDate(isoPath, digestPath, dgst) {
+		logrus.Debugf("%q is up to date (%s)", isoPath, dgst)
+		return res, res.setSize(isoPath)
+	}
+	// Remove the stale digest first, so that it never describes a different ISO.
+	if err := os.RemoveAll(digestPath); err != nil {
+		return nil, err
+	}
+
+	guestAgentEntryPath, err := iso9660util.JoinPath(guestAgentFile)
+	if err != nil {
+		return nil, err
 	}
-	uid, err := strconv.Atoi(u.Uid)
+	layout = append(layout, iso9660util.Entry{
+		Path:   guestAgentEntryPath,
+		Reader: guestAgentBinary,
+	})
+
+	if withContainerd {
+		td, err := ioutil.TempDir("", "lima-download-nerdctl")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(td)
+		nftgzPath, status, err := containerdArchive(ctx, o, filepath.Join(td, "nerdctl-full"), y.Containerd.Archives, y.Arch)
+		if err != nil {
+			return nil, err
+		}
+
+		res.ContainerdArchiveStatus = status
+
+		nftgzR, err := os.Open(nftgzPath)
+		if err != nil {
+			return nil, err
+		}
+		defer nftgzR.Close()
+		nftgzName, err := containerdArchiveName(nftgzR)
+		if err != nil {
+			return nil, fmt.Errorf("containerd archive %q: %w", nftgzPath, err)
+		}
+		nftgzEntryPath, err := iso9660util.JoinPath(nftgzName)
+		if err != nil {
+			return nil, err
+		}
+		layout = append(layout, iso9660util.Entry{
+			Path:   nftgzEntryPath,
+			Reader: nftgzR,
+		})
+	}
+
+	manifest, err := manifestEntry(layout)
+	if err != nil {
+		return nil, err
+	}
+	layout = append(layout, manifest)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := w.Write(isoPath, "cidata", layout); err != nil {
+		return nil, err
+	}
+	res.Rewritten = true
+	if err := os.WriteFile(digestPath, []byte(dgst.String()), 0644); err != nil {
+		return res, err
+	}
+	return res, res.setSize(isoPath)
+}
+
+// SeedWriter returns the writer of the cidata image for the filesystem, one of limayaml.CIDataFilesystem*.
+// The layout of the image is the same for every filesystem.
+func SeedWriter(filesystem limayaml.CIDataFilesystem) (iso9660util.Writer, error) {
+	switch filesystem {
+	case limayaml.CIDataFilesystemISO9660:
+		return iso9660util.ISO9660Writer, nil
+	case limayaml.CIDataFilesystemVFAT:
+		return iso9660util.FATWriter, nil
+	default:
+		return nil, fmt.Errorf("unsupported cidata filesystem %q", filesystem)
+	}
+}
+
+// cidataMountOptions returns the mount(8) options of the cidata filesystem for the boot script.
+// The files are only accessible to root, and are executable.
+func cidataMountOptions(filesystem limayaml.CIDataFilesystem) string {
+	if filesystem == limayaml.CIDataFilesystemVFAT {
+		return "ro,fmask=0077,dmask=0077,exec,uid=0"
+	}
+	return "ro,mode=0700,dmode=0700,overriderockperm,exec,uid=0"
+}
+
+func (res *GenerateResult) setSize(isoPath string) error {
+	st, err := os.Stat(isoPath)
 	if err != nil {
 		return err
 	}
+	res.Size = st.Size()
+	return nil
+}
+
+// Names of the fixed entries of the cidata ISO, which the boot scripts of the guest refer to.
+// Each one must be valid for iso9660util.ValidatePath, in particular at most iso9660util.MaxNameLen characters long.
+const (
+	guestAgentFile            = "lima-guestagent"
+	containerdArchiveGzipFile = "nerdctl-full.tgz"
+	containerdArchiveXzFile   = "nerdctl-full.txz"
+	// manifestFile lists the SHA256 digests of the other files of the ISO.
+	manifestFile = "manifest.txt"
+)
+
+// manifestEntry returns the entry of manifestFile for layout, in the format of `sha256sum`,
+// so that the guest can verify the files with `sha256sum -c`.
+// The readers of layout must be io.ReadSeeker, and are rewound after computing the digests.
+func manifestEntry(layout []iso9660util.Entry) (iso9660util.Entry, error) {
+	var b bytes.Buffer
+	for _, f := range layout {
+		rs, ok := f.Reader.(io.ReadSeeker)
+		if !ok {
+			return iso9660util.Entry{}, fmt.Errorf("internal error: the reader of %q is not seekable", f.Path)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, rs); err != nil {
+			return iso9660util.Entry{}, fmt.Errorf("failed to compute the digest of %q: %w", f.Path, err)
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return iso9660util.Entry{}, err
+		}
+		fmt.Fprintf(&b, "%x  %s\n", h.Sum(nil), f.Path)
+	}
+	p, err := iso9660util.JoinPath(manifestFile)
+	if err != nil {
+		return iso9660util.Entry{}, err
+	}
+	return iso9660util.Entry{Path: p, Reader: &b}, nil
+}
+
+// bufferLayout reads the entries of layout into memory, so that they can be read more than once.
+func bufferLayout(layout []iso9660util.Entry) ([]iso9660util.Entry, error) {
+	res := make([]iso9660util.Entry, len(layout))
+	for i, f := range layout {
+		b, err := io.ReadAll(f.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %w", f.Path, err)
+		}
+		res[i] = iso9660util.Entry{Path: f.Path, Reader: bytes.NewReader(b)}
+	}
+	return res, nil
+}
+
+// layoutDigest returns the digest of the content of the cidata ISO.
+// The readers of layout must be *bytes.Reader, see bufferLayout.
+// The readers, including guestAgentBinary, are rewound after hashing them.
+func layoutDigest(filesystem limayaml.CIDataFilesystem, layout []iso9660util.Entry, guestAgentBinary io.ReadSeeker, archives []limayaml.File) (digest.Digest, error) {
+	digester := digest.SHA256.Digester()
+	h := digester.Hash()
+	fmt.Fprintf(h, "%s\x00", filesystem)
+	for _, f := range layout {
+		r := f.Reader.(*bytes.Reader)
+		fmt.Fprintf(h, "%s\x00%d\x00", f.Path, r.Size())
+		if _, err := r.WriteTo(h); err != nil {
+			return "", err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(h, "lima-guestagent\x00")
+	if _, err := io.Copy(h, guestAgentBinary); err != nil {
+		return "", err
+	}
+	if _, err := guestAgentBinary.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// The archives are identified by their locations and digests, so that they are not downloaded just for hashing.
+	b, err := json.Marshal(archives)
+	if err != nil {
+		return "", err
+	}
+	h.Write(b)
+	return digester.Digest(), nil
+}
+
+// isoUpToDate returns whether the ISO at isoPath exists and the digest stored at digestPath is dgst.
+func isoUpToDate(isoPath, digestPath string, dgst digest.Digest) bool {
+	if _, err := os.Stat(isoPath); err != nil {
+		return false
+	}
+	b, err := os.ReadFile(digestPath)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(b)) == dgst.String()
+}
+
+// BuildTemplateArgs returns the validated arguments of the templates for the instance,
+// without executing the templates or writing anything.
+// y must have been validated with ValidateForGenerate.
+func BuildTemplateArgs(instDir, name string, y *limayaml.LimaYAML, udpDNSLocalPort, tcpDNSLocalPort int) (TemplateArgs, error) {
+	username, uid, err := limayaml.GuestUser(y, true)
+	if err != nil {
+		return TemplateArgs{}, err
+	}
+	hostname := y.Hostname
+	if hostname == "" {
+		hostname = "lima-" + name
+	}
 	args := TemplateArgs{
 		Name:         name,
-		User:         u.Username,
+		Hostname:     hostname,
+		Timezone:     y.Timezone,
+		Locale:       y.Locale,
+		Packages:     dedupStrings(y.Packages),
+		User:         username,
 		UID:          uid,
 		Containerd:   Containerd{System: *y.Containerd.System, User: *y.Containerd.User},
 		SlirpNICName: qemu.SlirpNICName,
 		SlirpGateway: qemu.SlirpGateway,
 		SlirpDNS:     qemu.SlirpDNS,
-	}
 
-	// change instance id on every boot so network config will be processed again
-	args.IID = fmt.Sprintf("iid-%d", time.Now().Unix())
+		CIDataMountOptions: cidataMountOptions(y.CIData.Filesystem),
+	}
 
 	pubKeys, err := sshutil.DefaultPubKeys(*y.SSH.LoadDotSSHPubKeys)
 	if err != nil {
-		return err
+		return TemplateArgs{}, err
 	}
+	pubKeys = sshutil.FilterPubKeys(pubKeys, *y.SSH.AllowWeakPubKeys)
 	if len(pubKeys) == 0 {
-		return errors.New("no SSH key was found, run `ssh-keygen`")
+		return TemplateArgs{}, ErrNoSSHKey
 	}
+	seenPubKeys := make(map[string]string, len(pubKeys))
 	for _, f := range pubKeys {
+		blob := sshPubKeyBlob(f.Content)
+		if first, ok := seenPubKeys[blob]; ok {
+			logrus.Debugf("dropping the SSH public key from %q, as it is the same key as the one from %q", f.Filename, first)
+			continue
+		}
+		seenPubKeys[blob] = f.Filename
 		args.SSHPubKeys = append(args.SSHPubKeys, f.Content)
 	}
 
 	for _, f := range y.Mounts {
 		expanded, err := localpathutil.Expand(f.Location)
 		if err != nil {
-			return err
+			return TemplateArgs{}, err
 		}
 		args.Mounts = append(args.Mounts, expanded)
 	}
 
+	for _, f := range y.CopyToGuest {
+		args.CopyToGuest = append(args.CopyToGuest, CopyToGuest{
+			Destination: f.Destination,
+			Mode:        f.Mode,
+		})
+	}
+
 	slirpMACAddress := limayaml.MACAddress(instDir)
 	args.Networks = append(args.Networks, Network{MACAddress: slirpMACAddress, Interface: qemu.SlirpNICName})
 	for _, nw := range y.Networks {
 		args.Networks = append(args.Networks, Network{MACAddress: nw.MACAddress, Interface: nw.Interface})
 	}
 
-	args.Env, err = setupEnv(y)
+	args.Env, err = BuildEnv(y)
 	if err != nil {
-		return err
+		return TemplateArgs{}, err
 	}
 	if *y.UseHostResolver {
 		args.UDPDNSLocalPort = udpDNSLocalPort
-		args.DNSAddresses = append(args.DNSAddresses, qemu.SlirpDNS)
-	} else if len(y.DNS) > 0 {
-		for _, addr := range y.DNS {
-			args.DNSAddresses = append(args.DNSAddresses, addr.String())
+		args.TCPDNSLocalPort = tcpDNSLocalPort
+	}
+	args.DNSAddresses, err = dnsAddresses(y)
+	if err != nil {
+		return TemplateArgs{}, err
+	}
+	args.DNSSearchDomains = dedupStrings(y.DNSSearchDomains)
+	for _, o := range y.DNSOptions {
+		name, value, err := limayaml.ParseDNSOption(o)
+		if err != nil {
+			return TemplateArgs{}, err
 		}
-	} else {
-		args.DNSAddresses, err = osutil.DNSAddresses()
+		if value == "" {
+			value = "true"
+		}
+		if args.DNSOptions == nil {
+			args.DNSOptions = make(map[string]string)
+		}
+		args.DNSOptions[name] = value
+	}
+
+	if *y.CIData.StableInstanceID {
+		// change instance id only when the content changes, so cloud-init does not process the config again on every boot
+		args.IID, err = stableInstanceID(args)
 		if err != nil {
-			return err
+			return TemplateArgs{}, err
 		}
+	} else {
+		// change instance id on every boot so network config will be processed again
+		args.IID = fmt.Sprintf("iid-%d", time.Now().Unix())
 	}
 
 	if err := ValidateTemplateArgs(args); err != nil {
-		return err
+		return TemplateArgs{}, err
 	}
+	return args, nil
+}
 
-	layout, err := ExecuteTemplate(args)
+// configLayout returns the files of the ISO that are generated from args and y:
+// the templates, the provision scripts, the files of `copyToGuest`, and the CA certificates.
+func configLayout(args TemplateArgs, y *limayaml.LimaYAML) ([]iso9660util.Entry, error) {
+	userDataTemplate, err := readUserDataTemplate(y)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	layout, err := ExecuteTemplateWithUserData(args, userDataTemplate)
+	if err != nil {
+		return nil, err
 	}
 
-	for i, f := range y.Provision {
+	// With Ignition, the provision scripts are installed as systemd units instead
+	var provision []limayaml.Provision
+	if y.CIData.Format != limayaml.CIDataFormatIgnition {
+		provision = sortProvision(limayaml.MatchingProvision(y))
+	}
+	for i, f := range provision {
 		switch f.Mode {
-		case limayaml.ProvisionModeSystem, limayaml.ProvisionModeUser:
+		case limayaml.ProvisionModeSystem, limayaml.ProvisionModeUser, limayaml.ProvisionModeDependency:
+			script := f.Script
+			if f.File != "" {
+				b, err := limayaml.ReadProvisionFile(f.File)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read the provision script %q: %w", f.File, err)
+				}
+				script = string(b)
+			}
+			p, err := iso9660util.JoinPath("provision."+f.Mode, fmt.Sprintf("%08d", i))
+			if err != nil {
+				return nil, fmt.Errorf("cannot add `provision[%d]` to the cidata ISO: %w", i, err)
+			}
 			layout = append(layout, iso9660util.Entry{
-				Path:   fmt.Sprintf("provision.%s/%08d", f.Mode, i),
-				Reader: strings.NewReader(f.Script),
+				Path: p,
+				// A CR at the end of the shebang line would become part of the interpreter path
+				Reader: strings.NewReader(strings.ReplaceAll(script, "\r\n", "\n")),
 			})
 		default:
-			return fmt.Errorf("unknown provision mode %q", f.Mode)
+			return nil, fmt.Errorf("%w %q", ErrUnknownProvisionMode, f.Mode)
 		}
 	}
 
-	if guestAgentBinary, err := GuestAgentBinary(y.Arch); err != nil {
-		return err
-	} else {
-		defer guestAgentBinary.Close()
+	for i, f := range y.CopyToGuest {
+		b, err := readCopyToGuest(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the file of `copyToGuest[%d]`: %w", i, err)
+		}
 		layout = append(layout, iso9660util.Entry{
-			Path:   "lima-guestagent",
-			Reader: guestAgentBinary,
+			Path:   fmt.Sprintf("copy/%08d", i),
+			Reader: bytes.NewReader(b),
 		})
 	}
 
-	if args.Containerd.System || args.Containerd.User {
-		var nftgz *limayaml.File
-		for i := range y.Containerd.Archives {
-			f := &y.Containerd.Archives[i]
-			if f.Arch != y.Arch {
-				continue
-			}
-			nftgz = f
+	caCerts, err := loadCACerts(y.CACerts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range caCerts {
+		layout = append(layout, iso9660util.Entry{
+			Path:   fmt.Sprintf("%s/%08d.crt", caCertsDir, i),
+			Reader: bytes.NewReader(b),
+		})
+	}
+
+	// Checked here rather than only in iso9660util.Write, so that the problem is reported
+	// before downloading the containerd archive
+	for _, f := range layout {
+		if err := iso9660util.ValidatePath(f.Path); err != nil {
+			return nil, fmt.Errorf("cannot add %q to the cidata ISO: %w", f.Path, err)
 		}
-		if nftgz == nil {
-			return fmt.Errorf("no containerd archive was provided for arch %q", y.Arch)
+	}
+	return layout, nil
+}
+
+// readCopyToGuest reads the source file of f.
+func readCopyToGuest(f limayaml.CopyToGuest) ([]byte, error) {
+	expanded, err := localpathutil.Expand(f.Source)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(expanded)
+}
+
+// sortProvision returns a copy of provision sorted by the order, preserving the list order for the same order.
+// boot.sh executes the scripts of each mode in the lexical order of their file names, i.e., the sorted order.
+func sortProvision(provision []limayaml.Provision) []limayaml.Provision {
+	res := make([]limayaml.Provision, len(provision))
+	copy(res, provision)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Order < res[j].Order
+	})
+	return res
+}
+
+// guestAgentBinaryPath returns the path of the guest agent binary for arch, after checking that it is not truncated.
+// When there is no binary on the disk but limactl embeds one, the returned path starts with embeddedGuestAgentPrefix.
+func guestAgentBinaryPath(arch limayaml.Arch) (string, error) {
+	var size int64
+	guestAgentPath, guestAgentSt, err := GuestAgentBinaryStat(arch)
+	if err == nil {
+		size = guestAgentSt.Size()
+	} else {
+		if !errors.Is(err, ErrGuestAgentNotFound) {
+			return "", err
 		}
-		td, err := ioutil.TempDir("", "lima-download-nerdctl")
+		b, name, ok := embeddedGuestAgent(embeddedGuestAgents, arch)
+		if !ok {
+			return "", err
+		}
+		guestAgentPath, size = embeddedGuestAgentPrefix+name, int64(len(b))
+	}
+	if size < minGuestAgentBinarySize {
+		return "", fmt.Errorf("guest agent binary %q is truncated: expected at least %d bytes, got %d",
+			guestAgentPath, minGuestAgentBinarySize, size)
+	}
+	return guestAgentPath, nil
+}
+
+// verifyGuestAgentBinary checks the digest of the guest agent binary at guestAgentPath, read from r,
+// against $LIMA_GUESTAGENT_<ARCH>_DIGEST, if set, to detect a stale or corrupted binary left by an upgrade.
+// A hex value without the algorithm is taken as SHA256. r is rewound after reading it.
+func verifyGuestAgentBinary(r io.ReadSeeker, guestAgentPath string, arch limayaml.Arch) error {
+	envK := "LIMA_GUESTAGENT_" + strings.ToUpper(arch) + "_DIGEST"
+	envV := strings.TrimSpace(os.Getenv(envK))
+	if envV == "" {
+		return nil
+	}
+	if !strings.Contains(envV, ":") {
+		envV = digest.SHA256.String() + ":" + envV
+	}
+	expected, err := digest.Parse(envV)
+	if err != nil {
+		return fmt.Errorf("invalid $%s: %w", envK, err)
+	}
+	if !expected.Algorithm().Available() {
+		return fmt.Errorf("invalid $%s: unavailable algorithm %q", envK, expected.Algorithm())
+	}
+	actual, err := expected.Algorithm().FromReader(r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("%w: %q has the digest %s, but $%s is %s", ErrGuestAgentDigestMismatch, guestAgentPath, actual, envK, expected)
+	}
+	return nil
+}
+
+// openGuestAgentBinary opens the guest agent binary returned by guestAgentBinaryPath.
+func openGuestAgentBinary(guestAgentPath string) (io.ReadSeekCloser, error) {
+	if name := strings.TrimPrefix(guestAgentPath, embeddedGuestAgentPrefix); name != guestAgentPath {
+		b, err := fs.ReadFile(embeddedGuestAgents, name)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer os.RemoveAll(td)
-		nftgzLocal := filepath.Join(td, "nerdctl-full.tgz")
-		logrus.Infof("Downloading %q (%s)", nftgz.Location, nftgz.Digest)
-		res, err := downloader.Download(nftgzLocal, nftgz.Location, downloader.WithCache(), downloader.WithExpectedDigest(nftgz.Digest))
+		return nopSeekCloser{bytes.NewReader(b)}, nil
+	}
+	return os.Open(guestAgentPath)
+}
+
+// nopSeekCloser is like ioutil.NopCloser, but keeps the Seek method.
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// stableInstanceID derives the instance id from the hash of args.
+func stableInstanceID(args TemplateArgs) (string, error) {
+	// The IID must not depend on itself, and the ports of the host agent DNS server
+	// are chosen on every boot but only consumed by the boot scripts, not by cloud-init.
+	args.IID = ""
+	args.UDPDNSLocalPort = 0
+	args.TCPDNSLocalPort = 0
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("iid-%x", sha256.Sum256(b))[:20], nil
+}
+
+// logProgressInterval is the minimum interval of the progress logs of logProgress.
+const logProgressInterval = 5 * time.Second
+
+// logProgress returns a downloader.ProgressFunc that periodically logs the progress of downloading remote.
+// The progress is logged rather than rendered as a progress bar, as the host agent has no terminal.
+func logProgress(remote string) downloader.ProgressFunc {
+	var last time.Time
+	return func(downloaded, total int64) {
+		now := time.Now()
+		if now.Sub(last) < logProgressInterval && downloaded != total {
+			return
+		}
+		last = now
+		if total > 0 {
+			logrus.Infof("Downloading %q: %d%% (%s / %s)", remote, downloaded*100/total,
+				units.HumanSize(float64(downloaded)), units.HumanSize(float64(total)))
+		} else {
+			logrus.Infof("Downloading %q: %s", remote, units.HumanSize(float64(downloaded)))
+		}
+	}
+}
+
+// containerdArchive returns the path of the first of the archives for arch that is cached, or that can be downloaded
+// into local, with the expected digest. Multiple archives for the same arch are mirrors of each other, tried in order.
+// The cached archives are used as is, without copying them into local.
+// The returned status is either downloader.StatusDownloaded or downloader.StatusUsedCache.
+// In the offline mode, only the local archives are tried when none is cached.
+func containerdArchive(ctx context.Context, o *options, local string, archives []limayaml.File, arch limayaml.Arch) (string, downloader.Status, error) {
+	for _, f := range archives {
+		if f.Arch != arch {
+			continue
+		}
+		cachePath, err := o.downloader.Cached(f.Location, downloader.WithCache(), downloader.WithExpectedDigest(f.Digest))
 		if err != nil {
-			return fmt.Errorf("failed to download %q: %w", nftgz.Location, err)
+			logrus.WithError(err).Debugf("ignoring the cache of %q", f.Location)
+			continue
+		}
+		if cachePath != "" {
+			logrus.Infof("Using cache %q", cachePath)
+			return cachePath, downloader.StatusUsedCache, nil
+		}
+	}
+	groups := mirrorGroups(archives, arch)
+	if len(groups) == 0 {
+		return "", downloader.StatusUnknown, fmt.Errorf("%w for arch %q", ErrNoContainerdArchive, arch)
+	}
+	if o.offline {
+		groups = localMirrorGroups(groups)
+		if len(groups) == 0 {
+			return "", downloader.StatusUnknown, fmt.Errorf("%w (arch %q)", ErrArchiveNotCached, arch)
+		}
+	}
+	var (
+		attempted int
+		errs      []error
+	)
+	for _, g := range groups {
+		if err := ctx.Err(); err != nil {
+			return "", downloader.StatusUnknown, err
+		}
+		logrus.Infof("Downloading %q (%s)", g.locations[0], g.digest)
+		res, location, err := downloadWithRetry(ctx, o, local, g)
+		attempted += len(g.locations)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return "", downloader.StatusUnknown, ctxErr
+			}
+			errs = append(errs, err)
+			continue
 		}
 		logrus.Debugf("res.ValidatedDigest=%v", res.ValidatedDigest)
 		switch res.Status {
 		case downloader.StatusDownloaded:
-			logrus.Infof("Downloaded %q", nftgz.Location)
+			logrus.Infof("Downloaded %q", location)
 		case downloader.StatusUsedCache:
 			logrus.Infof("Using cache %q", res.CachePath)
 		default:
 			logrus.Warnf("Unexpected result from downloader.Download(): %+v", res)
 		}
+		return local, res.Status, nil
+	}
+	return "", downloader.StatusUnknown, fmt.Errorf("failed to download the containerd archive, attempted %d candidates, errors=%v", attempted, errs)
+}
 
-		nftgzR, err := os.Open(nftgzLocal)
+// downloadWithRetry downloads the archive of g, retrying with an exponential backoff on failures,
+// until o.retryAttempts attempts have been made or ctx is done.
+func downloadWithRetry(ctx context.Context, o *options, local string, g mirrorGroup) (*downloader.Result, string, error) {
+	attempts := o.retryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := o.retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		res, location, err := o.downloader.DownloadWithMirrors(ctx, local, g.locations, downloader.WithCache(),
+			downloader.WithExpectedDigest(g.digest), downloader.WithProgress(logProgress(g.locations[0])))
+		if err == nil || attempt >= attempts || ctx.Err() != nil {
+			return res, location, err
+		}
+		logrus.WithError(err).Warnf("Failed to download %q (attempt %d/%d), retrying in %v", g.locations[0], attempt, attempts, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, "", ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// mirrorGroup is a set of the locations of the same archive.
+type mirrorGroup struct {
+	locations []string
+	digest    digest.Digest
+}
+
+// mirrorGroups groups the consecutive archives for arch with the same digest, as the mirrors of the same archive.
+// Archives without a digest are never grouped, as they cannot be known to have the same content.
+func mirrorGroups(archives []limayaml.File, arch limayaml.Arch) []mirrorGroup {
+	var groups []mirrorGroup
+	for _, f := range archives {
+		if f.Arch != arch {
+			continue
+		}
+		if n := len(groups); n > 0 && f.Digest != "" && groups[n-1].digest == f.Digest {
+			groups[n-1].locations = append(groups[n-1].locations, f.Location)
+			continue
+		}
+		groups = append(groups, mirrorGroup{locations: []string{f.Location}, digest: f.Digest})
+	}
+	return groups
+}
+
+// localMirrorGroups returns groups with only the local locations, dropping the groups without any.
+func localMirrorGroups(groups []mirrorGroup) []mirrorGroup {
+	var res []mirrorGroup
+	for _, g := range groups {
+		var locations []string
+		for _, loc := range g.locations {
+			if downloader.IsLocal(loc) {
+				locations = append(locations, loc)
+			}
+		}
+		if len(locations) > 0 {
+			res = append(res, mirrorGroup{locations: locations, digest: g.digest})
+		}
+	}
+	return res
+}
+
+// containerdArchiveName returns the name of the containerd archive in the ISO, with the extension
+// that tells the guest which decompressor to use. The compression is detected from the magic bytes,
+// so that corrupt downloads are caught before booting the guest.
+func containerdArchiveName(r io.ReaderAt) (string, error) {
+	magics := []struct {
+		magic []byte
+		name  string
+	}{
+		{[]byte{0x1f, 0x8b}, containerdArchiveGzipFile},
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, containerdArchiveXzFile},
+	}
+	head := make([]byte, 6)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	head = head[:n]
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.name, nil
+		}
+	}
+	return "", errors.New("not a gzip or xz compressed archive")
+}
+
+// sshPubKeyBlob returns the key type and the base64 key material of an SSH public key line,
+// without the comment, so that the same key is recognized regardless of its comment.
+func sshPubKeyBlob(content string) string {
+	fields := strings.Fields(content)
+	if len(fields) < 2 {
+		return strings.TrimSpace(content)
+	}
+	return fields[0] + " " + fields[1]
+}
+
+// dnsAddresses returns the normalized DNS addresses of the guest:
+// the host agent DNS server, `dns`, or the DNS addresses of the host, in this order of preference.
+// The validation of `dnsPrecedence` ensures that `dns` is only set along with `useHostResolver`
+// when `dns` is meant for the host agent DNS server, i.e., with limayaml.DNSPrecedenceHostResolver.
+func dnsAddresses(y *limayaml.LimaYAML) ([]string, error) {
+	var addrs []string
+	if *y.UseHostResolver {
+		addrs = append(addrs, qemu.SlirpDNS)
+	} else if len(y.DNS) > 0 {
+		for _, addr := range y.DNS {
+			addrs = append(addrs, addr.String())
+		}
+	} else {
+		hostAddrs, err := osutil.DNSAddresses()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer nftgzR.Close()
-		layout = append(layout, iso9660util.Entry{
-			// ISO9660 requires len(Path) <= 30
-			Path:   "nerdctl-full.tgz",
-			Reader: nftgzR,
-		})
+		addrs = usableHostDNSAddresses(hostAddrs)
 	}
+	return normalizeDNSAddresses(addrs)
+}
 
-	return iso9660util.Write(filepath.Join(instDir, filenames.CIDataISO), "cidata", layout)
+// usableHostDNSAddresses returns the IPv4 and IPv6 DNS addresses of the host that are reachable from the guest,
+// preserving the order. The link-local and loopback addresses, and the addresses with a zone (e.g., "fe80::1%en0"),
+// are dropped, as they are only meaningful on the host.
+func usableHostDNSAddresses(addrs []string) []string {
+	var res []string
+	for _, addr := range addrs {
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+		if strings.Contains(host, "%") {
+			logrus.Debugf("ignoring the host DNS address %q, as it is scoped to a host interface", addr)
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			logrus.Warnf("ignoring the host DNS address %q, as it is not an IP address", addr)
+			continue
+		}
+		if ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+			logrus.Debugf("ignoring the host DNS address %q, as it is a link-local or loopback address", addr)
+			continue
+		}
+		res = append(res, addr)
+	}
+	return res
+}
+
+// dedupStrings returns ss without duplicates, preserving the order of the first occurrences.
+func dedupStrings(ss []string) []string {
+	var res []string
+	seen := make(map[string]struct{}, len(ss))
+	for _, s := range ss {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		res = append(res, s)
+	}
+	return res
+}
+
+// normalizeDNSAddresses returns the nameserver addresses in the canonical form of the IP addresses,
+// without duplicates. As resolv.conf(5) has no syntax for the port, "host:port" is only accepted with port 53.
+func normalizeDNSAddresses(addrs []string) ([]string, error) {
+	var res []string
+	seen := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		host := addr
+		if h, port, err := net.SplitHostPort(addr); err == nil {
+			if port != "53" {
+				return nil, fmt.Errorf("DNS address %q must not have a port other than 53", addr)
+			}
+			host = h
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("DNS address %q is not an IP address", addr)
+		}
+		s := ip.String()
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		res = append(res, s)
+	}
+	return res, nil
 }
 
+// minGuestAgentBinarySize is the minimum size of the guest agent binary.
+// The guest agent is a statically linked Go binary of several megabytes, so anything
+// smaller is a truncated file that would only fail inside the guest at boot.
+const minGuestAgentBinarySize = 1 << 20
+
+// GuestAgentBinary returns the guest agent binary for arch.
+// The binary embedded in limactl, if any, is returned when there is none on the disk.
 func GuestAgentBinary(arch string) (io.ReadCloser, error) {
+	r, _, err := GuestAgentBinaryWithPath(arch)
+	return r, err
+}
+
+// GuestAgentBinaryWithPath is like GuestAgentBinary, but also returns the absolute path of the binary,
+// so that the caller can tell which of the candidates was used.
+// The path of the embedded binary starts with "embedded:".
+// The embedded binary is only used when no binary is found on the disk, not when the lookup fails otherwise.
+// A truncated binary is an error, see guestAgentBinaryPath.
+func GuestAgentBinaryWithPath(arch string) (io.ReadCloser, string, error) {
+	path, err := guestAgentBinaryPath(arch)
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := openGuestAgentBinary(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return r, path, nil
+}
+
+// GuestAgentBinaryResult is the result of GuestAgentBinaries for an arch.
+type GuestAgentBinaryResult struct {
+	// Path is the path of the binary, as returned by GuestAgentBinaryWithPath, when Err is nil.
+	Path string
+	Err  error
+}
+
+// GuestAgentBinaries is like GuestAgentBinaryWithPath, but looks up the binaries of several archs at once,
+// e.g., for reporting which archs of a template have a guest agent binary on this installation.
+// The result has an entry for each arch. The binaries that are truncated are reported as errors.
+func GuestAgentBinaries(arches []string) map[string]GuestAgentBinaryResult {
+	res := make(map[string]GuestAgentBinaryResult, len(arches))
+	for _, arch := range arches {
+		path, err := guestAgentBinaryPath(arch)
+		res[arch] = GuestAgentBinaryResult{Path: path, Err: err}
+	}
+	return res
+}
+
+// GuestAgentBinaryStat returns the absolute path and the file info of the guest agent binary for arch.
+func GuestAgentBinaryStat(arch string) (string, os.FileInfo, error) {
 	if arch == "" {
-		return nil, errors.New("arch must be set")
+		return "", nil, errors.New("arch must be set")
 	}
 	self, err := os.Executable()
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	selfSt, err := os.Stat(self)
+	return resolveGuestAgentBinary(self, arch)
+}
+
+// resolveGuestAgentBinary is like findGuestAgentBinary, but resolves the symlinks of self first.
+// limactl is often a chain of symlinks, e.g., /opt/homebrew/bin/limactl -> ../Cellar/lima/VERSION/bin/limactl,
+// and the candidates are relative to the real binary.
+func resolveGuestAgentBinary(self, arch string) (string, os.FileInfo, error) {
+	resolved, err := filepath.EvalSymlinks(self)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	if selfSt.Mode()&fs.ModeSymlink != 0 {
-		self, err = os.Readlink(self)
-		if err != nil {
-			return nil, err
+	return findGuestAgentBinary(resolved, arch)
+}
+
+// guestAgentArchAliases maps an arch to its other spelling, which may be used as the suffix of the guest agent binary.
+var guestAgentArchAliases = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "x86_64",
+	"aarch64": "arm64",
+	"arm64":   "aarch64",
+}
+
+// embeddedGuestAgents contains the guest agent binaries embedded in limactl, or is nil.
+var embeddedGuestAgents fs.FS
+
+// embeddedGuestAgentPrefix is the prefix of the pseudo paths of the embedded guest agent binaries.
+const embeddedGuestAgentPrefix = "embedded:"
+
+// embeddedGuestAgent returns the content and the name of the guest agent binary for arch in fsys,
+// also looking up the other spelling of arch.
+func embeddedGuestAgent(fsys fs.FS, arch string) ([]byte, string, bool) {
+	if fsys == nil {
+		return nil, "", false
+	}
+	archs := []string{arch}
+	if alias, ok := guestAgentArchAliases[arch]; ok {
+		archs = append(archs, alias)
+	}
+	for _, arch := range archs {
+		name := "lima-guestagent.Linux-" + arch
+		if b, err := fs.ReadFile(fsys, name); err == nil {
+			return b, name, true
 		}
 	}
+	return nil, "", false
+}
 
+// findGuestAgentBinary finds the guest agent binary for arch, relative to self, i.e., the path of limactl.
+// The binary is also looked up with the other spelling of arch, e.g., "amd64" for "x86_64".
+// $LIMA_GUESTAGENT_<ARCH>, when set, is tried before the default locations.
+func findGuestAgentBinary(self, arch string) (string, os.FileInfo, error) {
+	archs := []string{arch}
+	if alias, ok := guestAgentArchAliases[arch]; ok {
+		archs = append(archs, alias)
+	}
 	// self:  /usr/local/bin/limactl
 	selfDir := filepath.Dir(self)
 	selfDirDir := filepath.Dir(selfDir)
-	candidates := []string{
-		// candidate 0:
-		// - self:  /Applications/Lima.app/Contents/MacOS/limactl
-		// - agent: /Applications/Lima.app/Contents/MacOS/lima-guestagent.Linux-x86_64
-		filepath.Join(selfDir, "lima-guestagent.Linux-"+arch),
-		// candidate 1:
-		// - self:  /usr/local/bin/limactl
-		// - agent: /usr/local/share/lima/lima-guestagent.Linux-x86_64
-		filepath.Join(selfDirDir, "share/lima/lima-guestagent.Linux-"+arch),
-		// TODO: support custom path
+	var candidates, names []string
+	// candidate specified by $LIMA_GUESTAGENT_X86_64 or $LIMA_GUESTAGENT_AARCH64, for custom install layouts
+	if envV := os.Getenv("LIMA_GUESTAGENT_" + strings.ToUpper(arch)); envV != "" {
+		candidates = append(candidates, envV)
+	}
+	for _, arch := range archs {
+		name := "lima-guestagent.Linux-" + arch
+		names = append(names, strconv.Quote(name))
+		candidates = append(candidates,
+			// candidate 0:
+			// - self:  /Applications/Lima.app/Contents/MacOS/limactl
+			// - agent: /Applications/Lima.app/Contents/MacOS/lima-guestagent.Linux-x86_64
+			filepath.Join(selfDir, name),
+			// candidate 1:
+			// - self:  /usr/local/bin/limactl
+			// - agent: /usr/local/share/lima/lima-guestagent.Linux-x86_64
+			filepath.Join(selfDirDir, "share/lima", name),
+		)
 	}
 	for _, candidate := range candidates {
-		if f, err := os.Open(candidate); err == nil {
-			return f, nil
-		} else if !errors.Is(err, os.ErrNotExist) {
-			return nil, err
+		abs, st, err := statGuestAgentBinary(candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
 		}
+		return abs, st, err
 	}
 
-	return nil, fmt.Errorf("failed to find \"lima-guestagent.Linux-%s\" binary for %q, attempted %v",
-		arch, self, candidates)
+	return "", nil, fmt.Errorf("failed to find %s binary for %q, attempted %v: %w",
+		strings.Join(names, " or "), self, candidates, ErrGuestAgentNotFound)
+}
+
+// statGuestAgentBinary returns the absolute path and the file info of the guest agent binary at path,
+// after checking that it is a regular file that can be opened, e.g., not a directory.
+func statGuestAgentBinary(path string) (string, os.FileInfo, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("guest agent binary %q is not a regular file (mode %s)", path, st.Mode())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		return "", nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return abs, st, nil
 }
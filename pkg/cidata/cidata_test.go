@@ -0,0 +1,891 @@
+package cidata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/lima-vm/lima/pkg/downloader"
+	"github.com/lima-vm/lima/pkg/iso9660util"
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/lima-vm/lima/pkg/store/filenames"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+func TestNormalizeDNSAddresses(t *testing.T) {
+	addrs, err := normalizeDNSAddresses([]string{"8.8.8.8", "1.1.1.1:53", "8.8.8.8", "2001:4860:4860:0:0:0:0:8888", "[2001:4860:4860::8888]:53"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, addrs, []string{"8.8.8.8", "1.1.1.1", "2001:4860:4860::8888"})
+
+	addrs, err = normalizeDNSAddresses(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 0)
+
+	_, err = normalizeDNSAddresses([]string{"8.8.8.8", "dns.example.com"})
+	assert.ErrorContains(t, err, `"dns.example.com" is not an IP address`)
+
+	_, err = normalizeDNSAddresses([]string{"8.8.8.8", "1.1.1.1:5353"})
+	assert.ErrorContains(t, err, "port other than 53")
+}
+
+func TestUsableHostDNSAddresses(t *testing.T) {
+	addrs := usableHostDNSAddresses([]string{
+		"192.168.1.1",
+		"fe80::1%en0",
+		"2001:db8::53",
+		"fe80::1",
+		"127.0.0.1",
+		"::1",
+		"8.8.8.8",
+		"[fe80::2%en1]:53",
+		"[2001:db8::54]:53",
+		"dns.example.com",
+	})
+	assert.DeepEqual(t, addrs, []string{"192.168.1.1", "2001:db8::53", "8.8.8.8", "[2001:db8::54]:53"})
+
+	normalized, err := normalizeDNSAddresses(addrs)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, normalized, []string{"192.168.1.1", "2001:db8::53", "8.8.8.8", "2001:db8::54"})
+
+	assert.Equal(t, len(usableHostDNSAddresses([]string{"fe80::1%en0"})), 0)
+}
+
+func TestContainerdArchiveName(t *testing.T) {
+	name, err := containerdArchiveName(strings.NewReader("\x1f\x8b\x08\x00"))
+	assert.NilError(t, err)
+	assert.Equal(t, name, "nerdctl-full.tgz")
+
+	name, err = containerdArchiveName(strings.NewReader("\xfd7zXZ\x00\x00"))
+	assert.NilError(t, err)
+	assert.Equal(t, name, "nerdctl-full.txz")
+
+	_, err = containerdArchiveName(strings.NewReader("<html>"))
+	assert.ErrorContains(t, err, "not a gzip or xz compressed archive")
+
+	_, err = containerdArchiveName(strings.NewReader(""))
+	assert.ErrorContains(t, err, "not a gzip or xz compressed archive")
+}
+
+func TestSSHPubKeyBlob(t *testing.T) {
+	assert.Equal(t, sshPubKeyBlob("ssh-ed25519 AAAAC3Nza foo@example.com\n"), "ssh-ed25519 AAAAC3Nza")
+	assert.Equal(t, sshPubKeyBlob("ssh-ed25519 AAAAC3Nza  bar@example.com"), sshPubKeyBlob("ssh-ed25519 AAAAC3Nza"))
+	assert.Assert(t, sshPubKeyBlob("ssh-ed25519 AAAAC3Nza") != sshPubKeyBlob("ssh-rsa AAAAC3Nza"))
+}
+
+// unsetProxyEnv unsets the proxy variables of the process environment for the duration of the test.
+func unsetProxyEnv(t *testing.T) {
+	for _, name := range []string{"ftp_proxy", "http_proxy", "https_proxy", "no_proxy", "FTP_PROXY", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		if value, ok := os.LookupEnv(name); ok {
+			name := name
+			assert.NilError(t, os.Unsetenv(name))
+			t.Cleanup(func() { _ = os.Setenv(name, value) })
+		}
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("the proxy settings of the host system would be included")
+	}
+	unsetProxyEnv(t)
+	t.Setenv("https_proxy", "http://process.example.com")
+	t.Setenv("NO_PROXY", "localhost")
+	y := &limayaml.LimaYAML{
+		Env: map[string]string{
+			"FOO":         "bar",
+			"https_proxy": "http://yaml.example.com",
+			"http_proxy":  "http://lower.example.com",
+			"HTTP_PROXY":  "http://upper.example.com",
+		},
+	}
+	env, err := BuildEnv(y)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, env, map[string]string{
+		"FOO": "bar",
+		// the process environment overrides env.*
+		"https_proxy": "http://process.example.com",
+		"HTTPS_PROXY": "http://process.example.com",
+		// the lowercase variant takes precedence over the uppercase one
+		"http_proxy": "http://lower.example.com",
+		"HTTP_PROXY": "http://lower.example.com",
+		// the uppercase variant is copied to the lowercase one
+		"no_proxy": "localhost",
+		"NO_PROXY": "localhost",
+	})
+}
+
+func TestBuildEnvMergesNoProxy(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("the proxy settings of the host system would be included")
+	}
+	unsetProxyEnv(t)
+	t.Setenv("no_proxy", "localhost, .corp.example.com")
+	t.Setenv("NO_PROXY", "10.0.0.0/8")
+	y := &limayaml.LimaYAML{
+		Env: map[string]string{
+			"no_proxy":   "127.0.0.1,localhost",
+			"NO_PROXY":   ".internal",
+			"http_proxy": "http://yaml.example.com",
+		},
+	}
+	env, err := BuildEnv(y)
+	assert.NilError(t, err)
+	const merged = "127.0.0.1,localhost,.internal,.corp.example.com,10.0.0.0/8"
+	assert.Equal(t, env["no_proxy"], merged)
+	assert.Equal(t, env["NO_PROXY"], merged)
+	// other proxy variables are still overridden
+	assert.Equal(t, env["http_proxy"], "http://yaml.example.com")
+}
+
+func TestMergeNoProxy(t *testing.T) {
+	assert.Equal(t, mergeNoProxy([]string{"a,b", " b , c,", "", "a"}), "a,b,c")
+	assert.Equal(t, mergeNoProxy(nil), "")
+}
+
+func TestLayoutDigest(t *testing.T) {
+	dir := t.TempDir()
+	guestAgentPath := filepath.Join(dir, "lima-guestagent")
+	assert.NilError(t, os.WriteFile(guestAgentPath, []byte("dummy"), 0755))
+	guestAgentBinary, err := openGuestAgentBinary(guestAgentPath)
+	assert.NilError(t, err)
+	defer guestAgentBinary.Close()
+
+	newLayout := func(s string) []iso9660util.Entry {
+		layout, err := bufferLayout([]iso9660util.Entry{{Path: "lima.env", Reader: strings.NewReader(s)}})
+		assert.NilError(t, err)
+		return layout
+	}
+	layout := newLayout("FOO=1")
+	d1, err := layoutDigest(limayaml.CIDataFilesystemISO9660, layout, guestAgentBinary, nil)
+	assert.NilError(t, err)
+	d2, err := layoutDigest(limayaml.CIDataFilesystemISO9660, layout, guestAgentBinary, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, d1, d2)
+
+	d3, err := layoutDigest(limayaml.CIDataFilesystemISO9660, newLayout("FOO=2"), guestAgentBinary, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, d1 != d3)
+
+	d4, err := layoutDigest(limayaml.CIDataFilesystemVFAT, layout, guestAgentBinary, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, d1 != d4)
+	// The guest agent binary is rewound, to be written to the ISO
+	b, err := io.ReadAll(guestAgentBinary)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "dummy")
+
+	isoPath := filepath.Join(dir, "cidata.iso")
+	digestPath := filepath.Join(dir, "cidata.iso.digest")
+	assert.NilError(t, os.WriteFile(digestPath, []byte(d1.String()), 0644))
+	assert.Assert(t, !isoUpToDate(isoPath, digestPath, d1))
+	assert.NilError(t, os.WriteFile(isoPath, nil, 0644))
+	assert.Assert(t, isoUpToDate(isoPath, digestPath, d1))
+	assert.Assert(t, !isoUpToDate(isoPath, digestPath, d3))
+}
+
+func TestStableInstanceID(t *testing.T) {
+	args := TemplateArgs{Name: "default", User: "foo", UID: 501, UDPDNSLocalPort: 1053, TCPDNSLocalPort: 1053}
+	iid, err := stableInstanceID(args)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(iid, "iid-"), iid)
+	assert.Equal(t, len(iid), 20)
+
+	// The IID does not depend on the previous IID, nor on the ports of the DNS server
+	args.IID = iid
+	args.UDPDNSLocalPort, args.TCPDNSLocalPort = 2053, 2054
+	iid2, err := stableInstanceID(args)
+	assert.NilError(t, err)
+	assert.Equal(t, iid2, iid)
+
+	args.UID = 502
+	iid3, err := stableInstanceID(args)
+	assert.NilError(t, err)
+	assert.Assert(t, iid3 != iid)
+}
+
+func TestConfigLayoutProvisionOrder(t *testing.T) {
+	y := &limayaml.LimaYAML{
+		Provision: []limayaml.Provision{
+			{Mode: limayaml.ProvisionModeSystem, Script: "system-a", Order: 10},
+			{Mode: limayaml.ProvisionModeUser, Script: "user-a"},
+			{Mode: limayaml.ProvisionModeSystem, Script: "system-b"},
+			{Mode: limayaml.ProvisionModeUser, Script: "user-b", Order: -1},
+			{Mode: limayaml.ProvisionModeSystem, Script: "system-c", Order: 10},
+			{Mode: limayaml.ProvisionModeSystem, Script: "system-d\r\n"}, // CRLF is converted to LF
+		},
+	}
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+	}
+	layout, err := configLayout(args, y)
+	assert.NilError(t, err)
+	var scripts []string
+	for _, f := range layout {
+		if !strings.HasPrefix(f.Path, "provision.") {
+			continue
+		}
+		b, err := io.ReadAll(f.Reader)
+		assert.NilError(t, err)
+		scripts = append(scripts, f.Path+"="+string(b))
+	}
+	sort.Strings(scripts) // the lexical order, as executed by boot.sh
+	assert.DeepEqual(t, scripts, []string{
+		"provision.system/00000002=system-b",
+		"provision.system/00000003=system-d\n",
+		"provision.system/00000004=system-a",
+		"provision.system/00000005=system-c",
+		"provision.user/00000000=user-b",
+		"provision.user/00000001=user-a",
+	})
+}
+
+func TestConfigLayoutProvisionCondition(t *testing.T) {
+	y := &limayaml.LimaYAML{
+		Arch:   limayaml.AARCH64,
+		Distro: "debian",
+		Provision: []limayaml.Provision{
+			{Mode: limayaml.ProvisionModeSystem, Script: "x86_64", Condition: &limayaml.ProvisionCondition{Arch: limayaml.X8664}},
+			{Mode: limayaml.ProvisionModeSystem, Script: "aarch64", Condition: &limayaml.ProvisionCondition{Arch: limayaml.AARCH64}},
+			{Mode: limayaml.ProvisionModeSystem, Script: "ubuntu", Condition: &limayaml.ProvisionCondition{Distro: "ubuntu"}},
+			{Mode: limayaml.ProvisionModeSystem, Script: "debian-aarch64", Condition: &limayaml.ProvisionCondition{Arch: limayaml.AARCH64, Distro: "debian"}},
+			// Not read, as it is not embedded
+			{Mode: limayaml.ProvisionModeUser, File: "/nonexistent", Condition: &limayaml.ProvisionCondition{Arch: limayaml.X8664}},
+			{Mode: limayaml.ProvisionModeUser, Script: "any"},
+		},
+	}
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+	}
+	layout, err := configLayout(args, y)
+	assert.NilError(t, err)
+	var scripts []string
+	for _, f := range layout {
+		if !strings.HasPrefix(f.Path, "provision.") {
+			continue
+		}
+		b, err := io.ReadAll(f.Reader)
+		assert.NilError(t, err)
+		scripts = append(scripts, f.Path+"="+string(b))
+	}
+	assert.DeepEqual(t, scripts, []string{
+		"provision.system/00000000=aarch64",
+		"provision.system/00000001=debian-aarch64",
+		"provision.user/00000002=any",
+	})
+}
+
+func TestConfigLayoutProvisionFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "provision.sh")
+	assert.NilError(t, os.WriteFile(file, []byte("#!/bin/sh\r\necho hello\r\n"), 0644))
+	y := &limayaml.LimaYAML{
+		Provision: []limayaml.Provision{
+			{Mode: limayaml.ProvisionModeSystem, File: file},
+		},
+	}
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+	}
+	layout, err := configLayout(args, y)
+	assert.NilError(t, err)
+	last := layout[len(layout)-1]
+	assert.Equal(t, last.Path, "provision.system/00000000")
+	b, err := io.ReadAll(last.Reader)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "#!/bin/sh\necho hello\n")
+
+	y.Provision[0].File = filepath.Join(t.TempDir(), "non-existent.sh")
+	_, err = configLayout(args, y)
+	assert.ErrorContains(t, err, "failed to read the provision script")
+}
+
+func TestConfigLayoutCopyToGuest(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "foo.conf")
+	assert.NilError(t, os.WriteFile(file, []byte("foo=1\n"), 0644))
+	y := &limayaml.LimaYAML{
+		CopyToGuest: []limayaml.CopyToGuest{
+			{Source: file, Destination: "/etc/foo.conf", Mode: "0600"},
+		},
+	}
+	args := TemplateArgs{
+		Name:        "default",
+		Hostname:    "lima-default",
+		User:        "foo",
+		UID:         501,
+		SSHPubKeys:  []string{"ssh-rsa dummy foo@example.com"},
+		CopyToGuest: []CopyToGuest{{Destination: "/etc/foo.conf", Mode: "0600"}},
+	}
+	layout, err := configLayout(args, y)
+	assert.NilError(t, err)
+	files := make(map[string]string)
+	for _, f := range layout {
+		b, err := io.ReadAll(f.Reader)
+		assert.NilError(t, err)
+		files[f.Path] = string(b)
+	}
+	assert.Equal(t, files["copy/00000000"], "foo=1\n")
+	assert.Assert(t, strings.Contains(files["lima.env"], "LIMA_CIDATA_COPY_TO_GUEST=1\n"))
+	assert.Assert(t, strings.Contains(files["lima.env"], "LIMA_CIDATA_COPY_TO_GUEST_0_DESTINATION=/etc/foo.conf\n"))
+	assert.Assert(t, strings.Contains(files["lima.env"], "LIMA_CIDATA_COPY_TO_GUEST_0_MODE=0600\n"))
+
+	y.CopyToGuest[0].Source = filepath.Join(t.TempDir(), "non-existent.conf")
+	_, err = configLayout(args, y)
+	assert.ErrorContains(t, err, "failed to read the file of `copyToGuest[0]`")
+}
+
+func TestManifestEntry(t *testing.T) {
+	layout := []iso9660util.Entry{
+		{Path: "lima.env", Reader: strings.NewReader("FOO=1\n")},
+		{Path: "provision.system/00000000", Reader: strings.NewReader("")},
+	}
+	manifest, err := manifestEntry(layout)
+	assert.NilError(t, err)
+	assert.Equal(t, manifest.Path, "manifest.txt")
+	b, err := io.ReadAll(manifest.Reader)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b),
+		"335f098c02f16b0aff69799f407b2bf915756c3f29240b26f7d5037bfb6970c4  lima.env\n"+
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  provision.system/00000000\n")
+
+	// The readers are rewound
+	b, err = io.ReadAll(layout[0].Reader)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "FOO=1\n")
+}
+
+func TestEntryPaths(t *testing.T) {
+	for _, p := range []string{guestAgentFile, containerdArchiveGzipFile, containerdArchiveXzFile, manifestFile} {
+		assert.NilError(t, iso9660util.ValidatePath(p), p)
+	}
+
+	file := filepath.Join(t.TempDir(), "foo.conf")
+	assert.NilError(t, os.WriteFile(file, []byte("foo=1\n"), 0644))
+	y := &limayaml.LimaYAML{
+		Provision: []limayaml.Provision{
+			{Mode: limayaml.ProvisionModeSystem, Script: "system"},
+			{Mode: limayaml.ProvisionModeUser, Script: "user"},
+			{Mode: limayaml.ProvisionModeDependency, Script: "dependency"},
+		},
+		CopyToGuest: []limayaml.CopyToGuest{
+			{Source: file, Destination: "/etc/foo.conf"},
+		},
+	}
+	args := TemplateArgs{
+		Name:        "default",
+		Hostname:    "lima-default",
+		User:        "foo",
+		UID:         501,
+		SSHPubKeys:  []string{"ssh-rsa dummy foo@example.com"},
+		CopyToGuest: []CopyToGuest{{Destination: "/etc/foo.conf"}},
+	}
+	layout, err := configLayout(args, y)
+	assert.NilError(t, err)
+	manifest, err := manifestEntry(layout)
+	assert.NilError(t, err)
+	for _, f := range append(layout, manifest) {
+		assert.NilError(t, iso9660util.ValidatePath(f.Path), f.Path)
+	}
+}
+
+func TestSeedWriter(t *testing.T) {
+	dir := t.TempDir()
+	layout := func() []iso9660util.Entry {
+		return []iso9660util.Entry{{Path: "meta-data", Reader: strings.NewReader("instance-id: default\n")}}
+	}
+	for _, tc := range []struct {
+		filesystem limayaml.CIDataFilesystem
+		isISO9660  bool
+	}{
+		{limayaml.CIDataFilesystemISO9660, true},
+		{limayaml.CIDataFilesystemVFAT, false},
+	} {
+		w, err := SeedWriter(tc.filesystem)
+		assert.NilError(t, err, tc.filesystem)
+		imagePath := filepath.Join(dir, tc.filesystem+".img")
+		assert.NilError(t, w.Write(imagePath, "cidata", layout()), tc.filesystem)
+		isISO9660, err := iso9660util.IsISO9660(imagePath)
+		assert.NilError(t, err)
+		assert.Equal(t, isISO9660, tc.isISO9660, tc.filesystem)
+	}
+
+	_, err := SeedWriter("ext4")
+	assert.Error(t, err, `unsupported cidata filesystem "ext4"`)
+}
+
+func TestFindGuestAgentBinary(t *testing.T) {
+	for _, tc := range []struct {
+		arch, binary string
+	}{
+		{"x86_64", "lima-guestagent.Linux-x86_64"},
+		{"x86_64", "lima-guestagent.Linux-amd64"},
+		{"amd64", "lima-guestagent.Linux-x86_64"},
+		{"aarch64", "lima-guestagent.Linux-arm64"},
+		{"arm64", "lima-guestagent.Linux-aarch64"},
+	} {
+		dir := t.TempDir()
+		self := filepath.Join(dir, "bin", "limactl")
+		binary := filepath.Join(dir, "share", "lima", tc.binary)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(binary), 0755))
+		assert.NilError(t, os.WriteFile(binary, nil, 0755))
+		path, _, err := findGuestAgentBinary(self, tc.arch)
+		assert.NilError(t, err, tc)
+		assert.Equal(t, path, binary, tc)
+	}
+
+	// The binary next to limactl (e.g., in the app bundle) takes precedence over the one in the share dir
+	dir := t.TempDir()
+	self := filepath.Join(dir, "bin", "limactl")
+	for _, binary := range []string{
+		filepath.Join(dir, "bin", "lima-guestagent.Linux-x86_64"),
+		filepath.Join(dir, "share", "lima", "lima-guestagent.Linux-x86_64"),
+	} {
+		assert.NilError(t, os.MkdirAll(filepath.Dir(binary), 0755))
+		assert.NilError(t, os.WriteFile(binary, nil, 0755))
+	}
+	path, _, err := findGuestAgentBinary(self, "x86_64")
+	assert.NilError(t, err)
+	assert.Equal(t, path, filepath.Join(dir, "bin", "lima-guestagent.Linux-x86_64"))
+
+	_, _, err = findGuestAgentBinary(filepath.Join(t.TempDir(), "bin", "limactl"), "aarch64")
+	assert.ErrorContains(t, err, `failed to find "lima-guestagent.Linux-aarch64" or "lima-guestagent.Linux-arm64" binary`)
+	assert.Assert(t, errors.Is(err, ErrGuestAgentNotFound))
+}
+
+func TestFindGuestAgentBinaryOverride(t *testing.T) {
+	dir := t.TempDir()
+	self := filepath.Join(dir, "bin", "limactl")
+	binary := filepath.Join(dir, "share", "lima", "lima-guestagent.Linux-x86_64")
+	custom := filepath.Join(dir, "custom", "lima-guestagent")
+	for _, p := range []string{binary, custom} {
+		assert.NilError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NilError(t, os.WriteFile(p, nil, 0755))
+	}
+
+	t.Setenv("LIMA_GUESTAGENT_X86_64", custom)
+	path, _, err := findGuestAgentBinary(self, "x86_64")
+	assert.NilError(t, err)
+	assert.Equal(t, path, custom)
+
+	// The alias spelling of the variable is not read
+	t.Setenv("LIMA_GUESTAGENT_X86_64", "")
+	t.Setenv("LIMA_GUESTAGENT_AMD64", custom)
+	path, _, err = findGuestAgentBinary(self, "x86_64")
+	assert.NilError(t, err)
+	assert.Equal(t, path, binary)
+
+	// A missing override falls back to the default locations
+	missing := filepath.Join(dir, "missing")
+	t.Setenv("LIMA_GUESTAGENT_X86_64", missing)
+	path, _, err = findGuestAgentBinary(self, "x86_64")
+	assert.NilError(t, err)
+	assert.Equal(t, path, binary)
+
+	// The error lists the override along with the default locations
+	assert.NilError(t, os.Remove(binary))
+	_, _, err = findGuestAgentBinary(self, "x86_64")
+	assert.Assert(t, errors.Is(err, ErrGuestAgentNotFound))
+	assert.ErrorContains(t, err, "attempted ["+missing+" ")
+	assert.ErrorContains(t, err, binary)
+	assert.NilError(t, os.WriteFile(binary, nil, 0755))
+
+	// A directory is not taken as a (truncated) binary
+	t.Setenv("LIMA_GUESTAGENT_X86_64", filepath.Dir(custom))
+	_, _, err = findGuestAgentBinary(self, "x86_64")
+	assert.ErrorContains(t, err, "is not a regular file")
+	t.Setenv("LIMA_GUESTAGENT_X86_64", "")
+	assert.NilError(t, os.Remove(binary))
+	assert.NilError(t, os.Mkdir(binary, 0755))
+	_, _, err = findGuestAgentBinary(self, "x86_64")
+	assert.ErrorContains(t, err, "is not a regular file")
+}
+
+func TestFindGuestAgentBinarySymlinkChain(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	dir := t.TempDir()
+	// bin/limactl -> ../opt/limactl -> ../cellar/lima/bin/limactl
+	real := filepath.Join(dir, "cellar", "lima", "bin", "limactl")
+	binary := filepath.Join(dir, "cellar", "lima", "share", "lima", "lima-guestagent.Linux-x86_64")
+	for _, p := range []string{real, binary} {
+		assert.NilError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NilError(t, os.WriteFile(p, nil, 0755))
+	}
+	for _, d := range []string{"bin", "opt"} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	assert.NilError(t, os.Symlink("../cellar/lima/bin/limactl", filepath.Join(dir, "opt", "limactl")))
+	assert.NilError(t, os.Symlink("../opt/limactl", filepath.Join(dir, "bin", "limactl")))
+
+	path, _, err := resolveGuestAgentBinary(filepath.Join(dir, "bin", "limactl"), "x86_64")
+	assert.NilError(t, err)
+	expected, err := filepath.EvalSymlinks(binary)
+	assert.NilError(t, err)
+	assert.Equal(t, path, expected)
+}
+
+func TestGuestAgentBinaries(t *testing.T) {
+	dir := t.TempDir()
+	for arch, size := range map[string]int64{"X86_64": minGuestAgentBinarySize, "AARCH64": 42} {
+		binary := filepath.Join(dir, "lima-guestagent.Linux-"+strings.ToLower(arch))
+		f, err := os.Create(binary)
+		assert.NilError(t, err)
+		assert.NilError(t, f.Truncate(size))
+		assert.NilError(t, f.Close())
+		t.Setenv("LIMA_GUESTAGENT_"+arch, binary)
+	}
+
+	res := GuestAgentBinaries([]string{"x86_64", "aarch64", "riscv64"})
+	assert.Equal(t, len(res), 3)
+	assert.NilError(t, res["x86_64"].Err)
+	assert.Equal(t, res["x86_64"].Path, filepath.Join(dir, "lima-guestagent.Linux-x86_64"))
+	assert.ErrorContains(t, res["aarch64"].Err, "is truncated")
+	assert.ErrorContains(t, res["riscv64"].Err, `failed to find "lima-guestagent.Linux-riscv64" binary`)
+
+	// GuestAgentBinaryWithPath validates the binaries the same way
+	r, path, err := GuestAgentBinaryWithPath("x86_64")
+	assert.NilError(t, err)
+	assert.NilError(t, r.Close())
+	assert.Equal(t, path, res["x86_64"].Path)
+	_, _, err = GuestAgentBinaryWithPath("aarch64")
+	assert.ErrorContains(t, err, "is truncated")
+}
+
+func TestEmbeddedGuestAgent(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lima-guestagent.Linux-x86_64": {Data: []byte("x86_64 agent")},
+	}
+	for _, arch := range []string{"x86_64", "amd64"} {
+		b, name, ok := embeddedGuestAgent(fsys, arch)
+		assert.Assert(t, ok, arch)
+		assert.Equal(t, name, "lima-guestagent.Linux-x86_64", arch)
+		assert.Equal(t, string(b), "x86_64 agent", arch)
+	}
+	_, _, ok := embeddedGuestAgent(fsys, "aarch64")
+	assert.Assert(t, !ok)
+	_, _, ok = embeddedGuestAgent(nil, "x86_64")
+	assert.Assert(t, !ok)
+
+	orig := embeddedGuestAgents
+	embeddedGuestAgents = fsys
+	t.Cleanup(func() { embeddedGuestAgents = orig })
+	r, err := openGuestAgentBinary(embeddedGuestAgentPrefix + "lima-guestagent.Linux-x86_64")
+	assert.NilError(t, err)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "x86_64 agent")
+
+	// The embedded binary is used when there is none on the disk, even with a missing override
+	fsys["lima-guestagent.Linux-x86_64"].Data = make([]byte, minGuestAgentBinarySize)
+	for _, override := range []string{"", filepath.Join(t.TempDir(), "missing")} {
+		t.Setenv("LIMA_GUESTAGENT_X86_64", override)
+		r2, path, err := GuestAgentBinaryWithPath("x86_64")
+		assert.NilError(t, err, override)
+		assert.NilError(t, r2.Close())
+		assert.Equal(t, path, embeddedGuestAgentPrefix+"lima-guestagent.Linux-x86_64", override)
+	}
+}
+
+func TestVerifyGuestAgentBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lima-guestagent.Linux-x86_64")
+	assert.NilError(t, os.WriteFile(path, []byte("agent"), 0644))
+	dgst := digest.FromString("agent")
+	r, err := openGuestAgentBinary(path)
+	assert.NilError(t, err)
+	defer r.Close()
+
+	t.Setenv("LIMA_GUESTAGENT_X86_64_DIGEST", "")
+	assert.NilError(t, verifyGuestAgentBinary(r, path, limayaml.X8664))
+
+	t.Setenv("LIMA_GUESTAGENT_X86_64_DIGEST", dgst.String())
+	assert.NilError(t, verifyGuestAgentBinary(r, path, limayaml.X8664))
+
+	t.Setenv("LIMA_GUESTAGENT_X86_64_DIGEST", dgst.Encoded())
+	assert.NilError(t, verifyGuestAgentBinary(r, path, limayaml.X8664))
+
+	t.Setenv("LIMA_GUESTAGENT_X86_64_DIGEST", digest.FromString("stale agent").String())
+	err = verifyGuestAgentBinary(r, path, limayaml.X8664)
+	assert.Assert(t, errors.Is(err, ErrGuestAgentDigestMismatch), err)
+	assert.ErrorContains(t, err, dgst.String())
+
+	t.Setenv("LIMA_GUESTAGENT_X86_64_DIGEST", "sha256:bogus")
+	assert.ErrorContains(t, verifyGuestAgentBinary(r, path, limayaml.X8664), "invalid $LIMA_GUESTAGENT_X86_64_DIGEST")
+
+	// The digest of the other arch is not used
+	assert.NilError(t, verifyGuestAgentBinary(r, path, limayaml.AARCH64))
+
+	// r is rewound after verifying it
+	t.Setenv("LIMA_GUESTAGENT_X86_64_DIGEST", dgst.String())
+	assert.NilError(t, verifyGuestAgentBinary(r, path, limayaml.X8664))
+	b, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "agent")
+}
+
+func TestMirrorGroups(t *testing.T) {
+	const (
+		d1 = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		d2 = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+	)
+	archives := []limayaml.File{
+		{Location: "https://a/amd64", Arch: limayaml.X8664, Digest: d1},
+		{Location: "https://b/amd64", Arch: limayaml.X8664, Digest: d1},
+		{Location: "https://a/arm64", Arch: limayaml.AARCH64, Digest: d2},
+		{Location: "https://c/amd64", Arch: limayaml.X8664, Digest: d2},
+		{Location: "https://d/amd64", Arch: limayaml.X8664},
+		{Location: "https://e/amd64", Arch: limayaml.X8664},
+	}
+	groups := mirrorGroups(archives, limayaml.X8664)
+	assert.Equal(t, len(groups), 4)
+	assert.DeepEqual(t, groups[0].locations, []string{"https://a/amd64", "https://b/amd64"})
+	assert.Equal(t, groups[0].digest, digest.Digest(d1))
+	assert.DeepEqual(t, groups[1].locations, []string{"https://c/amd64"})
+	assert.Equal(t, groups[1].digest, digest.Digest(d2))
+	assert.DeepEqual(t, groups[2].locations, []string{"https://d/amd64"})
+	assert.DeepEqual(t, groups[3].locations, []string{"https://e/amd64"})
+
+	groups = mirrorGroups(archives, limayaml.AARCH64)
+	assert.Equal(t, len(groups), 1)
+	assert.DeepEqual(t, groups[0].locations, []string{"https://a/arm64"})
+}
+
+func TestBuildTemplateArgs(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("the guest user is derived from the host user, which must not be root")
+	}
+	t.Setenv("LIMA_HOME", t.TempDir())
+	y, err := limayaml.Load([]byte(`
+images:
+- location: "https://example.com/image.img"
+hostname: guest
+useHostResolver: false
+dns:
+- 192.0.2.53
+dnsSearchDomains:
+- corp.example.com
+dnsOptions: ["ndots:2", "rotate"]
+env:
+  FOO: bar
+`), "lima.yaml")
+	assert.NilError(t, err)
+	instDir := t.TempDir()
+	args, err := BuildTemplateArgs(instDir, "default", y, 0, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, args.Name, "default")
+	assert.Equal(t, args.Hostname, "guest")
+	assert.Assert(t, args.User != "")
+	assert.Assert(t, args.UID != 0)
+	assert.Assert(t, len(args.SSHPubKeys) > 0)
+	assert.DeepEqual(t, args.DNSAddresses, []string{"192.0.2.53"})
+	assert.DeepEqual(t, args.DNSSearchDomains, []string{"corp.example.com"})
+	assert.DeepEqual(t, args.DNSOptions, map[string]string{"ndots": "2", "rotate": "true"})
+	assert.Equal(t, args.Env["FOO"], "bar")
+	assert.Equal(t, args.Networks[0].MACAddress, limayaml.MACAddress(instDir))
+
+	// Nothing is written to the instance directory
+	entries, err := os.ReadDir(instDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestGenerateISO9660Plan(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("the guest user is derived from the host user, which must not be root")
+	}
+	t.Setenv("LIMA_HOME", t.TempDir())
+	guestAgent := filepath.Join(t.TempDir(), "lima-guestagent")
+	assert.NilError(t, os.WriteFile(guestAgent, make([]byte, minGuestAgentBinarySize), 0755))
+	t.Setenv("LIMA_GUESTAGENT_X86_64", guestAgent)
+	d := digest.FromString("nerdctl-full")
+	y, err := limayaml.Load([]byte(`
+arch: x86_64
+images:
+- location: "https://example.com/image.img"
+useHostResolver: false
+dns:
+- 192.0.2.53
+containerd:
+  system: false
+  user: true
+  archives:
+  - location: "https://192.0.2.1/nerdctl-full-amd64.tar.xz"
+    arch: x86_64
+    digest: `+d.String()+`
+  - location: "https://192.0.2.1/nerdctl-full-arm64.tar.gz"
+    arch: aarch64
+provision:
+- mode: system
+  script: "#!/bin/sh"
+`), "lima.yaml")
+	assert.NilError(t, err)
+	instDir := t.TempDir()
+	plan, err := GenerateISO9660Plan(instDir, "default", y, 0, 0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, plan.Args.DNSAddresses, []string{"192.0.2.53"})
+	assert.Equal(t, plan.GuestAgentBinary, guestAgent)
+	assert.DeepEqual(t, plan.ContainerdArchives, []limayaml.File{
+		{Location: "https://192.0.2.1/nerdctl-full-amd64.tar.xz", Arch: limayaml.X8664, Digest: d},
+	})
+	assert.Assert(t, len(plan.Paths) > 4)
+	tail := plan.Paths[len(plan.Paths)-3:]
+	assert.DeepEqual(t, tail, []string{guestAgentFile, containerdArchiveXzFile, manifestFile})
+	assert.Assert(t, strings.Contains(strings.Join(plan.Paths, "\n"), "provision.system/00000000"))
+
+	// Nothing is downloaded or written to the instance directory
+	entries, err := os.ReadDir(instDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+
+	// Without containerd, no archive is planned
+	y.Containerd.User = &[]bool{false}[0]
+	plan, err = GenerateISO9660Plan(instDir, "default", y, 0, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.ContainerdArchives), 0)
+	assert.Equal(t, plan.Paths[len(plan.Paths)-2], guestAgentFile)
+}
+
+// testInstance returns the directory and the config of an instance that GenerateISO9660 can generate the ISO of,
+// with the guest agent binary and a containerd archive served by d.
+func testInstance(t *testing.T) (string, *limayaml.LimaYAML, *fakeDownloader) {
+	t.Setenv("LIMA_HOME", t.TempDir())
+	dir := t.TempDir()
+	guestAgent := filepath.Join(dir, "lima-guestagent")
+	assert.NilError(t, os.WriteFile(guestAgent, make([]byte, minGuestAgentBinarySize), 0755))
+	t.Setenv("LIMA_GUESTAGENT_X86_64", guestAgent)
+	t.Setenv("LIMA_GUESTAGENT_X86_64_DIGEST", "")
+	archive := filepath.Join(dir, "nerdctl-full.tar.gz")
+	assert.NilError(t, os.WriteFile(archive, []byte{0x1f, 0x8b, 0x08}, 0644))
+	const location = "https://192.0.2.1/nerdctl-full-amd64.tar.gz"
+	y, err := limayaml.Load([]byte(`
+arch: x86_64
+images:
+- location: "https://example.com/image.img"
+user:
+  name: lima
+  uid: 1000
+useHostResolver: false
+dns:
+- 192.0.2.53
+containerd:
+  system: false
+  user: true
+  archives:
+  - location: "`+location+`"
+    arch: x86_64
+`), "lima.yaml")
+	assert.NilError(t, err)
+	d := &fakeDownloader{files: map[string]string{location: archive}}
+	return t.TempDir(), y, d
+}
+
+func TestGenerateISO9660Result(t *testing.T) {
+	instDir, y, d := testInstance(t)
+	isoPath := filepath.Join(instDir, filenames.CIDataISO)
+
+	res, err := GenerateISO9660(instDir, "default", y, 0, 0, WithDownloader(d))
+	assert.NilError(t, err)
+	assert.Assert(t, res.Rewritten)
+	assert.Equal(t, res.ContainerdArchiveStatus, downloader.StatusDownloaded)
+	assert.DeepEqual(t, res.DNSAddresses, []string{"192.0.2.53"})
+	st, err := os.Stat(isoPath)
+	assert.NilError(t, err)
+	assert.Equal(t, res.Size, st.Size())
+	assert.Equal(t, len(d.attempted), 1)
+
+	// The unchanged ISO is left untouched, without downloading the archive again
+	res, err = GenerateISO9660(instDir, "default", y, 0, 0, WithDownloader(d))
+	assert.NilError(t, err)
+	assert.Assert(t, !res.Rewritten)
+	assert.Equal(t, res.ContainerdArchiveStatus, downloader.StatusUnknown)
+	assert.Equal(t, res.Size, st.Size())
+	assert.Equal(t, len(d.attempted), 1)
+
+	// Without containerd, there is no archive status
+	y.Containerd.User = &[]bool{false}[0]
+	res, err = GenerateISO9660(instDir, "default", y, 0, 0, WithDownloader(d))
+	assert.NilError(t, err)
+	assert.Assert(t, res.Rewritten)
+	assert.Equal(t, res.ContainerdArchiveStatus, downloader.StatusUnknown)
+	assert.Assert(t, res.Size > 0)
+}
+
+func TestGenerateISO9660DefaultSettings(t *testing.T) {
+	instDir, y, d := testInstance(t)
+	y.UseHostResolver = &[]bool{true}[0]
+	y.DNS = nil
+	assert.Assert(t, !*y.CIData.StableInstanceID)
+
+	res, err := GenerateISO9660(instDir, "default", y, 12345, 12346, WithDownloader(d))
+	assert.NilError(t, err)
+	assert.Assert(t, res.Rewritten)
+
+	// The default instance ID changes every second, but alone it does not rewrite the ISO
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	res, err = GenerateISO9660(instDir, "default", y, 12345, 12346, WithDownloader(d))
+	assert.NilError(t, err)
+	assert.Assert(t, !res.Rewritten)
+
+	// The ports of the DNS server of the host agent are passed to the guest
+	res, err = GenerateISO9660(instDir, "default", y, 12345, 12347, WithDownloader(d))
+	assert.NilError(t, err)
+	assert.Assert(t, res.Rewritten)
+}
+
+func TestGenerateISO9660ContextCancel(t *testing.T) {
+	instDir, y, d := testInstance(t)
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	isoPath := filepath.Join(instDir, filenames.CIDataISO)
+	_, err := GenerateISO9660(instDir, "default", y, 0, 0, WithDownloader(d))
+	assert.NilError(t, err)
+	iso, err := os.ReadFile(isoPath)
+	assert.NilError(t, err)
+
+	// A change of the config requires downloading the archive again, which is cancelled
+	y.Containerd.Archives[0].Location += "?v=2"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	d.started = started
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = GenerateISO9660Context(ctx, instDir, "default", y, 0, 0, WithDownloader(d))
+	assert.Assert(t, errors.Is(err, context.Canceled), err)
+
+	// The previous ISO is intact, and the temporary files are removed
+	b, err := os.ReadFile(isoPath)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(b, iso))
+	entries, err := os.ReadDir(tmpDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+	entries, err = os.ReadDir(instDir)
+	assert.NilError(t, err)
+	for _, e := range entries {
+		assert.Assert(t, !strings.Contains(e.Name(), ".tmp"), e.Name())
+	}
+}
@@ -0,0 +1,114 @@
+package cidata
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lima-vm/lima/pkg/iso9660util"
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/lima-vm/lima/pkg/store/filenames"
+	"github.com/sirupsen/logrus"
+)
+
+// dnsEntries are the files of the ISO that are rewritten by UpdateISO9660DNS:
+// user-data and network-config contain the nameservers and the search domains, and meta-data contains
+// the instance ID, which must change for cloud-init to apply the new network config.
+var dnsEntries = map[string]struct{}{
+	"user-data":      {},
+	"network-config": {},
+	"meta-data":      {},
+}
+
+// UpdateISO9660DNS rewrites the DNS settings of the existing cidata ISO of the instance, e.g., after the host
+// has moved to another network, without downloading the containerd archive again.
+//
+// Only the files in dnsEntries are rendered again from the current config, and manifest.txt is updated
+// accordingly. The other files, including the guest agent binary and the containerd archive, are copied
+// from the existing ISO as is.
+// The digest of the ISO is removed, so that the next GenerateISO9660 does not mistake the ISO for up to date.
+// Only ISO9660 images are supported, other filesystems have to be regenerated with GenerateISO9660.
+func UpdateISO9660DNS(instDir, name string, y *limayaml.LimaYAML, udpDNSLocalPort, tcpDNSLocalPort int) (*GenerateResult, error) {
+	if err := ValidateForGenerate(y, name); err != nil {
+		return nil, err
+	}
+	if y.CIData.Filesystem != limayaml.CIDataFilesystemISO9660 {
+		return nil, fmt.Errorf("cannot update the DNS settings of a %q cidata image, regenerate it with GenerateISO9660", y.CIData.Filesystem)
+	}
+	args, err := BuildTemplateArgs(instDir, name, y, udpDNSLocalPort, tcpDNSLocalPort)
+	if err != nil {
+		return nil, err
+	}
+	userDataTemplate, err := readUserDataTemplate(y)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := ExecuteTemplateWithUserData(args, userDataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string][]byte, len(dnsEntries))
+	for _, f := range rendered {
+		if _, ok := dnsEntries[f.Path]; !ok {
+			continue
+		}
+		b, err := ioutil.ReadAll(f.Reader)
+		if err != nil {
+			return nil, err
+		}
+		updates[f.Path] = b
+	}
+
+	digestPath := filepath.Join(instDir, filenames.CIDataISODigest)
+	if err := os.RemoveAll(digestPath); err != nil {
+		return nil, err
+	}
+	isoPath := filepath.Join(instDir, filenames.CIDataISO)
+	if err := replaceISO9660Entries(isoPath, updates); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Updated the DNS settings of %q (dnsAddresses=%v)", isoPath, args.DNSAddresses)
+	res := &GenerateResult{
+		Rewritten:    true,
+		DNSAddresses: args.DNSAddresses,
+	}
+	return res, res.setSize(isoPath)
+}
+
+// replaceISO9660Entries rewrites the ISO with the contents of the entries in updates, which must all exist in the ISO,
+// and updates manifest.txt accordingly. The other entries are copied byte-for-byte.
+func replaceISO9660Entries(isoPath string, updates map[string][]byte) error {
+	isoFile, err := os.Open(isoPath)
+	if err != nil {
+		return err
+	}
+	defer isoFile.Close()
+	existing, err := iso9660util.ReadLayout(isoFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", isoPath, err)
+	}
+	var layout []iso9660util.Entry
+	replaced := 0
+	for _, f := range existing {
+		switch b, ok := updates[f.Path]; {
+		case f.Path == manifestFile:
+			// regenerated below
+		case ok:
+			layout = append(layout, iso9660util.Entry{Path: f.Path, Reader: bytes.NewReader(b)})
+			replaced++
+		default:
+			layout = append(layout, f)
+		}
+	}
+	if replaced != len(updates) {
+		return fmt.Errorf("%q lacks some of the files to be updated (user-data, network-config, meta-data), regenerate it with GenerateISO9660", isoPath)
+	}
+	manifest, err := manifestEntry(layout)
+	if err != nil {
+		return err
+	}
+	layout = append(layout, manifest)
+	return iso9660util.Write(isoPath, "cidata", layout)
+}
@@ -0,0 +1,52 @@
+package cidata
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lima-vm/lima/pkg/iso9660util"
+	"gotest.tools/v3/assert"
+)
+
+func TestReplaceISO9660Entries(t *testing.T) {
+	isoPath := filepath.Join(t.TempDir(), "cidata.iso")
+	layout := []iso9660util.Entry{
+		{Path: "meta-data", Reader: strings.NewReader("instance-id: iid-1\n")},
+		{Path: "user-data", Reader: strings.NewReader("#cloud-config\nold\n")},
+		{Path: "lima-guestagent", Reader: strings.NewReader("\x7fELF guest agent")},
+		{Path: "provision.system/00000000", Reader: strings.NewReader("#!/bin/sh\n")},
+	}
+	manifest, err := manifestEntry(layout)
+	assert.NilError(t, err)
+	assert.NilError(t, iso9660util.Write(isoPath, "cidata", append(layout, manifest)))
+
+	updates := map[string][]byte{
+		"meta-data": []byte("instance-id: iid-2\n"),
+		"user-data": []byte("#cloud-config\nnew\n"),
+	}
+	assert.NilError(t, replaceISO9660Entries(isoPath, updates))
+
+	f, err := os.Open(isoPath)
+	assert.NilError(t, err)
+	defer f.Close()
+	got, err := iso9660util.ReadLayout(f)
+	assert.NilError(t, err)
+	contents := make(map[string]string)
+	for _, e := range got {
+		b, err := io.ReadAll(e.Reader)
+		assert.NilError(t, err)
+		contents[e.Path] = string(b)
+	}
+	assert.Equal(t, contents["meta-data"], "instance-id: iid-2\n")
+	assert.Equal(t, contents["user-data"], "#cloud-config\nnew\n")
+	assert.Equal(t, contents["lima-guestagent"], "\x7fELF guest agent")
+	assert.Equal(t, contents["provision.system/00000000"], "#!/bin/sh\n")
+	assert.Assert(t, strings.Contains(contents["manifest.txt"], "  meta-data\n"))
+	assert.Assert(t, !strings.Contains(contents["manifest.txt"], "  manifest.txt\n"))
+
+	err = replaceISO9660Entries(isoPath, map[string][]byte{"network-config": []byte("version: 2\n")})
+	assert.ErrorContains(t, err, "lacks some of the files")
+}
@@ -0,0 +1,124 @@
+package cidata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lima-vm/lima/pkg/downloader"
+)
+
+// Downloader fetches the containerd archive for GenerateISO9660.
+// The options passed to the methods include downloader.WithCache and downloader.WithExpectedDigest.
+type Downloader interface {
+	// Cached is like downloader.Cached.
+	Cached(remote string, opts ...downloader.Opt) (string, error)
+	// DownloadWithMirrors is like downloader.DownloadWithMirrorsContext.
+	DownloadWithMirrors(ctx context.Context, local string, remotes []string, opts ...downloader.Opt) (*downloader.Result, string, error)
+}
+
+// DefaultDownloader is the Downloader that uses the downloader package.
+var DefaultDownloader Downloader = defaultDownloader{}
+
+type defaultDownloader struct{}
+
+func (defaultDownloader) Cached(remote string, opts ...downloader.Opt) (string, error) {
+	return downloader.Cached(remote, opts...)
+}
+
+func (defaultDownloader) DownloadWithMirrors(ctx context.Context, local string, remotes []string, opts ...downloader.Opt) (*downloader.Result, string, error) {
+	return downloader.DownloadWithMirrorsContext(ctx, local, remotes, opts...)
+}
+
+// CacheDirDownloader returns a Downloader that uses cacheDir as the download cache instead of
+// the default one, e.g., a cache populated in advance for hosts without network access.
+func CacheDirDownloader(cacheDir string) Downloader {
+	return cacheDirDownloader{cacheDir: cacheDir}
+}
+
+type cacheDirDownloader struct {
+	cacheDir string
+}
+
+func (d cacheDirDownloader) Cached(remote string, opts ...downloader.Opt) (string, error) {
+	return DefaultDownloader.Cached(remote, d.opts(opts)...)
+}
+
+func (d cacheDirDownloader) DownloadWithMirrors(ctx context.Context, local string, remotes []string, opts ...downloader.Opt) (*downloader.Result, string, error) {
+	return DefaultDownloader.DownloadWithMirrors(ctx, local, remotes, d.opts(opts)...)
+}
+
+// opts returns opts with the cache dir overridden, as the later options take precedence.
+func (d cacheDirDownloader) opts(opts []downloader.Opt) []downloader.Opt {
+	return append(append([]downloader.Opt(nil), opts...), downloader.WithCacheDir(d.cacheDir))
+}
+
+// ErrArchiveNotCached is returned in the offline mode when the containerd archive is not in the download cache.
+var ErrArchiveNotCached = errors.New("the containerd archive is not cached, run in online mode first")
+
+type options struct {
+	downloader Downloader
+	offline    bool
+	// retryAttempts is the number of attempts to download the containerd archive from each group of mirrors,
+	// 0 is the same as 1.
+	retryAttempts int
+	// retryBaseDelay is the delay before the second attempt, doubled for each further attempt.
+	retryBaseDelay time.Duration
+}
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = 2 * time.Second
+)
+
+// Opt is an option of GenerateISO9660.
+type Opt func(*options) error
+
+// WithDownloader sets the Downloader of the containerd archive. Default: DefaultDownloader
+func WithDownloader(d Downloader) Opt {
+	return func(o *options) error {
+		o.downloader = d
+		return nil
+	}
+}
+
+// WithOffline makes GenerateISO9660 fail with ErrArchiveNotCached instead of downloading the containerd archive
+// when it is not in the download cache. The archives with a local location are still used.
+func WithOffline() Opt {
+	return func(o *options) error {
+		o.offline = true
+		return nil
+	}
+}
+
+// WithRetry sets the number of attempts to download the containerd archive, and the delay before the second attempt,
+// which is doubled for each further attempt. The digest is verified on every attempt.
+// Default: 3 attempts, with a base delay of 2 seconds.
+func WithRetry(attempts int, baseDelay time.Duration) Opt {
+	return func(o *options) error {
+		if attempts < 1 {
+			return fmt.Errorf("the number of attempts must be at least 1, got %d", attempts)
+		}
+		if baseDelay < 0 {
+			return fmt.Errorf("the base delay must not be negative, got %v", baseDelay)
+		}
+		o.retryAttempts = attempts
+		o.retryBaseDelay = baseDelay
+		return nil
+	}
+}
+
+func newOptions(opts []Opt) (*options, error) {
+	o := &options{
+		downloader:     DefaultDownloader,
+		retryAttempts:  defaultRetryAttempts,
+		retryBaseDelay: defaultRetryBaseDelay,
+	}
+	for _, f := range opts {
+		if err := f(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
@@ -0,0 +1,265 @@
+package cidata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lima-vm/lima/pkg/downloader"
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+// fakeDownloader serves the archives from the local files in files, keyed by the remote location.
+// The first failures downloads fail as if the network was down.
+// When started is set, the next download closes it, and blocks until the context is done.
+type fakeDownloader struct {
+	cached    map[string]string
+	files     map[string]string
+	failures  int
+	started   chan struct{}
+	attempted [][]string
+}
+
+func (d *fakeDownloader) Cached(remote string, opts ...downloader.Opt) (string, error) {
+	return d.cached[remote], nil
+}
+
+func (d *fakeDownloader) DownloadWithMirrors(ctx context.Context, local string, remotes []string, opts ...downloader.Opt) (*downloader.Result, string, error) {
+	d.attempted = append(d.attempted, remotes)
+	if d.started != nil {
+		close(d.started)
+		d.started = nil
+		<-ctx.Done()
+		return nil, "", ctx.Err()
+	}
+	if d.failures > 0 {
+		d.failures--
+		return nil, "", errors.New("connection reset by peer")
+	}
+	for _, remote := range remotes {
+		src, ok := d.files[remote]
+		if !ok {
+			continue
+		}
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := os.WriteFile(local, b, 0644); err != nil {
+			return nil, "", err
+		}
+		return &downloader.Result{Status: downloader.StatusDownloaded}, remote, nil
+	}
+	return nil, "", errors.New("not found")
+}
+
+func TestContainerdArchive(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "nerdctl-full.tar.gz")
+	assert.NilError(t, os.WriteFile(src, []byte{0x1f, 0x8b, 0x08}, 0644))
+	const dgst = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	archives := []limayaml.File{
+		{Location: "https://example.com/arm64.tar.gz", Arch: limayaml.AARCH64},
+		{Location: "https://a.example.com/x86_64.tar.gz", Arch: limayaml.X8664, Digest: dgst},
+		{Location: "https://b.example.com/x86_64.tar.gz", Arch: limayaml.X8664, Digest: dgst},
+	}
+
+	t.Run("download", func(t *testing.T) {
+		d := &fakeDownloader{files: map[string]string{"https://b.example.com/x86_64.tar.gz": src}}
+		local := filepath.Join(t.TempDir(), "nerdctl-full")
+		path, status, err := containerdArchive(context.Background(), &options{downloader: d}, local, archives, limayaml.X8664)
+		assert.NilError(t, err)
+		assert.Equal(t, path, local)
+		assert.Equal(t, status, downloader.StatusDownloaded)
+		assert.DeepEqual(t, d.attempted, [][]string{{"https://a.example.com/x86_64.tar.gz", "https://b.example.com/x86_64.tar.gz"}})
+		r, err := os.Open(path)
+		assert.NilError(t, err)
+		defer r.Close()
+		name, err := containerdArchiveName(r)
+		assert.NilError(t, err)
+		assert.Equal(t, name, "nerdctl-full.tgz")
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		d := &fakeDownloader{cached: map[string]string{"https://b.example.com/x86_64.tar.gz": src}}
+		path, status, err := containerdArchive(context.Background(), &options{downloader: d}, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+		assert.NilError(t, err)
+		assert.Equal(t, path, src)
+		assert.Equal(t, status, downloader.StatusUsedCache)
+		assert.Equal(t, len(d.attempted), 0)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		d := &fakeDownloader{}
+		_, _, err := containerdArchive(context.Background(), &options{downloader: d}, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+		assert.ErrorContains(t, err, "attempted 2 candidates")
+	})
+
+	t.Run("no archive for arch", func(t *testing.T) {
+		_, _, err := containerdArchive(context.Background(), &options{downloader: &fakeDownloader{}}, filepath.Join(t.TempDir(), "nerdctl-full"), archives, "riscv64")
+		assert.ErrorContains(t, err, `no containerd archive was provided for arch "riscv64"`)
+	})
+}
+
+func TestContainerdArchiveMirrorDigest(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.tar.gz")
+	assert.NilError(t, os.WriteFile(stale, []byte("stale"), 0644))
+	good := filepath.Join(dir, "good.tar.gz")
+	assert.NilError(t, os.WriteFile(good, []byte{0x1f, 0x8b, 0x08}, 0644))
+	dgst := digest.FromBytes([]byte{0x1f, 0x8b, 0x08})
+	o := &options{downloader: CacheDirDownloader(t.TempDir()), retryAttempts: 1}
+
+	// The mirror that does not match the digest is skipped
+	archives := []limayaml.File{
+		{Location: stale, Arch: limayaml.X8664, Digest: dgst},
+		{Location: good, Arch: limayaml.X8664, Digest: dgst},
+	}
+	local := filepath.Join(t.TempDir(), "nerdctl-full")
+	path, status, err := containerdArchive(context.Background(), o, local, archives, limayaml.X8664)
+	assert.NilError(t, err)
+	assert.Equal(t, path, local)
+	assert.Equal(t, status, downloader.StatusDownloaded)
+	b, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, b, []byte{0x1f, 0x8b, 0x08})
+
+	_, _, err = containerdArchive(context.Background(), o, filepath.Join(t.TempDir(), "nerdctl-full"), archives[:1], limayaml.X8664)
+	assert.ErrorContains(t, err, "expected digest")
+
+	// The stronger digests are verified too, and the mismatch names both digests
+	sha512 := digest.SHA512.FromBytes([]byte{0x1f, 0x8b, 0x08})
+	archives = []limayaml.File{{Location: good, Arch: limayaml.X8664, Digest: sha512}}
+	_, _, err = containerdArchive(context.Background(), o, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.NilError(t, err)
+	archives[0].Location = stale
+	_, _, err = containerdArchive(context.Background(), o, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.ErrorContains(t, err, fmt.Sprintf("expected digest %q, got %q", sha512, digest.SHA512.FromString("stale")))
+}
+
+func TestContainerdArchiveCached(t *testing.T) {
+	content := []byte{0x1f, 0x8b, 0x08}
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(content)
+	}))
+	t.Cleanup(srv.Close)
+	archives := []limayaml.File{
+		{Location: srv.URL + "/nerdctl-full.tar.gz", Arch: limayaml.X8664, Digest: digest.FromBytes(content)},
+	}
+	o := &options{downloader: CacheDirDownloader(t.TempDir()), retryAttempts: 1}
+
+	local := filepath.Join(t.TempDir(), "nerdctl-full")
+	_, status, err := containerdArchive(context.Background(), o, local, archives, limayaml.X8664)
+	assert.NilError(t, err)
+	assert.Equal(t, status, downloader.StatusDownloaded)
+	assert.Equal(t, atomic.LoadInt32(&requests), int32(1))
+
+	// The cached archive is used in place, without copying it to local
+	local = filepath.Join(t.TempDir(), "nerdctl-full")
+	path, status, err := containerdArchive(context.Background(), o, local, archives, limayaml.X8664)
+	assert.NilError(t, err)
+	assert.Equal(t, status, downloader.StatusUsedCache)
+	assert.Assert(t, path != local)
+	_, err = os.Stat(local)
+	assert.Assert(t, errors.Is(err, os.ErrNotExist), err)
+	b, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, b, content)
+	assert.Equal(t, atomic.LoadInt32(&requests), int32(1))
+}
+
+func TestContainerdArchiveOffline(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "nerdctl-full.tar.gz")
+	assert.NilError(t, os.WriteFile(src, []byte{0x1f, 0x8b, 0x08}, 0644))
+	archives := []limayaml.File{
+		{Location: "https://example.com/x86_64.tar.gz", Arch: limayaml.X8664},
+	}
+
+	d := &fakeDownloader{files: map[string]string{"https://example.com/x86_64.tar.gz": src}}
+	_, _, err := containerdArchive(context.Background(), &options{downloader: d, offline: true}, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.Assert(t, errors.Is(err, ErrArchiveNotCached), err)
+	assert.Equal(t, len(d.attempted), 0)
+
+	d = &fakeDownloader{cached: map[string]string{"https://example.com/x86_64.tar.gz": src}}
+	path, status, err := containerdArchive(context.Background(), &options{downloader: d, offline: true}, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.NilError(t, err)
+	assert.Equal(t, path, src)
+	assert.Equal(t, status, downloader.StatusUsedCache)
+
+	// The local archives do not need the network
+	archives = append(archives, limayaml.File{Location: src, Arch: limayaml.X8664})
+	d = &fakeDownloader{files: map[string]string{src: src}}
+	_, status, err = containerdArchive(context.Background(), &options{downloader: d, offline: true}, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.NilError(t, err)
+	assert.Equal(t, status, downloader.StatusDownloaded)
+	assert.DeepEqual(t, d.attempted, [][]string{{src}})
+}
+
+func TestContainerdArchiveRetry(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "nerdctl-full.tar.gz")
+	assert.NilError(t, os.WriteFile(src, []byte{0x1f, 0x8b, 0x08}, 0644))
+	archives := []limayaml.File{
+		{Location: "https://example.com/x86_64.tar.gz", Arch: limayaml.X8664},
+	}
+	files := map[string]string{"https://example.com/x86_64.tar.gz": src}
+
+	d := &fakeDownloader{files: files, failures: 2}
+	o := &options{downloader: d, retryAttempts: 3, retryBaseDelay: time.Millisecond}
+	_, status, err := containerdArchive(context.Background(), o, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.NilError(t, err)
+	assert.Equal(t, status, downloader.StatusDownloaded)
+	assert.Equal(t, len(d.attempted), 3)
+
+	d = &fakeDownloader{files: files, failures: 3}
+	o = &options{downloader: d, retryAttempts: 3, retryBaseDelay: time.Millisecond}
+	_, _, err = containerdArchive(context.Background(), o, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.ErrorContains(t, err, "connection reset by peer")
+	assert.Equal(t, len(d.attempted), 3)
+
+	// The context is respected between the attempts
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d = &fakeDownloader{files: files, failures: 1}
+	o = &options{downloader: d, retryAttempts: 3, retryBaseDelay: time.Hour}
+	_, _, err = containerdArchive(ctx, o, filepath.Join(t.TempDir(), "nerdctl-full"), archives, limayaml.X8664)
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Equal(t, len(d.attempted), 1)
+}
+
+func TestNewOptions(t *testing.T) {
+	o, err := newOptions(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, o.downloader, DefaultDownloader)
+
+	d := &fakeDownloader{}
+	o, err = newOptions([]Opt{WithDownloader(d)})
+	assert.NilError(t, err)
+	assert.Equal(t, o.downloader, Downloader(d))
+	assert.Assert(t, !o.offline)
+
+	o, err = newOptions([]Opt{WithOffline()})
+	assert.NilError(t, err)
+	assert.Assert(t, o.offline)
+	assert.Equal(t, o.retryAttempts, defaultRetryAttempts)
+
+	o, err = newOptions([]Opt{WithRetry(5, time.Second)})
+	assert.NilError(t, err)
+	assert.Equal(t, o.retryAttempts, 5)
+	assert.Equal(t, o.retryBaseDelay, time.Second)
+
+	_, err = newOptions([]Opt{WithRetry(0, time.Second)})
+	assert.ErrorContains(t, err, "must be at least 1")
+}
@@ -0,0 +1,63 @@
+package cidata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/lima-vm/lima/pkg/localpathutil"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadEnvFiles reads the env files in order, the variables of a file overriding the ones of the previous files.
+func loadEnvFiles(files []string) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, f := range files {
+		expanded, err := localpathutil.Expand(f)
+		if err != nil {
+			return nil, err
+		}
+		r, err := os.Open(expanded)
+		if err != nil {
+			return nil, err
+		}
+		fileEnv, err := parseEnvFile(r, f)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fileEnv {
+			env[name] = value
+		}
+	}
+	return env, nil
+}
+
+// parseEnvFile parses KEY=VALUE lines. Empty lines and lines starting with "#" are ignored.
+// The values are taken literally, without removing quotes or expanding variables.
+func parseEnvFile(r io.Reader, name string) (map[string]string, error) {
+	env := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE, got %q", name, lineNo, line)
+		}
+		if !envNameRegexp.MatchString(kv[0]) {
+			return nil, fmt.Errorf("%s:%d: invalid variable name %q", name, lineNo, kv[0])
+		}
+		env[kv[0]] = kv[1]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return env, nil
+}
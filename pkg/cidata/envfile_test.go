@@ -0,0 +1,31 @@
+package cidata
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	env, err := parseEnvFile(strings.NewReader(`
+# comment
+FOO=bar
+  EMPTY=
+WITH_EQUALS=a=b
+QUOTED="x y"
+`), "test.env")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, env, map[string]string{
+		"FOO":         "bar",
+		"EMPTY":       "",
+		"WITH_EQUALS": "a=b",
+		"QUOTED":      `"x y"`,
+	})
+
+	_, err = parseEnvFile(strings.NewReader("FOO=bar\nBAZ\n"), "test.env")
+	assert.Error(t, err, `test.env:2: expected KEY=VALUE, got "BAZ"`)
+
+	_, err = parseEnvFile(strings.NewReader("\n\n1FOO=bar\n"), "test.env")
+	assert.Error(t, err, `test.env:3: invalid variable name "1FOO"`)
+}
@@ -0,0 +1,22 @@
+//go:build embed_guestagent
+// +build embed_guestagent
+
+package cidata
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The guest agent binaries are copied to pkg/cidata/guestagent by `make limactl-embedded`.
+//
+//go:embed guestagent/lima-guestagent.Linux-*
+var embeddedGuestAgentFS embed.FS
+
+func init() {
+	sub, err := fs.Sub(embeddedGuestAgentFS, "guestagent")
+	if err != nil {
+		panic(err)
+	}
+	embeddedGuestAgents = sub
+}
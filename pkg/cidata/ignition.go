@@ -0,0 +1,246 @@
+package cidata
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/lima-vm/lima/pkg/store/filenames"
+)
+
+// ignitionVersion is the spec version of the generated Ignition config.
+// Fedora CoreOS supports it since Ignition v2.14, and Flatcar since v3227.2.0.
+const ignitionVersion = "3.3.0"
+
+const (
+	ignitionLibexecDir = "/usr/local/libexec/lima"
+	// ignitionBootScript mounts the cidata ISO and executes boot.sh, like the per-boot script written by user-data.
+	// The format argument is the mount options of the cidata filesystem.
+	ignitionBootScript = `#!/bin/sh
+set -eux
+LIMA_CIDATA_MNT="/mnt/lima-cidata"
+LIMA_CIDATA_DEV="/dev/disk/by-label/cidata"
+mkdir -p -m 700 "${LIMA_CIDATA_MNT}"
+mount -o %s "${LIMA_CIDATA_DEV}" "${LIMA_CIDATA_MNT}"
+export LIMA_CIDATA_MNT
+exec "${LIMA_CIDATA_MNT}"/boot.sh
+`
+	ignitionBootUnit = "lima-boot.service"
+)
+
+// The subset of the Ignition config spec v3.3.0 used by Lima.
+// See https://coreos.github.io/ignition/configuration-v3_3/
+type ignitionConfig struct {
+	Ignition ignitionMeta    `json:"ignition"`
+	Passwd   ignitionPasswd  `json:"passwd"`
+	Storage  ignitionStorage `json:"storage"`
+	Systemd  ignitionSystemd `json:"systemd"`
+}
+
+type ignitionMeta struct {
+	Version string `json:"version"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	UID               int      `json:"uid"`
+	HomeDir           string   `json:"homeDir"`
+	Shell             string   `json:"shell"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files,omitempty"`
+	Links []ignitionLink `json:"links,omitempty"`
+}
+
+type ignitionFile struct {
+	Path      string           `json:"path"`
+	Mode      int              `json:"mode"`
+	Overwrite bool             `json:"overwrite"`
+	Contents  ignitionContents `json:"contents"`
+}
+
+type ignitionContents struct {
+	Source string `json:"source"` // data URL
+}
+
+type ignitionLink struct {
+	Path      string `json:"path"`
+	Target    string `json:"target"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+// GenerateIgnition writes the Ignition config of the instance to instDir/ignition.json, for the distros
+// provisioned with Ignition instead of cloud-init (`cidata.format: ignition`).
+// QEMU passes the file to the guest with the firmware config device, where both Fedora CoreOS and Flatcar
+// look for it.
+//
+// The config creates the user, and installs a systemd unit that executes boot.sh of the cidata ISO on every boot,
+// so the cidata ISO generated by GenerateISO9660 must still be attached.
+// The provision scripts are installed by the config as systemd units, instead of being executed by boot.sh.
+func GenerateIgnition(instDir, name string, y *limayaml.LimaYAML) error {
+	if err := ValidateForGenerate(y, name); err != nil {
+		return err
+	}
+	// The DNS ports are only written to lima.env of the cidata ISO
+	args, err := BuildTemplateArgs(instDir, name, y, 0, 0)
+	if err != nil {
+		return err
+	}
+	cfg, err := buildIgnitionConfig(args, y)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(instDir, filenames.IgnitionConfig), b, 0644)
+}
+
+func buildIgnitionConfig(args TemplateArgs, y *limayaml.LimaYAML) (*ignitionConfig, error) {
+	homeDir := fmt.Sprintf("/home/%s.linux", args.User)
+	cfg := &ignitionConfig{
+		Ignition: ignitionMeta{Version: ignitionVersion},
+		Passwd: ignitionPasswd{
+			Users: []ignitionUser{
+				{
+					Name:              args.User,
+					UID:               args.UID,
+					HomeDir:           homeDir,
+					Shell:             "/bin/bash",
+					SSHAuthorizedKeys: args.SSHPubKeys,
+				},
+			},
+		},
+	}
+	addFile := func(path string, mode int, content string) {
+		cfg.Storage.Files = append(cfg.Storage.Files, ignitionFile{
+			Path:      path,
+			Mode:      mode,
+			Overwrite: true,
+			Contents:  ignitionContents{Source: dataURL(content)},
+		})
+	}
+	addFile("/etc/hostname", 0644, args.Hostname+"\n")
+	addFile("/etc/sudoers.d/90-lima-user", 0440, args.User+" ALL=(ALL) NOPASSWD:ALL\n")
+	if args.Locale != "" {
+		addFile("/etc/locale.conf", 0644, "LANG="+args.Locale+"\n")
+	}
+	if args.Timezone != "" {
+		cfg.Storage.Links = append(cfg.Storage.Links, ignitionLink{
+			Path:      "/etc/localtime",
+			Target:    "../usr/share/zoneinfo/" + args.Timezone,
+			Overwrite: true,
+		})
+	}
+
+	bootScript := ignitionLibexecDir + "/boot.sh"
+	addFile(bootScript, 0755, fmt.Sprintf(ignitionBootScript, cidataMountOptions(y.CIData.Filesystem)))
+	cfg.Systemd.Units = append(cfg.Systemd.Units, ignitionUnit{
+		Name:    ignitionBootUnit,
+		Enabled: true,
+		Contents: `[Unit]
+Description=Lima boot scripts
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=` + bootScript + `
+
+[Install]
+WantedBy=multi-user.target
+`,
+	})
+
+	// The units are executed one by one in the same order as boot.sh would, and the failure of
+	// a dependency script skips the other scripts.
+	after := []string{ignitionBootUnit}
+	var requires []string
+	hasUserScript := false
+	type indexedProvision struct {
+		index int
+		limayaml.Provision
+	}
+	var provision []indexedProvision
+	sorted := sortProvision(limayaml.MatchingProvision(y))
+	for _, mode := range []limayaml.ProvisionMode{limayaml.ProvisionModeDependency, limayaml.ProvisionModeSystem, limayaml.ProvisionModeUser} {
+		for i, f := range sorted {
+			if f.Mode == mode {
+				provision = append(provision, indexedProvision{index: i, Provision: f})
+			}
+		}
+	}
+	for _, f := range provision {
+		i := f.index
+		script := f.Script
+		if f.File != "" {
+			b, err := limayaml.ReadProvisionFile(f.File)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the provision script %q: %w", f.File, err)
+			}
+			script = string(b)
+		}
+		scriptPath := fmt.Sprintf("%s/provision.%s/%08d", ignitionLibexecDir, f.Mode, i)
+		addFile(scriptPath, 0755, strings.ReplaceAll(script, "\r\n", "\n"))
+
+		unitName := fmt.Sprintf("lima-provision-%08d.service", i)
+		var unit strings.Builder
+		fmt.Fprintf(&unit, "[Unit]\nDescription=Lima provision script %08d (mode %q)\n", i, f.Mode)
+		unitAfter := after
+		if f.Mode == limayaml.ProvisionModeUser {
+			unitAfter = append(append([]string{}, after...), fmt.Sprintf("user@%d.service", args.UID))
+		}
+		fmt.Fprintf(&unit, "After=%s\n", strings.Join(unitAfter, " "))
+		if len(requires) > 0 {
+			fmt.Fprintf(&unit, "Requires=%s\n", strings.Join(requires, " "))
+		}
+		unit.WriteString("\n[Service]\nType=oneshot\nRemainAfterExit=yes\nEnvironmentFile=-/etc/environment\n")
+		if f.Mode == limayaml.ProvisionModeUser {
+			hasUserScript = true
+			fmt.Fprintf(&unit, "User=%s\nWorkingDirectory=%s\nEnvironment=XDG_RUNTIME_DIR=/run/user/%d\n", args.User, homeDir, args.UID)
+		}
+		fmt.Fprintf(&unit, "ExecStart=%s\n\n[Install]\nWantedBy=multi-user.target\n", scriptPath)
+		cfg.Systemd.Units = append(cfg.Systemd.Units, ignitionUnit{
+			Name:     unitName,
+			Enabled:  true,
+			Contents: unit.String(),
+		})
+
+		after = []string{unitName}
+		if f.Mode == limayaml.ProvisionModeDependency {
+			requires = append(requires, unitName)
+		}
+	}
+	if hasUserScript {
+		// The user scripts need the systemd user instance, which is only started on boot with lingering
+		addFile("/var/lib/systemd/linger/"+args.User, 0644, "")
+	}
+	return cfg, nil
+}
+
+// dataURL returns the RFC 2397 data URL of content.
+func dataURL(content string) string {
+	return "data:;base64," + base64.StdEncoding.EncodeToString([]byte(content))
+}
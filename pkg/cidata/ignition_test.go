@@ -0,0 +1,61 @@
+package cidata
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"gotest.tools/v3/assert"
+)
+
+func TestBuildIgnitionConfig(t *testing.T) {
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		Timezone:   "Asia/Tokyo",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-ed25519 dummy foo@example.com"},
+	}
+	y := &limayaml.LimaYAML{
+		Provision: []limayaml.Provision{
+			{Mode: limayaml.ProvisionModeUser, Script: "#!/bin/sh\r\necho user\r\n"},
+			{Mode: limayaml.ProvisionModeSystem, Script: "#!/bin/sh\necho system\n"},
+			{Mode: limayaml.ProvisionModeDependency, Script: "#!/bin/sh\necho dependency\n"},
+		},
+	}
+	cfg, err := buildIgnitionConfig(args, y)
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.Ignition.Version, ignitionVersion)
+	assert.Equal(t, len(cfg.Passwd.Users), 1)
+	assert.Equal(t, cfg.Passwd.Users[0].Name, "foo")
+	assert.Equal(t, cfg.Passwd.Users[0].UID, 501)
+	assert.Equal(t, cfg.Passwd.Users[0].HomeDir, "/home/foo.linux")
+	assert.DeepEqual(t, cfg.Passwd.Users[0].SSHAuthorizedKeys, args.SSHPubKeys)
+	assert.DeepEqual(t, cfg.Storage.Links, []ignitionLink{{Path: "/etc/localtime", Target: "../usr/share/zoneinfo/Asia/Tokyo", Overwrite: true}})
+
+	files := make(map[string]string)
+	for _, f := range cfg.Storage.Files {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(f.Contents.Source, "data:;base64,"))
+		assert.NilError(t, err)
+		files[f.Path] = string(b)
+	}
+	assert.Equal(t, files["/etc/hostname"], "lima-default\n")
+	assert.Assert(t, strings.Contains(files["/usr/local/libexec/lima/boot.sh"], "mount -o ro,mode=0700,dmode=0700,overriderockperm,exec,uid=0 "))
+	assert.Equal(t, files["/usr/local/libexec/lima/provision.user/00000000"], "#!/bin/sh\necho user\n")
+	_, ok := files["/var/lib/systemd/linger/foo"]
+	assert.Assert(t, ok)
+
+	// lima-boot.service, then the provision scripts in the sorted order: dependency, system, user
+	assert.Equal(t, len(cfg.Systemd.Units), 4)
+	assert.Equal(t, cfg.Systemd.Units[0].Name, ignitionBootUnit)
+	dep, system, user := cfg.Systemd.Units[1], cfg.Systemd.Units[2], cfg.Systemd.Units[3]
+	assert.Equal(t, dep.Name, "lima-provision-00000002.service")
+	assert.Assert(t, strings.Contains(dep.Contents, "ExecStart=/usr/local/libexec/lima/provision.dependency/00000002\n"))
+	assert.Assert(t, strings.Contains(system.Contents, "After=lima-provision-00000002.service\n"))
+	assert.Assert(t, strings.Contains(system.Contents, "Requires=lima-provision-00000002.service\n"))
+	assert.Assert(t, strings.Contains(user.Contents, "After=lima-provision-00000001.service user@501.service\n"))
+	assert.Assert(t, strings.Contains(user.Contents, "User=foo\n"))
+	assert.Assert(t, !strings.Contains(system.Contents, "User="))
+}
@@ -6,12 +6,23 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"net"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
 
 	"github.com/lima-vm/lima/pkg/iso9660util"
 
 	"github.com/containerd/containerd/identifiers"
+	"github.com/hashicorp/go-multierror"
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/lima-vm/lima/pkg/localpathutil"
 	"github.com/lima-vm/lima/pkg/templateutil"
+	"gopkg.in/yaml.v2"
 )
 
 //go:embed cidata.TEMPLATE.d
@@ -23,55 +34,139 @@ type Containerd struct {
 	System bool
 	User   bool
 }
+type CopyToGuest struct {
+	Destination string // abs path in the guest
+	Mode        string // octal permission bits
+}
 type Network struct {
 	MACAddress string
 	Interface  string
 }
 type TemplateArgs struct {
-	Name            string // instance name
-	IID             string // instance id
-	User            string // user name
-	UID             int
-	SSHPubKeys      []string
-	Mounts          []string // abs path, accessible by the User
-	Containerd      Containerd
-	Networks        []Network
-	SlirpNICName    string
-	SlirpGateway    string
-	SlirpDNS        string
-	UDPDNSLocalPort int
-	Env             map[string]string
-	DNSAddresses    []string
+	Name             string // instance name
+	Hostname         string // host name of the guest
+	Timezone         string // optional
+	Locale           string // optional
+	Packages         []string
+	CopyToGuest      []CopyToGuest // the content is in "copy/%08d" of the ISO
+	IID              string        // instance id
+	User             string        // user name
+	UID              int
+	SSHPubKeys       []string
+	Mounts           []string // abs path, accessible by the User
+	Containerd       Containerd
+	Networks         []Network
+	SlirpNICName     string
+	SlirpGateway     string
+	SlirpDNS         string
+	UDPDNSLocalPort  int
+	TCPDNSLocalPort  int
+	Env              map[string]string
+	DNSAddresses     []string
+	DNSSearchDomains []string
+	// DNSOptions are the resolv.conf(5) options, mapped to their values, or to "true" for the options without a value
+	DNSOptions map[string]string
+	// CIDataMountOptions are the mount(8) options of the cidata filesystem for the boot script.
+	// Default: the options for ISO9660
+	CIDataMountOptions string
 }
 
+// ValidateTemplateArgs returns an error listing every problem of args.
 func ValidateTemplateArgs(args TemplateArgs) error {
-	if err := identifiers.Validate(args.Name); err != nil {
-		return err
+	var merr *multierror.Error
+	add := func(err error) {
+		if err != nil {
+			merr = multierror.Append(merr, err)
+		}
 	}
-	if err := identifiers.Validate(args.User); err != nil {
-		return err
+	add(identifiers.Validate(args.Name))
+	if args.Hostname == "" {
+		add(errors.New("field Hostname must be set"))
 	}
+	add(identifiers.Validate(args.User))
 	if args.User == "root" {
-		return errors.New("field User must not be \"root\"")
+		add(errors.New("field User must not be \"root\""))
 	}
 	if args.UID == 0 {
-		return errors.New("field UID must not be 0")
+		add(errors.New("field UID must not be 0"))
 	}
 	if len(args.SSHPubKeys) == 0 {
-		return errors.New("field SSHPubKeys must be set")
+		add(errors.New("field SSHPubKeys must be set"))
 	}
 	for i, f := range args.Mounts {
 		if !filepath.IsAbs(f) {
-			return fmt.Errorf("field mounts[%d] must be absolute, got %q", i, f)
+			add(fmt.Errorf("field mounts[%d] must be absolute, got %q", i, f))
 		}
 	}
-	return nil
+	for i, p := range args.Packages {
+		// The names are quoted in the user-data, and the package managers may pass them to a shell
+		if p == "" || strings.ContainsAny(p, " \t\r\n\"'\\`$;&|<>(){}*?[]!#") {
+			add(fmt.Errorf("field Packages[%d] must be a package name, got %q", i, p))
+		}
+	}
+	for i, d := range args.DNSSearchDomains {
+		// The domains are written to resolv.conf, where whitespace separates the domains
+		if d == "" || strings.ContainsAny(d, " \t\r\n\"'\\") {
+			add(fmt.Errorf("field DNSSearchDomains[%d] must be a domain name, got %q", i, d))
+		}
+	}
+	for name, value := range args.DNSOptions {
+		// The options are written to resolv.conf, where whitespace separates the options and ':' the values
+		if name == "" || strings.ContainsAny(name+value, " \t\r\n\"'\\:") {
+			add(fmt.Errorf("field DNSOptions[%q] must be a resolv.conf option, got %q", name, value))
+		}
+	}
+	if strings.ContainsAny(args.CIDataMountOptions, " \t\r\n\"'\\") {
+		add(fmt.Errorf("field CIDataMountOptions must be mount options, got %q", args.CIDataMountOptions))
+	}
+	for _, err := range validateNetworks(args.Networks) {
+		add(err)
+	}
+	return merr.ErrorOrNil()
+}
+
+// validateNetworks checks that the MAC addresses of networks are well-formed and unique.
+func validateNetworks(networks []Network) []error {
+	var errs []error
+	seen := make(map[string]string, len(networks)) // MAC address -> interface
+	for i, nw := range networks {
+		hw, err := net.ParseMAC(nw.MACAddress)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("field networks[%d] (%q) has an invalid MAC address %q: %w", i, nw.Interface, nw.MACAddress, err))
+			continue
+		}
+		if len(hw) != 6 {
+			errs = append(errs, fmt.Errorf("field networks[%d] (%q) must have a 48 bit (6 bytes) MAC address, got %q", i, nw.Interface, nw.MACAddress))
+			continue
+		}
+		mac := hw.String()
+		if other, ok := seen[mac]; ok {
+			errs = append(errs, fmt.Errorf("MAC address %s is used by both %q and %q", mac, other, nw.Interface))
+			continue
+		}
+		seen[mac] = nw.Interface
+	}
+	return errs
 }
 
 func ExecuteTemplate(args TemplateArgs) ([]iso9660util.Entry, error) {
+	return ExecuteTemplateWithUserData(args, "")
+}
+
+// ExecuteTemplateWithUserData is like ExecuteTemplate, but renders userDataTemplate instead of the built-in
+// user-data template, unless userDataTemplate is empty.
+func ExecuteTemplateWithUserData(args TemplateArgs, userDataTemplate string) ([]iso9660util.Entry, error) {
+	if userDataTemplate != "" {
+		if err := ValidateUserDataTemplate(userDataTemplate); err != nil {
+			return nil, err
+		}
+	}
 	if err := ValidateTemplateArgs(args); err != nil {
 		return nil, err
 	}
+	if args.CIDataMountOptions == "" {
+		args.CIDataMountOptions = cidataMountOptions(limayaml.CIDataFilesystemISO9660)
+	}
 
 	fsys, err := fs.Sub(templateFS, templateFSRoot)
 	if err != nil {
@@ -93,10 +188,18 @@ func ExecuteTemplate(args TemplateArgs) ([]iso9660util.Entry, error) {
 		if err != nil {
 			return err
 		}
+		if path == "user-data" && userDataTemplate != "" {
+			templateB = []byte(userDataTemplate)
+		}
 		b, err := templateutil.Execute(string(templateB), args)
 		if err != nil {
 			return err
 		}
+		if path == "user-data" {
+			if err := validateUserData(b); err != nil {
+				return fmt.Errorf("rendered %q is invalid: %w", path, err)
+			}
+		}
 		layout = append(layout, iso9660util.Entry{
 			Path:   path,
 			Reader: bytes.NewReader(b),
@@ -110,3 +213,141 @@ func ExecuteTemplate(args TemplateArgs) ([]iso9660util.Entry, error) {
 
 	return layout, nil
 }
+
+// userDataTemplateRequiredArgs are the fields of TemplateArgs that a custom user-data template must refer to,
+// as the guest is not accessible without the user and its SSH keys.
+var userDataTemplateRequiredArgs = []string{"User", "UID", "SSHPubKeys"}
+
+// ValidateUserDataTemplate checks that tmpl, the content of `cidata.userDataTemplate`, is a valid template
+// that refers to userDataTemplateRequiredArgs.
+// Whether the rendered user-data is valid is only checked when it is executed.
+func ValidateUserDataTemplate(tmpl string) error {
+	x, err := template.New("user-data").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to parse the user-data template: %w", err)
+	}
+	refs := make(map[string]struct{})
+	collectFieldRefs(x.Tree.Root, refs)
+	var missing []string
+	for _, f := range userDataTemplateRequiredArgs {
+		if _, ok := refs[f]; !ok {
+			missing = append(missing, "."+f)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the user-data template must refer to %v", missing)
+	}
+	return nil
+}
+
+// collectFieldRefs adds the names of the top-level fields referred by node, like "User" for {{.User}} or {{$.User}}.
+func collectFieldRefs(node parse.Node, refs map[string]struct{}) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			collectFieldRefs(c, refs)
+		}
+	case *parse.ActionNode:
+		collectFieldRefs(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			collectFieldRefs(c, refs)
+		}
+	case *parse.CommandNode:
+		for _, c := range n.Args {
+			collectFieldRefs(c, refs)
+		}
+	case *parse.FieldNode:
+		refs[n.Ident[0]] = struct{}{}
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			refs[n.Ident[1]] = struct{}{}
+		}
+	case *parse.ChainNode:
+		collectFieldRefs(n.Node, refs)
+	case *parse.IfNode:
+		collectFieldRefs(&n.BranchNode, refs)
+	case *parse.RangeNode:
+		collectFieldRefs(&n.BranchNode, refs)
+	case *parse.WithNode:
+		collectFieldRefs(&n.BranchNode, refs)
+	case *parse.BranchNode:
+		collectFieldRefs(n.Pipe, refs)
+		collectFieldRefs(n.List, refs)
+		collectFieldRefs(n.ElseList, refs)
+	case *parse.TemplateNode:
+		collectFieldRefs(n.Pipe, refs)
+	}
+}
+
+// readUserDataTemplate returns the content of `cidata.userDataTemplate`, or "" for the built-in template.
+func readUserDataTemplate(y *limayaml.LimaYAML) (string, error) {
+	if y.CIData.UserDataTemplate == "" {
+		return "", nil
+	}
+	expanded, err := localpathutil.Expand(y.CIData.UserDataTemplate)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(expanded)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the user-data template: %w", err)
+	}
+	return string(b), nil
+}
+
+// userDataRequiredKeys are the top-level keys that the user-data template always renders.
+var userDataRequiredKeys = []string{"users", "write_files"}
+
+var yamlErrorLineRegexp = regexp.MustCompile(`line (\d+):`)
+
+// validateUserData checks that the rendered user-data is a cloud-config YAML with the expected top-level keys,
+// so that a broken template is caught on the host instead of inside the guest.
+func validateUserData(b []byte) error {
+	if !bytes.HasPrefix(b, []byte("#cloud-config\n")) {
+		return errors.New("the first line must be \"#cloud-config\"")
+	}
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		if sm := yamlErrorLineRegexp.FindStringSubmatch(err.Error()); sm != nil {
+			if line, convErr := strconv.Atoi(sm[1]); convErr == nil {
+				return fmt.Errorf("%w\n%s", err, snippet(b, line, 2))
+			}
+		}
+		return err
+	}
+	var missing []string
+	for _, k := range userDataRequiredKeys {
+		if _, ok := m[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing the top-level keys %v", missing)
+	}
+	return nil
+}
+
+// snippet returns the lines of b around the 1-based line number, prefixed with their line numbers.
+// The line is marked with ">".
+func snippet(b []byte, line, context int) string {
+	lines := strings.Split(string(b), "\n")
+	var sb strings.Builder
+	for i := line - context; i <= line+context; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		mark := " "
+		if i == line {
+			mark = ">"
+		}
+		fmt.Fprintf(&sb, "%s%4d | %s\n", mark, i, lines[i-1])
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -2,16 +2,22 @@ package cidata
 
 import (
 	"io/ioutil"
+	"strings"
 	"testing"
 
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"gopkg.in/yaml.v2"
 	"gotest.tools/v3/assert"
 )
 
 func TestTemplate(t *testing.T) {
 	args := TemplateArgs{
-		Name: "default",
-		User: "foo",
-		UID:  501,
+		Name:     "default",
+		Hostname: "lima-default",
+		Timezone: "Asia/Tokyo",
+		Locale:   "en_US.UTF-8",
+		User:     "foo",
+		UID:      501,
 		SSHPubKeys: []string{
 			"ssh-rsa dummy foo@example.com",
 		},
@@ -19,6 +25,7 @@ func TestTemplate(t *testing.T) {
 			"/Users/dummy",
 			"/Users/dummy/lima",
 		},
+		Packages: []string{"vim", "curl"},
 	}
 	layout, err := ExecuteTemplate(args)
 	assert.NilError(t, err)
@@ -27,5 +34,277 @@ func TestTemplate(t *testing.T) {
 		b, err := ioutil.ReadAll(f.Reader)
 		assert.NilError(t, err)
 		t.Log(string(b))
+		if f.Path == "lima.env" {
+			assert.Assert(t, strings.Contains(string(b), "LIMA_CIDATA_MOUNTS_1_MOUNTPOINT=/Users/dummy/lima\n"))
+		}
 	}
 }
+
+func TestTemplateCIDataMountOptions(t *testing.T) {
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+	}
+	userData := func() string {
+		layout, err := ExecuteTemplate(args)
+		assert.NilError(t, err)
+		for _, f := range layout {
+			if f.Path == "user-data" {
+				b, err := ioutil.ReadAll(f.Reader)
+				assert.NilError(t, err)
+				return string(b)
+			}
+		}
+		t.Fatal("no user-data")
+		return ""
+	}
+	assert.Assert(t, strings.Contains(userData(), `mount -o ro,mode=0700,dmode=0700,overriderockperm,exec,uid=0 "${LIMA_CIDATA_DEV}"`))
+
+	args.CIDataMountOptions = cidataMountOptions(limayaml.CIDataFilesystemVFAT)
+	assert.Assert(t, strings.Contains(userData(), `mount -o ro,fmask=0077,dmask=0077,exec,uid=0 "${LIMA_CIDATA_DEV}"`))
+
+	args.CIDataMountOptions = "ro; reboot"
+	_, err := ExecuteTemplate(args)
+	assert.ErrorContains(t, err, "field CIDataMountOptions must be mount options")
+}
+
+func TestValidateTemplateArgsNetworks(t *testing.T) {
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+		Networks: []Network{
+			{MACAddress: "52:55:55:12:34:56", Interface: "eth0"},
+			{MACAddress: "52:55:55:12:34:57", Interface: "lima0"},
+		},
+	}
+	assert.NilError(t, ValidateTemplateArgs(args))
+
+	args.Networks[1].MACAddress = "52:55:55:12:34:56"
+	assert.ErrorContains(t, ValidateTemplateArgs(args), `MAC address 52:55:55:12:34:56 is used by both "eth0" and "lima0"`)
+
+	args.Networks[1].MACAddress = "52:55:55:12:34"
+	assert.ErrorContains(t, ValidateTemplateArgs(args), "invalid MAC address")
+}
+
+func TestValidateTemplateArgsPackages(t *testing.T) {
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+		Packages:   []string{"vim", "libc6:arm64", "curl=7.74.0-1"},
+	}
+	assert.NilError(t, ValidateTemplateArgs(args))
+
+	args.Packages = append(args.Packages, `vim"; rm -rf /; "`)
+	assert.ErrorContains(t, ValidateTemplateArgs(args), "field Packages[3] must be a package name")
+}
+
+func TestValidateTemplateArgsReportsEveryProblem(t *testing.T) {
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "root",
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+		Mounts:     []string{"dummy"},
+	}
+	err := ValidateTemplateArgs(args)
+	assert.ErrorContains(t, err, `field User must not be "root"`)
+	assert.ErrorContains(t, err, "field UID must not be 0")
+	assert.ErrorContains(t, err, `field mounts[0] must be absolute, got "dummy"`)
+}
+
+func TestValidateUserData(t *testing.T) {
+	assert.NilError(t, validateUserData([]byte("#cloud-config\nusers:\n- name: foo\nwrite_files: []\n")))
+
+	assert.ErrorContains(t, validateUserData([]byte("users: []\nwrite_files: []\n")), `"#cloud-config"`)
+	assert.ErrorContains(t, validateUserData([]byte("#cloud-config\nusers: []\n")), "missing the top-level keys [write_files]")
+
+	err := validateUserData([]byte("#cloud-config\nusers:\n  - name: \"foo\"\n   uid: \"501\"\nwrite_files: []\n"))
+	assert.ErrorContains(t, err, "line 3")
+	assert.ErrorContains(t, err, `>   3 |   - name: "foo"`)
+	assert.ErrorContains(t, err, `    4 |    uid: "501"`)
+}
+
+func TestTemplateIPv6DNSAddresses(t *testing.T) {
+	args := TemplateArgs{
+		Name:         "default",
+		Hostname:     "lima-default",
+		User:         "foo",
+		UID:          501,
+		SSHPubKeys:   []string{"ssh-rsa dummy foo@example.com"},
+		SlirpNICName: "eth0",
+		Networks:     []Network{{MACAddress: "52:55:55:00:00:01", Interface: "eth0"}},
+		DNSAddresses: []string{"192.168.1.1", "::1", "2001:db8::53"},
+	}
+	layout, err := ExecuteTemplate(args)
+	assert.NilError(t, err)
+	for _, f := range layout {
+		if f.Path != "network-config" {
+			continue
+		}
+		b, err := ioutil.ReadAll(f.Reader)
+		assert.NilError(t, err)
+		var nc struct {
+			Ethernets map[string]struct {
+				Nameservers struct {
+					Addresses []string `yaml:"addresses"`
+				} `yaml:"nameservers"`
+			} `yaml:"ethernets"`
+		}
+		assert.NilError(t, yaml.Unmarshal(b, &nc))
+		assert.DeepEqual(t, nc.Ethernets["eth0"].Nameservers.Addresses, args.DNSAddresses)
+		return
+	}
+	t.Fatal("network-config was not found")
+}
+
+func TestTemplateDNSSearchDomains(t *testing.T) {
+	args := TemplateArgs{
+		Name:             "default",
+		Hostname:         "lima-default",
+		User:             "foo",
+		UID:              501,
+		SSHPubKeys:       []string{"ssh-rsa dummy foo@example.com"},
+		SlirpNICName:     "eth0",
+		Networks:         []Network{{MACAddress: "52:55:55:00:00:01", Interface: "eth0"}},
+		DNSSearchDomains: []string{"corp.example.com", "example.com"},
+	}
+	layout, err := ExecuteTemplate(args)
+	assert.NilError(t, err)
+	found := 0
+	for _, f := range layout {
+		b, err := ioutil.ReadAll(f.Reader)
+		assert.NilError(t, err)
+		switch f.Path {
+		case "network-config":
+			var nc struct {
+				Ethernets map[string]struct {
+					Nameservers struct {
+						Addresses []string `yaml:"addresses"`
+						Search    []string `yaml:"search"`
+					} `yaml:"nameservers"`
+				} `yaml:"ethernets"`
+			}
+			assert.NilError(t, yaml.Unmarshal(b, &nc))
+			assert.Equal(t, len(nc.Ethernets["eth0"].Nameservers.Addresses), 0)
+			assert.DeepEqual(t, nc.Ethernets["eth0"].Nameservers.Search, args.DNSSearchDomains)
+			found++
+		case "user-data":
+			var ud struct {
+				ResolvConf struct {
+					SearchDomains []string `yaml:"searchdomains"`
+				} `yaml:"resolv_conf"`
+			}
+			assert.NilError(t, yaml.Unmarshal(b, &ud))
+			assert.DeepEqual(t, ud.ResolvConf.SearchDomains, args.DNSSearchDomains)
+			found++
+		}
+	}
+	assert.Equal(t, found, 2)
+
+	args.DNSSearchDomains = []string{"example.com nameserver 1.2.3.4"}
+	assert.ErrorContains(t, ValidateTemplateArgs(args), "field DNSSearchDomains[0] must be a domain name")
+}
+
+func TestTemplateDNSOptions(t *testing.T) {
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+		DNSOptions: map[string]string{"ndots": "2", "rotate": "true"},
+	}
+	layout, err := ExecuteTemplate(args)
+	assert.NilError(t, err)
+	found := false
+	for _, f := range layout {
+		if f.Path != "user-data" {
+			continue
+		}
+		b, err := ioutil.ReadAll(f.Reader)
+		assert.NilError(t, err)
+		var ud struct {
+			ManageResolvConf bool `yaml:"manage_resolv_conf"`
+			ResolvConf       struct {
+				Options map[string]interface{} `yaml:"options"`
+			} `yaml:"resolv_conf"`
+		}
+		assert.NilError(t, yaml.Unmarshal(b, &ud))
+		assert.Assert(t, ud.ManageResolvConf)
+		assert.DeepEqual(t, ud.ResolvConf.Options, map[string]interface{}{"ndots": 2, "rotate": true})
+		found = true
+	}
+	assert.Assert(t, found)
+
+	args.DNSOptions = map[string]string{"ndots": "2\nnameserver 1.2.3.4"}
+	assert.ErrorContains(t, ValidateTemplateArgs(args), "field DNSOptions[\"ndots\"] must be a resolv.conf option")
+}
+
+func TestValidateUserDataTemplate(t *testing.T) {
+	assert.NilError(t, ValidateUserDataTemplate(`#cloud-config
+users:
+  - name: "{{.User}}"
+    uid: "{{$.UID}}"
+    ssh-authorized-keys:
+    {{- range $val := .SSHPubKeys}}
+      - "{{$val}}"
+    {{- end}}
+`))
+	assert.ErrorContains(t, ValidateUserDataTemplate("#cloud-config\n{{if .User}}"), "failed to parse the user-data template")
+	assert.ErrorContains(t, ValidateUserDataTemplate("#cloud-config\nusers:\n  - name: {{.User}}\n"), "must refer to [.UID .SSHPubKeys]")
+}
+
+func TestExecuteTemplateWithUserData(t *testing.T) {
+	args := TemplateArgs{
+		Name:       "default",
+		Hostname:   "lima-default",
+		User:       "foo",
+		UID:        501,
+		SSHPubKeys: []string{"ssh-rsa dummy foo@example.com"},
+	}
+	tmpl := `#cloud-config
+users:
+  - name: "{{.User}}"
+    uid: "{{.UID}}"
+    ssh-authorized-keys:
+    {{- range $val := .SSHPubKeys}}
+      - "{{$val}}"
+    {{- end}}
+write_files: []
+bootcmd:
+  - echo custom
+`
+	layout, err := ExecuteTemplateWithUserData(args, tmpl)
+	assert.NilError(t, err)
+	var userData string
+	for _, f := range layout {
+		if f.Path == "user-data" {
+			b, err := ioutil.ReadAll(f.Reader)
+			assert.NilError(t, err)
+			userData = string(b)
+		}
+	}
+	assert.Equal(t, userData, `#cloud-config
+users:
+  - name: "foo"
+    uid: "501"
+    ssh-authorized-keys:
+      - "ssh-rsa dummy foo@example.com"
+write_files: []
+bootcmd:
+  - echo custom
+`)
+
+	// The rendered user-data is validated as well
+	_, err = ExecuteTemplateWithUserData(args, "#cloud-config\nusers: [{{.User}}, {{.UID}}, {{.SSHPubKeys}}]\n")
+	assert.ErrorContains(t, err, "missing the top-level keys [write_files]")
+}
@@ -0,0 +1,103 @@
+package cidata
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/identifiers"
+	"github.com/hashicorp/go-multierror"
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/lima-vm/lima/pkg/localpathutil"
+	"github.com/lima-vm/lima/pkg/sshutil"
+	"github.com/lima-vm/lima/pkg/store/dirnames"
+	"github.com/lima-vm/lima/pkg/store/filenames"
+)
+
+// ValidateForGenerate runs the checks of GenerateISO9660 for the instance, without generating anything,
+// and returns an error listing every problem found.
+//
+// y must have been filled with limayaml.FillDefault.
+func ValidateForGenerate(y *limayaml.LimaYAML, name string) error {
+	var merr *multierror.Error
+	if err := identifiers.Validate(name); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("invalid instance name: %w", err))
+	}
+	if err := limayaml.Validate(*y, false); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if err := validatePubKeys(y); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	for i, f := range y.Mounts {
+		// The host agent creates the missing writable mounts, but cannot mount a missing read-only one
+		if f.Writable {
+			continue
+		}
+		expanded, err := localpathutil.Expand(f.Location)
+		if err != nil {
+			continue // reported by limayaml.Validate
+		}
+		if _, err := os.Stat(expanded); errors.Is(err, os.ErrNotExist) {
+			merr = multierror.Append(merr, fmt.Errorf("read-only mount `mounts[%d]` does not exist: %q", i, f.Location))
+		}
+	}
+	for i, f := range y.Provision {
+		// The scripts that are not embedded are not read by configLayout either
+		if f.File == "" || !f.Matches(y.Arch, y.Distro) {
+			continue
+		}
+		if _, err := limayaml.ReadProvisionFile(f.File); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("failed to read the provision script of `provision[%d]`: %w", i, err))
+		}
+	}
+	if tmpl, err := readUserDataTemplate(y); err != nil {
+		merr = multierror.Append(merr, err)
+	} else if tmpl != "" {
+		if err := ValidateUserDataTemplate(tmpl); err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+	for i, f := range y.CopyToGuest {
+		if _, err := readCopyToGuest(f); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("failed to read the file of `copyToGuest[%d]`: %w", i, err))
+		}
+	}
+	if _, err := loadCACerts(y.CACerts, time.Now()); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if *y.Containerd.System || *y.Containerd.User {
+		if len(mirrorGroups(y.Containerd.Archives, y.Arch)) == 0 {
+			merr = multierror.Append(merr, fmt.Errorf("%w for arch %q", ErrNoContainerdArchive, y.Arch))
+		}
+	}
+	if _, err := dnsAddresses(y); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if _, err := guestAgentBinaryPath(y.Arch); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	return merr.ErrorOrNil()
+}
+
+// validatePubKeys checks that there is a usable SSH public key.
+// The key of Lima is not generated here; it is always usable once sshutil.DefaultPubKeys has generated it.
+func validatePubKeys(y *limayaml.LimaYAML) error {
+	configDir, err := dirnames.LimaConfigDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(configDir, filenames.UserPrivateKey)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	pubKeys, err := sshutil.DefaultPubKeys(*y.SSH.LoadDotSSHPubKeys)
+	if err != nil {
+		return err
+	}
+	if len(sshutil.UsablePubKeys(pubKeys, *y.SSH.AllowWeakPubKeys)) == 0 {
+		return ErrNoSSHKey
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package cidata
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"gotest.tools/v3/assert"
+)
+
+func TestValidateForGenerate(t *testing.T) {
+	t.Setenv("LIMA_HOME", t.TempDir())
+	y, err := limayaml.Load([]byte(`
+images:
+- location: "https://example.com/image.img"
+containerd:
+  system: true
+provision:
+- mode: foo
+  script: "#!/bin/sh"
+`), "lima.yaml")
+	assert.NilError(t, err)
+	y.Containerd.Archives = nil
+	y.Mounts = []limayaml.Mount{{Location: filepath.Join(t.TempDir(), "does-not-exist")}}
+
+	err = ValidateForGenerate(y, "default")
+	assert.ErrorContains(t, err, "field `provision[0].mode` must be one of")
+	assert.ErrorContains(t, err, "read-only mount `mounts[0]` does not exist")
+	assert.ErrorContains(t, err, `no containerd archive was provided for arch "`+y.Arch+`"`)
+	assert.Assert(t, errors.Is(err, ErrNoContainerdArchive))
+}
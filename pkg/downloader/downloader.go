@@ -1,7 +1,9 @@
 package downloader
 
 import (
+	"context"
 	"crypto/sha256"
+	_ "crypto/sha512" // register sha384 and sha512 for go-digest
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,9 +38,15 @@ type Result struct {
 	ValidatedDigest bool
 }
 
+// ProgressFunc is called with the number of the bytes downloaded so far, and the total size of the download,
+// or -1 if the total size is unknown.
+// ProgressFunc may be called very frequently, so it should throttle any output on its own.
+type ProgressFunc func(downloaded, total int64)
+
 type options struct {
 	cacheDir       string // default: empty (disables caching)
 	expectedDigest digest.Digest
+	progress       ProgressFunc // default: nil (no-op)
 }
 
 type Opt func(*options) error
@@ -64,6 +73,7 @@ func WithCacheDir(cacheDir string) Opt {
 }
 
 // WithExpectedDigest is used to validate the downloaded file against the expected digest.
+// The supported algorithms are "sha256", "sha384", and "sha512".
 //
 // The digest is not verified in the following cases:
 // - The digest was not specified.
@@ -88,7 +98,22 @@ func WithExpectedDigest(expectedDigest digest.Digest) Opt {
 	}
 }
 
+// WithProgress sets the function to be called while downloading from HTTP(S).
+// Local files and cached files do not report progress.
+func WithProgress(progress ProgressFunc) Opt {
+	return func(o *options) error {
+		o.progress = progress
+		return nil
+	}
+}
+
 func Download(local, remote string, opts ...Opt) (*Result, error) {
+	return DownloadContext(context.Background(), local, remote, opts...)
+}
+
+// DownloadContext is like Download, but aborts downloading from HTTP(S) when ctx is done.
+// The partial data of an aborted download is kept in the cache, so that the download can be resumed later.
+func DownloadContext(ctx context.Context, local, remote string, opts ...Opt) (*Result, error) {
 	var o options
 	for _, f := range opts {
 		if err := f(&o); err != nil {
@@ -115,7 +140,7 @@ func Download(local, remote string, opts ...Opt) (*Result, error) {
 		return nil, err
 	}
 
-	if isLocal(remote) {
+	if IsLocal(remote) {
 		if err := copyLocal(localPath, remote, o.expectedDigest); err != nil {
 			return nil, err
 		}
@@ -127,7 +152,11 @@ func Download(local, remote string, opts ...Opt) (*Result, error) {
 	}
 
 	if o.cacheDir == "" {
-		if err := downloadHTTP(localPath, remote, o.expectedDigest); err != nil {
+		// Without the cache, a partial download is not associated with the URL, so it cannot be resumed safely
+		if err := removePartial(localPath + ".tmp"); err != nil {
+			return nil, err
+		}
+		if err := downloadHTTP(ctx, localPath, remote, o.expectedDigest, o.progress); err != nil {
 			return nil, err
 		}
 		res := &Result{
@@ -137,32 +166,20 @@ func Download(local, remote string, opts ...Opt) (*Result, error) {
 		return res, nil
 	}
 
-	shad := filepath.Join(o.cacheDir, "download", "by-url-sha256", fmt.Sprintf("%x", sha256.Sum256([]byte(remote))))
+	shad := cacheEntryDir(o.cacheDir, remote)
 	shadData := filepath.Join(shad, "data")
-	shadDigest := ""
-	if o.expectedDigest != "" {
-		algo := o.expectedDigest.Algorithm().String()
-		if strings.Contains(algo, "/") || strings.Contains(algo, "\\") {
-			return nil, fmt.Errorf("invalid digest algorithm %q", algo)
-		}
-		shadDigest = filepath.Join(shad, algo+".digest")
+	shadDigest, err := cacheDigestFile(shad, o.expectedDigest)
+	if err != nil {
+		return nil, err
 	}
 	if _, err := os.Stat(shadData); err == nil {
 		logrus.Debugf("file %q is cached as %q", localPath, shadData)
-		if shadDigestB, err := os.ReadFile(shadDigest); err == nil {
-			logrus.Debugf("Comparing digest %q with the cached digest file %q, not computing the actual digest of %q",
-				o.expectedDigest, shadDigest, shadData)
-			shadDigestS := strings.TrimSpace(string(shadDigestB))
-			if o.expectedDigest.String() != shadDigestS {
-				return nil, fmt.Errorf("expected digest %q does not match the cached digest %q", o.expectedDigest.String(), shadDigestS)
-			}
-			if err := copyLocal(localPath, shadData, ""); err != nil {
-				return nil, err
-			}
-		} else {
-			if err := copyLocal(localPath, shadData, o.expectedDigest); err != nil {
-				return nil, err
-			}
+		if err := validateCachedDigest(shadData, shadDigest, o.expectedDigest); err != nil {
+			return nil, err
+		}
+		// no need to pass the digest to copyLocal(), as we already verified the digest
+		if err := copyLocal(localPath, shadData, ""); err != nil {
+			return nil, err
 		}
 		res := &Result{
 			Status:          StatusUsedCache,
@@ -171,7 +188,8 @@ func Download(local, remote string, opts ...Opt) (*Result, error) {
 		}
 		return res, nil
 	}
-	if err := os.RemoveAll(shad); err != nil {
+	// Keep the partial data of an interrupted download, so that downloadHTTP can resume it
+	if err := removeAllExcept(shad, "data.tmp", "data.tmp"+validatorSuffix); err != nil {
 		return nil, err
 	}
 	if err := os.MkdirAll(shad, 0700); err != nil {
@@ -181,7 +199,7 @@ func Download(local, remote string, opts ...Opt) (*Result, error) {
 	if err := os.WriteFile(shadURL, []byte(remote), 0644); err != nil {
 		return nil, err
 	}
-	if err := downloadHTTP(shadData, remote, o.expectedDigest); err != nil {
+	if err := downloadHTTP(ctx, shadData, remote, o.expectedDigest, o.progress); err != nil {
 		return nil, err
 	}
 	// no need to pass the digest to copyLocal(), as we already verified the digest
@@ -201,12 +219,157 @@ func Download(local, remote string, opts ...Opt) (*Result, error) {
 	return res, nil
 }
 
-func isLocal(s string) bool {
+// Cached returns the path of the cached data of remote, without copying it anywhere,
+// or an empty string if remote is not cached. Caching must be enabled with WithCache or WithCacheDir.
+//
+// The cached data is validated against the digest specified with WithExpectedDigest,
+// in the same way as Download does.
+func Cached(remote string, opts ...Opt) (string, error) {
+	var o options
+	for _, f := range opts {
+		if err := f(&o); err != nil {
+			return "", err
+		}
+	}
+	if o.cacheDir == "" || IsLocal(remote) {
+		return "", nil
+	}
+	shad := cacheEntryDir(o.cacheDir, remote)
+	shadData := filepath.Join(shad, "data")
+	shadDigest, err := cacheDigestFile(shad, o.expectedDigest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(shadData); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	if err := validateCachedDigest(shadData, shadDigest, o.expectedDigest); err != nil {
+		return "", err
+	}
+	return shadData, nil
+}
+
+// DownloadWithMirrors downloads local from the first of remotes that succeeds, and returns the remote that was used.
+// The remotes are expected to be mirrors of the same content, so the same options (including the expected digest)
+// apply to all of them.
+func DownloadWithMirrors(local string, remotes []string, opts ...Opt) (*Result, string, error) {
+	return DownloadWithMirrorsContext(context.Background(), local, remotes, opts...)
+}
+
+// DownloadWithMirrorsContext is like DownloadWithMirrors, but aborts downloading when ctx is done.
+//
+// A mirror that is already cached is preferred over the ones before it, so that switching mirrors does not
+// download the same content again.
+func DownloadWithMirrorsContext(ctx context.Context, local string, remotes []string, opts ...Opt) (*Result, string, error) {
+	if len(remotes) == 0 {
+		return nil, "", errors.New("no mirror was specified")
+	}
+	candidates := append([]string(nil), remotes...)
+	for i, remote := range candidates {
+		cachePath, err := Cached(remote, opts...)
+		if err != nil {
+			logrus.WithError(err).Debugf("ignoring the cache of %q", remote)
+			continue
+		}
+		if cachePath != "" {
+			copy(candidates[1:i+1], candidates[:i])
+			candidates[0] = remote
+			break
+		}
+	}
+	var errs []error
+	for _, remote := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		res, err := DownloadContext(ctx, local, remote, opts...)
+		if err == nil {
+			return res, remote, nil
+		}
+		logrus.WithError(err).Debugf("failed to download %q", remote)
+		errs = append(errs, fmt.Errorf("failed to download %q: %w", remote, err))
+		// Download skips existing files, so a partial copy must not be left for the next mirror
+		if localPath, err := localPath(local); err == nil {
+			_ = os.RemoveAll(localPath)
+		}
+	}
+	if len(errs) == 1 {
+		return nil, "", errs[0]
+	}
+	return nil, "", fmt.Errorf("failed to download from any of %d mirrors, errors=%v", len(errs), errs)
+}
+
+// removeAllExcept removes the entries of dir except the ones in keep. A non-existent dir is not an error.
+func removeAllExcept(dir string, keep ...string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+Entries:
+	for _, e := range entries {
+		for _, k := range keep {
+			if e.Name() == k {
+				continue Entries
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheEntryDir returns the directory of the cache entry of remote.
+func cacheEntryDir(cacheDir, remote string) string {
+	return filepath.Join(cacheDir, "download", "by-url-sha256", fmt.Sprintf("%x", sha256.Sum256([]byte(remote))))
+}
+
+// cacheDigestFile returns the path of the file that records the digest of the cached data,
+// or an empty string if no digest is expected.
+func cacheDigestFile(shad string, expectedDigest digest.Digest) (string, error) {
+	if expectedDigest == "" {
+		return "", nil
+	}
+	algo := expectedDigest.Algorithm().String()
+	if strings.Contains(algo, "/") || strings.Contains(algo, "\\") {
+		return "", fmt.Errorf("invalid digest algorithm %q", algo)
+	}
+	return filepath.Join(shad, algo+".digest"), nil
+}
+
+// validateCachedDigest validates the cached data against expectedDigest.
+// When the digest file exists, its content is compared with the expected digest,
+// and the actual digest of the data is not computed.
+func validateCachedDigest(shadData, shadDigest string, expectedDigest digest.Digest) error {
+	if expectedDigest == "" {
+		return nil
+	}
+	shadDigestB, err := os.ReadFile(shadDigest)
+	if err != nil {
+		return validateLocalFileDigest(shadData, expectedDigest)
+	}
+	logrus.Debugf("Comparing digest %q with the cached digest file %q, not computing the actual digest of %q",
+		expectedDigest, shadDigest, shadData)
+	shadDigestS := strings.TrimSpace(string(shadDigestB))
+	if expectedDigest.String() != shadDigestS {
+		return fmt.Errorf("expected digest %q does not match the cached digest %q", expectedDigest.String(), shadDigestS)
+	}
+	return nil
+}
+
+// IsLocal returns true if s is a local path or a "file://" URL, which is never downloaded from the network.
+func IsLocal(s string) bool {
 	return !strings.Contains(s, "://") || strings.HasPrefix(s, "file://")
 }
 
 func localPath(s string) (string, error) {
-	if !isLocal(s) {
+	if !IsLocal(s) {
 		return "", fmt.Errorf("got non-local path: %q", s)
 	}
 	if strings.HasPrefix(s, "file://") {
@@ -279,69 +442,249 @@ func createBar(size int64) (*pb.ProgressBar, error) {
 	return bar, nil
 }
 
-func downloadHTTP(localPath, url string, expectedDigest digest.Digest) error {
-	logrus.Debugf("downloading %q into %q", url, localPath)
-	localPathTmp := localPath + ".tmp"
+// progressReader calls progress with the number of the bytes read so far.
+type progressReader struct {
+	r        io.Reader
+	n, total int64
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.progress(r.n, r.total)
+	}
+	return n, err
+}
+
+// validatorSuffix is the suffix of the file next to a partial download that records the ETag or the Last-Modified
+// value of the remote file, which is sent as If-Range when resuming the download.
+const validatorSuffix = ".validator"
+
+// removePartial removes the partial download localPathTmp and its validator.
+func removePartial(localPathTmp string) error {
 	if err := os.RemoveAll(localPathTmp); err != nil {
 		return err
 	}
-	fileWriter, err := os.Create(localPathTmp)
+	return os.RemoveAll(localPathTmp + validatorSuffix)
+}
+
+// rangeValidator returns the value of If-Range for the response header h: the ETag if it is a strong one,
+// or else the Last-Modified value. Weak ETags must not be used in If-Range.
+func rangeValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// downloadHTTP downloads url into localPath, via localPath+".tmp".
+// When localPath+".tmp" was left by an interrupted download, the download is resumed with an HTTP range request,
+// conditional on the remote file being unchanged (If-Range). A partial download is only resumed when the ETag or
+// the Last-Modified value of the remote file was recorded, as nothing else tells that the remote file was not
+// replaced in the meantime.
+// A resumed download that does not match expectedDigest is downloaded again from scratch.
+func downloadHTTP(ctx context.Context, localPath, url string, expectedDigest digest.Digest, progress ProgressFunc) error {
+	logrus.Debugf("downloading %q into %q", url, localPath)
+	localPathTmp := localPath + ".tmp"
+	var algo digest.Algorithm
+	if expectedDigest != "" {
+		algo = expectedDigest.Algorithm()
+	}
+	resumed, actualDigest, err := fetchHTTP(ctx, localPathTmp, url, algo, progress)
 	if err != nil {
 		return err
 	}
-	defer fileWriter.Close()
+	if expectedDigest != "" && actualDigest != expectedDigest {
+		if !resumed {
+			return fmt.Errorf("expected digest %q, got %q", expectedDigest, actualDigest)
+		}
+		logrus.Warnf("the resumed download of %q does not match the expected digest %q, downloading it again from scratch", url, expectedDigest)
+		if err := removePartial(localPathTmp); err != nil {
+			return err
+		}
+		if _, actualDigest, err = fetchHTTP(ctx, localPathTmp, url, algo, progress); err != nil {
+			return err
+		}
+		if actualDigest != expectedDigest {
+			return fmt.Errorf("expected digest %q, got %q", expectedDigest, actualDigest)
+		}
+	}
 
-	resp, err := http.Get(url)
-	if err != nil {
+	if err := os.RemoveAll(localPath); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("expected HTTP status %d, got %s", http.StatusOK, resp.Status)
+	if err := os.Rename(localPathTmp, localPath); err != nil {
+		return err
 	}
-	bar, err := createBar(resp.ContentLength)
+	return os.RemoveAll(localPathTmp + validatorSuffix)
+}
+
+// fetchHTTP downloads url into localPathTmp, resuming from the existing content of localPathTmp if possible,
+// and returns whether the download was resumed, and the digest of the whole file computed with algo.
+// The digest is empty if algo is empty.
+//
+// localPathTmp is left as is on errors, so that the download can be resumed later.
+func fetchHTTP(ctx context.Context, localPathTmp, url string, algo digest.Algorithm, progress ProgressFunc) (bool, digest.Digest, error) {
+	validatorPath := localPathTmp + validatorSuffix
+	var offset int64
+	if st, err := os.Stat(localPathTmp); err == nil {
+		offset = st.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, "", err
+	}
+	var validator string
+	if offset > 0 {
+		if b, err := os.ReadFile(validatorPath); err == nil {
+			validator = strings.TrimSpace(string(b))
+		}
+		if validator == "" {
+			logrus.Debugf("the partial download of %q has no ETag or Last-Modified value to resume it with, downloading it from scratch", url)
+			offset = 0
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return false, "", err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			logrus.Debugf("the server does not support resuming the download of %q, or the file was changed, downloading it from scratch", url)
+			offset = 0
+		}
+		if v := rangeValidator(resp.Header); v != "" {
+			if err := os.WriteFile(validatorPath, []byte(v), 0644); err != nil {
+				return false, "", err
+			}
+		} else if err := os.RemoveAll(validatorPath); err != nil {
+			return false, "", err
+		}
+	case http.StatusPartialContent:
+		if offset == 0 {
+			return false, "", fmt.Errorf("expected HTTP status %d, got %s", http.StatusOK, resp.Status)
+		}
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			logrus.Debugf("unexpected Content-Range %q for %q, downloading it from scratch",
+				resp.Header.Get("Content-Range"), url)
+			return restartHTTP(ctx, localPathTmp, url, algo, progress)
+		}
+		logrus.Infof("Resuming the download of %q from %d bytes", url, offset)
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			return false, "", fmt.Errorf("expected HTTP status %d, got %s", http.StatusOK, resp.Status)
+		}
+		// The partial file is not smaller than the remote file, so it cannot be a prefix of it
+		logrus.Debugf("the partial download of %q is inconsistent, downloading it from scratch", url)
+		return restartHTTP(ctx, localPathTmp, url, algo, progress)
+	default:
+		return false, "", fmt.Errorf("expected HTTP status %d, got %s", http.StatusOK, resp.Status)
 	}
 
-	writers := []io.Writer{fileWriter}
 	var digester digest.Digester
-	if expectedDigest != "" {
-		algo := expectedDigest.Algorithm()
+	if algo != "" {
 		if !algo.Available() {
-			return fmt.Errorf("unsupported digest algorithm %q", algo)
+			return false, "", fmt.Errorf("unsupported digest algorithm %q", algo)
 		}
 		digester = algo.Digester()
-		hasher := digester.Hash()
-		writers = append(writers, hasher)
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flag = os.O_WRONLY | os.O_APPEND
+		if digester != nil {
+			if err := hashFile(digester.Hash(), localPathTmp, offset); err != nil {
+				return false, "", err
+			}
+		}
+	}
+	fileWriter, err := os.OpenFile(localPathTmp, flag, 0644)
+	if err != nil {
+		return false, "", err
+	}
+	defer fileWriter.Close()
+
+	total := resp.ContentLength
+	if total >= 0 {
+		total += offset
+	}
+	bar, err := createBar(total)
+	if err != nil {
+		return false, "", err
+	}
+	bar.SetCurrent(offset)
+
+	writers := []io.Writer{fileWriter}
+	if digester != nil {
+		writers = append(writers, digester.Hash())
 	}
 	multiWriter := io.MultiWriter(writers...)
 
+	var body io.Reader = resp.Body
+	if progress != nil {
+		body = &progressReader{r: body, n: offset, total: total, progress: progress}
+	}
+
 	bar.Start()
-	if _, err := io.Copy(multiWriter, bar.NewProxyReader(resp.Body)); err != nil {
-		return err
+	if _, err := io.Copy(multiWriter, bar.NewProxyReader(body)); err != nil {
+		return false, "", err
 	}
 	bar.Finish()
 
+	if err := fileWriter.Sync(); err != nil {
+		return false, "", err
+	}
+	if err := fileWriter.Close(); err != nil {
+		return false, "", err
+	}
+	var actualDigest digest.Digest
 	if digester != nil {
-		actualDigest := digester.Digest()
-		if actualDigest != expectedDigest {
-			return fmt.Errorf("expected digest %q, got %q", expectedDigest, actualDigest)
-		}
+		actualDigest = digester.Digest()
 	}
+	return offset > 0, actualDigest, nil
+}
 
-	if err := fileWriter.Sync(); err != nil {
-		return err
+// restartHTTP removes the partial download localPathTmp and downloads url from scratch.
+func restartHTTP(ctx context.Context, localPathTmp, url string, algo digest.Algorithm, progress ProgressFunc) (bool, digest.Digest, error) {
+	if err := removePartial(localPathTmp); err != nil {
+		return false, "", err
 	}
-	if err := fileWriter.Close(); err != nil {
-		return err
+	return fetchHTTP(ctx, localPathTmp, url, algo, progress)
+}
+
+// contentRangeStart returns the first byte position of the Content-Range header value s, e.g., "bytes 100-199/200".
+func contentRangeStart(s string) (int64, bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, false
 	}
-	if err := os.RemoveAll(localPath); err != nil {
-		return err
+	ss := strings.SplitN(strings.TrimPrefix(s, "bytes "), "-", 2)
+	if len(ss) != 2 {
+		return 0, false
 	}
-	if err := os.Rename(localPathTmp, localPath); err != nil {
-		return err
+	start, err := strconv.ParseInt(ss[0], 10, 64)
+	if err != nil {
+		return 0, false
 	}
+	return start, true
+}
 
-	return nil
+// hashFile writes the first n bytes of the file at path to w.
+func hashFile(w io.Writer, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, n)
+	return err
 }
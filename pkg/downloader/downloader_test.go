@@ -0,0 +1,259 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+func TestDownloadProgress(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sized" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	t.Cleanup(ts.Close)
+
+	for _, tc := range []struct {
+		path  string
+		total int64
+	}{
+		{"/sized", int64(len(content))},
+		{"/chunked", -1},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			var calls [][2]int64
+			progress := func(downloaded, total int64) {
+				calls = append(calls, [2]int64{downloaded, total})
+			}
+			local := filepath.Join(t.TempDir(), "data")
+			res, err := Download(local, ts.URL+tc.path, WithProgress(progress))
+			assert.NilError(t, err)
+			assert.Equal(t, res.Status, StatusDownloaded)
+			assert.Assert(t, len(calls) > 0)
+			var last int64
+			for _, c := range calls {
+				assert.Assert(t, c[0] > last, calls)
+				assert.Equal(t, c[1], tc.total)
+				last = c[0]
+			}
+			assert.Equal(t, last, int64(len(content)))
+
+			// Local files do not report progress
+			calls = nil
+			_, err = Download(filepath.Join(t.TempDir(), "data"), local, WithProgress(progress))
+			assert.NilError(t, err)
+			assert.Equal(t, len(calls), 0)
+		})
+	}
+}
+
+// partialDownload leaves the partial download of remote in the cache dir, as an interrupted download does.
+// The validator is not recorded when empty.
+func partialDownload(t *testing.T, cacheDir, remote, data, validator string) string {
+	shad := cacheEntryDir(cacheDir, remote)
+	assert.NilError(t, os.MkdirAll(shad, 0700))
+	tmp := filepath.Join(shad, "data.tmp")
+	assert.NilError(t, os.WriteFile(tmp, []byte(data), 0644))
+	if validator != "" {
+		assert.NilError(t, os.WriteFile(tmp+validatorSuffix, []byte(validator), 0644))
+	}
+	return tmp
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	const etag = `"v1"`
+	serveContent := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "data", time.Time{}, strings.NewReader(content))
+	}
+	testCases := []struct {
+		name      string
+		partial   string
+		validator string
+		handler   http.HandlerFunc
+		// ranges are the Range headers of the requests
+		ranges []string
+	}{
+		{
+			name:      "partial content",
+			partial:   content[:4000],
+			validator: etag,
+			handler:   serveContent,
+			ranges:    []string{"bytes=4000-"},
+		},
+		{
+			name:    "no validator",
+			partial: content[:4000],
+			handler: serveContent,
+			ranges:  []string{""},
+		},
+		{
+			name:      "changed remote file",
+			partial:   content[:4000],
+			validator: `"v0"`,
+			handler:   serveContent,
+			// ServeContent ignores Range, as If-Range does not match
+			ranges: []string{"bytes=4000-"},
+		},
+		{
+			name:      "ranges not supported",
+			partial:   content[:4000],
+			validator: etag,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(content))
+			},
+			ranges: []string{"bytes=4000-"},
+		},
+		{
+			name:      "range not satisfiable",
+			partial:   content + "garbage",
+			validator: etag,
+			handler:   serveContent,
+			ranges:    []string{fmt.Sprintf("bytes=%d-", len(content)+len("garbage")), ""},
+		},
+		{
+			name:      "bad Content-Range",
+			partial:   content[:4000],
+			validator: etag,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes 100-%d/%d", len(content)-1, len(content)))
+					w.WriteHeader(http.StatusPartialContent)
+					_, _ = w.Write([]byte(content[100:]))
+					return
+				}
+				_, _ = w.Write([]byte(content))
+			},
+			ranges: []string{"bytes=4000-", ""},
+		},
+		{
+			name:      "digest mismatch after resume",
+			partial:   strings.Repeat("x", 4000),
+			validator: etag,
+			handler:   serveContent,
+			ranges:    []string{"bytes=4000-", ""},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				ranges   []string
+				ifRanges []string
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+				mu.Unlock()
+				tc.handler(w, r)
+			}))
+			defer ts.Close()
+			cacheDir := t.TempDir()
+			remote := ts.URL + "/data"
+			tmp := partialDownload(t, cacheDir, remote, tc.partial, tc.validator)
+
+			local := filepath.Join(t.TempDir(), "data")
+			res, err := Download(local, remote, WithCacheDir(cacheDir), WithExpectedDigest(digest.FromString(content)))
+			assert.NilError(t, err)
+			assert.Equal(t, res.Status, StatusDownloaded)
+			b, err := os.ReadFile(local)
+			assert.NilError(t, err)
+			assert.Equal(t, string(b), content)
+			assert.DeepEqual(t, ranges, tc.ranges)
+			if tc.ranges[0] != "" {
+				assert.Equal(t, ifRanges[0], tc.validator)
+			}
+
+			// The partial download is gone, along with its validator
+			_, err = os.Stat(tmp)
+			assert.Assert(t, errors.Is(err, os.ErrNotExist))
+			_, err = os.Stat(tmp + validatorSuffix)
+			assert.Assert(t, errors.Is(err, os.ErrNotExist))
+		})
+	}
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content[:4000]))
+		// Drop the connection in the middle of the body
+		panic(http.ErrAbortHandler)
+	}))
+	defer ts.Close()
+	cacheDir := t.TempDir()
+	remote := ts.URL + "/data"
+	_, err := Download(filepath.Join(t.TempDir(), "data"), remote, WithCacheDir(cacheDir))
+	assert.Assert(t, err != nil)
+
+	// The partial download and the ETag to resume it with are kept
+	tmp := filepath.Join(cacheEntryDir(cacheDir, remote), "data.tmp")
+	b, err := os.ReadFile(tmp)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), content[:4000])
+	b, err = os.ReadFile(tmp + validatorSuffix)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), `"v1"`)
+}
+
+func TestDownloadDigestMismatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer ts.Close()
+	expected := digest.FromString("other")
+	_, err := Download(filepath.Join(t.TempDir(), "data"), ts.URL+"/data", WithCacheDir(t.TempDir()), WithExpectedDigest(expected))
+	assert.Error(t, err, fmt.Sprintf("expected digest %q, got %q", expected, digest.FromString("content")))
+}
+
+func TestDownloadContextCancel(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content[:4000]))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	var once sync.Once
+	progress := func(downloaded, total int64) {
+		if downloaded == 4000 {
+			once.Do(cancel)
+		}
+	}
+	cacheDir := t.TempDir()
+	remote := ts.URL + "/data"
+	local := filepath.Join(t.TempDir(), "data")
+	_, err := DownloadContext(ctx, local, remote, WithCacheDir(cacheDir), WithProgress(progress))
+	assert.Assert(t, errors.Is(err, context.Canceled), err)
+	_, err = os.Stat(local)
+	assert.Assert(t, errors.Is(err, os.ErrNotExist))
+
+	// The partial data is kept to resume the download
+	b, err := os.ReadFile(filepath.Join(cacheEntryDir(cacheDir, remote), "data.tmp"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), content[:4000])
+}
@@ -3,17 +3,244 @@
 package hostagent
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/hashicorp/go-multierror"
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/lima-vm/lima/pkg/store/filenames"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
+// queryBudget is the time available for forwarding a single query to the upstream servers,
+// matching the default timeout of the resolver in the guest.
+const queryBudget = 5 * time.Second
+
+// ednsUDPSize is the UDP payload size advertised in the EDNS0 OPT record of the replies that are not forwarded as is,
+// as recommended by the DNS flag day 2020 to avoid IP fragmentation.
+const ednsUDPSize = 1232
+
 type Handler struct {
-	clientConfig *dns.ClientConfig
-	clients      []*dns.Client
+	// upstreams are the groups of upstreams that queries are forwarded to, in order of preference
+	upstreams     [][]upstream
+	domains       domainUpstreams // the upstreams of the domains with their own nameservers
+	tlds          *tldFilter      // nil when every name is resolved by the host
+	mdnsMode      limayaml.MDNSMode
+	mdns          upstream // the mDNS responder of limayaml.MDNSModeForward
+	parallel      bool
+	logQueries    bool
+	metrics       *dnsMetrics    // nil when metrics are disabled
+	cache         *responseCache // nil when caching is disabled
+	negativeCache *responseCache // nil when caching negative responses is disabled
+	hosts         staticHosts
+	records       staticRecords
+	rewrites      rewriteRules
+	ptr           map[string][]string // reverse names of hosts -> names
+	block         blockList
+	blockNull     bool
+	roundRobin    bool
+	rotation      uint32          // incremented atomically on every query when roundRobin is set
+	health        *upstreamHealth // nil when skipping unhealthy upstreams is disabled
+	inflight      singleflight.Group
+	dns64Prefix   *net.IPNet // nil when DNS64 is disabled
+	maxUDPSize    int        // 0 for the size advertised by the client
+}
+
+type handlerOptions struct {
+	// cacheDisabled disables caching the responses
+	cacheDisabled bool
+	// cacheMaxEntries is the maximum number of cached responses (default: 1000)
+	cacheMaxEntries int
+	// negativeCacheDisabled disables caching the NXDOMAIN and NODATA responses
+	negativeCacheDisabled bool
+	// negativeCacheMaxEntries is the maximum number of cached negative responses (default: 1000)
+	negativeCacheMaxEntries int
+	// hosts maps names (optionally with a "*." wildcard prefix) to IP addresses, answered without contacting the upstream
+	hosts map[string]string
+	// timeout is the timeout of a single exchange with an upstream server (default: 2s)
+	timeout time.Duration
+	// retries is the number of times an exchange is retried after a timeout, before moving on to the next server
+	retries int
+	// parallel sends each query to all the upstream servers at once, instead of one after another
+	parallel bool
+	// doh is the list of the URLs of the DNS-over-HTTPS upstreams, preferred over the system nameservers
+	doh []string
+	// logQueries logs every query at debug level, along with how it was answered
+	logQueries bool
+	// metricsPort is the port of the HTTP endpoint serving the metrics, or 0 to disable the metrics
+	metricsPort int
+	// block is the list of names (optionally with a "*." wildcard prefix) that are not resolved
+	block []string
+	// blockNull answers the queries for blocked names with the unspecified address, instead of NXDOMAIN
+	blockNull bool
+	// roundRobin rotates the order of the A and AAAA records of the answers on every query
+	roundRobin bool
+	// failureThreshold is the number of consecutive failures after which an upstream is skipped, or 0 to never skip
+	failureThreshold int
+	// cooldown is the period an upstream is skipped for, before it is probed again (default: 30s)
+	cooldown time.Duration
+	// fallback is the list of the nameservers used when the system nameservers cannot be detected (default: defaultFallbackIPs)
+	fallback []net.IP
+	// domainClientConfigs are the nameservers of the domains (and their subdomains) that are not resolved
+	// with the nameservers of the host, optionally only for some query types
+	domainClientConfigs map[forwardKey]*dns.ClientConfig
+	// dns64Prefix is the NAT64 prefix of the AAAA records synthesized from A records, or nil to disable DNS64
+	dns64Prefix *net.IPNet
+	// nameservers are the upstream nameservers used instead of the nameservers of the host, when not empty
+	nameservers []net.IP
+	// order is the list of the nameservers tried first, in this order
+	order []net.IP
+	// records are the static TXT and SRV records
+	records []dns.RR
+	// rewrite maps domains to the domains that their names are resolved as
+	rewrite map[string]string
+	// maxUDPSize is the maximum size of the replies over UDP, or 0 for the size advertised by the client
+	maxUDPSize int
+	// tldAllow and tldDeny are the top-level domains whose names are (or are not) resolved by the host
+	tldAllow, tldDeny []string
+	// tldUpstream are the nameservers of the names that are not resolved by the host (default: fallback)
+	tldUpstream []net.IP
+	// mdnsMode decides how the queries for the names of .local are answered (default: limayaml.MDNSModeHost)
+	mdnsMode limayaml.MDNSMode
+	// mdnsResponder is the "IP:port" address of the mDNS responder of limayaml.MDNSModeForward
+	mdnsResponder string
+}
+
+// defaultFallbackIPs are the nameservers used when the system nameservers cannot be detected,
+// and hostResolver.fallback is not set.
+var defaultFallbackIPs = []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1")}
+
+func newHandlerOptions(hostResolver limayaml.HostResolver) (handlerOptions, error) {
+	timeout, err := time.ParseDuration(hostResolver.Timeout)
+	if err != nil {
+		return handlerOptions{}, err
+	}
+	cooldown, err := time.ParseDuration(hostResolver.Cooldown)
+	if err != nil {
+		return handlerOptions{}, err
+	}
+	var fallback []net.IP
+	for _, addr := range hostResolver.Fallback {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return handlerOptions{}, fmt.Errorf("invalid fallback nameserver %q", addr)
+		}
+		fallback = append(fallback, ip)
+	}
+	var tldUpstream []net.IP
+	for _, addr := range hostResolver.TLDs.Upstream {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return handlerOptions{}, fmt.Errorf("invalid TLD upstream nameserver %q", addr)
+		}
+		tldUpstream = append(tldUpstream, ip)
+	}
+	var order []net.IP
+	for _, addr := range hostResolver.Order {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return handlerOptions{}, fmt.Errorf("invalid nameserver %q in the order", addr)
+		}
+		order = append(order, ip)
+	}
+	domainClientConfigs := make(map[forwardKey]*dns.ClientConfig, len(hostResolver.Forward))
+	for _, f := range hostResolver.Forward {
+		qtypes := []uint16{dns.TypeNone}
+		if len(f.Types) > 0 {
+			qtypes = nil
+			for _, t := range f.Types {
+				qtype, ok := dns.StringToType[strings.ToUpper(t)]
+				if !ok {
+					return handlerOptions{}, fmt.Errorf("invalid query type %q of domain %q", t, f.Domain)
+				}
+				qtypes = append(qtypes, qtype)
+			}
+		}
+		var ips []net.IP
+		for _, addr := range f.Nameservers {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return handlerOptions{}, fmt.Errorf("invalid nameserver %q of domain %q", addr, f.Domain)
+			}
+			ips = append(ips, ip)
+		}
+		domain := dns.Fqdn(strings.ToLower(f.Domain))
+		for _, qtype := range qtypes {
+			k := forwardKey{domain: domain, qtype: qtype}
+			if cc, ok := domainClientConfigs[k]; ok {
+				// The same domain (and type) specified twice gets the nameservers of both
+				for _, ip := range ips {
+					cc.Servers = append(cc.Servers, ip.String())
+				}
+				continue
+			}
+			cc, err := newStaticClientConfig(ips)
+			if err != nil {
+				return handlerOptions{}, err
+			}
+			domainClientConfigs[k] = cc
+		}
+	}
+	var records []dns.RR
+	for _, r := range hostResolver.Records {
+		rr, err := limayaml.ParseHostResolverRecord(r)
+		if err != nil {
+			return handlerOptions{}, err
+		}
+		records = append(records, rr)
+	}
+	rewrite := make(map[string]string, len(hostResolver.Rewrite))
+	for _, r := range hostResolver.Rewrite {
+		rewrite[r.From] = r.To
+	}
+	var dns64Prefix *net.IPNet
+	if *hostResolver.DNS64.Enabled {
+		if err := limayaml.ValidateDNS64Prefix(hostResolver.DNS64.Prefix); err != nil {
+			return handlerOptions{}, err
+		}
+		_, dns64Prefix, _ = net.ParseCIDR(hostResolver.DNS64.Prefix)
+	}
+	return handlerOptions{
+		cacheDisabled:           !*hostResolver.Cache.Enabled,
+		cacheMaxEntries:         hostResolver.Cache.MaxEntries,
+		negativeCacheDisabled:   !*hostResolver.NegativeCache.Enabled,
+		negativeCacheMaxEntries: hostResolver.NegativeCache.MaxEntries,
+		hosts:                   hostResolver.Hosts,
+		timeout:                 timeout,
+		retries:                 *hostResolver.Retries,
+		parallel:                *hostResolver.Parallel,
+		doh:                     hostResolver.DoH,
+		logQueries:              *hostResolver.LogQueries,
+		metricsPort:             hostResolver.MetricsPort,
+		block:                   hostResolver.Block,
+		blockNull:               hostResolver.BlockResponse == limayaml.BlockResponseNull,
+		roundRobin:              *hostResolver.RoundRobin,
+		failureThreshold:        *hostResolver.FailureThreshold,
+		cooldown:                cooldown,
+		fallback:                fallback,
+		order:                   order,
+		domainClientConfigs:     domainClientConfigs,
+		dns64Prefix:             dns64Prefix,
+		records:                 records,
+		rewrite:                 rewrite,
+		maxUDPSize:              hostResolver.MaxUDPSize,
+		tldAllow:                hostResolver.TLDs.Allow,
+		tldDeny:                 hostResolver.TLDs.Deny,
+		tldUpstream:             tldUpstream,
+		mdnsMode:                hostResolver.MDNS.Mode,
+		mdnsResponder:           hostResolver.MDNS.Responder,
+	}, nil
 }
 
 func newStaticClientConfig(ips []net.IP) (*dns.ClientConfig, error) {
@@ -25,34 +252,179 @@ func newStaticClientConfig(ips []net.IP) (*dns.ClientConfig, error) {
 	return dns.ClientConfigFromReader(r)
 }
 
-func newHandler() (dns.Handler, error) {
-	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+func newHandler(opts handlerOptions) (*Handler, error) {
+	var (
+		cc  *dns.ClientConfig
+		err error
+	)
+	domainClientConfigs := opts.domainClientConfigs
+	if len(opts.nameservers) > 0 {
+		cc, err = newStaticClientConfig(opts.nameservers)
+	} else {
+		sr := newSystemResolver()
+		cc, err = sr.clientConfig()
+		if dr, ok := sr.(domainResolver); ok {
+			// The domains of hostResolver.forward take precedence over the ones of the host
+			if system, err := dr.domainClientConfigs(); err != nil {
+				logrus.WithError(err).Warn("failed to detect the nameservers of the domains of the host")
+			} else {
+				domainClientConfigs = withSystemDomains(domainClientConfigs, system)
+			}
+		}
+	}
+	fallbackIPs := opts.fallback
+	if len(fallbackIPs) == 0 {
+		fallbackIPs = defaultFallbackIPs
+	}
 	if err != nil {
-		fallbackIPs := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1")}
 		logrus.WithError(err).Warnf("failed to detect system DNS, falling back to %v", fallbackIPs)
 		cc, err = newStaticClientConfig(fallbackIPs)
 		if err != nil {
 			return nil, err
 		}
 	}
-	clients := []*dns.Client{
-		{}, // UDP
-		{Net: "tcp"},
+	if len(opts.nameservers) == 0 {
+		// The nameservers set explicitly are trusted, but the detected (and the fallback) ones may not be routable
+		// from the current network of the host
+		prioritizeReachable(cc, checkRoute)
+	}
+	orderServers(cc, opts.order)
+	var upstreams [][]upstream
+	if len(opts.doh) > 0 {
+		httpClient := &http.Client{Timeout: opts.timeout}
+		var group []upstream
+		for _, u := range opts.doh {
+			group = append(group, &dohUpstream{client: httpClient, url: u, retries: opts.retries})
+		}
+		upstreams = append(upstreams, group)
+	}
+	upstreams = append(upstreams, newDNSUpstreams(cc, opts)...)
+	var tldUpstreams [][]upstream
+	if len(opts.tldAllow) > 0 || len(opts.tldDeny) > 0 {
+		tldUpstreamIPs := opts.tldUpstream
+		if len(tldUpstreamIPs) == 0 {
+			tldUpstreamIPs = fallbackIPs
+		}
+		tldCC, err := newStaticClientConfig(tldUpstreamIPs)
+		if err != nil {
+			return nil, err
+		}
+		tldUpstreams = newDNSUpstreams(tldCC, opts)
+	}
+	var mdns upstream
+	if opts.mdnsMode == limayaml.MDNSModeForward {
+		if err := limayaml.ValidateMDNSResponder(opts.mdnsResponder); err != nil {
+			return nil, fmt.Errorf("invalid mDNS responder %q: %w", opts.mdnsResponder, err)
+		}
+		addr, err := net.ResolveUDPAddr("udp", opts.mdnsResponder)
+		if err != nil {
+			return nil, err
+		}
+		mdns = &mdnsUpstream{addr: addr, timeout: opts.timeout}
 	}
 	h := &Handler{
-		clientConfig: cc,
-		clients:      clients,
+		upstreams:   upstreams,
+		domains:     newDomainUpstreams(domainClientConfigs, opts),
+		tlds:        newTLDFilter(opts.tldAllow, opts.tldDeny, tldUpstreams),
+		mdnsMode:    opts.mdnsMode,
+		mdns:        mdns,
+		parallel:    opts.parallel,
+		logQueries:  opts.logQueries,
+		hosts:       newStaticHosts(withInternalHosts(opts.hosts)),
+		records:     newStaticRecords(opts.records),
+		rewrites:    newRewriteRules(opts.rewrite),
+		block:       newBlockList(opts.block),
+		blockNull:   opts.blockNull,
+		roundRobin:  opts.roundRobin,
+		health:      newUpstreamHealth(opts.failureThreshold, opts.cooldown, opts.timeout),
+		dns64Prefix: opts.dns64Prefix,
+		maxUDPSize:  opts.maxUDPSize,
+	}
+	h.ptr = h.hosts.reverse()
+	if opts.metricsPort != 0 {
+		h.metrics = newDNSMetrics()
+	}
+	if !opts.cacheDisabled {
+		h.cache = newResponseCache(opts.cacheMaxEntries)
+	}
+	if !opts.negativeCacheDisabled {
+		h.negativeCache = newResponseCache(opts.negativeCacheMaxEntries)
 	}
 	return h, nil
 }
 
-func (h *Handler) handleQuery(w dns.ResponseWriter, req *dns.Msg) {
+// Sources of the replies, as logged with logQueries.
+// Replies forwarded to an upstream are logged with the name of the upstream instead.
+const (
+	sourceBlockList    = "block list"
+	sourceCache        = "cache"
+	sourceHosts        = "hosts"
+	sourceRecords      = "records"
+	sourceHostResolver = "host resolver"
+	sourceTLDFilter    = "tld filter"
+	sourceMDNS         = "mdns"
+	sourceNone         = "none"
+)
+
+// newDNSUpstreams returns the upstreams for the nameservers of cc: first all of them over UDP, then over TCP.
+func newDNSUpstreams(cc *dns.ClientConfig, opts handlerOptions) [][]upstream {
+	clients := []*dns.Client{
+		{Timeout: opts.timeout}, // UDP
+		{Net: "tcp", Timeout: opts.timeout},
+	}
+	var upstreams [][]upstream
+	for _, client := range clients {
+		var group []upstream
+		for _, srv := range cc.Servers {
+			// JoinHostPort adds the brackets around IPv6 addresses
+			addr := net.JoinHostPort(srv, cc.Port)
+			group = append(group, &dnsUpstream{client: client, addr: addr, retries: opts.retries})
+		}
+		upstreams = append(upstreams, group)
+	}
+	return upstreams
+}
+
+// handleQuery returns the reply to req, along with its source.
+func (h *Handler) handleQuery(req *dns.Msg) (*dns.Msg, string) {
 	var (
 		reply   dns.Msg
 		handled bool
+		source  = sourceHostResolver
 	)
 	reply.SetReply(req)
 	for _, q := range reply.Question {
+		if names, ok := h.ptr[strings.ToLower(q.Name)]; ok && q.Qtype == dns.TypePTR {
+			// The internal addresses are unknown to the upstreams, so they must not be forwarded
+			reply.Answer = append(reply.Answer, ptrAnswers(q, names)...)
+			handled = true
+			source = sourceHosts
+			continue
+		}
+		if rrs := h.records.answer(q); len(rrs) > 0 {
+			// The records are defined here, so the answer is authoritative
+			reply.Answer = append(reply.Answer, rrs...)
+			reply.Authoritative = true
+			handled = true
+			source = sourceRecords
+			continue
+		}
+		if ip, ok := h.hosts.lookup(q.Name); ok && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+			// The name is known, so an answer of the other address family is NODATA, not a reason to forward
+			if rr := h.hosts.answer(q, ip); rr != nil {
+				reply.Answer = append(reply.Answer, rr)
+			}
+			handled = true
+			source = sourceHosts
+			continue
+		}
+		if _, ok := h.domains.lookup(q.Name, q.Qtype); ok {
+			// The resolver of the host does not know the nameservers of the domain
+			continue
+		}
+		if !h.tlds.hostResolved(q.Name) {
+			continue
+		}
 		switch q.Qtype {
 		case dns.TypeA:
 			addrs, err := net.LookupIP(q.Name)
@@ -76,48 +448,631 @@ func (h *Handler) handleQuery(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 	if handled {
-		_ = w.WriteMsg(&reply)
-		return
+		return &reply, source
 	}
-	h.handleDefault(w, req)
+	return h.handleDefault(req)
 }
 
-func (h *Handler) handleDefault(w dns.ResponseWriter, req *dns.Msg) {
-	for _, client := range h.clients {
-		for _, srv := range h.clientConfig.Servers {
-			addr := fmt.Sprintf("%s:%s", srv, h.clientConfig.Port)
-			reply, _, err := client.Exchange(req, addr)
+// handleDefault forwards req to the upstreams of the domain of the name asked for, or to the default upstreams
+// when the name belongs to no domain of hostResolver.forward, and returns the reply along with its source.
+func (h *Handler) handleDefault(req *dns.Msg) (*dns.Msg, string) {
+	var (
+		reply *dns.Msg
+		u     upstream
+	)
+	upstreams := h.upstreams
+	if len(req.Question) > 0 {
+		if domainUpstreams, ok := h.domains.lookup(req.Question[0].Name, req.Question[0].Qtype); ok {
+			upstreams = domainUpstreams
+		} else if tldUpstreams, ok := h.tlds.upstreamsOf(req.Question[0].Name); ok {
+			if tldUpstreams == nil {
+				// The names of .local must not leak to the public upstreams
+				var nxdomain dns.Msg
+				nxdomain.SetRcode(req, dns.RcodeNameError)
+				return &nxdomain, sourceTLDFilter
+			}
+			upstreams = tldUpstreams
+		}
+	}
+	if h.parallel {
+		reply, u = h.forwardParallel(req, upstreams)
+	} else {
+		reply, u = h.forwardSequential(req, upstreams)
+	}
+	if reply != nil {
+		return reply, u.String()
+	}
+	// Do not reply with an empty answer, as it would be taken (and cached) as NODATA
+	var servfail dns.Msg
+	servfail.SetRcode(req, dns.RcodeServerFailure)
+	return &servfail, sourceNone
+}
+
+// forwardSequential tries the groups of upstreams one after another, in order of preference,
+// and returns the first reply along with the upstream that sent it, or nil if none of them replied.
+func (h *Handler) forwardSequential(req *dns.Msg, groups [][]upstream) (*dns.Msg, upstream) {
+	deadline := time.Now().Add(queryBudget)
+	upstreams := h.health.filter(groups, time.Now())
+	var attemptsLeft int
+	for _, group := range upstreams {
+		attemptsLeft += len(group)
+	}
+	for _, group := range upstreams {
+		for _, u := range group {
+			// Each upstream gets a fair share of the remaining budget, so a slow upstream cannot starve the others
+			share := time.Until(deadline) / time.Duration(attemptsLeft)
+			attemptsLeft--
+			if share <= 0 {
+				return nil, nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), share)
+			reply, err := u.exchange(ctx, req)
+			cancel()
+			h.health.observe(u, err)
 			if err == nil {
-				_ = w.WriteMsg(reply)
-				return
+				return reply, u
+			}
+			h.metrics.observeUpstreamError(u)
+			logrus.WithError(err).Debugf("failed to forward the DNS query to %s", u)
+		}
+	}
+	return nil, nil
+}
+
+// forwardParallel sends req to all the upstreams of a group at once, and returns the first reply along with
+// the upstream that sent it, or nil if none of them replied.
+// The next group is only tried when none of the upstreams of the group replied.
+func (h *Handler) forwardParallel(req *dns.Msg, groups [][]upstream) (*dns.Msg, upstream) {
+	deadline := time.Now().Add(queryBudget)
+	upstreams := h.health.filter(groups, time.Now())
+	for i, group := range upstreams {
+		share := time.Until(deadline) / time.Duration(len(upstreams)-i)
+		if share <= 0 {
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), share)
+		reply, u := h.exchangeParallel(ctx, group, req)
+		cancel()
+		if reply != nil {
+			return reply, u
+		}
+	}
+	return nil, nil
+}
+
+func (h *Handler) exchangeParallel(ctx context.Context, group []upstream, req *dns.Msg) (*dns.Msg, upstream) {
+	type result struct {
+		reply    *dns.Msg
+		upstream upstream
+		err      error
+	}
+	// Buffered, so that the exchanges still in flight after returning do not block
+	ch := make(chan result, len(group))
+	for _, u := range group {
+		u := u
+		go func() {
+			// Each goroutine needs its own copy of the request, as the exchange may modify it
+			reply, err := u.exchange(ctx, req.Copy())
+			ch <- result{reply: reply, upstream: u, err: err}
+		}()
+	}
+	for range group {
+		select {
+		case res := <-ch:
+			h.health.observe(res.upstream, res.err)
+			if res.err == nil {
+				return res.reply, res.upstream
+			}
+			h.metrics.observeUpstreamError(res.upstream)
+			logrus.WithError(res.err).Debugf("failed to forward the DNS query to %s", res.upstream)
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// FlushCache removes the cached responses for name, including the negative ones, or all the cached responses
+// when name is "", e.g., after a record has been changed upstream. name is case-insensitive.
+// It returns the number of the removed responses.
+func (h *Handler) FlushCache(name string) int {
+	if name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+	n := 0
+	for _, c := range []*responseCache{h.cache, h.negativeCache} {
+		if c != nil {
+			n += c.flush(name)
+		}
+	}
+	return n
+}
+
+func (h *Handler) cachedReply(key cacheKey, now time.Time) *dns.Msg {
+	for _, c := range []*responseCache{h.cache, h.negativeCache} {
+		if c == nil {
+			continue
+		}
+		if reply := c.get(key, now); reply != nil {
+			return reply
+		}
+	}
+	return nil
+}
+
+func (h *Handler) cacheReply(key cacheKey, reply *dns.Msg, now time.Time) {
+	if reply.Truncated {
+		return
+	}
+	switch {
+	case isNegative(reply):
+		if h.negativeCache != nil {
+			h.negativeCache.add(key, reply, negativeTTL(reply), now)
+		}
+	case reply.Rcode == dns.RcodeSuccess:
+		if h.cache != nil {
+			if ttl, ok := minTTL(reply); ok {
+				h.cache.add(key, reply, ttl, now)
 			}
 		}
 	}
-	var reply dns.Msg
-	reply.SetReply(req)
-	_ = w.WriteMsg(&reply)
 }
 
 func (h *Handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	switch req.Opcode {
-	case dns.OpcodeQuery:
-		h.handleQuery(w, req)
+	start := time.Now()
+	reply, source := h.respond(req)
+	if h.roundRobin {
+		// The cache keeps the original order, as it stores a copy of the reply
+		rotateAddresses(reply, atomic.AddUint32(&h.rotation, 1))
+	}
+	// The datagram Unix socket has the same size limit as UDP
+	network := w.LocalAddr().Network()
+	fitReply(req, reply, network == "udp" || network == "unixgram", h.maxUDPSize)
+	_ = w.WriteMsg(reply)
+	latency := time.Since(start)
+	h.metrics.observeQuery(req, reply, latency)
+	if h.logQueries {
+		logQuery(req, reply, source, latency)
+	}
+}
+
+// Resolve resolves name of type qtype (e.g., dns.TypeA) like a query of the guest, but without a DNS socket,
+// e.g., for diagnostics. The query goes through the same path as the queries of the guest, including
+// the cache, the hosts, and the upstreams, and Resolve returns the reply along with its source:
+// the name of the upstream that answered, or "cache", "hosts", "records", "block list", "host resolver", "tld filter",
+// "mdns", or "none".
+//
+// The upstreams are given the same time budget as for the queries of the guest; when ctx is done first,
+// Resolve returns ctx.Err() without waiting for them.
+func (h *Handler) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, string, error) {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, "", fmt.Errorf("invalid name %q", name)
+	}
+	var req dns.Msg
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	type result struct {
+		reply  *dns.Msg
+		source string
+	}
+	// Buffered, so that the resolution still in flight after returning does not block
+	ch := make(chan result, 1)
+	go func() {
+		reply, source := h.respond(&req)
+		ch <- result{reply: reply, source: source}
+	}()
+	select {
+	case res := <-ch:
+		return res.reply, res.source, nil
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+}
+
+// respond returns the reply to req, along with its source. This is the common path of ServeDNS and Resolve.
+func (h *Handler) respond(req *dns.Msg) (*dns.Msg, string) {
+	if reply := rejectQuery(req); reply != nil {
+		return reply, sourceNone
+	}
+	// The blocked names are answered first, so that the blocked names of .local are not sent to the mDNS responder either
+	if blocked := h.block.blockedReply(req, h.blockNull); blocked != nil {
+		return blocked, sourceBlockList
+	}
+	// The names of .local are answered before the cache, so that they never reach the unicast upstreams
+	if reply, source := h.mdnsReply(req); reply != nil {
+		return reply, source
+	}
+	return h.reply(req)
+}
+
+// rejectQuery returns the error reply to req when it is not a query that can be forwarded, or nil.
+// Queries without a question get FORMERR. The opcodes other than QUERY (e.g., IQUERY, UPDATE, and NOTIFY) get NOTIMP
+// (RFC 1035 section 4.1.1) rather than FORMERR, as they are well-formed, only not implemented here.
+// Neither is sent to the upstream nameservers.
+func rejectQuery(req *dns.Msg) *dns.Msg {
+	var rcode int
+	switch {
+	case req.Opcode != dns.OpcodeQuery:
+		rcode = dns.RcodeNotImplemented
+	case len(req.Question) == 0:
+		rcode = dns.RcodeFormatError
 	default:
-		h.handleDefault(w, req)
+		return nil
+	}
+	var reply dns.Msg
+	reply.SetRcode(req, rcode)
+	return &reply
+}
+
+// reply returns the reply to req, along with its source.
+// Concurrent identical queries that are not cached are resolved only once, and share the reply.
+func (h *Handler) reply(req *dns.Msg) (*dns.Msg, string) {
+	key, cacheable := cacheKeyFor(req)
+	if !cacheable {
+		return h.resolve(req)
+	}
+	if reply := h.cachedReply(key, time.Now()); reply != nil {
+		h.metrics.observeCache(true)
+		reply.Id = req.Id
+		reply.Question = req.Question
+		return reply, sourceCache
+	}
+	h.metrics.observeCache(false)
+	// Nothing but the reply is kept once the flight has landed, so a failure is not reused by later queries
+	v, _, shared := h.inflight.Do(key.String(), func() (interface{}, error) {
+		reply, source := h.resolve(req)
+		h.cacheReply(key, reply, time.Now())
+		return inflightResult{reply: reply, source: source}, nil
+	})
+	res := v.(inflightResult)
+	reply := res.reply
+	if shared {
+		// Every query sharing the reply gets its own copy, as the reply is modified before being written
+		reply = reply.Copy()
+		reply.Id = req.Id
+		reply.Question = req.Question
+	}
+	return reply, res.source
+}
+
+type inflightResult struct {
+	reply  *dns.Msg
+	source string
+}
+
+// resolve returns the reply to req without looking up the cache, along with its source.
+// req must be a standard query, as the other ones are rejected by respond.
+func (h *Handler) resolve(req *dns.Msg) (*dns.Msg, string) {
+	if rewritten, from, to := h.rewrites.rewrittenQuery(req); rewritten != nil {
+		// The rewritten name goes through the whole lookup, e.g., the block list, the hosts,
+		// and the nameservers of its domain
+		reply, source := h.block.blockedReply(rewritten, h.blockNull), sourceBlockList
+		if reply == nil {
+			reply, source = h.resolveQuery(rewritten)
+		}
+		restoreReply(req, reply, from, to)
+		return reply, source
+	}
+	return h.resolveQuery(req)
+}
+
+// resolveQuery is like resolve, but for standard queries, which are not rewritten.
+func (h *Handler) resolveQuery(req *dns.Msg) (*dns.Msg, string) {
+	reply, source := h.handleQuery(req)
+	if synthesized := h.dns64Reply(req, reply); synthesized != nil {
+		return synthesized, source
+	}
+	return reply, source
+}
+
+// rotateAddresses rotates the A and AAAA records in the answer section of msg by n positions,
+// leaving the other records, such as the CNAME records preceding the addresses, in place.
+func rotateAddresses(msg *dns.Msg, n uint32) {
+	var idx []int
+	for i, rr := range msg.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return
+	}
+	addrs := make([]dns.RR, len(idx))
+	for i, j := range idx {
+		addrs[i] = msg.Answer[j]
+	}
+	shift := int(n % uint32(len(addrs)))
+	for i, j := range idx {
+		msg.Answer[j] = addrs[(i+shift)%len(addrs)]
+	}
+}
+
+// fitReply adjusts the EDNS0 OPT record of reply to req (RFC 6891 section 7),
+// and truncates UDP replies to the buffer size advertised by the client, or to maxUDPSize if smaller (and not 0).
+// Truncated replies have the TC bit set, so that the client retries over TCP.
+func fitReply(req, reply *dns.Msg, udp bool, maxUDPSize int) {
+	reqOpt := req.IsEdns0()
+	replyOpt := reply.IsEdns0()
+	switch {
+	case reqOpt == nil && replyOpt != nil:
+		// Cached replies may carry the OPT record of the query of another client
+		extra := reply.Extra[:0]
+		for _, rr := range reply.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		reply.Extra = extra
+	case reqOpt != nil && replyOpt == nil:
+		// Replies that were not forwarded (static hosts, host resolver, SERVFAIL) lack the OPT record
+		reply.SetEdns0(ednsUDPSize, reqOpt.Do())
+	}
+	if !udp {
+		return
+	}
+	size := dns.MinMsgSize
+	if reqOpt != nil && int(reqOpt.UDPSize()) > size {
+		size = int(reqOpt.UDPSize())
+	}
+	if maxUDPSize > 0 && size > maxUDPSize {
+		size = maxUDPSize
+	}
+	reply.Truncate(size)
+}
+
+func logQuery(req, reply *dns.Msg, source string, latency time.Duration) {
+	fields := logrus.Fields{
+		"opcode":  dns.OpcodeToString[req.Opcode],
+		"source":  source,
+		"rcode":   dns.RcodeToString[reply.Rcode],
+		"answers": len(reply.Answer),
+		"latency": latency,
+	}
+	if len(req.Question) > 0 {
+		q := req.Question[0]
+		fields["name"] = q.Name
+		fields["type"] = dns.TypeToString[q.Qtype]
+	}
+	logrus.WithFields(fields).Debug("DNS query")
+}
+
+// DNSServer is the DNS server of the host agent, listening on both UDP and TCP.
+type DNSServer struct {
+	// UDPPort and TCPPort are the ports actually bound, even when the requested ports are 0 (ephemeral).
+	UDPPort int
+	TCPPort int
+	// UnixSocket and UnixgramSocket are the paths of the Unix sockets, or "" when `hostResolver.unixSocket` is false.
+	UnixSocket     string
+	UnixgramSocket string
+
+	handler  *Handler
+	udp      *dns.Server
+	tcp      *dns.Server
+	unix     *dns.Server  // nil when the Unix sockets are disabled
+	unixgram *dns.Server  // nil when the Unix sockets are disabled
+	metrics  *http.Server // nil when metrics are disabled
+	errCh    chan error
+
+	mu     sync.Mutex
+	failed map[string]bool // the Net of the listeners that have failed, not to be shut down
+}
+
+// FlushCache is like Handler.FlushCache.
+func (s *DNSServer) FlushCache(name string) int {
+	return s.handler.FlushCache(name)
+}
+
+// Resolve is like Handler.Resolve.
+func (s *DNSServer) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, string, error) {
+	return s.handler.Resolve(ctx, name, qtype)
+}
+
+// servers returns the DNS servers of all the listeners.
+func (s *DNSServer) servers() []*dns.Server {
+	servers := []*dns.Server{s.udp, s.tcp}
+	if s.unix != nil {
+		servers = append(servers, s.unix, s.unixgram)
 	}
+	return servers
+}
+
+// DNSListenerError is sent by DNSServer.Errors when a listener fails.
+type DNSListenerError struct {
+	Net string // "udp", "tcp", "unix", "unixgram", or "http" for the metrics endpoint
+	Err error
 }
 
-func (a *HostAgent) StartDNS() (*dns.Server, error) {
-	h, err := newHandler()
+func (e *DNSListenerError) Error() string {
+	return fmt.Sprintf("DNS server (%s) failed: %v", e.Net, e.Err)
+}
+
+func (e *DNSListenerError) Unwrap() error {
+	return e.Err
+}
+
+// Errors returns the channel that receives a *DNSListenerError for each listener that fails.
+// The channel is closed when all the listeners have stopped.
+func (s *DNSServer) Errors() <-chan error {
+	return s.errCh
+}
+
+// fail records that the listener of net has failed, before sending the error to Errors.
+func (s *DNSServer) fail(net string, err error) {
+	s.mu.Lock()
+	if s.failed == nil {
+		s.failed = make(map[string]bool)
+	}
+	s.failed[net] = true
+	s.mu.Unlock()
+	s.errCh <- &DNSListenerError{Net: net, Err: err}
+}
+
+func (s *DNSServer) hasFailed(net string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed[net]
+}
+
+// Shutdown stops all the listeners, waiting for the in-flight queries without a deadline.
+func (s *DNSServer) Shutdown() error {
+	return s.ShutdownContext(context.Background())
+}
+
+// ShutdownContext stops all the listeners, and waits for the in-flight queries to finish until ctx is done.
+// The listeners that have already failed (see Errors) are skipped.
+// The returned error tells which of the listeners failed to stop.
+func (s *DNSServer) ShutdownContext(ctx context.Context) error {
+	var (
+		mu   sync.Mutex
+		mErr error
+		wg   sync.WaitGroup
+	)
+	appendErr := func(net string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		mErr = multierror.Append(mErr, fmt.Errorf("failed to shut down the DNS server (%s): %w", net, err))
+	}
+	for _, server := range s.servers() {
+		server := server
+		if s.hasFailed(server.Net) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.ShutdownContext(ctx); err != nil {
+				appendErr(server.Net, err)
+			}
+		}()
+	}
+	if s.metrics != nil && !s.hasFailed("http") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.metrics.Shutdown(ctx); err != nil {
+				appendErr("http", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// The listener of the datagram socket does not remove the socket file on close
+	for _, p := range []string{s.UnixSocket, s.UnixgramSocket} {
+		if p == "" {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			mErr = multierror.Append(mErr, err)
+		}
+	}
+	return mErr
+}
+
+// StartDNS starts the DNS server on a.udpDNSLocalPort and a.tcpDNSLocalPort.
+// The ports can be 0 to bind ephemeral ports, see DNSServer.UDPPort and DNSServer.TCPPort.
+// With `hostResolver.unixSocket`, the DNS server also listens on the Unix sockets of the instance directory,
+// replacing the stale socket files of a previous run.
+//
+// StartDNS returns after all the listeners have been bound and the DNS servers have started accepting queries,
+// or returns a *DNSListenerError when a listener cannot be bound.
+func (a *HostAgent) StartDNS() (*DNSServer, error) {
+	opts, err := newHandlerOptions(a.y.HostResolver)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	addr := fmt.Sprintf("127.0.0.1:%d", a.udpDNSLocalPort)
-	server := &dns.Server{Net: "udp", Addr: addr, Handler: h}
-	go func() {
-		if e := server.ListenAndServe(); e != nil {
-			panic(e)
+	if a.y.DNSPrecedence == limayaml.DNSPrecedenceHostResolver {
+		opts.nameservers = a.y.DNS
+	}
+	h, err := newHandler(opts)
+	if err != nil {
+		return nil, err
+	}
+	// Listen before serving, so that the bound ports are known and listening errors are returned immediately
+	pc, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", a.udpDNSLocalPort))
+	if err != nil {
+		return nil, &DNSListenerError{Net: "udp", Err: err}
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", a.tcpDNSLocalPort))
+	if err != nil {
+		pc.Close()
+		return nil, &DNSListenerError{Net: "tcp", Err: err}
+	}
+	s := &DNSServer{
+		UDPPort: pc.LocalAddr().(*net.UDPAddr).Port,
+		TCPPort: l.Addr().(*net.TCPAddr).Port,
+		handler: h,
+		udp:     &dns.Server{Net: "udp", PacketConn: pc, Handler: h},
+		tcp:     &dns.Server{Net: "tcp", Listener: l, Handler: h},
+		errCh:   make(chan error, 5),
+	}
+	closeListeners := func() {
+		pc.Close()
+		l.Close()
+		if s.unix != nil {
+			s.unix.Listener.Close()
+			s.unixgram.PacketConn.Close()
+			os.Remove(s.UnixgramSocket)
+		}
+	}
+	if *a.y.HostResolver.UnixSocket {
+		sockPath := filepath.Join(a.instDir, filenames.DNSSock)
+		dgramSockPath := filepath.Join(a.instDir, filenames.DNSDgramSock)
+		for _, p := range []string{sockPath, dgramSockPath} {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				closeListeners()
+				return nil, err
+			}
+		}
+		ul, err := net.Listen("unix", sockPath)
+		if err != nil {
+			closeListeners()
+			return nil, &DNSListenerError{Net: "unix", Err: err}
+		}
+		upc, err := net.ListenPacket("unixgram", dgramSockPath)
+		if err != nil {
+			ul.Close()
+			closeListeners()
+			return nil, &DNSListenerError{Net: "unixgram", Err: err}
+		}
+		s.UnixSocket, s.UnixgramSocket = sockPath, dgramSockPath
+		s.unix = &dns.Server{Net: "unix", Listener: ul, Handler: h}
+		s.unixgram = &dns.Server{Net: "unixgram", PacketConn: upc, Handler: h}
+	}
+	var wg sync.WaitGroup
+	if h.metrics != nil {
+		s.metrics = newMetricsServer(h, opts.metricsPort)
+		ml, err := net.Listen("tcp", s.metrics.Addr)
+		if err != nil {
+			closeListeners()
+			return nil, &DNSListenerError{Net: "http", Err: err}
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.metrics.Serve(ml); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.fail("http", err)
+			}
+		}()
+	}
+	for _, server := range s.servers() {
+		server := server
+		// ready is closed when the server has started or failed to start,
+		// so that ShutdownContext is not called before the server has started.
+		var once sync.Once
+		ready := make(chan struct{})
+		server.NotifyStartedFunc = func() { once.Do(func() { close(ready) }) }
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.ActivateAndServe(); err != nil {
+				s.fail(server.Net, err)
+			}
+			once.Do(func() { close(ready) })
+		}()
+		<-ready
+	}
+	go func() {
+		wg.Wait()
+		close(s.errCh)
 	}()
-	return server, nil
+	return s, nil
 }
@@ -0,0 +1,61 @@
+package hostagent
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// blockList is the set of lower-cased FQDNs (optionally starting with the "*." wildcard label)
+// that must not be resolved.
+type blockList map[string]struct{}
+
+func newBlockList(names []string) blockList {
+	res := make(blockList, len(names))
+	for _, name := range names {
+		res[dns.Fqdn(strings.ToLower(name))] = struct{}{}
+	}
+	return res
+}
+
+func (b blockList) contains(name string) bool {
+	for _, pattern := range namePatterns(name) {
+		if _, ok := b[pattern]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedReply returns the reply to req when it asks for a blocked name, or nil otherwise.
+// With nullAddress, A and AAAA queries are answered with the unspecified address
+// (and other queries with NODATA), instead of NXDOMAIN.
+func (b blockList) blockedReply(req *dns.Msg, nullAddress bool) *dns.Msg {
+	var blocked bool
+	for _, q := range req.Question {
+		if b.contains(q.Name) {
+			blocked = true
+			break
+		}
+	}
+	if !blocked {
+		return nil
+	}
+	var reply dns.Msg
+	if !nullAddress {
+		reply.SetRcode(req, dns.RcodeNameError)
+		return &reply
+	}
+	reply.SetReply(req)
+	for _, q := range req.Question {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+		switch q.Qtype {
+		case dns.TypeA:
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	}
+	return &reply
+}
@@ -0,0 +1,198 @@
+package hostagent
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSCacheMaxEntries = 1000
+	// defaultNegativeTTL is used for negative responses without a SOA record.
+	defaultNegativeTTL = 60
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is an LRU cache of DNS responses.
+// Entries expire when the minimum TTL of their resource records has elapsed.
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List // front is the most recently used entry
+	entries    map[cacheKey]*list.Element
+}
+
+func newResponseCache(maxEntries int) *responseCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultDNSCacheMaxEntries
+	}
+	return &responseCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    make(map[cacheKey]*list.Element),
+	}
+}
+
+func (k cacheKey) String() string {
+	return fmt.Sprintf("%s/%d/%d", k.name, k.qtype, k.qclass)
+}
+
+// cacheKeyFor returns the cache key for req.
+// Only queries with exactly one question can be cached.
+func cacheKeyFor(req *dns.Msg) (cacheKey, bool) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return cacheKey{}, false
+	}
+	q := req.Question[0]
+	key := cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}
+	return key, true
+}
+
+// get returns a copy of the cached response with the TTLs decremented by the time spent in the cache,
+// or nil if there is no unexpired entry for key.
+func (c *responseCache) get(key cacheKey, now time.Time) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.ll.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.ll.MoveToFront(elem)
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	forEachRR(msg, func(rr dns.RR) {
+		hdr := rr.Header()
+		if hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+	})
+	return msg
+}
+
+// add stores msg as the response for key, for ttl seconds.
+func (c *responseCache) add(key cacheKey, msg *dns.Msg, ttl uint32, now time.Time) {
+	if ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// flush removes the entries of name (a lower-cased FQDN) for all the types and classes,
+// or all the entries when name is "", and returns the number of the removed entries.
+func (c *responseCache) flush(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if name == "" {
+		n := c.ll.Len()
+		c.ll.Init()
+		c.entries = make(map[cacheKey]*list.Element)
+		return n
+	}
+	n := 0
+	for key, elem := range c.entries {
+		if key.name == name {
+			c.ll.Remove(elem)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// isNegative returns true for NXDOMAIN and NODATA responses.
+func isNegative(msg *dns.Msg) bool {
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(msg.Answer) == 0
+	}
+	return false
+}
+
+// negativeTTL returns the TTL for caching a negative response, as defined in RFC 2308 section 5:
+// the minimum of the TTL of the SOA record in the authority section and its MINIMUM field.
+func negativeTTL(msg *dns.Msg) uint32 {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return defaultNegativeTTL
+}
+
+// forEachRR calls f for every resource record of msg, except for the EDNS0 OPT pseudo record.
+func forEachRR(msg *dns.Msg, f func(dns.RR)) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			f(rr)
+		}
+	}
+}
+
+// minTTL returns the minimum TTL of the resource records of msg.
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var (
+		ttl   uint32
+		found bool
+	)
+	forEachRR(msg, func(rr dns.RR) {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	})
+	return ttl, found
+}
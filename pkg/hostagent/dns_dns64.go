@@ -0,0 +1,70 @@
+package hostagent
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// synthesizeDNS64 returns the IPv6 address for ip4 embedded into prefix, as defined in RFC 6052 section 2.2.
+// prefix must be 32, 40, 48, 56, 64, or 96 bits long (see limayaml.ValidateDNS64Prefix).
+// The IPv4 address fills the bits after the prefix, skipping bits 64 to 71 (the "u" octet), which stay zero.
+func synthesizeDNS64(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	res := make(net.IP, net.IPv6len)
+	copy(res, prefix.IP.To16()[:ones/8])
+	j := ones / 8
+	for _, b := range ip4.To4() {
+		if j == 8 {
+			j++
+		}
+		res[j] = b
+		j++
+	}
+	return res
+}
+
+// dns64Reply returns the reply to the AAAA query req synthesized from the A records of the name, when reply has no AAAA record
+// (RFC 6147 section 5.1), or nil when there is nothing to synthesize.
+// The other records of the reply to the A query, such as CNAME, are kept as is.
+func (h *Handler) dns64Reply(req, reply *dns.Msg) *dns.Msg {
+	if h.dns64Prefix == nil || len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeAAAA {
+		return nil
+	}
+	// NXDOMAIN means there is no A record either, and the other errors are not NODATA
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	for _, rr := range reply.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return nil
+		}
+	}
+	aReq := req.Copy()
+	aReq.Question[0].Qtype = dns.TypeA
+	aReply, _ := h.reply(aReq)
+	if aReply.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	var (
+		synthesized dns.Msg
+		found       bool
+	)
+	synthesized.SetReply(req)
+	for _, rr := range aReply.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			synthesized.Answer = append(synthesized.Answer, dns.Copy(rr))
+			continue
+		}
+		hdr := a.Hdr
+		hdr.Rrtype = dns.TypeAAAA
+		hdr.Rdlength = 0
+		synthesized.Answer = append(synthesized.Answer, &dns.AAAA{Hdr: hdr, AAAA: synthesizeDNS64(h.dns64Prefix, a.A)})
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return &synthesized
+}
@@ -0,0 +1,99 @@
+package hostagent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+)
+
+func TestSynthesizeDNS64(t *testing.T) {
+	// The examples of RFC 6052 section 2.4
+	ip4 := net.ParseIP("192.0.2.33")
+	for prefix, expected := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+	} {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		assert.NilError(t, err)
+		assert.Equal(t, synthesizeDNS64(ipNet, ip4).String(), expected, prefix)
+	}
+}
+
+// answersReply returns the function of a funcUpstream that replies with the records of answers of the type asked for.
+func answersReply(answers map[uint16][]dns.RR) func(req *dns.Msg) *dns.Msg {
+	return func(req *dns.Msg) *dns.Msg {
+		var reply dns.Msg
+		reply.SetReply(req)
+		for _, rr := range answers[req.Question[0].Qtype] {
+			rr := dns.Copy(rr)
+			rr.Header().Name = req.Question[0].Name
+			reply.Answer = append(reply.Answer, rr)
+		}
+		return &reply
+	}
+}
+
+func TestDNS64Reply(t *testing.T) {
+	_, prefix, err := net.ParseCIDR("64:ff9b::/96")
+	assert.NilError(t, err)
+	aRR := &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}
+	aaaaRR := &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")}
+	cnameRR := &dns.CNAME{Hdr: dns.RR_Header{Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "target.example.com."}
+
+	query := func(h *Handler) *dns.Msg {
+		var req dns.Msg
+		req.SetQuestion("ipv4only.example.", dns.TypeAAAA)
+		reply, _ := h.reply(&req)
+		return reply
+	}
+
+	// IPv4 only: synthesized
+	h := &Handler{
+		upstreams:   [][]upstream{{&funcUpstream{f: answersReply(map[uint16][]dns.RR{dns.TypeA: {cnameRR, aRR}})}}},
+		hosts:       newStaticHosts(nil),
+		dns64Prefix: prefix,
+	}
+	reply := query(h)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, len(reply.Answer), 2)
+	assert.Equal(t, reply.Answer[0].(*dns.CNAME).Target, "target.example.com.")
+	aaaa := reply.Answer[1].(*dns.AAAA)
+	assert.Equal(t, aaaa.AAAA.String(), "64:ff9b::c000:201")
+	assert.Equal(t, aaaa.Hdr.Rrtype, dns.TypeAAAA)
+	assert.Equal(t, aaaa.Hdr.Ttl, uint32(60))
+
+	// Real AAAA records are kept
+	h = &Handler{
+		upstreams:   [][]upstream{{&funcUpstream{f: answersReply(map[uint16][]dns.RR{dns.TypeA: {aRR}, dns.TypeAAAA: {aaaaRR}})}}},
+		hosts:       newStaticHosts(nil),
+		dns64Prefix: prefix,
+	}
+	reply = query(h)
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, reply.Answer[0].(*dns.AAAA).AAAA.String(), "2001:db8::1")
+
+	// Disabled
+	h = &Handler{
+		upstreams: [][]upstream{{&funcUpstream{f: answersReply(map[uint16][]dns.RR{dns.TypeA: {aRR}})}}},
+		hosts:     newStaticHosts(nil),
+	}
+	reply = query(h)
+	assert.Equal(t, len(reply.Answer), 0)
+
+	// Neither A nor AAAA: NODATA
+	h = &Handler{
+		upstreams:   [][]upstream{{&funcUpstream{}}},
+		hosts:       newStaticHosts(nil),
+		dns64Prefix: prefix,
+	}
+	reply = query(h)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, len(reply.Answer), 0)
+}
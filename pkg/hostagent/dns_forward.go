@@ -0,0 +1,48 @@
+package hostagent
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// forwardKey is the key of the nameservers of hostResolver.forward: a domain, optionally restricted to a query type.
+type forwardKey struct {
+	domain string // lower-cased FQDN
+	qtype  uint16 // 0 (dns.TypeNone) for all the types
+}
+
+// domainUpstreams maps the domains (and query types) to the upstreams of their own nameservers (split DNS).
+// The upstreams of a domain are used for the domain and all its subdomains.
+type domainUpstreams map[forwardKey][][]upstream
+
+func newDomainUpstreams(domainClientConfigs map[forwardKey]*dns.ClientConfig, opts handlerOptions) domainUpstreams {
+	res := make(domainUpstreams, len(domainClientConfigs))
+	for k, cc := range domainClientConfigs {
+		k.domain = dns.Fqdn(strings.ToLower(k.domain))
+		res[k] = newDNSUpstreams(cc, opts)
+	}
+	return res
+}
+
+// lookup returns the upstreams of the domains that name belongs to, from the longest domain to the shortest one,
+// so that the nameservers of a shorter domain are only tried when the ones of a longer domain did not reply.
+// For each domain, the upstreams specific to qtype take precedence over the ones for all the types.
+func (d domainUpstreams) lookup(name string, qtype uint16) ([][]upstream, bool) {
+	if len(d) == 0 {
+		return nil, false
+	}
+	var res [][]upstream
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := range labels {
+		domain := dns.Fqdn(strings.Join(labels[i:], "."))
+		if upstreams, ok := d[forwardKey{domain: domain, qtype: qtype}]; ok && qtype != dns.TypeNone {
+			res = append(res, upstreams...)
+			continue
+		}
+		if upstreams, ok := d[forwardKey{domain: domain}]; ok {
+			res = append(res, upstreams...)
+		}
+	}
+	return res, len(res) > 0
+}
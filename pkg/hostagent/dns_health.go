@@ -0,0 +1,134 @@
+package hostagent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamHealth is a circuit breaker for the upstreams.
+// An upstream is skipped for the cooldown period after failureThreshold consecutive failures.
+// When the cooldown period has elapsed, the upstream is probed in the background with a lightweight query,
+// and used again once a probe succeeds.
+//
+// A nil *upstreamHealth is valid and treats all the upstreams as healthy.
+type upstreamHealth struct {
+	failureThreshold int
+	cooldown         time.Duration
+	probeTimeout     time.Duration
+
+	mu     sync.Mutex
+	states map[upstream]*upstreamState
+}
+
+type upstreamState struct {
+	failures       int // consecutive failures
+	unhealthyUntil time.Time
+	probing        bool
+}
+
+func newUpstreamHealth(failureThreshold int, cooldown, probeTimeout time.Duration) *upstreamHealth {
+	if failureThreshold <= 0 {
+		return nil
+	}
+	return &upstreamHealth{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		probeTimeout:     probeTimeout,
+		states:           make(map[upstream]*upstreamState),
+	}
+}
+
+// state returns the state of u. h.mu must be held.
+func (h *upstreamHealth) state(u upstream) *upstreamState {
+	st, ok := h.states[u]
+	if !ok {
+		st = &upstreamState{}
+		h.states[u] = st
+	}
+	return st
+}
+
+// filter returns the groups of upstreams without the unhealthy ones, and starts probing the unhealthy upstreams
+// whose cooldown period has elapsed.
+// All the upstreams are returned when all of them are unhealthy, as skipping all of them would not help.
+func (h *upstreamHealth) filter(groups [][]upstream, now time.Time) [][]upstream {
+	if h == nil {
+		return groups
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var (
+		res   [][]upstream
+		found bool
+	)
+	for _, group := range groups {
+		var healthy []upstream
+		for _, u := range group {
+			st := h.state(u)
+			if st.unhealthyUntil.IsZero() {
+				healthy = append(healthy, u)
+				continue
+			}
+			if !now.Before(st.unhealthyUntil) && !st.probing {
+				st.probing = true
+				go h.probe(u)
+			}
+		}
+		if len(healthy) > 0 {
+			res = append(res, healthy)
+			found = true
+		}
+	}
+	if !found {
+		return groups
+	}
+	return res
+}
+
+// observe records the result of an exchange with u.
+func (h *upstreamHealth) observe(u upstream, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.state(u)
+	if err == nil {
+		if !st.unhealthyUntil.IsZero() {
+			logrus.Infof("DNS upstream %s is healthy again", u)
+		}
+		*st = upstreamState{probing: st.probing}
+		return
+	}
+	st.failures++
+	if st.failures >= h.failureThreshold && st.unhealthyUntil.IsZero() {
+		logrus.WithError(err).Warnf("DNS upstream %s failed %d times in a row, skipping it for %v", u, st.failures, h.cooldown)
+		st.unhealthyUntil = time.Now().Add(h.cooldown)
+	}
+}
+
+// probe sends a lightweight query to u, and marks u as healthy if it replies,
+// or extends its cooldown period otherwise.
+func (h *upstreamHealth) probe(u upstream) {
+	var req dns.Msg
+	req.SetQuestion(".", dns.TypeNS)
+	ctx, cancel := context.WithTimeout(context.Background(), h.probeTimeout)
+	defer cancel()
+	_, err := u.exchange(ctx, &req)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.state(u)
+	st.probing = false
+	if err != nil {
+		logrus.WithError(err).Debugf("DNS upstream %s is still unhealthy", u)
+		st.unhealthyUntil = time.Now().Add(h.cooldown)
+		return
+	}
+	logrus.Infof("DNS upstream %s is healthy again", u)
+	*st = upstreamState{}
+}
@@ -0,0 +1,106 @@
+package hostagent
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	a := &funcUpstream{name: "a", fail: 1}
+	b := &funcUpstream{name: "b"}
+	groups := [][]upstream{{a}, {b}}
+	h := newUpstreamHealth(2, 10*time.Millisecond, time.Second)
+
+	h.observe(a, errors.New("fake failure"))
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, time.Now())), upstreamNames(groups))
+	h.observe(a, errors.New("fake failure"))
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, time.Now())), [][]string{{"b"}})
+
+	// All the upstreams are used when all of them are unhealthy
+	h.observe(b, errors.New("fake failure"))
+	h.observe(b, errors.New("fake failure"))
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, time.Now())), upstreamNames(groups))
+	h.observe(b, nil)
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, time.Now())), [][]string{{"b"}})
+
+	// a is probed after the cooldown period, and used again once a probe succeeds
+	atomic.StoreInt32(&a.fail, 0)
+	time.Sleep(20 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.filter(groups, time.Now())) != 2 {
+		assert.Assert(t, time.Now().Before(deadline), "a did not recover")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUpstreamHealthProbe(t *testing.T) {
+	a := &funcUpstream{name: "a", fail: 1}
+	b := &funcUpstream{name: "b"}
+	groups := [][]upstream{{a, b}}
+	const cooldown = 50 * time.Millisecond
+	h := newUpstreamHealth(1, cooldown, time.Second)
+	waitProbed := func(n int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			h.mu.Lock()
+			probing := h.state(a).probing
+			h.mu.Unlock()
+			if atomic.LoadInt32(&a.exchanges) == n && !probing {
+				return
+			}
+			assert.Assert(t, time.Now().Before(deadline), "a was not probed")
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	h.observe(a, errors.New("fake failure"))
+	now := time.Now()
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, now)), [][]string{{"b"}})
+	assert.Equal(t, atomic.LoadInt32(&a.exchanges), int32(0), "a must not be probed during the cooldown period")
+
+	// A failed probe extends the cooldown period, and a single probe is in flight at a time
+	after := now.Add(cooldown)
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, after)), [][]string{{"b"}})
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, after)), [][]string{{"b"}})
+	waitProbed(1)
+	h.mu.Lock()
+	until := h.state(a).unhealthyUntil
+	h.mu.Unlock()
+	assert.Assert(t, until.After(after))
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, after)), [][]string{{"b"}})
+	assert.Equal(t, atomic.LoadInt32(&a.exchanges), int32(1))
+
+	// A successful probe recovers a, and resets its failures
+	atomic.StoreInt32(&a.fail, 0)
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, until)), [][]string{{"b"}})
+	waitProbed(2)
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, until)), upstreamNames(groups))
+	h.mu.Lock()
+	assert.Equal(t, h.state(a).failures, 0)
+	h.mu.Unlock()
+}
+
+func TestUpstreamHealthSingleUpstream(t *testing.T) {
+	a := &funcUpstream{name: "a", fail: 1}
+	groups := [][]upstream{{a}}
+	h := newUpstreamHealth(1, time.Minute, time.Second)
+	for i := 0; i < 3; i++ {
+		h.observe(a, errors.New("fake failure"))
+		assert.DeepEqual(t, upstreamNames(h.filter(groups, time.Now())), upstreamNames(groups))
+	}
+}
+
+func TestUpstreamHealthDisabled(t *testing.T) {
+	h := newUpstreamHealth(0, time.Second, time.Second)
+	assert.Assert(t, h == nil)
+	a := &funcUpstream{name: "a", fail: 1}
+	groups := [][]upstream{{a}}
+	for i := 0; i < 10; i++ {
+		h.observe(a, errors.New("fake failure"))
+	}
+	assert.DeepEqual(t, upstreamNames(h.filter(groups, time.Now())), upstreamNames(groups))
+}
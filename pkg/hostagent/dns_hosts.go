@@ -0,0 +1,147 @@
+package hostagent
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	qemu "github.com/lima-vm/lima/pkg/qemu/const"
+	"github.com/miekg/dns"
+)
+
+// internalHosts are the names of the internal addresses of the slirp network, which are added to the static hosts
+// unless the same names are configured explicitly.
+var internalHosts = map[string]string{
+	"host.lima.internal": qemu.SlirpGateway,
+	"dns.lima.internal":  qemu.SlirpDNS,
+}
+
+// staticHosts maps lower-cased FQDNs (optionally starting with the "*." wildcard label) to IP addresses.
+type staticHosts map[string]net.IP
+
+func newStaticHosts(hosts map[string]string) staticHosts {
+	res := make(staticHosts, len(hosts))
+	for name, addr := range hosts {
+		// The addresses have been validated by limayaml.Validate
+		res[dns.Fqdn(strings.ToLower(name))] = net.ParseIP(addr)
+	}
+	return res
+}
+
+// withInternalHosts returns hosts along with internalHosts. The entries of hosts take precedence.
+func withInternalHosts(hosts map[string]string) map[string]string {
+	res := make(map[string]string, len(internalHosts)+len(hosts))
+	for name, addr := range internalHosts {
+		res[name] = addr
+	}
+	for name, addr := range hosts {
+		res[name] = addr
+	}
+	return res
+}
+
+// reverse returns the map from the reverse names ("*.in-addr.arpa." and "*.ip6.arpa.") of the addresses
+// to the sorted names of the addresses, for answering PTR queries. The wildcard entries are not included.
+func (s staticHosts) reverse() map[string][]string {
+	res := make(map[string][]string)
+	for name, ip := range s {
+		if strings.HasPrefix(name, "*.") {
+			continue
+		}
+		arpa, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		res[arpa] = append(res[arpa], name)
+	}
+	for _, names := range res {
+		sort.Strings(names)
+	}
+	return res
+}
+
+// ptrAnswers returns the PTR records of names for q.
+func ptrAnswers(q dns.Question, names []string) []dns.RR {
+	var res []dns.RR
+	for _, name := range names {
+		res = append(res, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET},
+			Ptr: name,
+		})
+	}
+	return res
+}
+
+// lookup returns the address of name. An exact match takes precedence over
+// the wildcard entries, and more specific wildcards take precedence over less specific ones.
+func (s staticHosts) lookup(name string) (net.IP, bool) {
+	for _, pattern := range namePatterns(name) {
+		if ip, ok := s[pattern]; ok {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+// namePatterns returns the patterns that match name, from the most specific to the least specific:
+// the lower-cased FQDN itself, followed by the "*." wildcards of its parent domains.
+func namePatterns(name string) []string {
+	name = dns.Fqdn(strings.ToLower(name))
+	patterns := []string{name}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		patterns = append(patterns, "*."+dns.Fqdn(strings.Join(labels[i:], ".")))
+	}
+	return patterns
+}
+
+// recordKey is the key of staticRecords.
+type recordKey struct {
+	name  string // lower-cased FQDN
+	rtype uint16
+}
+
+// staticRecords are the records of hostResolver.records, keyed by their names and types.
+type staticRecords map[recordKey][]dns.RR
+
+func newStaticRecords(rrs []dns.RR) staticRecords {
+	res := make(staticRecords, len(rrs))
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		k := recordKey{name: dns.Fqdn(strings.ToLower(hdr.Name)), rtype: hdr.Rrtype}
+		res[k] = append(res[k], rr)
+	}
+	return res
+}
+
+// answer returns the records for q, with the name spelled as in q.
+func (s staticRecords) answer(q dns.Question) []dns.RR {
+	rrs := s[recordKey{name: dns.Fqdn(strings.ToLower(q.Name)), rtype: q.Qtype}]
+	res := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		res = append(res, rr)
+	}
+	return res
+}
+
+// answer returns the A or AAAA record of ip for q, or nil when ip is not of the type asked for.
+func (s staticHosts) answer(q dns.Question, ip net.IP) dns.RR {
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+	}
+	switch q.Qtype {
+	case dns.TypeA:
+		if ip4 := ip.To4(); ip4 != nil {
+			return &dns.A{Hdr: hdr, A: ip4}
+		}
+	case dns.TypeAAAA:
+		if ip.To4() == nil {
+			return &dns.AAAA{Hdr: hdr, AAAA: ip}
+		}
+	}
+	return nil
+}
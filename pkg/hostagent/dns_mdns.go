@@ -0,0 +1,94 @@
+package hostagent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// mdnsUpstream is an mDNS responder queried with legacy unicast queries (RFC 6762 section 6.7):
+// the query is sent from an ephemeral port, so that the responders reply to it with unicast.
+// Unlike dnsUpstream, the socket is not connected, as the replies to a multicast query come from the
+// addresses of the responders rather than from the multicast address.
+type mdnsUpstream struct {
+	addr    *net.UDPAddr
+	timeout time.Duration
+}
+
+func (u *mdnsUpstream) String() string {
+	return fmt.Sprintf("%s (mdns)", u.addr)
+}
+
+func (u *mdnsUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	network := "udp4"
+	if u.addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	pc, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	deadline := time.Now().Add(u.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := pc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	query := req.Copy()
+	query.Id = dns.Id()
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pc.WriteTo(b, u.addr); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		var reply dns.Msg
+		// Every host on the link may see the query, so the unrelated and the malformed messages are skipped
+		if err := reply.Unpack(buf[:n]); err != nil || !reply.Response || reply.Id != query.Id {
+			continue
+		}
+		reply.Id = req.Id
+		return &reply, nil
+	}
+}
+
+// mdnsReply returns the reply to req when it asks for a name of .local and hostResolver.mdns.mode is not "host",
+// along with its source, or nil.
+func (h *Handler) mdnsReply(req *dns.Msg) (*dns.Msg, string) {
+	if h.mdnsMode == "" || h.mdnsMode == limayaml.MDNSModeHost ||
+		len(req.Question) != 1 || topLevelDomain(req.Question[0].Name) != localTLD {
+		return nil, ""
+	}
+	var reply dns.Msg
+	switch h.mdnsMode {
+	case limayaml.MDNSModeRefuse:
+		reply.SetRcode(req, dns.RcodeRefused)
+	case limayaml.MDNSModeNotImp:
+		reply.SetRcode(req, dns.RcodeNotImplemented)
+	case limayaml.MDNSModeForward:
+		ctx, cancel := context.WithTimeout(context.Background(), queryBudget)
+		defer cancel()
+		forwarded, err := h.mdns.exchange(ctx, req)
+		if err == nil {
+			return forwarded, h.mdns.String()
+		}
+		// The responders do not reply for the names they do not have
+		logrus.WithError(err).Debugf("no mDNS responder replied for %q", req.Question[0].Name)
+		reply.SetRcode(req, dns.RcodeNameError)
+	}
+	return &reply, sourceMDNS
+}
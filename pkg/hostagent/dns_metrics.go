@@ -0,0 +1,129 @@
+package hostagent
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// latencyBuckets are the upper bounds of the buckets of the response latency histogram.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// dnsMetrics holds the metrics of the DNS server, in the format of the expvar package.
+// The metrics are not published in the global expvar registry, but served by newMetricsServer.
+//
+// A nil *dnsMetrics is valid and records nothing, so that metrics cost nothing when they are disabled.
+type dnsMetrics struct {
+	vars *expvar.Map
+
+	queries        *expvar.Map // by query type
+	rcodes         *expvar.Map // by response code
+	cacheHits      *expvar.Int
+	cacheMisses    *expvar.Int
+	upstreamErrors *expvar.Map // by upstream
+	// latency is a histogram of the response latency, keyed by the upper bound of the bucket in seconds.
+	// The buckets are not cumulative.
+	latency      *expvar.Map
+	latencySum   *expvar.Float // seconds
+	latencyCount *expvar.Int
+}
+
+func newDNSMetrics() *dnsMetrics {
+	m := &dnsMetrics{
+		vars:           new(expvar.Map).Init(),
+		queries:        new(expvar.Map).Init(),
+		rcodes:         new(expvar.Map).Init(),
+		cacheHits:      new(expvar.Int),
+		cacheMisses:    new(expvar.Int),
+		upstreamErrors: new(expvar.Map).Init(),
+		latency:        new(expvar.Map).Init(),
+		latencySum:     new(expvar.Float),
+		latencyCount:   new(expvar.Int),
+	}
+	m.vars.Set("queries_total", m.queries)
+	m.vars.Set("responses_total", m.rcodes)
+	m.vars.Set("cache_hits_total", m.cacheHits)
+	m.vars.Set("cache_misses_total", m.cacheMisses)
+	m.vars.Set("upstream_errors_total", m.upstreamErrors)
+	m.vars.Set("response_latency_seconds_bucket", m.latency)
+	m.vars.Set("response_latency_seconds_sum", m.latencySum)
+	m.vars.Set("response_latency_seconds_count", m.latencyCount)
+	return m
+}
+
+func (m *dnsMetrics) observeQuery(req, reply *dns.Msg, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	for _, q := range req.Question {
+		m.queries.Add(dns.TypeToString[q.Qtype], 1)
+	}
+	m.rcodes.Add(dns.RcodeToString[reply.Rcode], 1)
+	bucket := "+Inf"
+	for _, le := range latencyBuckets {
+		if latency <= le {
+			bucket = strconv.FormatFloat(le.Seconds(), 'f', -1, 64)
+			break
+		}
+	}
+	m.latency.Add(bucket, 1)
+	m.latencySum.Add(latency.Seconds())
+	m.latencyCount.Add(1)
+}
+
+func (m *dnsMetrics) observeCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheHits.Add(1)
+	} else {
+		m.cacheMisses.Add(1)
+	}
+}
+
+func (m *dnsMetrics) observeUpstreamError(u upstream) {
+	if m == nil {
+		return
+	}
+	m.upstreamErrors.Add(u.String(), 1)
+}
+
+// newMetricsServer returns the HTTP server for serving the metrics as JSON on 127.0.0.1:port, at /debug/vars.
+// POST /debug/flush flushes the cache of h, or only the responses for the name of the "name" query parameter,
+// and returns the number of the removed responses as JSON.
+func newMetricsServer(h *Handler, port int) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintln(w, h.metrics.vars.String())
+	})
+	mux.HandleFunc("/debug/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n := h.FlushCache(r.URL.Query().Get("name"))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\"evicted\": %d}\n", n)
+	})
+	return &http.Server{
+		Addr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		Handler: mux,
+	}
+}
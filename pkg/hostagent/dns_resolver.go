@@ -0,0 +1,100 @@
+package hostagent
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// systemResolver discovers the nameservers of the host.
+// The implementation is OS-specific, see newSystemResolver.
+type systemResolver interface {
+	clientConfig() (*dns.ClientConfig, error)
+}
+
+// domainResolver is a systemResolver that also knows the nameservers of some domains, e.g., of a VPN on macOS.
+type domainResolver interface {
+	systemResolver
+	domainClientConfigs() (map[forwardKey]*dns.ClientConfig, error)
+}
+
+// withSystemDomains returns the client configs of configured, along with the ones of system
+// for the domains (and query types) that are not in configured.
+func withSystemDomains(configured, system map[forwardKey]*dns.ClientConfig) map[forwardKey]*dns.ClientConfig {
+	res := make(map[forwardKey]*dns.ClientConfig, len(configured)+len(system))
+	for k, cc := range system {
+		res[k] = cc
+	}
+	for k, cc := range configured {
+		res[k] = cc
+	}
+	return res
+}
+
+// resolvConf is the path of a resolv.conf(5) file.
+type resolvConf string
+
+func (path resolvConf) clientConfig() (*dns.ClientConfig, error) {
+	cc, err := dns.ClientConfigFromFile(string(path))
+	if err != nil {
+		return nil, err
+	}
+	if len(cc.Servers) == 0 {
+		return nil, fmt.Errorf("no nameserver found in %q", string(path))
+	}
+	return cc, nil
+}
+
+// checkRoute returns an error when there is no route from the host to the nameserver ip.
+// "Connecting" a UDP socket does not send any packet, so this is cheap enough to be done for every nameserver
+// at startup, but it catches, e.g., the IPv6 nameservers of an IPv4-only network.
+func checkRoute(ip string) error {
+	conn, err := net.Dial("udp", net.JoinHostPort(ip, "53"))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// prioritizeReachable moves the nameservers of cc that fail checkRoute after the reachable ones,
+// so that they are only tried when all the reachable ones have failed.
+// The unreachable nameservers are kept rather than removed, as the network of the host may change later.
+func prioritizeReachable(cc *dns.ClientConfig, checkRoute func(ip string) error) {
+	var reachable, unreachable []string
+	for _, srv := range cc.Servers {
+		if err := checkRoute(srv); err != nil {
+			logrus.WithError(err).Warnf("DNS nameserver %s seems unreachable, trying it last", srv)
+			unreachable = append(unreachable, srv)
+			continue
+		}
+		reachable = append(reachable, srv)
+	}
+	cc.Servers = append(reachable, unreachable...)
+}
+
+// orderServers moves the nameservers of cc that are in order to the front, in the order of order.
+// The nameservers in order that are not in cc are ignored with a warning.
+func orderServers(cc *dns.ClientConfig, order []net.IP) {
+	if len(order) == 0 {
+		return
+	}
+	rest := append([]string(nil), cc.Servers...)
+	var ordered []string
+	for _, ip := range order {
+		found := false
+		for i, srv := range rest {
+			if ip.Equal(net.ParseIP(srv)) {
+				ordered = append(ordered, srv)
+				rest = append(rest[:i], rest[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			logrus.Warnf("DNS nameserver %s of hostResolver.order is not among the nameservers %v, ignoring it", ip, cc.Servers)
+		}
+	}
+	cc.Servers = append(ordered, rest...)
+}
@@ -0,0 +1,48 @@
+package hostagent
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// scutilDNS is the resolver configuration of macOS, as shown by `scutil --dns`.
+// Unlike /etc/resolv.conf, which only has the primary resolver, it also has the resolvers of the other interfaces,
+// and the resolvers of the domains of a VPN.
+type scutilDNS struct{}
+
+func newSystemResolver() systemResolver {
+	return scutilDNS{}
+}
+
+func (scutilDNS) resolvers() ([]scutilResolver, error) {
+	out, err := exec.Command("scutil", "--dns").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run `scutil --dns`: %w", err)
+	}
+	return parseScutilDNS(bytes.NewReader(out))
+}
+
+func (s scutilDNS) clientConfig() (*dns.ClientConfig, error) {
+	resolvers, err := s.resolvers()
+	if err == nil {
+		var cc *dns.ClientConfig
+		if cc, err = scutilClientConfig(resolvers); err == nil {
+			return cc, nil
+		}
+	}
+	// /etc/resolv.conf is generated by configd from the primary resolver
+	logrus.WithError(err).Debug("falling back to /etc/resolv.conf")
+	return resolvConf("/etc/resolv.conf").clientConfig()
+}
+
+func (s scutilDNS) domainClientConfigs() (map[forwardKey]*dns.ClientConfig, error) {
+	resolvers, err := s.resolvers()
+	if err != nil {
+		return nil, err
+	}
+	return scutilDomainClientConfigs(resolvers), nil
+}
@@ -0,0 +1,31 @@
+package hostagent
+
+import (
+	"github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+)
+
+// resolvConfs is the list of the resolv.conf files of the host, in order of preference.
+type resolvConfs []resolvConf
+
+func newSystemResolver() systemResolver {
+	return resolvConfs{
+		// When systemd-resolved is used, this usually lists its stub resolver (127.0.0.53),
+		// which is kept, as it implements the per-link DNS settings of the host.
+		"/etc/resolv.conf",
+		// The nameservers known to systemd-resolved, for when /etc/resolv.conf is missing or empty.
+		"/run/systemd/resolve/resolv.conf",
+	}
+}
+
+func (files resolvConfs) clientConfig() (*dns.ClientConfig, error) {
+	var mErr error
+	for _, f := range files {
+		cc, err := f.clientConfig()
+		if err == nil {
+			return cc, nil
+		}
+		mErr = multierror.Append(mErr, err)
+	}
+	return nil, mErr
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package hostagent
+
+func newSystemResolver() systemResolver {
+	return resolvConf("/etc/resolv.conf")
+}
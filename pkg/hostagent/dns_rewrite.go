@@ -0,0 +1,87 @@
+package hostagent
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rewriteRules maps the lower-cased FQDNs of domains to the domains that their names (and the names of their
+// subdomains) are resolved as, e.g., "staging.example.com." -> "prod.example.com." resolves
+// "db.staging.example.com." as "db.prod.example.com.".
+type rewriteRules map[string]string
+
+func newRewriteRules(rules map[string]string) rewriteRules {
+	res := make(rewriteRules, len(rules))
+	for from, to := range rules {
+		res[dns.Fqdn(strings.ToLower(from))] = dns.Fqdn(strings.ToLower(to))
+	}
+	return res
+}
+
+// lookup returns the longest domain of the rules that name belongs to, and the domain it is rewritten to.
+func (r rewriteRules) lookup(name string) (string, string, bool) {
+	if len(r) == 0 {
+		return "", "", false
+	}
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := range labels {
+		from := dns.Fqdn(strings.Join(labels[i:], "."))
+		if to, ok := r[from]; ok {
+			return from, to, true
+		}
+	}
+	return "", "", false
+}
+
+// replaceDomain replaces the domain from (a lower-cased FQDN) at the end of name with to,
+// keeping the case of the other labels of name. It returns false when name does not belong to from.
+func replaceDomain(name, from, to string) (string, bool) {
+	lname := strings.ToLower(dns.Fqdn(name))
+	if lname != from && !strings.HasSuffix(lname, "."+from) {
+		return name, false
+	}
+	return dns.Fqdn(name)[:len(lname)-len(from)] + to, true
+}
+
+// rewrittenQuery returns a copy of req asking for the name of the question rewritten by the rules,
+// along with the domains of the rule, or nil when no rule applies.
+// Only queries with exactly one question are rewritten, as for the cache.
+func (r rewriteRules) rewrittenQuery(req *dns.Msg) (*dns.Msg, string, string) {
+	if len(req.Question) != 1 {
+		return nil, "", ""
+	}
+	from, to, ok := r.lookup(req.Question[0].Name)
+	if !ok {
+		return nil, "", ""
+	}
+	rewritten := req.Copy()
+	rewritten.Question[0].Name, _ = replaceDomain(req.Question[0].Name, from, to)
+	return rewritten, from, to
+}
+
+// restoreReply rewrites the reply to the rewritten query back to the names of req: the question,
+// and the owner names and the CNAME targets that belong to the domain to, so that the client
+// gets the answer for the name it asked for.
+func restoreReply(req, reply *dns.Msg, from, to string) {
+	asked := req.Question[0].Name
+	rewritten, _ := replaceDomain(asked, from, to)
+	reply.Question = req.Question
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == dns.TypeOPT:
+				continue
+			case strings.EqualFold(hdr.Name, rewritten):
+				// Keep the case of the name asked for
+				hdr.Name = asked
+			default:
+				hdr.Name, _ = replaceDomain(hdr.Name, to, from)
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				cname.Target, _ = replaceDomain(cname.Target, to, from)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package hostagent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// scutilResolver is a resolver of the output of `scutil --dns` on macOS.
+type scutilResolver struct {
+	domain      string // "" for the resolvers of all the domains
+	nameservers []string
+	search      []string
+	port        string // "" for 53
+	// scoped is true for the resolvers of the "for scoped queries" section, i.e., the resolvers of an interface
+	scoped bool
+}
+
+// parseScutilDNS parses the resolvers of the output of `scutil --dns`, e.g.:
+//
+//	DNS configuration
+//
+//	resolver #1
+//	  search domain[0] : example.com
+//	  nameserver[0] : 192.168.1.1
+//	  if_index : 14 (en0)
+//	  flags    : Request A records
+//
+//	resolver #2
+//	  domain   : corp.example.com
+//	  nameserver[0] : 10.0.0.53
+//
+//	DNS configuration (for scoped queries)
+//
+//	resolver #1
+//	  nameserver[0] : 192.168.1.1
+//	  if_index : 14 (en0)
+//	  flags    : Scoped, Request A records
+func parseScutilDNS(r io.Reader) ([]scutilResolver, error) {
+	var (
+		res    []scutilResolver
+		cur    *scutilResolver
+		scoped bool
+	)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "DNS configuration"):
+			scoped = strings.Contains(line, "scoped")
+			cur = nil
+			continue
+		case strings.HasPrefix(line, "resolver #"):
+			res = append(res, scutilResolver{scoped: scoped})
+			cur = &res[len(res)-1]
+			continue
+		}
+		i := strings.Index(line, ":")
+		if cur == nil || i < 0 {
+			continue
+		}
+		// IPv6 nameservers contain colons too, so only the first colon separates the key from the value
+		k, v := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.HasPrefix(k, "nameserver["):
+			cur.nameservers = append(cur.nameservers, v)
+		case strings.HasPrefix(k, "search domain["):
+			cur.search = append(cur.search, v)
+		case k == "domain":
+			cur.domain = v
+		case k == "port":
+			cur.port = v
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// scutilClientConfig returns the client config of the nameservers of the resolvers of all the domains,
+// followed by the nameservers of the resolvers of the interfaces.
+// The search domains are the ones of the first resolver.
+func scutilClientConfig(resolvers []scutilResolver) (*dns.ClientConfig, error) {
+	cc := &dns.ClientConfig{Port: "53", Ndots: 1, Timeout: 5, Attempts: 2}
+	seen := make(map[string]bool)
+	for _, scoped := range []bool{false, true} {
+		for _, r := range resolvers {
+			// The resolvers of the other ports cannot share the client config
+			if r.scoped != scoped || r.domain != "" || (r.port != "" && r.port != cc.Port) {
+				continue
+			}
+			if cc.Search == nil {
+				cc.Search = r.search
+			}
+			for _, ns := range r.nameservers {
+				if !seen[ns] {
+					seen[ns] = true
+					cc.Servers = append(cc.Servers, ns)
+				}
+			}
+		}
+	}
+	if len(cc.Servers) == 0 {
+		return nil, fmt.Errorf("no nameserver found in the output of `scutil --dns`")
+	}
+	return cc, nil
+}
+
+// scutilDomainClientConfigs returns the client configs of the domains with their own resolvers,
+// e.g., the split DNS of a VPN. The resolvers without nameservers, e.g., of the mDNS domains, are skipped,
+// as well as the resolvers of the interfaces, which duplicate the others.
+func scutilDomainClientConfigs(resolvers []scutilResolver) map[forwardKey]*dns.ClientConfig {
+	res := make(map[forwardKey]*dns.ClientConfig)
+	for _, r := range resolvers {
+		if r.scoped || r.domain == "" || len(r.nameservers) == 0 {
+			continue
+		}
+		k := forwardKey{domain: dns.Fqdn(strings.ToLower(r.domain))}
+		if k.domain == localTLD+"." {
+			continue
+		}
+		if cc, ok := res[k]; ok {
+			cc.Servers = append(cc.Servers, r.nameservers...)
+			continue
+		}
+		port := r.port
+		if port == "" {
+			port = "53"
+		}
+		res[k] = &dns.ClientConfig{Servers: r.nameservers, Port: port, Ndots: 1, Timeout: 5, Attempts: 2}
+	}
+	return res
+}
@@ -0,0 +1,1785 @@
+package hostagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/lima-vm/lima/pkg/store/filenames"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"gotest.tools/v3/assert"
+)
+
+// startTestDNSServer starts a DNS server on addr that answers every A query with ip,
+// and returns the port it is listening on.
+func startTestDNSServer(t *testing.T, addr string, ip net.IP) string {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			var reply dns.Msg
+			reply.SetReply(req)
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   ip,
+			})
+			_ = w.WriteMsg(&reply)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	<-started
+	_, port, err := net.SplitHostPort(pc.LocalAddr().String())
+	assert.NilError(t, err)
+	return port
+}
+
+// startTestDNSHandler starts DNS servers with handler on both UDP and TCP, on the same ephemeral port of 127.0.0.1,
+// and returns the "host:port" address they are listening on.
+func startTestDNSHandler(t *testing.T, handler dns.HandlerFunc) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Skipf("cannot listen on %s over udp: %v", l.Addr(), err)
+	}
+	for _, server := range []*dns.Server{
+		{Net: "tcp", Listener: l, Handler: handler},
+		{Net: "udp", PacketConn: pc, Handler: handler},
+	} {
+		server := server
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func() {
+			_ = server.ActivateAndServe()
+		}()
+		t.Cleanup(func() {
+			_ = server.Shutdown()
+		})
+		<-started
+	}
+	return l.Addr().String()
+}
+
+func TestDNSUpstreamRetries(t *testing.T) {
+	var queries, drop int32
+	addr := startTestDNSHandler(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		// The first queries are dropped, as if they were lost
+		if atomic.AddInt32(&queries, 1) <= atomic.LoadInt32(&drop) {
+			return
+		}
+		var reply dns.Msg
+		reply.SetReply(req)
+		_ = w.WriteMsg(&reply)
+	})
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	atomic.StoreInt32(&drop, 1)
+	u := &dnsUpstream{client: &dns.Client{Timeout: 100 * time.Millisecond}, addr: addr, retries: 1}
+	_, err := u.exchange(context.Background(), &req)
+	assert.NilError(t, err)
+	assert.Equal(t, atomic.LoadInt32(&queries), int32(2))
+
+	atomic.StoreInt32(&queries, 0)
+	u.retries = 0
+	_, err = u.exchange(context.Background(), &req)
+	var netErr net.Error
+	assert.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), err)
+	assert.Equal(t, atomic.LoadInt32(&queries), int32(1))
+
+	// The retries do not outlive the deadline of the query, even with a longer timeout
+	atomic.StoreInt32(&queries, 0)
+	atomic.StoreInt32(&drop, 100)
+	u = &dnsUpstream{client: &dns.Client{Timeout: 5 * time.Second}, addr: addr, retries: 10}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = u.exchange(ctx, &req)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, time.Since(start) < 2*time.Second, time.Since(start))
+}
+
+func TestForwardParallel(t *testing.T) {
+	timingOut := startTestDNSHandler(t, func(dns.ResponseWriter, *dns.Msg) {})
+	// Nothing listens on the port of a closed socket, so the exchanges fail right away
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	failing := pc.LocalAddr().String()
+	assert.NilError(t, pc.Close())
+	var answered int32
+	answering := startTestDNSHandler(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&answered, 1)
+		var reply dns.Msg
+		reply.SetReply(req)
+		_ = w.WriteMsg(&reply)
+	})
+
+	client := &dns.Client{Timeout: 2 * time.Second}
+	timingOutUpstream := &dnsUpstream{client: client, addr: timingOut}
+	answeringUpstream := &dnsUpstream{client: client, addr: answering}
+	h := &Handler{
+		upstreams: [][]upstream{{timingOutUpstream, &dnsUpstream{client: client, addr: failing}, answeringUpstream}},
+		parallel:  true,
+	}
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	reply, source := h.handleDefault(&req)
+	// The reply does not wait for the upstream that times out, although it is preferred
+	assert.Assert(t, time.Since(start) < client.Timeout, time.Since(start))
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, source, answeringUpstream.String())
+	assert.Equal(t, atomic.LoadInt32(&answered), int32(1))
+
+	// The next group is only tried when none of the upstreams of the group replied
+	h.upstreams = [][]upstream{{&dnsUpstream{client: client, addr: failing}}, {answeringUpstream}, {timingOutUpstream}}
+	_, source = h.handleDefault(&req)
+	assert.Equal(t, source, answeringUpstream.String())
+	assert.Equal(t, atomic.LoadInt32(&answered), int32(2))
+}
+
+func TestDNSUpstreamTruncated(t *testing.T) {
+	var tcpFails int32
+	addr := startTestDNSHandler(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		var reply dns.Msg
+		reply.SetReply(req)
+		if w.RemoteAddr().Network() == "udp" {
+			reply.Truncated = true
+		} else if atomic.LoadInt32(&tcpFails) != 0 {
+			return
+		} else {
+			for i := 0; i < 50; i++ {
+				reply.Answer = append(reply.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(192, 0, 2, byte(i)),
+				})
+			}
+		}
+		_ = w.WriteMsg(&reply)
+	})
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// The truncated reply over UDP is retried over TCP, to the same server
+	u := &dnsUpstream{client: &dns.Client{Timeout: 200 * time.Millisecond}, addr: addr}
+	reply, err := u.exchange(context.Background(), &req)
+	assert.NilError(t, err)
+	assert.Assert(t, !reply.Truncated)
+	assert.Equal(t, len(reply.Answer), 50)
+
+	// The truncated reply is returned when TCP fails, so that the guest can retry on its own
+	atomic.StoreInt32(&tcpFails, 1)
+	reply, err = u.exchange(context.Background(), &req)
+	assert.NilError(t, err)
+	assert.Assert(t, reply.Truncated)
+	assert.Equal(t, len(reply.Answer), 0)
+}
+
+func TestDoHUpstream(t *testing.T) {
+	var status int32 = http.StatusOK
+	contentType := dohMediaType
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req dns.Msg
+		if err := req.Unpack(body); err != nil || req.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		var reply dns.Msg
+		reply.SetReply(&req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		packed, err := reply.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		_, _ = w.Write(packed)
+	}))
+	t.Cleanup(srv.Close)
+
+	u := &dohUpstream{client: srv.Client(), url: srv.URL}
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+	reply, err := u.exchange(context.Background(), &req)
+	assert.NilError(t, err)
+	// The ID of the query is restored, although it is sent as 0
+	assert.Equal(t, reply.Id, req.Id)
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	_, err = u.exchange(context.Background(), &req)
+	assert.ErrorContains(t, err, "expected HTTP status 200")
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	contentType = "text/plain"
+	_, err = u.exchange(context.Background(), &req)
+	assert.ErrorContains(t, err, `expected content type "application/dns-message"`)
+}
+
+func TestForwardToIPv6Upstream(t *testing.T) {
+	port := startTestDNSServer(t, "[::1]:0", net.ParseIP("192.0.2.1"))
+
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("::1")})
+	assert.NilError(t, err)
+	cc.Port = port
+	h := &Handler{
+		upstreams: newDNSUpstreams(cc, handlerOptions{timeout: time.Second}),
+	}
+	assert.Equal(t, h.upstreams[0][0].String(), "[::1]:"+port+" (udp)")
+
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+	reply, source := h.handleDefault(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, source, h.upstreams[0][0].String())
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+}
+
+func TestFitReply(t *testing.T) {
+	newReply := func(req *dns.Msg, answers int) *dns.Msg {
+		var reply dns.Msg
+		reply.SetReply(req)
+		for i := 0; i < answers; i++ {
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(i)),
+			})
+		}
+		return &reply
+	}
+
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+	reply := newReply(&req, 100)
+	fitReply(&req, reply, true, 0)
+	assert.Assert(t, reply.Truncated)
+	assert.Assert(t, reply.Len() <= dns.MinMsgSize)
+
+	var ednsReq dns.Msg
+	ednsReq.SetQuestion("example.com.", dns.TypeA)
+	ednsReq.SetEdns0(4096, true)
+	reply = newReply(&ednsReq, 100)
+	fitReply(&ednsReq, reply, true, 0)
+	assert.Assert(t, !reply.Truncated)
+	assert.Equal(t, len(reply.Answer), 100)
+	opt := reply.IsEdns0()
+	assert.Assert(t, opt != nil)
+	assert.Equal(t, opt.UDPSize(), uint16(ednsUDPSize))
+	assert.Assert(t, opt.Do())
+
+	// The OPT record of a cached reply must not be sent to a client that does not support EDNS0
+	fitReply(&req, reply, false, 0)
+	assert.Assert(t, reply.IsEdns0() == nil)
+
+	// maxUDPSize takes precedence over the larger size advertised by the client, but not over TCP
+	reply = newReply(&ednsReq, 100)
+	fitReply(&ednsReq, reply, false, ednsUDPSize)
+	assert.Assert(t, !reply.Truncated)
+	fitReply(&ednsReq, reply, true, ednsUDPSize)
+	assert.Assert(t, reply.Truncated)
+	assert.Assert(t, len(reply.Answer) < 100)
+	assert.Assert(t, reply.Len() <= ednsUDPSize)
+
+	// The smaller size advertised by the client takes precedence over maxUDPSize
+	reply = newReply(&req, 100)
+	fitReply(&req, reply, true, 4096)
+	assert.Assert(t, reply.Truncated)
+	assert.Assert(t, reply.Len() <= dns.MinMsgSize)
+}
+
+func TestBlockList(t *testing.T) {
+	b := newBlockList([]string{"telemetry.example.com", "*.ads.example.com"})
+	assert.Assert(t, b.contains("Telemetry.Example.com."))
+	assert.Assert(t, !b.contains("sub.telemetry.example.com."))
+	assert.Assert(t, b.contains("x.y.ads.example.com."))
+	assert.Assert(t, !b.contains("ads.example.com."))
+	assert.Assert(t, !b.contains("example.com."))
+
+	var req dns.Msg
+	req.SetQuestion("x.ads.example.com.", dns.TypeAAAA)
+	reply := b.blockedReply(&req, false)
+	assert.Equal(t, reply.Rcode, dns.RcodeNameError)
+
+	reply = b.blockedReply(&req, true)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, reply.Answer[0].(*dns.AAAA).AAAA.String(), "::")
+
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.Assert(t, b.blockedReply(&req, false) == nil)
+}
+
+func TestDNSServerShutdownContext(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan struct{})
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		close(handled)
+		<-release
+		var reply dns.Msg
+		reply.SetReply(req)
+		_ = w.WriteMsg(&reply)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	udpStarted, tcpStarted := make(chan struct{}), make(chan struct{})
+	s := &DNSServer{
+		udp: &dns.Server{Net: "udp", PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(udpStarted) }},
+		tcp: &dns.Server{Net: "tcp", Listener: l, Handler: handler, NotifyStartedFunc: func() { close(tcpStarted) }},
+	}
+	go func() { _ = s.udp.ActivateAndServe() }()
+	go func() { _ = s.tcp.ActivateAndServe() }()
+	<-udpStarted
+	<-tcpStarted
+
+	// Keep a UDP query in flight
+	go func() {
+		var req dns.Msg
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, _ = dns.Exchange(&req, pc.LocalAddr().String())
+	}()
+	<-handled
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.ShutdownContext(ctx)
+	assert.ErrorContains(t, err, "failed to shut down the DNS server (udp)")
+	assert.Assert(t, !strings.Contains(err.Error(), "(tcp)"), err)
+	close(release)
+}
+
+func TestDNSServerShutdownSkipsFailedListeners(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	udpStarted := make(chan struct{})
+	s := &DNSServer{
+		udp:   &dns.Server{Net: "udp", PacketConn: pc, Handler: &Handler{}, NotifyStartedFunc: func() { close(udpStarted) }},
+		tcp:   &dns.Server{Net: "tcp", Handler: &Handler{}}, // fails to start without a listener
+		errCh: make(chan error, 2),
+	}
+	go func() { _ = s.udp.ActivateAndServe() }()
+	go func() {
+		if err := s.tcp.ActivateAndServe(); err != nil {
+			s.fail(s.tcp.Net, err)
+		}
+	}()
+	<-udpStarted
+	err = <-s.Errors()
+	var listenerErr *DNSListenerError
+	assert.Assert(t, errors.As(err, &listenerErr), err)
+	assert.Equal(t, listenerErr.Net, "tcp")
+
+	// The UDP listener is still running, and stops without an error for the failed TCP listener
+	assert.NilError(t, s.Shutdown())
+}
+
+func TestStartDNSEphemeralPorts(t *testing.T) {
+	var y limayaml.LimaYAML
+	limayaml.FillDefault(&y, "")
+	y.HostResolver.Hosts = map[string]string{"host.example.com": "192.0.2.1"}
+	a := &HostAgent{y: &y}
+	s, err := a.StartDNS()
+	assert.NilError(t, err)
+	defer func() { assert.NilError(t, s.Shutdown()) }()
+	assert.Assert(t, s.UDPPort != 0)
+	assert.Assert(t, s.TCPPort != 0)
+
+	for _, tc := range []struct {
+		net  string
+		port int
+	}{{"udp", s.UDPPort}, {"tcp", s.TCPPort}} {
+		var req dns.Msg
+		req.SetQuestion("host.example.com.", dns.TypeA)
+		c := &dns.Client{Net: tc.net, Timeout: 5 * time.Second}
+		reply, _, err := c.Exchange(&req, net.JoinHostPort("127.0.0.1", strconv.Itoa(tc.port)))
+		assert.NilError(t, err, tc.net)
+		assert.Equal(t, len(reply.Answer), 1, tc.net)
+		assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1", tc.net)
+	}
+}
+
+func TestStartDNSMaxUDPSize(t *testing.T) {
+	var y limayaml.LimaYAML
+	limayaml.FillDefault(&y, "")
+	for i := 0; i < 10; i++ {
+		y.HostResolver.Records = append(y.HostResolver.Records,
+			fmt.Sprintf(`big.internal. TXT "%d%s"`, i, strings.Repeat("x", 200)))
+	}
+	y.HostResolver.MaxUDPSize = 1024
+	a := &HostAgent{y: &y}
+	s, err := a.StartDNS()
+	assert.NilError(t, err)
+	defer func() { assert.NilError(t, s.Shutdown()) }()
+
+	var req dns.Msg
+	req.SetQuestion("big.internal.", dns.TypeTXT)
+	req.SetEdns0(4096, false)
+	c := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	reply, _, err := c.Exchange(&req, net.JoinHostPort("127.0.0.1", strconv.Itoa(s.UDPPort)))
+	assert.NilError(t, err)
+	assert.Assert(t, reply.Truncated)
+	assert.Assert(t, reply.Len() <= 1024)
+
+	c = &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	reply, _, err = c.Exchange(&req, net.JoinHostPort("127.0.0.1", strconv.Itoa(s.TCPPort)))
+	assert.NilError(t, err)
+	assert.Assert(t, !reply.Truncated)
+	assert.Equal(t, len(reply.Answer), 10)
+}
+
+func TestServeDNSRejectsMalformedQueries(t *testing.T) {
+	var y limayaml.LimaYAML
+	limayaml.FillDefault(&y, "")
+	a := &HostAgent{y: &y}
+	s, err := a.StartDNS()
+	assert.NilError(t, err)
+	defer func() { assert.NilError(t, s.Shutdown()) }()
+
+	noQuestion := new(dns.Msg)
+	noQuestion.Id = dns.Id()
+	noQuestion.RecursionDesired = true
+
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+
+	withOpcode := func(opcode int) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("host.lima.internal.", dns.TypeA)
+		req.Opcode = opcode
+		return req
+	}
+
+	for _, tc := range []struct {
+		name  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"no question", noQuestion, dns.RcodeFormatError},
+		{"update", update, dns.RcodeNotImplemented},
+		{"query", withOpcode(dns.OpcodeQuery), dns.RcodeSuccess},
+		{"iquery", withOpcode(dns.OpcodeIQuery), dns.RcodeNotImplemented},
+		{"status", withOpcode(dns.OpcodeStatus), dns.RcodeNotImplemented},
+		{"notify", withOpcode(dns.OpcodeNotify), dns.RcodeNotImplemented},
+		{"update with a question", withOpcode(dns.OpcodeUpdate), dns.RcodeNotImplemented},
+	} {
+		c := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+		reply, _, err := c.Exchange(tc.req, net.JoinHostPort("127.0.0.1", strconv.Itoa(s.UDPPort)))
+		assert.NilError(t, err, tc.name)
+		assert.Equal(t, reply.Rcode, tc.rcode, tc.name)
+		assert.Equal(t, reply.Id, tc.req.Id, tc.name)
+	}
+}
+
+func TestRespondDoesNotForwardOtherOpcodes(t *testing.T) {
+	port := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.1"))
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	cc.Port = port
+	h := &Handler{
+		upstreams: newDNSUpstreams(cc, handlerOptions{timeout: time.Second}),
+		hosts:     newStaticHosts(nil),
+		domains:   domainUpstreams{forwardKey{domain: "example.com."}: newDNSUpstreams(cc, handlerOptions{timeout: time.Second})},
+	}
+	for _, opcode := range []int{dns.OpcodeIQuery, dns.OpcodeStatus, dns.OpcodeNotify, dns.OpcodeUpdate} {
+		var req dns.Msg
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.Opcode = opcode
+		reply, source := h.respond(&req)
+		assert.Equal(t, reply.Rcode, dns.RcodeNotImplemented, dns.OpcodeToString[opcode])
+		assert.Equal(t, source, sourceNone, dns.OpcodeToString[opcode])
+	}
+}
+
+func TestStartDNSUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unixgram sockets are not supported on Windows")
+	}
+	var y limayaml.LimaYAML
+	limayaml.FillDefault(&y, "")
+	y.HostResolver.Hosts = map[string]string{"host.example.com": "192.0.2.1"}
+	y.HostResolver.UnixSocket = &[]bool{true}[0]
+	instDir := t.TempDir()
+	// A stale socket of a previous run is replaced
+	assert.NilError(t, os.WriteFile(filepath.Join(instDir, filenames.DNSSock), nil, 0600))
+	a := &HostAgent{y: &y, instDir: instDir}
+	s, err := a.StartDNS()
+	assert.NilError(t, err)
+	assert.Equal(t, s.UnixSocket, filepath.Join(instDir, filenames.DNSSock))
+	assert.Equal(t, s.UnixgramSocket, filepath.Join(instDir, filenames.DNSDgramSock))
+
+	var req dns.Msg
+	req.SetQuestion("host.example.com.", dns.TypeA)
+	checkReply := func(reply *dns.Msg) {
+		t.Helper()
+		assert.Equal(t, len(reply.Answer), 1)
+		assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+	}
+
+	// The stream socket uses the same framing as TCP
+	conn, err := net.Dial("unix", s.UnixSocket)
+	assert.NilError(t, err)
+	defer conn.Close()
+	assert.NilError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	b, err := req.Pack()
+	assert.NilError(t, err)
+	_, err = conn.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...))
+	assert.NilError(t, err)
+	var l [2]byte
+	_, err = io.ReadFull(conn, l[:])
+	assert.NilError(t, err)
+	b = make([]byte, int(l[0])<<8|int(l[1]))
+	_, err = io.ReadFull(conn, b)
+	assert.NilError(t, err)
+	var reply dns.Msg
+	assert.NilError(t, reply.Unpack(b))
+	checkReply(&reply)
+
+	// The datagram client must be bound to receive the reply
+	dgramConn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: filepath.Join(t.TempDir(), "client.sock"), Net: "unixgram"},
+		&net.UnixAddr{Name: s.UnixgramSocket, Net: "unixgram"})
+	assert.NilError(t, err)
+	defer dgramConn.Close()
+	c := &dns.Conn{Conn: dgramConn}
+	assert.NilError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	assert.NilError(t, c.WriteMsg(&req))
+	dgramReply, err := c.ReadMsg()
+	assert.NilError(t, err)
+	checkReply(dgramReply)
+
+	assert.NilError(t, s.Shutdown())
+	for _, p := range []string{s.UnixSocket, s.UnixgramSocket} {
+		_, err := os.Stat(p)
+		assert.Assert(t, errors.Is(err, os.ErrNotExist), p)
+	}
+}
+
+func TestStartDNSBindError(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer pc.Close()
+
+	var y limayaml.LimaYAML
+	limayaml.FillDefault(&y, "")
+	a := &HostAgent{y: &y, udpDNSLocalPort: pc.LocalAddr().(*net.UDPAddr).Port}
+	_, err = a.StartDNS()
+	var listenerErr *DNSListenerError
+	assert.Assert(t, errors.As(err, &listenerErr), err)
+	assert.Equal(t, listenerErr.Net, "udp")
+}
+
+func TestRotateAddresses(t *testing.T) {
+	newReply := func() *dns.Msg {
+		var reply dns.Msg
+		reply.Answer = []dns.RR{
+			&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "example.com."},
+		}
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   net.ParseIP(ip),
+			})
+		}
+		return &reply
+	}
+	order := func(msg *dns.Msg) []string {
+		var res []string
+		for _, rr := range msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				res = append(res, rr.Target)
+			case *dns.A:
+				res = append(res, rr.A.String())
+			}
+		}
+		return res
+	}
+	for n, expected := range [][]string{
+		{"example.com.", "192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		{"example.com.", "192.0.2.2", "192.0.2.3", "192.0.2.1"},
+		{"example.com.", "192.0.2.3", "192.0.2.1", "192.0.2.2"},
+		{"example.com.", "192.0.2.1", "192.0.2.2", "192.0.2.3"},
+	} {
+		reply := newReply()
+		rotateAddresses(reply, uint32(n))
+		assert.DeepEqual(t, order(reply), expected)
+	}
+}
+
+// funcUpstream replies with the reply returned by f, or with an empty reply when f is nil, and counts the exchanges.
+// The exchanges fail while fail is 1. The fields are accessed atomically, so that they can be changed while
+// exchanges are in flight.
+type funcUpstream struct {
+	name      string // "func" when empty
+	f         func(req *dns.Msg) *dns.Msg
+	fail      int32
+	exchanges int32
+}
+
+func (u *funcUpstream) String() string {
+	if u.name != "" {
+		return u.name
+	}
+	return "func"
+}
+
+func (u *funcUpstream) exchange(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.exchanges, 1)
+	if atomic.LoadInt32(&u.fail) == 1 {
+		return nil, errors.New("fake failure")
+	}
+	if u.f == nil {
+		var reply dns.Msg
+		reply.SetReply(req)
+		return &reply, nil
+	}
+	return u.f(req), nil
+}
+
+func upstreamNames(groups [][]upstream) [][]string {
+	res := make([][]string, len(groups))
+	for i, group := range groups {
+		for _, u := range group {
+			res[i] = append(res[i], u.String())
+		}
+	}
+	return res
+}
+
+func TestReplyCache(t *testing.T) {
+	u := &funcUpstream{f: func(req *dns.Msg) *dns.Msg {
+		var reply dns.Msg
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		return &reply
+	}}
+	h := &Handler{
+		upstreams: [][]upstream{{u}},
+		hosts:     newStaticHosts(nil),
+		cache:     newResponseCache(2),
+	}
+	query := func(name string) string {
+		var req dns.Msg
+		req.SetQuestion(name, dns.TypeA)
+		_, source := h.reply(&req)
+		return source
+	}
+
+	assert.Equal(t, query("a.example.com."), "func")
+	// The names are case-insensitive
+	assert.Equal(t, query("A.Example.com."), sourceCache)
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(1))
+
+	// The TTLs of the cached replies are decremented by the time spent in the cache
+	key := cacheKey{name: "a.example.com.", qtype: dns.TypeA, qclass: dns.ClassINET}
+	reply := h.cachedReply(key, time.Now().Add(4*time.Second))
+	assert.Assert(t, reply != nil)
+	assert.Equal(t, reply.Answer[0].Header().Ttl, uint32(6))
+
+	// The expired replies are forwarded again
+	assert.Assert(t, h.cachedReply(key, time.Now().Add(10*time.Second)) == nil)
+	assert.Equal(t, query("a.example.com."), "func")
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(2))
+
+	// The least recently used reply is evicted first
+	assert.Equal(t, query("b.example.com."), "func")
+	assert.Equal(t, query("a.example.com."), sourceCache)
+	assert.Equal(t, query("c.example.com."), "func")
+	assert.Equal(t, query("a.example.com."), sourceCache)
+	assert.Equal(t, query("b.example.com."), "func")
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(5))
+
+	// Every query is forwarded when the cache is disabled
+	h, err := newHandler(handlerOptions{cacheDisabled: true, nameservers: []net.IP{net.ParseIP("127.0.0.1")}})
+	assert.NilError(t, err)
+	assert.Assert(t, h.cache == nil)
+	h.upstreams = [][]upstream{{u}}
+	assert.Equal(t, query("a.example.com."), "func")
+	assert.Equal(t, query("a.example.com."), "func")
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(7))
+}
+
+func TestReplyNegativeCache(t *testing.T) {
+	u := &funcUpstream{f: func(req *dns.Msg) *dns.Msg {
+		var reply dns.Msg
+		reply.SetRcode(req, dns.RcodeNameError)
+		reply.Ns = append(reply.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: 30,
+		})
+		return &reply
+	}}
+	h := &Handler{
+		upstreams:     [][]upstream{{u}},
+		hosts:         newStaticHosts(nil),
+		cache:         newResponseCache(0),
+		negativeCache: newResponseCache(0),
+	}
+	var req dns.Msg
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+	reply, source := h.reply(&req)
+	assert.Equal(t, source, "func")
+	assert.Equal(t, reply.Rcode, dns.RcodeNameError)
+	reply, source = h.reply(&req)
+	assert.Equal(t, source, sourceCache)
+	assert.Equal(t, reply.Rcode, dns.RcodeNameError)
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(1))
+
+	// The negative reply is cached for the SOA MINIMUM, lower than the TTL of the SOA
+	key, _ := cacheKeyFor(&req)
+	assert.Assert(t, h.cachedReply(key, time.Now().Add(29*time.Second)) != nil)
+	assert.Assert(t, h.cache.get(key, time.Now()) == nil, "negative replies must not be in the positive cache")
+	assert.Assert(t, h.cachedReply(key, time.Now().Add(30*time.Second)) == nil)
+	_, source = h.reply(&req)
+	assert.Equal(t, source, "func")
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(2))
+}
+
+func TestServeDNSLogQueries(t *testing.T) {
+	hook := logrustest.NewGlobal()
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	t.Cleanup(func() {
+		logrus.SetLevel(level)
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	})
+
+	queryEntries := func() []*logrus.Entry {
+		var res []*logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "DNS query" {
+				res = append(res, entry)
+			}
+		}
+		return res
+	}
+	// The queries are logged after the reply has been sent
+	served := make(chan struct{})
+	serve := func(h *Handler) string {
+		return startTestDNSHandler(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			h.ServeDNS(w, req)
+			served <- struct{}{}
+		})
+	}
+	hosts := newStaticHosts(map[string]string{"db.internal": "192.0.2.1"})
+	var req dns.Msg
+	req.SetQuestion("db.internal.", dns.TypeA)
+	_, err := dns.Exchange(&req, serve(&Handler{hosts: hosts}))
+	assert.NilError(t, err)
+	<-served
+	assert.Equal(t, len(queryEntries()), 0, "queries must not be logged by default")
+
+	_, err = dns.Exchange(&req, serve(&Handler{hosts: hosts, logQueries: true}))
+	assert.NilError(t, err)
+	<-served
+	entries := queryEntries()
+	assert.Equal(t, len(entries), 1)
+	entry := entries[0]
+	assert.Equal(t, entry.Level, logrus.DebugLevel)
+	assert.Equal(t, entry.Data["name"], "db.internal.")
+	assert.Equal(t, entry.Data["type"], "A")
+	assert.Equal(t, entry.Data["source"], sourceHosts)
+	assert.Equal(t, entry.Data["rcode"], "NOERROR")
+	assert.Equal(t, entry.Data["answers"], 1)
+}
+
+func TestServeDNSMetrics(t *testing.T) {
+	u := &funcUpstream{f: func(req *dns.Msg) *dns.Msg {
+		var reply dns.Msg
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		return &reply
+	}}
+	h := &Handler{
+		upstreams: [][]upstream{{&funcUpstream{name: "down", fail: 1}, u}},
+		hosts:     newStaticHosts(nil),
+		cache:     newResponseCache(0),
+		metrics:   newDNSMetrics(),
+	}
+	// The metrics are recorded after the reply has been sent
+	served := make(chan struct{})
+	addr := startTestDNSHandler(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		h.ServeDNS(w, req)
+		served <- struct{}{}
+	})
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeA, dns.TypeMX} {
+		var req dns.Msg
+		req.SetQuestion("example.com.", qtype)
+		_, err := dns.Exchange(&req, addr)
+		assert.NilError(t, err)
+		<-served
+	}
+
+	server := httptest.NewServer(newMetricsServer(h, 0).Handler)
+	t.Cleanup(server.Close)
+	resp, err := http.Get(server.URL + "/debug/vars")
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	var vars struct {
+		Queries        map[string]int `json:"queries_total"`
+		Responses      map[string]int `json:"responses_total"`
+		CacheHits      int            `json:"cache_hits_total"`
+		CacheMisses    int            `json:"cache_misses_total"`
+		UpstreamErrors map[string]int `json:"upstream_errors_total"`
+		LatencyCount   int            `json:"response_latency_seconds_count"`
+	}
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&vars))
+	assert.DeepEqual(t, vars.Queries, map[string]int{"A": 2, "MX": 1})
+	assert.DeepEqual(t, vars.Responses, map[string]int{"NOERROR": 3})
+	assert.Equal(t, vars.CacheHits, 1)
+	assert.Equal(t, vars.CacheMisses, 2)
+	assert.DeepEqual(t, vars.UpstreamErrors, map[string]int{"down": 2})
+	assert.Equal(t, vars.LatencyCount, 3)
+}
+
+func TestRoundRobinWithCache(t *testing.T) {
+	h := &Handler{
+		hosts:      newStaticHosts(nil),
+		cache:      newResponseCache(0),
+		roundRobin: true,
+	}
+	var upstreamReply dns.Msg
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+	upstreamReply.SetReply(&req)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		upstreamReply.Answer = append(upstreamReply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+	}
+	key, _ := cacheKeyFor(&req)
+	h.cacheReply(key, &upstreamReply, time.Now())
+
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		reply, source := h.reply(&req)
+		assert.Equal(t, source, sourceCache)
+		rotateAddresses(reply, atomic.AddUint32(&h.rotation, 1))
+		firsts = append(firsts, reply.Answer[0].(*dns.A).A.String())
+	}
+	assert.DeepEqual(t, firsts, []string{"192.0.2.2", "192.0.2.1", "192.0.2.2", "192.0.2.1"})
+	// The cached reply keeps the upstream order
+	assert.Equal(t, h.cachedReply(key, time.Now()).Answer[0].(*dns.A).A.String(), "192.0.2.1")
+}
+
+func TestFlushCache(t *testing.T) {
+	h := &Handler{
+		hosts:         newStaticHosts(nil),
+		cache:         newResponseCache(0),
+		negativeCache: newResponseCache(0),
+		metrics:       newDNSMetrics(),
+	}
+	fill := func() {
+		now := time.Now()
+		for _, q := range []struct {
+			name  string
+			qtype uint16
+			rcode int
+		}{
+			{"example.com.", dns.TypeA, dns.RcodeSuccess},
+			{"example.com.", dns.TypeAAAA, dns.RcodeNameError},
+			{"example.org.", dns.TypeA, dns.RcodeSuccess},
+		} {
+			var req dns.Msg
+			req.SetQuestion(q.name, q.qtype)
+			var reply dns.Msg
+			reply.SetRcode(&req, q.rcode)
+			if q.rcode == dns.RcodeSuccess {
+				reply.Answer = append(reply.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("192.0.2.1"),
+				})
+			} else {
+				reply.Ns = append(reply.Ns, &dns.SOA{
+					Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+					Ns:     "ns.com.",
+					Mbox:   "hostmaster.com.",
+					Minttl: 60,
+				})
+			}
+			key, _ := cacheKeyFor(&req)
+			h.cacheReply(key, &reply, now)
+		}
+	}
+
+	fill()
+	assert.Equal(t, h.FlushCache("EXAMPLE.com"), 2)
+	assert.Equal(t, h.FlushCache("example.com."), 0)
+	assert.Equal(t, h.FlushCache(""), 1)
+
+	fill()
+	server := httptest.NewServer(newMetricsServer(h, 0).Handler)
+	t.Cleanup(server.Close)
+	resp, err := http.Get(server.URL + "/debug/flush")
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+	resp, err = http.Post(server.URL+"/debug/flush?name=example.org", "", nil)
+	assert.NilError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "{\"evicted\": 1}\n")
+	resp, err = http.Post(server.URL+"/debug/flush", "", nil)
+	assert.NilError(t, err)
+	b, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "{\"evicted\": 2}\n")
+}
+
+func TestStaticHosts(t *testing.T) {
+	hosts := newStaticHosts(map[string]string{
+		"*.internal":         "192.0.2.1",
+		"*.lima.internal":    "192.0.2.2",
+		"db.lima.internal":   "192.0.2.3",
+		"Web.Example.com":    "192.0.2.4",
+		"ipv6.example.com.":  "2001:db8::1",
+		"*.Apps.Example.com": "192.0.2.5",
+	})
+	for _, tc := range []struct {
+		name     string
+		expected string // "" for no match
+	}{
+		{"db.lima.internal.", "192.0.2.3"},  // the exact match takes precedence over the wildcards
+		{"DB.Lima.Internal.", "192.0.2.3"},  // case-insensitive
+		{"web.lima.internal.", "192.0.2.2"}, // the more specific wildcard takes precedence
+		{"a.b.lima.internal.", "192.0.2.2"}, // wildcards match several labels
+		{"foo.internal.", "192.0.2.1"},
+		{"FOO.INTERNAL.", "192.0.2.1"},
+		{"internal.", ""}, // wildcards do not match the domain itself
+		{"lima.internal.", "192.0.2.1"},
+		{"web.example.com", "192.0.2.4"}, // names without the trailing dot
+		{"www.web.example.com.", ""},     // exact entries do not match subdomains
+		{"ipv6.example.com.", "2001:db8::1"},
+		{"foo.apps.example.com.", "192.0.2.5"}, // the wildcards are case-insensitive too
+		{"apps.example.com.", ""},
+		{"internal.example.com.", ""},
+	} {
+		ip, ok := hosts.lookup(tc.name)
+		if tc.expected == "" {
+			assert.Assert(t, !ok, "%s: %v", tc.name, ip)
+			continue
+		}
+		assert.Assert(t, ok, tc.name)
+		assert.Equal(t, ip.String(), tc.expected, tc.name)
+	}
+
+	h := &Handler{hosts: hosts}
+	var req dns.Msg
+	req.SetQuestion("Foo.Lima.Internal.", dns.TypeA)
+	reply, source := h.reply(&req)
+	assert.Equal(t, source, sourceHosts)
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, reply.Answer[0].Header().Name, "Foo.Lima.Internal.")
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.2")
+}
+
+func TestPTR(t *testing.T) {
+	hosts := newStaticHosts(withInternalHosts(map[string]string{
+		"db.internal":   "192.168.5.2",
+		"*.internal":    "192.0.2.1",
+		"v6.internal":   "fd00::1",
+		"other.example": "192.0.2.2",
+	}))
+	h := &Handler{hosts: hosts, ptr: hosts.reverse()}
+	for _, tc := range []struct {
+		addr     string
+		expected []string
+	}{
+		{"192.168.5.2", []string{"db.internal.", "host.lima.internal."}},
+		{"192.168.5.3", []string{"dns.lima.internal."}},
+		{"fd00::1", []string{"v6.internal."}},
+		{"192.0.2.2", []string{"other.example."}},
+	} {
+		arpa, err := dns.ReverseAddr(tc.addr)
+		assert.NilError(t, err)
+		var req dns.Msg
+		req.SetQuestion(strings.ToUpper(arpa), dns.TypePTR)
+		reply, source := h.handleQuery(&req)
+		assert.Equal(t, source, sourceHosts, tc.addr)
+		var names []string
+		for _, rr := range reply.Answer {
+			names = append(names, rr.(*dns.PTR).Ptr)
+		}
+		assert.DeepEqual(t, names, tc.expected)
+	}
+	_, ok := h.ptr["1.2.0.192.in-addr.arpa."]
+	assert.Assert(t, !ok, "wildcard entries must not have PTR records")
+}
+
+func TestStaticRecords(t *testing.T) {
+	var rrs []dns.RR
+	for _, r := range []string{
+		`_config.internal. TXT "key=value"`,
+		`_config.internal. 300 TXT "other=value"`,
+		`_ldap._tcp.corp.internal. SRV 0 0 389 ldap.corp.internal.`,
+	} {
+		rr, err := limayaml.ParseHostResolverRecord(r)
+		assert.NilError(t, err)
+		rrs = append(rrs, rr)
+	}
+	h := &Handler{hosts: newStaticHosts(nil), records: newStaticRecords(rrs)}
+
+	var req dns.Msg
+	req.SetQuestion("_Config.Internal.", dns.TypeTXT)
+	reply, source := h.handleQuery(&req)
+	assert.Equal(t, source, sourceRecords)
+	assert.Assert(t, reply.Authoritative)
+	assert.Equal(t, len(reply.Answer), 2)
+	txt := reply.Answer[0].(*dns.TXT)
+	assert.Equal(t, txt.Hdr.Name, "_Config.Internal.")
+	assert.Equal(t, txt.Hdr.Ttl, uint32(limayaml.DefaultHostResolverRecordTTL))
+	assert.DeepEqual(t, txt.Txt, []string{"key=value"})
+	assert.Equal(t, reply.Answer[1].Header().Ttl, uint32(300))
+
+	req.SetQuestion("_ldap._tcp.corp.internal.", dns.TypeSRV)
+	reply, source = h.handleQuery(&req)
+	assert.Equal(t, source, sourceRecords)
+	srv := reply.Answer[0].(*dns.SRV)
+	assert.Equal(t, srv.Port, uint16(389))
+	assert.Equal(t, srv.Target, "ldap.corp.internal.")
+
+	// The records are not modified by the answers
+	assert.Equal(t, rrs[0].Header().Name, "_config.internal.")
+}
+
+func TestRewrite(t *testing.T) {
+	port := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.2"))
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	cc.Port = port
+	h := &Handler{
+		upstreams: newDNSUpstreams(cc, handlerOptions{timeout: time.Second}),
+		hosts:     newStaticHosts(map[string]string{"db.prod.example.com": "192.0.2.1"}),
+		rewrites: newRewriteRules(map[string]string{
+			"staging.example.com":     "prod.example.com",
+			"old.staging.example.com": "legacy.example.com.",
+		}),
+	}
+
+	var req dns.Msg
+	req.SetQuestion("DB.Staging.example.com.", dns.TypeA)
+	reply, source := h.resolve(&req)
+	assert.Equal(t, source, sourceHosts)
+	assert.DeepEqual(t, reply.Question, req.Question)
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, reply.Answer[0].Header().Name, "DB.Staging.example.com.")
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+
+	// The test server answers with the name it was asked for
+	req.SetQuestion("www.old.staging.example.com.", dns.TypeAAAA)
+	reply, source = h.resolve(&req)
+	assert.Equal(t, source, h.upstreams[0][0].String())
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, reply.Answer[0].Header().Name, "www.old.staging.example.com.")
+
+	// The names outside the rewritten domains are left alone
+	req.SetQuestion("www.example.com.", dns.TypeAAAA)
+	reply, _ = h.resolve(&req)
+	assert.Equal(t, reply.Answer[0].Header().Name, "www.example.com.")
+}
+
+func TestRestoreReply(t *testing.T) {
+	var req, rewritten, reply dns.Msg
+	req.SetQuestion("WWW.staging.example.com.", dns.TypeA)
+	rewritten.SetQuestion("WWW.prod.example.com.", dns.TypeA)
+	reply.SetReply(&rewritten)
+	for _, s := range []string{
+		"www.prod.example.com. 60 IN CNAME web.prod.example.com.",
+		"web.prod.example.com. 60 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(s)
+		assert.NilError(t, err)
+		reply.Answer = append(reply.Answer, rr)
+	}
+	restoreReply(&req, &reply, "staging.example.com.", "prod.example.com.")
+	var answers []string
+	for _, rr := range reply.Answer {
+		answers = append(answers, rr.String())
+	}
+	assert.DeepEqual(t, answers, []string{
+		"WWW.staging.example.com.\t60\tIN\tCNAME\tweb.staging.example.com.",
+		"web.staging.example.com.\t60\tIN\tCNAME\tcdn.example.net.",
+		"cdn.example.net.\t60\tIN\tA\t192.0.2.1",
+	})
+	assert.DeepEqual(t, reply.Question, req.Question)
+}
+
+func TestDomainUpstreams(t *testing.T) {
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("192.0.2.53")})
+	assert.NilError(t, err)
+	subCC, err := newStaticClientConfig([]net.IP{net.ParseIP("192.0.2.54")})
+	assert.NilError(t, err)
+	srvCC, err := newStaticClientConfig([]net.IP{net.ParseIP("192.0.2.55")})
+	assert.NilError(t, err)
+	d := newDomainUpstreams(map[forwardKey]*dns.ClientConfig{
+		{domain: "Corp.Example.com"}:                      cc,
+		{domain: "sub.corp.example.com."}:                 subCC,
+		{domain: "corp.example.com.", qtype: dns.TypeSRV}: srvCC,
+		{domain: "srv.example.org.", qtype: dns.TypeSRV}:  srvCC,
+	}, handlerOptions{timeout: time.Second})
+
+	for name, expected := range map[string]string{
+		"corp.example.com.":          "192.0.2.53:53 (udp)",
+		"host.CORP.example.com.":     "192.0.2.53:53 (udp)",
+		"sub.corp.example.com.":      "192.0.2.54:53 (udp)",
+		"host.sub.corp.example.com.": "192.0.2.54:53 (udp)",
+	} {
+		upstreams, ok := d.lookup(name, dns.TypeA)
+		assert.Assert(t, ok, name)
+		assert.Equal(t, upstreams[0][0].String(), expected, name)
+	}
+	for _, name := range []string{"example.com.", "notcorp.example.com.", "corp.example.org.", "srv.example.org."} {
+		_, ok := d.lookup(name, dns.TypeA)
+		assert.Assert(t, !ok, name)
+	}
+
+	// The upstreams of a query type take precedence over the ones of the same domain for all the types,
+	// but not over the ones of a longer domain
+	for name, expected := range map[string]string{
+		"_ldap._tcp.corp.example.com.": "192.0.2.55:53 (udp)",
+		"_ldap._tcp.srv.example.org.":  "192.0.2.55:53 (udp)",
+		"sub.corp.example.com.":        "192.0.2.54:53 (udp)",
+	} {
+		upstreams, ok := d.lookup(name, dns.TypeSRV)
+		assert.Assert(t, ok, name)
+		assert.Equal(t, upstreams[0][0].String(), expected, name)
+	}
+}
+
+func TestForwardToDomainUpstream(t *testing.T) {
+	port := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.1"))
+	defaultPort := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.2"))
+
+	opts, err := newHandlerOptions(limayaml.HostResolver{
+		Cache:            limayaml.HostResolverCache{Enabled: &[]bool{false}[0]},
+		NegativeCache:    limayaml.HostResolverCache{Enabled: &[]bool{false}[0]},
+		Timeout:          "1s",
+		Retries:          &[]int{0}[0],
+		Parallel:         &[]bool{false}[0],
+		LogQueries:       &[]bool{false}[0],
+		RoundRobin:       &[]bool{false}[0],
+		FailureThreshold: &[]int{0}[0],
+		Cooldown:         "30s",
+		DNS64:            limayaml.HostResolverDNS64{Enabled: &[]bool{false}[0]},
+		Forward: []limayaml.HostResolverForward{
+			{Domain: "corp.example.com", Nameservers: []string{"127.0.0.1"}},
+		},
+	})
+	assert.NilError(t, err)
+	cc := opts.domainClientConfigs[forwardKey{domain: "corp.example.com."}]
+	assert.Assert(t, cc != nil)
+	cc.Port = port
+	defaultCC, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	defaultCC.Port = defaultPort
+	h := &Handler{
+		upstreams: newDNSUpstreams(defaultCC, opts),
+		domains:   newDomainUpstreams(opts.domainClientConfigs, opts),
+	}
+
+	for name, expected := range map[string]string{
+		"db.corp.example.com.": "192.0.2.1",
+		"example.com.":         "192.0.2.2",
+	} {
+		var req dns.Msg
+		req.SetQuestion(name, dns.TypeA)
+		reply, _ := h.handleDefault(&req)
+		assert.Equal(t, reply.Rcode, dns.RcodeSuccess, name)
+		assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), expected, name)
+	}
+}
+
+func TestTLDFilter(t *testing.T) {
+	var f *tldFilter
+	assert.Assert(t, f.hostResolved("example.com."))
+	assert.Assert(t, newTLDFilter(nil, nil, nil) == nil)
+
+	f = newTLDFilter([]string{"corp", ".LOCAL"}, nil, nil)
+	for name, expected := range map[string]bool{
+		"db.corp.":         true,
+		"DB.Corp":          true,
+		"printer.local.":   true,
+		"example.com.":     false,
+		"corp.example.com": false,
+		".":                false,
+	} {
+		assert.Equal(t, f.hostResolved(name), expected, name)
+	}
+
+	f = newTLDFilter(nil, []string{"com", "local"}, nil)
+	for name, expected := range map[string]bool{
+		"db.corp.":       true,
+		"printer.local.": false,
+		"example.com.":   false,
+	} {
+		assert.Equal(t, f.hostResolved(name), expected, name)
+	}
+}
+
+func TestForwardToTLDUpstream(t *testing.T) {
+	tldPort := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.1"))
+	defaultPort := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.2"))
+
+	opts := handlerOptions{timeout: time.Second}
+	tldCC, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	tldCC.Port = tldPort
+	defaultCC, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	defaultCC.Port = defaultPort
+	h := &Handler{
+		upstreams: newDNSUpstreams(defaultCC, opts),
+		tlds:      newTLDFilter([]string{"corp"}, nil, newDNSUpstreams(tldCC, opts)),
+	}
+
+	for name, expected := range map[string]string{
+		"db.corp.":     "192.0.2.2",
+		"example.com.": "192.0.2.1",
+	} {
+		var req dns.Msg
+		req.SetQuestion(name, dns.TypeA)
+		reply, _ := h.handleDefault(&req)
+		assert.Equal(t, reply.Rcode, dns.RcodeSuccess, name)
+		assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), expected, name)
+	}
+
+	// The names of .local are neither resolved by the host nor sent to the TLD upstreams
+	var req dns.Msg
+	req.SetQuestion("printer.local.", dns.TypeA)
+	reply, source := h.handleDefault(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeNameError)
+	assert.Equal(t, source, sourceTLDFilter)
+}
+
+func TestMDNSReply(t *testing.T) {
+	var req dns.Msg
+	req.SetQuestion("printer.local.", dns.TypeA)
+	var other dns.Msg
+	other.SetQuestion("example.com.", dns.TypeA)
+
+	for mode, rcode := range map[limayaml.MDNSMode]int{
+		limayaml.MDNSModeRefuse: dns.RcodeRefused,
+		limayaml.MDNSModeNotImp: dns.RcodeNotImplemented,
+	} {
+		h := &Handler{mdnsMode: mode}
+		reply, source := h.mdnsReply(&req)
+		assert.Assert(t, reply != nil, mode)
+		assert.Equal(t, reply.Rcode, rcode, mode)
+		assert.Equal(t, reply.Id, req.Id, mode)
+		assert.Equal(t, source, sourceMDNS, mode)
+		reply, _ = h.mdnsReply(&other)
+		assert.Assert(t, reply == nil, mode)
+	}
+	h := &Handler{mdnsMode: limayaml.MDNSModeHost}
+	reply, _ := h.mdnsReply(&req)
+	assert.Assert(t, reply == nil)
+
+	port := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.1"))
+	h, err := newHandler(handlerOptions{
+		timeout:       time.Second,
+		nameservers:   []net.IP{net.ParseIP("127.0.0.1")},
+		mdnsMode:      limayaml.MDNSModeForward,
+		mdnsResponder: net.JoinHostPort("127.0.0.1", port),
+	})
+	assert.NilError(t, err)
+	reply, source := h.mdnsReply(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, reply.Id, req.Id)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+	assert.Equal(t, source, "127.0.0.1:"+port+" (mdns)")
+
+	// A responder that does not have the name does not reply
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer pc.Close()
+	h.mdns = &mdnsUpstream{addr: pc.LocalAddr().(*net.UDPAddr), timeout: 100 * time.Millisecond}
+	reply, source = h.mdnsReply(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeNameError)
+	assert.Equal(t, source, sourceMDNS)
+}
+
+func TestRespondBlocksBeforeMDNS(t *testing.T) {
+	mdns := &funcUpstream{f: func(req *dns.Msg) *dns.Msg {
+		var reply dns.Msg
+		reply.SetReply(req)
+		return &reply
+	}}
+	unicast := &funcUpstream{f: mdns.f}
+	h := &Handler{
+		upstreams: [][]upstream{{unicast}},
+		mdnsMode:  limayaml.MDNSModeForward,
+		mdns:      mdns,
+		block:     newBlockList([]string{"*.blocked.local", "blocked.example.com"}),
+		rewrites:  newRewriteRules(map[string]string{"staging.example.com": "blocked.example.com"}),
+	}
+
+	var req dns.Msg
+	req.SetQuestion("tracker.blocked.local.", dns.TypeA)
+	reply, source := h.respond(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeNameError)
+	assert.Equal(t, source, sourceBlockList)
+	assert.Equal(t, atomic.LoadInt32(&mdns.exchanges), int32(0))
+
+	req.SetQuestion("printer.local.", dns.TypeA)
+	_, source = h.respond(&req)
+	assert.Equal(t, source, "func")
+	assert.Equal(t, atomic.LoadInt32(&mdns.exchanges), int32(1))
+
+	// A name rewritten into a blocked one is blocked too
+	req.SetQuestion("staging.example.com.", dns.TypeA)
+	reply, source = h.respond(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeNameError)
+	assert.Equal(t, source, sourceBlockList)
+	assert.DeepEqual(t, reply.Question, req.Question)
+	assert.Equal(t, atomic.LoadInt32(&unicast.exchanges), int32(0))
+}
+
+func TestForwardToDomainUpstreamLabelBoundary(t *testing.T) {
+	port := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.1"))
+	defaultPort := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.2"))
+
+	opts := handlerOptions{timeout: time.Second}
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	cc.Port = port
+	defaultCC, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	defaultCC.Port = defaultPort
+	h := &Handler{
+		upstreams: newDNSUpstreams(defaultCC, opts),
+		domains:   newDomainUpstreams(map[forwardKey]*dns.ClientConfig{{domain: "corp.com"}: cc}, opts),
+	}
+
+	// The domain matches itself and its subdomains, on label boundaries only
+	for name, expected := range map[string]string{
+		"corp.com.":          "192.0.2.1",
+		"CORP.Com.":          "192.0.2.1",
+		"host.corp.com.":     "192.0.2.1",
+		"a.b.host.corp.com.": "192.0.2.1",
+		"notcorp.com.":       "192.0.2.2",
+		"host.notcorp.com.":  "192.0.2.2",
+		"corp.com.example.":  "192.0.2.2",
+		"com.":               "192.0.2.2",
+	} {
+		var req dns.Msg
+		req.SetQuestion(name, dns.TypeA)
+		reply, _ := h.handleDefault(&req)
+		assert.Equal(t, reply.Rcode, dns.RcodeSuccess, name)
+		assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), expected, name)
+	}
+}
+
+func TestForwardToShorterDomainUpstream(t *testing.T) {
+	port := startTestDNSServer(t, "127.0.0.1:0", net.ParseIP("192.0.2.1"))
+	// Nothing listens on the port of the nameservers of the longer domain
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	_, deadPort, err := net.SplitHostPort(pc.LocalAddr().String())
+	assert.NilError(t, err)
+	assert.NilError(t, pc.Close())
+
+	opts := handlerOptions{timeout: 200 * time.Millisecond}
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	cc.Port = port
+	engCC, err := newStaticClientConfig([]net.IP{net.ParseIP("127.0.0.1")})
+	assert.NilError(t, err)
+	engCC.Port = deadPort
+	d := newDomainUpstreams(map[forwardKey]*dns.ClientConfig{
+		{domain: "corp.com"}:     cc,
+		{domain: "eng.corp.com"}: engCC,
+	}, opts)
+
+	// The longest domain comes first: UDP and TCP of eng.corp.com, then UDP and TCP of corp.com
+	upstreams, ok := d.lookup("host.eng.corp.com.", dns.TypeA)
+	assert.Assert(t, ok)
+	assert.Equal(t, len(upstreams), 4)
+	assert.Equal(t, upstreams[0][0].String(), "127.0.0.1:"+deadPort+" (udp)")
+	assert.Equal(t, upstreams[2][0].String(), "127.0.0.1:"+port+" (udp)")
+
+	h := &Handler{domains: d}
+	var req dns.Msg
+	req.SetQuestion("host.eng.corp.com.", dns.TypeA)
+	reply, source := h.handleDefault(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+	assert.Equal(t, source, "127.0.0.1:"+port+" (udp)")
+}
+
+func TestFallbackNameservers(t *testing.T) {
+	hostResolver := limayaml.HostResolver{
+		Cache:            limayaml.HostResolverCache{Enabled: &[]bool{false}[0]},
+		NegativeCache:    limayaml.HostResolverCache{Enabled: &[]bool{false}[0]},
+		Timeout:          "1s",
+		Retries:          &[]int{0}[0],
+		Parallel:         &[]bool{false}[0],
+		LogQueries:       &[]bool{false}[0],
+		RoundRobin:       &[]bool{false}[0],
+		FailureThreshold: &[]int{0}[0],
+		Cooldown:         "30s",
+		DNS64:            limayaml.HostResolverDNS64{Enabled: &[]bool{false}[0]},
+		// The names outside of .corp are resolved with the fallback nameservers, as no TLD upstream is set
+		TLDs: limayaml.HostResolverTLDs{Allow: []string{"corp"}},
+	}
+	tldUpstreams := func(fallback []string) [][]string {
+		hostResolver.Fallback = fallback
+		opts, err := newHandlerOptions(hostResolver)
+		assert.NilError(t, err)
+		h, err := newHandler(opts)
+		assert.NilError(t, err)
+		return upstreamNames(h.tlds.upstreams)
+	}
+	assert.DeepEqual(t, tldUpstreams([]string{"192.0.2.53"}), [][]string{
+		{"192.0.2.53:53 (udp)"},
+		{"192.0.2.53:53 (tcp)"},
+	})
+	assert.DeepEqual(t, tldUpstreams(nil), [][]string{
+		{"8.8.8.8:53 (udp)", "1.1.1.1:53 (udp)"},
+		{"8.8.8.8:53 (tcp)", "1.1.1.1:53 (tcp)"},
+	})
+
+	hostResolver.Fallback = []string{"dns.example.org"}
+	_, err := newHandlerOptions(hostResolver)
+	assert.ErrorContains(t, err, `invalid fallback nameserver "dns.example.org"`)
+}
+
+func TestNewHandlerOptionsMergesForwardDomains(t *testing.T) {
+	opts, err := newHandlerOptions(limayaml.HostResolver{
+		Cache:            limayaml.HostResolverCache{Enabled: &[]bool{true}[0]},
+		NegativeCache:    limayaml.HostResolverCache{Enabled: &[]bool{true}[0]},
+		Timeout:          "2s",
+		Retries:          &[]int{1}[0],
+		Parallel:         &[]bool{false}[0],
+		LogQueries:       &[]bool{false}[0],
+		RoundRobin:       &[]bool{false}[0],
+		FailureThreshold: &[]int{3}[0],
+		Cooldown:         "30s",
+		DNS64:            limayaml.HostResolverDNS64{Enabled: &[]bool{false}[0]},
+		Forward: []limayaml.HostResolverForward{
+			{Domain: "corp.example.com", Nameservers: []string{"192.0.2.53"}},
+			{Domain: "CORP.example.com.", Nameservers: []string{"2001:db8::53"}},
+			{Domain: "corp.example.com", Types: []string{"srv", "TXT"}, Nameservers: []string{"192.0.2.54"}},
+		},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(opts.domainClientConfigs), 3)
+	assert.DeepEqual(t, opts.domainClientConfigs[forwardKey{domain: "corp.example.com."}].Servers, []string{"192.0.2.53", "2001:db8::53"})
+	assert.DeepEqual(t, opts.domainClientConfigs[forwardKey{domain: "corp.example.com.", qtype: dns.TypeSRV}].Servers, []string{"192.0.2.54"})
+	assert.DeepEqual(t, opts.domainClientConfigs[forwardKey{domain: "corp.example.com.", qtype: dns.TypeTXT}].Servers, []string{"192.0.2.54"})
+}
+
+// blockingTXTReply returns the function of a funcUpstream that replies with a TXT record once release is closed.
+func blockingTXTReply(release <-chan struct{}) func(req *dns.Msg) *dns.Msg {
+	return func(req *dns.Msg) *dns.Msg {
+		<-release
+		var reply dns.Msg
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{"hello"},
+		})
+		return &reply
+	}
+}
+
+func TestReplySingleFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	blocking := blockingTXTReply(release)
+	var once sync.Once
+	u := &funcUpstream{f: func(req *dns.Msg) *dns.Msg {
+		once.Do(func() { close(started) })
+		return blocking(req)
+	}}
+	h := &Handler{
+		upstreams: [][]upstream{{u}},
+		hosts:     newStaticHosts(nil),
+	}
+	const n = 10
+	replies := make(chan *dns.Msg, n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			var req dns.Msg
+			req.SetQuestion("Example.com.", dns.TypeTXT)
+			req.Id = uint16(i)
+			reply, _ := h.reply(&req)
+			replies <- reply
+		}()
+	}
+	<-started
+	// Give the other queries the time to join the flight
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	ids := make(map[uint16]bool)
+	for i := 0; i < n; i++ {
+		reply := <-replies
+		assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+		assert.Equal(t, len(reply.Answer), 1)
+		ids[reply.Id] = true
+	}
+	assert.Equal(t, len(ids), n)
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(1))
+}
+
+func TestReplySingleFlightDoesNotKeepFailures(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	u := &funcUpstream{f: blockingTXTReply(release), fail: 1}
+	h := &Handler{
+		upstreams: [][]upstream{{u}},
+		hosts:     newStaticHosts(nil),
+	}
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	reply, source := h.reply(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeServerFailure)
+	assert.Equal(t, source, sourceNone)
+
+	atomic.StoreInt32(&u.fail, 0)
+	reply, source = h.reply(&req)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, source, u.String())
+	assert.Equal(t, atomic.LoadInt32(&u.exchanges), int32(2))
+}
+
+func TestNewHandlerNameservers(t *testing.T) {
+	h, err := newHandler(handlerOptions{
+		timeout:     time.Second,
+		nameservers: []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53")},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, upstreamNames(h.upstreams), [][]string{
+		{"192.0.2.53:53 (udp)", "[2001:db8::53]:53 (udp)"},
+		{"192.0.2.53:53 (tcp)", "[2001:db8::53]:53 (tcp)"},
+	})
+}
+
+func TestResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	_, err := resolvConf(filepath.Join(dir, "missing")).clientConfig()
+	assert.Assert(t, errors.Is(err, os.ErrNotExist), err)
+
+	empty := filepath.Join(dir, "empty")
+	assert.NilError(t, os.WriteFile(empty, []byte("search example.com\n"), 0644))
+	_, err = resolvConf(empty).clientConfig()
+	assert.ErrorContains(t, err, "no nameserver found")
+
+	valid := filepath.Join(dir, "resolv.conf")
+	assert.NilError(t, os.WriteFile(valid, []byte("nameserver 192.0.2.53\nnameserver 2001:db8::53\nsearch example.com\n"), 0644))
+	cc, err := resolvConf(valid).clientConfig()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cc.Servers, []string{"192.0.2.53", "2001:db8::53"})
+	assert.DeepEqual(t, cc.Search, []string{"example.com"})
+}
+
+func TestScutilResolvers(t *testing.T) {
+	const out = `
+DNS configuration
+
+resolver #1
+  search domain[0] : example.com
+  nameserver[0] : 192.168.1.1
+  nameserver[1] : fe80::1%en0
+  if_index : 14 (en0)
+  flags    : Request A records, Request AAAA records
+  reach    : 0x00020002 (Reachable,Directly Reachable Address)
+
+resolver #2
+  domain   : local
+  options  : mdns
+  timeout  : 5
+  flags    : Request A records, Request AAAA records
+  reach    : 0x00000000 (Not Reachable)
+  order    : 300000
+
+resolver #3
+  domain   : 254.169.in-addr.arpa
+  options  : mdns
+  timeout  : 5
+  order    : 300200
+
+resolver #4
+  domain   : corp.example.com
+  nameserver[0] : 10.0.0.53
+  nameserver[1] : 10.0.0.54
+  flags    : Request A records
+  reach    : 0x00000003 (Reachable,Transient Connection)
+  order    : 1
+
+resolver #5
+  domain   : Lab.Example.com
+  nameserver[0] : 10.1.0.53
+  port     : 5353
+
+DNS configuration (for scoped queries)
+
+resolver #1
+  search domain[0] : example.com
+  nameserver[0] : 192.168.1.1
+  if_index : 14 (en0)
+  flags    : Scoped, Request A records
+  reach    : 0x00020002 (Reachable,Directly Reachable Address)
+
+resolver #2
+  nameserver[0] : 192.168.2.1
+  if_index : 15 (en1)
+  flags    : Scoped, Request A records
+  reach    : 0x00020002 (Reachable,Directly Reachable Address)
+
+resolver #3
+  domain   : corp.example.com
+  nameserver[0] : 10.0.0.53
+  if_index : 20 (utun3)
+  flags    : Scoped, Request A records
+`
+	resolvers, err := parseScutilDNS(strings.NewReader(out))
+	assert.NilError(t, err)
+	assert.Equal(t, len(resolvers), 8)
+
+	// The nameservers of the default resolvers come first, followed by the ones of the other interfaces
+	cc, err := scutilClientConfig(resolvers)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cc.Servers, []string{"192.168.1.1", "fe80::1%en0", "192.168.2.1"})
+	assert.DeepEqual(t, cc.Search, []string{"example.com"})
+	assert.Equal(t, cc.Port, "53")
+
+	// The domains of the VPN get their own nameservers, but not the mDNS domains
+	domains := scutilDomainClientConfigs(resolvers)
+	assert.Equal(t, len(domains), 2)
+	assert.DeepEqual(t, domains[forwardKey{domain: "corp.example.com."}].Servers, []string{"10.0.0.53", "10.0.0.54"})
+	assert.DeepEqual(t, domains[forwardKey{domain: "lab.example.com."}].Servers, []string{"10.1.0.53"})
+	assert.Equal(t, domains[forwardKey{domain: "lab.example.com."}].Port, "5353")
+
+	_, err = scutilClientConfig(resolvers[1:3])
+	assert.ErrorContains(t, err, "no nameserver found")
+
+	// The domains of hostResolver.forward take precedence over the ones of the host
+	configured, err := newStaticClientConfig([]net.IP{net.ParseIP("192.0.2.53")})
+	assert.NilError(t, err)
+	merged := withSystemDomains(map[forwardKey]*dns.ClientConfig{{domain: "corp.example.com."}: configured}, domains)
+	assert.Equal(t, len(merged), 2)
+	assert.Equal(t, merged[forwardKey{domain: "corp.example.com."}], configured)
+	assert.Equal(t, merged[forwardKey{domain: "lab.example.com."}], domains[forwardKey{domain: "lab.example.com."}])
+}
+
+func TestPrioritizeReachable(t *testing.T) {
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("2001:db8::53"), net.ParseIP("192.0.2.53"), net.ParseIP("192.0.2.54")})
+	assert.NilError(t, err)
+	prioritizeReachable(cc, func(ip string) error {
+		if strings.Contains(ip, ":") {
+			return errors.New("network is unreachable")
+		}
+		return nil
+	})
+	assert.DeepEqual(t, cc.Servers, []string{"192.0.2.53", "192.0.2.54", "2001:db8::53"})
+
+	assert.NilError(t, checkRoute("127.0.0.1"))
+}
+
+func TestOrderServers(t *testing.T) {
+	cc, err := newStaticClientConfig([]net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("192.0.2.54"), net.ParseIP("2001:db8::53")})
+	assert.NilError(t, err)
+	orderServers(cc, []net.IP{net.ParseIP("2001:db8:0::53"), net.ParseIP("198.51.100.53"), net.ParseIP("192.0.2.54")})
+	assert.DeepEqual(t, cc.Servers, []string{"2001:db8::53", "192.0.2.54", "192.0.2.53"})
+
+	h, err := newHandler(handlerOptions{
+		timeout:     time.Second,
+		nameservers: []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("192.0.2.54")},
+		order:       []net.IP{net.ParseIP("192.0.2.54")},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, upstreamNames(h.upstreams), [][]string{
+		{"192.0.2.54:53 (udp)", "192.0.2.53:53 (udp)"},
+		{"192.0.2.54:53 (tcp)", "192.0.2.53:53 (tcp)"},
+	})
+}
+
+func TestResolve(t *testing.T) {
+	release := make(chan struct{})
+	u := &funcUpstream{f: blockingTXTReply(release)}
+	h := &Handler{
+		upstreams: [][]upstream{{u}},
+		hosts:     newStaticHosts(map[string]string{"db.internal": "192.0.2.1"}),
+		cache:     newResponseCache(0),
+	}
+	ctx := context.Background()
+
+	reply, source, err := h.Resolve(ctx, "db.internal", dns.TypeA)
+	assert.NilError(t, err)
+	assert.Equal(t, source, sourceHosts)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+
+	// The upstream blocks until released, so ctx is done first
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, _, err = h.Resolve(timeoutCtx, "example.com.", dns.TypeTXT)
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	close(release)
+	reply, source, err = h.Resolve(ctx, "example.org.", dns.TypeTXT)
+	assert.NilError(t, err)
+	assert.Equal(t, source, u.String())
+	assert.DeepEqual(t, reply.Answer[0].(*dns.TXT).Txt, []string{"hello"})
+	_, source, err = h.Resolve(ctx, "example.org.", dns.TypeTXT)
+	assert.NilError(t, err)
+	assert.Equal(t, source, sourceCache)
+
+	_, _, err = h.Resolve(ctx, "bad..name", dns.TypeA)
+	assert.ErrorContains(t, err, "invalid name")
+}
@@ -0,0 +1,78 @@
+package hostagent
+
+import (
+	"strings"
+
+	"github.com/lima-vm/lima/pkg/limayaml"
+	"github.com/miekg/dns"
+)
+
+// localTLD is the top-level domain of multicast DNS (RFC 6762), whose names unicast nameservers cannot resolve.
+const localTLD = "local"
+
+// tldFilter decides by their top-level domains which names are resolved by the resolver of the host
+// and its nameservers, see limayaml.HostResolverTLDs.
+type tldFilter struct {
+	allow map[string]struct{} // nil to allow all the TLDs that are not denied
+	deny  map[string]struct{}
+	// upstreams are the upstreams of the names that are not resolved by the host
+	upstreams [][]upstream
+}
+
+// newTLDFilter returns nil (resolving every name with the host) when allow and deny are both empty.
+func newTLDFilter(allow, deny []string, upstreams [][]upstream) *tldFilter {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	f := &tldFilter{
+		deny:      make(map[string]struct{}, len(deny)),
+		upstreams: upstreams,
+	}
+	if len(allow) > 0 {
+		f.allow = make(map[string]struct{}, len(allow))
+		for _, tld := range allow {
+			f.allow[limayaml.NormalizeTLD(tld)] = struct{}{}
+		}
+	}
+	for _, tld := range deny {
+		f.deny[limayaml.NormalizeTLD(tld)] = struct{}{}
+	}
+	return f
+}
+
+// topLevelDomain returns the lower-cased last label of name, or "" for the root.
+func topLevelDomain(name string) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	if len(labels) == 0 {
+		return ""
+	}
+	return labels[len(labels)-1]
+}
+
+// hostResolved returns whether name is resolved by the resolver of the host.
+func (f *tldFilter) hostResolved(name string) bool {
+	if f == nil {
+		return true
+	}
+	tld := topLevelDomain(name)
+	if _, ok := f.deny[tld]; ok {
+		return false
+	}
+	if f.allow == nil {
+		return true
+	}
+	_, ok := f.allow[tld]
+	return ok
+}
+
+// upstreamsOf returns the upstreams of name when it is not resolved by the host, or false when it is.
+// The names of localTLD that are not resolved by the host have no upstreams, so the returned upstreams are nil.
+func (f *tldFilter) upstreamsOf(name string) ([][]upstream, bool) {
+	if f.hostResolved(name) {
+		return nil, false
+	}
+	if topLevelDomain(name) == localTLD {
+		return nil, true
+	}
+	return f.upstreams, true
+}
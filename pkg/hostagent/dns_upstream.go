@@ -0,0 +1,161 @@
+package hostagent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// upstream is a nameserver that queries are forwarded to.
+type upstream interface {
+	// exchange sends req to the nameserver and returns the reply.
+	// The exchange is not interrupted when ctx is cancelled, but it does not outlive the deadline of ctx.
+	exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+	fmt.Stringer
+}
+
+// dnsUpstream is a nameserver queried over plain UDP or TCP.
+type dnsUpstream struct {
+	client  *dns.Client
+	addr    string // "host:port"
+	retries int    // number of retries after a timeout
+}
+
+func (u *dnsUpstream) String() string {
+	network := u.client.Net
+	if network == "" {
+		network = "udp"
+	}
+	return fmt.Sprintf("%s (%s)", u.addr, network)
+}
+
+func (u *dnsUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(queryBudget)
+	}
+	var err error
+	for attempt := 0; attempt <= u.retries; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				err = ctxErr
+			}
+			break
+		}
+		c := u.client
+		if remaining := time.Until(deadline); remaining <= 0 {
+			break
+		} else if c.Timeout == 0 || remaining < c.Timeout {
+			c = &dns.Client{Net: u.client.Net, UDPSize: u.client.UDPSize, Timeout: remaining}
+		}
+		var reply *dns.Msg
+		reply, _, err = c.Exchange(req, u.addr)
+		if err == nil {
+			if reply.Truncated && (c.Net == "" || c.Net == "udp") {
+				return u.exchangeTruncated(deadline, req, reply), nil
+			}
+			return reply, nil
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			break
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no time left for querying %s", u)
+	}
+	return nil, err
+}
+
+// exchangeTruncated re-issues req over TCP, after the UDP reply came back with the TC bit set (RFC 7766 section 5).
+// The truncated reply is returned if the TCP exchange fails, so that the guest can still retry on its own.
+func (u *dnsUpstream) exchangeTruncated(deadline time.Time, req *dns.Msg, truncated *dns.Msg) *dns.Msg {
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return truncated
+	}
+	if u.client.Timeout != 0 && u.client.Timeout < timeout {
+		timeout = u.client.Timeout
+	}
+	tcpClient := &dns.Client{Net: "tcp", Timeout: timeout}
+	reply, _, err := tcpClient.Exchange(req, u.addr)
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to retry the truncated DNS reply from %s over tcp", u.addr)
+		return truncated
+	}
+	return reply
+}
+
+// dohMediaType is the media type of DNS messages sent over HTTPS (RFC 8484 section 6).
+const dohMediaType = "application/dns-message"
+
+// dohUpstream is a DNS-over-HTTPS (RFC 8484) server, queried with POST requests.
+type dohUpstream struct {
+	client  *http.Client
+	url     string
+	retries int // number of retries after a timeout
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// The ID should be 0, to make the responses cacheable by HTTP caches (RFC 8484 section 4.1)
+	query := req.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt <= u.retries; attempt++ {
+		var reply *dns.Msg
+		reply, err = u.post(ctx, packed)
+		if err == nil {
+			reply.Id = req.Id
+			return reply, nil
+		}
+		var netErr net.Error
+		if ctx.Err() != nil || !errors.As(err, &netErr) || !netErr.Timeout() {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (u *dohUpstream) post(ctx context.Context, packed []byte) (*dns.Msg, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected HTTP status %d from %s, got %s", http.StatusOK, u.url, resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != dohMediaType {
+		return nil, fmt.Errorf("expected content type %q from %s, got %q", dohMediaType, u.url, contentType)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	var reply dns.Msg
+	if err := reply.Unpack(body); err != nil {
+		return nil, fmt.Errorf("failed to parse the DNS reply from %s: %w", u.url, err)
+	}
+	return &reply, nil
+}
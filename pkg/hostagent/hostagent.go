@@ -9,9 +9,11 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/digitalocean/go-qemu/qmp"
@@ -36,6 +38,7 @@ type HostAgent struct {
 	y               *limayaml.LimaYAML
 	sshLocalPort    int
 	udpDNSLocalPort int
+	tcpDNSLocalPort int
 	instDir         string
 	sshConfig       *ssh.SSHConfig
 	portForwarder   *portForwarder
@@ -77,17 +80,34 @@ func New(instName string, stdout, stderr io.Writer, sigintCh chan os.Signal) (*H
 		return nil, err
 	}
 
-	var udpDNSLocalPort int
+	var udpDNSLocalPort, tcpDNSLocalPort int
 	if *y.UseHostResolver {
-		udpDNSLocalPort, err = findFreeUDPLocalPort()
+		udpDNSLocalPort, tcpDNSLocalPort, err = determineDNSLocalPorts(filepath.Join(inst.Dir, filenames.DNSLocalPorts))
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if err := cidata.GenerateISO9660(inst.Dir, instName, y, udpDNSLocalPort); err != nil {
+	ciRes, err := cidata.GenerateISO9660(inst.Dir, instName, y, udpDNSLocalPort, tcpDNSLocalPort)
+	if err != nil {
 		return nil, err
 	}
+	ciLog := l.WithFields(logrus.Fields{
+		"size":         ciRes.Size,
+		"containerd":   ciRes.ContainerdArchiveStatus,
+		"dnsAddresses": ciRes.DNSAddresses,
+	})
+	if ciRes.Rewritten {
+		ciLog.Debugf("Generated %q", filenames.CIDataISO)
+	} else {
+		ciLog.Debugf("Reusing %q, as its content is unchanged", filenames.CIDataISO)
+	}
+	if y.CIData.Format == limayaml.CIDataFormatIgnition {
+		if err := cidata.GenerateIgnition(inst.Dir, instName, y); err != nil {
+			return nil, err
+		}
+		l.Debugf("Generated %q", filenames.IgnitionConfig)
+	}
 
 	qCfg := qemu.Config{
 		Name:         instName,
@@ -100,7 +120,11 @@ func New(instName string, stdout, stderr io.Writer, sigintCh chan os.Signal) (*H
 		return nil, err
 	}
 
-	sshArgs, err := sshutil.SSHArgs(inst.Dir, *y.SSH.LoadDotSSHPubKeys)
+	username, _, err := limayaml.GuestUser(y, false)
+	if err != nil {
+		return nil, err
+	}
+	sshArgs, err := sshutil.SSHArgs(inst.Dir, username, *y.SSH.LoadDotSSHPubKeys)
 	if err != nil {
 		return nil, err
 	}
@@ -126,6 +150,7 @@ func New(instName string, stdout, stderr io.Writer, sigintCh chan os.Signal) (*H
 		y:               y,
 		sshLocalPort:    sshLocalPort,
 		udpDNSLocalPort: udpDNSLocalPort,
+		tcpDNSLocalPort: tcpDNSLocalPort,
 		instDir:         inst.Dir,
 		sshConfig:       sshConfig,
 		portForwarder:   newPortForwarder(l, sshConfig, sshLocalPort, rules),
@@ -149,7 +174,7 @@ func determineSSHLocalPort(y *limayaml.LimaYAML, instName string) (int, error) {
 		// use hard-coded value for "default" instance, for backward compatibility
 		return 60022, nil
 	default:
-		sshLocalPort, err := findFreeTCPLocalPort()
+		sshLocalPort, err := findFreeTCPLocalPort(0)
 		if err != nil {
 			return 0, fmt.Errorf("failed to find a free port, try setting `ssh.localPort` manually: %w", err)
 		}
@@ -157,13 +182,42 @@ func determineSSHLocalPort(y *limayaml.LimaYAML, instName string) (int, error) {
 	}
 }
 
-func findFreeTCPLocalPort() (int, error) {
-	lAddr0, err := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+// determineDNSLocalPorts returns the UDP and TCP ports of the DNS server of the host agent.
+// The ports of the previous start, recorded at portsPath, are reused while they are free, as they are
+// written to the cidata ISO, which would otherwise have to be rewritten on every start.
+func determineDNSLocalPorts(portsPath string) (int, int, error) {
+	var udpPort, tcpPort int
+	if b, err := os.ReadFile(portsPath); err == nil {
+		if _, err := fmt.Sscanf(string(b), "%d %d", &udpPort, &tcpPort); err != nil {
+			logrus.WithError(err).Debugf("Ignoring the ports in %q", portsPath)
+			udpPort, tcpPort = 0, 0
+		}
+	}
+	udpPort, err := findFreeUDPLocalPort(udpPort)
+	if err != nil {
+		return 0, 0, err
+	}
+	tcpPort, err = findFreeTCPLocalPort(tcpPort)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.WriteFile(portsPath, []byte(fmt.Sprintf("%d %d\n", udpPort, tcpPort)), 0644); err != nil {
+		return 0, 0, err
+	}
+	return udpPort, tcpPort, nil
+}
+
+// findFreeTCPLocalPort returns preferred if it is free, or any free port otherwise, e.g., when preferred is 0.
+func findFreeTCPLocalPort(preferred int) (int, error) {
+	lAddr0, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("127.0.0.1:%d", preferred))
 	if err != nil {
 		return 0, err
 	}
 	l, err := net.ListenTCP("tcp4", lAddr0)
 	if err != nil {
+		if preferred != 0 {
+			return findFreeTCPLocalPort(0)
+		}
 		return 0, err
 	}
 	defer l.Close()
@@ -179,13 +233,17 @@ func findFreeTCPLocalPort() (int, error) {
 	return port, nil
 }
 
-func findFreeUDPLocalPort() (int, error) {
-	lAddr0, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+// findFreeUDPLocalPort returns preferred if it is free, or any free port otherwise, e.g., when preferred is 0.
+func findFreeUDPLocalPort(preferred int) (int, error) {
+	lAddr0, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%d", preferred))
 	if err != nil {
 		return 0, err
 	}
 	l, err := net.ListenUDP("udp4", lAddr0)
 	if err != nil {
+		if preferred != 0 {
+			return findFreeUDPLocalPort(0)
+		}
 		return 0, err
 	}
 	defer l.Close()
@@ -235,7 +293,32 @@ func (a *HostAgent) Run(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("cannot start DNS server: %w", err)
 		}
-		defer func() { _ = dnsServer.Shutdown() }()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := dnsServer.ShutdownContext(shutdownCtx); err != nil {
+				a.l.WithError(err).Warn("failed to shut down the DNS server")
+			}
+		}()
+		go func() {
+			for dnsErr := range dnsServer.Errors() {
+				a.l.WithError(dnsErr).Warn("DNS server failed")
+			}
+		}()
+		// SIGHUP flushes the DNS cache, e.g., after a record has been changed upstream
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hupCh:
+					a.l.Infof("Flushed %d responses from the DNS cache", dnsServer.FlushCache(""))
+				}
+			}
+		}()
 	}
 
 	qCmd := exec.CommandContext(ctx, a.qExe, a.qArgs...)
@@ -0,0 +1,38 @@
+package hostagent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDetermineDNSLocalPorts(t *testing.T) {
+	portsPath := filepath.Join(t.TempDir(), "dns.ports")
+	udpPort, tcpPort, err := determineDNSLocalPorts(portsPath)
+	assert.NilError(t, err)
+	assert.Assert(t, udpPort > 0 && tcpPort > 0)
+
+	// The ports of the previous start are reused while they are free
+	udpPort2, tcpPort2, err := determineDNSLocalPorts(portsPath)
+	assert.NilError(t, err)
+	assert.Equal(t, udpPort2, udpPort)
+	assert.Equal(t, tcpPort2, tcpPort)
+
+	l, err := net.Listen("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(tcpPort)))
+	assert.NilError(t, err)
+	defer l.Close()
+	udpPort2, tcpPort2, err = determineDNSLocalPorts(portsPath)
+	assert.NilError(t, err)
+	assert.Equal(t, udpPort2, udpPort)
+	assert.Assert(t, tcpPort2 != tcpPort)
+
+	// A corrupted file is ignored
+	assert.NilError(t, os.WriteFile(portsPath, []byte("garbage"), 0644))
+	udpPort2, tcpPort2, err = determineDNSLocalPorts(portsPath)
+	assert.NilError(t, err)
+	assert.Assert(t, udpPort2 > 0 && tcpPort2 > 0)
+}
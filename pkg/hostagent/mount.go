@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/lima-vm/lima/pkg/limayaml"
@@ -48,7 +49,7 @@ func (a *HostAgent) setupMount(ctx context.Context, m limayaml.Mount) (*mount, e
 		RemotePath: expanded,
 		Readonly:   !m.Writable,
 		// NOTE: allow_other requires "user_allow_other" in /etc/fuse.conf
-		SSHFSAdditionalArgs: []string{"-o", "allow_other"},
+		SSHFSAdditionalArgs: sshfsAdditionalArgs(m, "allow_other"),
 	}
 	if err := rsf.Prepare(); err != nil {
 		return nil, fmt.Errorf("failed to prepare reverse sshfs for %q: %w", expanded, err)
@@ -56,7 +57,7 @@ func (a *HostAgent) setupMount(ctx context.Context, m limayaml.Mount) (*mount, e
 	if err := rsf.Start(); err != nil {
 		a.l.WithError(err).Warnf("failed to mount reverse sshfs for %q, retrying with `-o nonempty`", expanded)
 		// NOTE: nonempty is not supported for libfuse3: https://github.com/canonical/multipass/issues/1381
-		rsf.SSHFSAdditionalArgs = []string{"-o", "nonempty"}
+		rsf.SSHFSAdditionalArgs = sshfsAdditionalArgs(m, "nonempty")
 		if err := rsf.Start(); err != nil {
 			return nil, fmt.Errorf("failed to mount reverse sshfs for %q: %w", expanded, err)
 		}
@@ -73,3 +74,9 @@ func (a *HostAgent) setupMount(ctx context.Context, m limayaml.Mount) (*mount, e
 	}
 	return res, nil
 }
+
+// sshfsAdditionalArgs returns the sshfs arguments for opt and the options of m.
+func sshfsAdditionalArgs(m limayaml.Mount, opt string) []string {
+	opts := append([]string{opt}, m.Options...)
+	return []string{"-o", strings.Join(opts, ",")}
+}
@@ -0,0 +1,96 @@
+package iso9660util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+)
+
+const (
+	fatSectorSize = 512
+	// fatMinSize is the minimum size of the FAT32 images, so that they have enough clusters
+	// to be recognized as FAT32 rather than FAT16 by every reader.
+	fatMinSize = 64 * 1024 * 1024
+	// fatClusterSize is the largest cluster size used by fat32.Create for the images up to 8 GiB.
+	fatClusterSize = 4096
+)
+
+// WriteFAT writes the FAT32 image to imagePath, like Write does for ISO9660.
+// Unlike ISO9660, FAT has no permission bits, so the guest has to set them with the mount options (fmask, dmask).
+//
+// The size of the image is computed from the sizes of the entries, so the readers that are not
+// io.ReadSeeker are read into memory first.
+func WriteFAT(imagePath, label string, layout []Entry) error {
+	return writeImage(imagePath, func(imageFile *os.File) error {
+		return writeFAT(imageFile, label, layout)
+	})
+}
+
+func writeFAT(imageFile *os.File, label string, layout []Entry) error {
+	var dataSize int64
+	sized := make([]Entry, len(layout))
+	for i, f := range layout {
+		if err := ValidatePath(f.Path); err != nil {
+			return err
+		}
+		r, size, err := sizedReader(f.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to get the size of %q: %w", f.Path, err)
+		}
+		// Each file, and each directory, takes at least one cluster
+		dataSize += (size/fatClusterSize + 2) * fatClusterSize
+		sized[i] = Entry{Path: f.Path, Reader: r}
+	}
+	// The two copies of the file allocation table take 8 bytes per 512 bytes cluster
+	size := dataSize + dataSize/(fatSectorSize/8) + 1024*1024
+	if size < fatMinSize {
+		size = fatMinSize
+	}
+	size = (size + fatSectorSize - 1) / fatSectorSize * fatSectorSize
+	// fat32.Create does not extend the file, and some readers refuse images shorter than their filesystem
+	if err := imageFile.Truncate(size); err != nil {
+		return err
+	}
+	fs, err := fat32.Create(imageFile, size, 0, fatSectorSize, label)
+	if err != nil {
+		return err
+	}
+	for _, f := range sized {
+		// fat32 resolves the paths from the root directory
+		if _, err := WriteFile(fs, path.Join("/", f.Path), f.Reader); err != nil {
+			return fmt.Errorf("failed to write %q: %w", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// sizedReader returns a reader with the content of r, and its size.
+// The content of r is read into memory unless r is an io.ReadSeeker, in which case r is returned as is,
+// positioned at the original offset.
+func sizedReader(r io.Reader) (io.Reader, int64, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(b), int64(len(b)), nil
+	}
+	cur, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := rs.Seek(cur, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return rs, end - cur, nil
+}
@@ -1,9 +1,14 @@
 package iso9660util
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/filesystem/iso9660"
@@ -14,24 +19,121 @@ type Entry struct {
 	Reader io.Reader
 }
 
-func Write(isoPath, label string, layout []Entry) error {
-	if err := os.RemoveAll(isoPath); err != nil {
-		return err
+// MaxNameLen is the maximum length of each element of the paths in the image.
+const MaxNameLen = 30
+
+// ValidatePath checks that each element of p is at most MaxNameLen characters long,
+// and only consists of ASCII letters, digits, '.', '_', and '-'.
+// Other characters are mangled or rejected by some ISO9660 readers.
+func ValidatePath(p string) error {
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			return fmt.Errorf("path %q must not have an empty element", p)
+		}
+		if len(name) > MaxNameLen {
+			return fmt.Errorf("path %q has an element longer than %d characters: %q", p, MaxNameLen, name)
+		}
+		if name == "." || name == ".." {
+			return fmt.Errorf("path %q must not have a %q element", p, name)
+		}
+		for _, c := range name {
+			if !validNameChar(c) {
+				return fmt.Errorf("path %q has an invalid character %q", p, c)
+			}
+		}
 	}
+	return nil
+}
+
+func validNameChar(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	case c == '.', c == '_', c == '-':
+		return true
+	}
+	return false
+}
 
-	isoFile, err := os.Create(isoPath)
+// JoinPath joins elem into the path of an entry of the image, and validates it with ValidatePath.
+// The paths of the entries should be built with JoinPath, so that an invalid path is reported where it is made,
+// rather than when writing the image.
+func JoinPath(elem ...string) (string, error) {
+	p := strings.Join(elem, "/")
+	for _, e := range elem {
+		if e == "" {
+			// ValidatePath ignores the leading and the trailing slashes
+			return "", fmt.Errorf("path %q must not have an empty element", p)
+		}
+	}
+	if err := ValidatePath(p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// Writer writes the entries of layout to a filesystem image at imagePath, with the volume label label.
+// The paths of the entries must be valid for ValidatePath.
+type Writer interface {
+	Write(imagePath, label string, layout []Entry) error
+}
+
+// WriterFunc adapts a function to Writer.
+type WriterFunc func(imagePath, label string, layout []Entry) error
+
+func (f WriterFunc) Write(imagePath, label string, layout []Entry) error {
+	return f(imagePath, label, layout)
+}
+
+var (
+	// ISO9660Writer writes ISO9660 images with Rock Ridge extensions, with Write.
+	ISO9660Writer Writer = WriterFunc(Write)
+	// FATWriter writes FAT32 images, with WriteFAT.
+	FATWriter Writer = WriterFunc(WriteFAT)
+)
+
+// Write writes the ISO9660 image to isoPath.
+// The image is written to a temporary file in the same directory and then renamed to isoPath,
+// so that an interrupted write never leaves a truncated image behind.
+func Write(isoPath, label string, layout []Entry) error {
+	return writeImage(isoPath, func(isoFile *os.File) error {
+		return write(isoFile, label, layout)
+	})
+}
+
+// writeImage calls write with a temporary file in the directory of imagePath, and renames the file to imagePath
+// when write succeeds.
+func writeImage(imagePath string, write func(*os.File) error) (retErr error) {
+	imageFile, err := ioutil.TempFile(filepath.Dir(imagePath), filepath.Base(imagePath)+".tmp-")
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if retErr != nil {
+			imageFile.Close()
+			os.Remove(imageFile.Name())
+		}
+	}()
 
-	defer isoFile.Close()
+	if err := write(imageFile); err != nil {
+		return err
+	}
+	if err := imageFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(imageFile.Name(), imagePath)
+}
 
+func write(isoFile *os.File, label string, layout []Entry) error {
 	fs, err := iso9660.Create(isoFile, 0, 0, 0, "")
 	if err != nil {
 		return err
 	}
 
 	for _, f := range layout {
+		if err := ValidatePath(f.Path); err != nil {
+			return err
+		}
 		if _, err := WriteFile(fs, f.Path, f.Reader); err != nil {
 			return err
 		}
@@ -41,11 +143,7 @@ func Write(isoPath, label string, layout []Entry) error {
 		RockRidge:        true,
 		VolumeIdentifier: label,
 	}
-	if err := fs.Finalize(finalizeOptions); err != nil {
-		return err
-	}
-
-	return isoFile.Close()
+	return fs.Finalize(finalizeOptions)
 }
 
 func WriteFile(fs filesystem.FileSystem, pathStr string, r io.Reader) (int64, error) {
@@ -62,6 +160,50 @@ func WriteFile(fs filesystem.FileSystem, pathStr string, r io.Reader) (int64, er
 	return io.Copy(f, r)
 }
 
+// ReadLayout returns the regular files of the ISO9660 image imageFile, in the lexical order of their paths.
+// The readers of the entries read from imageFile, so they must be consumed before imageFile is closed.
+func ReadLayout(imageFile *os.File) ([]Entry, error) {
+	fileInfo, err := imageFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := iso9660.Read(imageFile, fileInfo.Size(), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var layout []Entry
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		infos, err := fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		for _, info := range infos {
+			p := path.Join(dir, info.Name())
+			if info.IsDir() {
+				if err := walk(p); err != nil {
+					return err
+				}
+				continue
+			}
+			f, err := fs.OpenFile(p, os.O_RDONLY)
+			if err != nil {
+				return err
+			}
+			layout = append(layout, Entry{
+				Path:   strings.TrimPrefix(p, "/"),
+				Reader: f,
+			})
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
 func IsISO9660(imagePath string) (bool, error) {
 	imageFile, err := os.Open(imagePath)
 	if err != nil {
@@ -0,0 +1,154 @@
+package iso9660util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"gotest.tools/v3/assert"
+)
+
+func TestValidatePath(t *testing.T) {
+	for _, p := range []string{
+		"user-data",
+		"boot/05-persistent-data-volume.sh",
+		"provision.dependency/00000000",
+		fmt.Sprintf("provision.dependency/%08d", 123456789),
+		strings.Repeat("a", MaxNameLen) + "/" + strings.Repeat("b", MaxNameLen),
+	} {
+		assert.NilError(t, ValidatePath(p), p)
+	}
+
+	err := ValidatePath("provision.some-very-long-mode-name/00000000")
+	assert.Error(t, err, `path "provision.some-very-long-mode-name/00000000" has an element longer than 30 characters: "provision.some-very-long-mode-name"`)
+	assert.ErrorContains(t, ValidatePath("provision.system//00000000"), "must not have an empty element")
+	assert.ErrorContains(t, ValidatePath("copy/../00000000"), `must not have a ".." element`)
+	assert.Error(t, ValidatePath("nerdctl full.tgz"), `path "nerdctl full.tgz" has an invalid character ' '`)
+	assert.ErrorContains(t, ValidatePath("lima-guestagent\x00"), "invalid character")
+}
+
+func TestJoinPath(t *testing.T) {
+	p, err := JoinPath("provision.system", "00000000")
+	assert.NilError(t, err)
+	assert.Equal(t, p, "provision.system/00000000")
+
+	_, err = JoinPath(strings.Repeat("a", MaxNameLen+1) + ".tgz")
+	assert.ErrorContains(t, err, "longer than 30 characters")
+	_, err = JoinPath("provision.system", "")
+	assert.ErrorContains(t, err, "must not have an empty element")
+	_, err = JoinPath("provision.sys:tem", "00000000")
+	assert.ErrorContains(t, err, "invalid character")
+}
+
+func TestWriteRejectsLongPath(t *testing.T) {
+	isoPath := filepath.Join(t.TempDir(), "cidata.iso")
+	layout := []Entry{
+		{Path: "copy/" + strings.Repeat("a", MaxNameLen+1), Reader: strings.NewReader("")},
+	}
+	assert.ErrorContains(t, Write(isoPath, "cidata", layout), "longer than 30 characters")
+	_, err := os.Stat(isoPath)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	isoPath := filepath.Join(dir, "cidata.iso")
+	assert.NilError(t, Write(isoPath, "cidata", []Entry{{Path: "meta-data", Reader: strings.NewReader("good")}}))
+	good, err := ioutil.ReadFile(isoPath)
+	assert.NilError(t, err)
+
+	// A failed write leaves the previous image and no temporary file behind
+	errRead := errors.New("read error")
+	layout := []Entry{
+		{Path: "meta-data", Reader: strings.NewReader("bad")},
+		{Path: "user-data", Reader: iotest.ErrReader(errRead)},
+	}
+	err = Write(isoPath, "cidata", layout)
+	assert.Assert(t, errors.Is(err, errRead), err)
+	b, err := ioutil.ReadFile(isoPath)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, b, good)
+	entries, err := os.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Name(), "cidata.iso")
+
+	// A successful write replaces the image
+	assert.NilError(t, Write(isoPath, "cidata", []Entry{{Path: "meta-data", Reader: strings.NewReader("new")}}))
+	b, err = ioutil.ReadFile(isoPath)
+	assert.NilError(t, err)
+	assert.Assert(t, string(b) != string(good))
+	entries, err = os.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+}
+
+func TestReadLayout(t *testing.T) {
+	isoPath := filepath.Join(t.TempDir(), "cidata.iso")
+	files := map[string]string{
+		"user-data":                         "#cloud-config\n",
+		"boot/05-persistent-data-volume.sh": "#!/bin/sh\n",
+		"provision.system/00000000":         "#!/bin/sh\necho hello\n",
+		"meta-data":                         "",
+	}
+	var layout []Entry
+	for p, content := range files {
+		layout = append(layout, Entry{Path: p, Reader: strings.NewReader(content)})
+	}
+	assert.NilError(t, Write(isoPath, "cidata", layout))
+
+	f, err := os.Open(isoPath)
+	assert.NilError(t, err)
+	defer f.Close()
+	read, err := ReadLayout(f)
+	assert.NilError(t, err)
+	var paths []string
+	for _, e := range read {
+		paths = append(paths, e.Path)
+		b, err := ioutil.ReadAll(e.Reader)
+		assert.NilError(t, err)
+		assert.Equal(t, string(b), files[e.Path], e.Path)
+	}
+	assert.DeepEqual(t, paths, []string{"boot/05-persistent-data-volume.sh", "meta-data", "provision.system/00000000", "user-data"})
+}
+
+func TestWriteFAT(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "cidata.iso")
+	files := map[string]string{
+		"user-data":                 "#cloud-config\n",
+		"provision.system/00000000": "#!/bin/sh\necho hello\n",
+		"lima-guestagent":           strings.Repeat("a", 100000),
+		"meta-data":                 "",
+	}
+	var layout []Entry
+	for p, content := range files {
+		// The guest agent binary is not an io.ReadSeeker
+		layout = append(layout, Entry{Path: p, Reader: ioutil.NopCloser(strings.NewReader(content))})
+	}
+	assert.NilError(t, FATWriter.Write(imagePath, "cidata", layout))
+
+	f, err := os.Open(imagePath)
+	assert.NilError(t, err)
+	defer f.Close()
+	st, err := f.Stat()
+	assert.NilError(t, err)
+	assert.Assert(t, st.Size() >= fatMinSize)
+	fs, err := fat32.Read(f, st.Size(), 0, fatSectorSize)
+	assert.NilError(t, err)
+	assert.Equal(t, strings.TrimSpace(fs.Label()), "cidata")
+	for p, content := range files {
+		r, err := fs.OpenFile("/"+p, os.O_RDONLY)
+		assert.NilError(t, err, p)
+		b, err := ioutil.ReadAll(r)
+		assert.NilError(t, err, p)
+		assert.Equal(t, string(b), content, p)
+	}
+
+	assert.ErrorContains(t, WriteFAT(imagePath, "cidata", []Entry{{Path: "copy/../x", Reader: strings.NewReader("")}}), `".." element`)
+}
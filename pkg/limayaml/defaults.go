@@ -11,6 +11,30 @@ import (
 	"github.com/lima-vm/lima/pkg/osutil"
 )
 
+// GuestUser returns the name and the UID of the user of the guest: `user.name` and `user.uid` when set,
+// otherwise the ones of the user of the host (see osutil.LimaUser). warn is passed to osutil.LimaUser.
+func GuestUser(y *LimaYAML, warn bool) (string, int, error) {
+	name := y.User.Name
+	if name != "" && y.User.UID != nil {
+		return name, *y.User.UID, nil
+	}
+	u, err := osutil.LimaUser(warn && name == "")
+	if err != nil {
+		return "", 0, err
+	}
+	if name == "" {
+		name = u.Username
+	}
+	if y.User.UID != nil {
+		return name, *y.User.UID, nil
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return "", 0, err
+	}
+	return name, uid, nil
+}
+
 func defaultContainerdArchives() []File {
 	const nerdctlVersion = "0.12.1"
 	location := func(goarch string) string {
@@ -67,12 +91,21 @@ func FillDefault(y *LimaYAML, filePath string) {
 	if y.SSH.LoadDotSSHPubKeys == nil {
 		y.SSH.LoadDotSSHPubKeys = &[]bool{true}[0]
 	}
+	if y.SSH.AllowWeakPubKeys == nil {
+		y.SSH.AllowWeakPubKeys = &[]bool{false}[0]
+	}
 	for i := range y.Provision {
 		provision := &y.Provision[i]
 		if provision.Mode == "" {
 			provision.Mode = ProvisionModeSystem
 		}
 	}
+	for i := range y.CopyToGuest {
+		f := &y.CopyToGuest[i]
+		if f.Mode == "" {
+			f.Mode = "0644"
+		}
+	}
 	if y.Containerd.System == nil {
 		y.Containerd.System = &[]bool{false}[0]
 	}
@@ -104,6 +137,69 @@ func FillDefault(y *LimaYAML, filePath string) {
 	if y.UseHostResolver == nil {
 		y.UseHostResolver = &[]bool{true}[0]
 	}
+	if y.DNSPrecedence == "" {
+		y.DNSPrecedence = DNSPrecedenceAuto
+	}
+	if y.HostResolver.Cache.Enabled == nil {
+		y.HostResolver.Cache.Enabled = &[]bool{true}[0]
+	}
+	if y.HostResolver.Cache.MaxEntries == 0 {
+		y.HostResolver.Cache.MaxEntries = 1000
+	}
+	if y.HostResolver.NegativeCache.Enabled == nil {
+		y.HostResolver.NegativeCache.Enabled = &[]bool{true}[0]
+	}
+	if y.HostResolver.NegativeCache.MaxEntries == 0 {
+		y.HostResolver.NegativeCache.MaxEntries = 1000
+	}
+	if y.HostResolver.DNS64.Enabled == nil {
+		y.HostResolver.DNS64.Enabled = &[]bool{false}[0]
+	}
+	if y.HostResolver.DNS64.Prefix == "" {
+		y.HostResolver.DNS64.Prefix = "64:ff9b::/96"
+	}
+	if y.HostResolver.MDNS.Mode == "" {
+		y.HostResolver.MDNS.Mode = MDNSModeHost
+	}
+	if y.HostResolver.MDNS.Responder == "" {
+		y.HostResolver.MDNS.Responder = "224.0.0.251:5353"
+	}
+	if y.HostResolver.UnixSocket == nil {
+		y.HostResolver.UnixSocket = &[]bool{false}[0]
+	}
+	if y.HostResolver.Timeout == "" {
+		y.HostResolver.Timeout = "2s"
+	}
+	if y.HostResolver.Retries == nil {
+		y.HostResolver.Retries = &[]int{1}[0]
+	}
+	if y.HostResolver.Parallel == nil {
+		y.HostResolver.Parallel = &[]bool{false}[0]
+	}
+	if y.HostResolver.BlockResponse == "" {
+		y.HostResolver.BlockResponse = BlockResponseNXDomain
+	}
+	if y.HostResolver.LogQueries == nil {
+		y.HostResolver.LogQueries = &[]bool{false}[0]
+	}
+	if y.HostResolver.RoundRobin == nil {
+		y.HostResolver.RoundRobin = &[]bool{false}[0]
+	}
+	if y.HostResolver.FailureThreshold == nil {
+		y.HostResolver.FailureThreshold = &[]int{0}[0]
+	}
+	if y.HostResolver.Cooldown == "" {
+		y.HostResolver.Cooldown = "30s"
+	}
+	if y.CIData.StableInstanceID == nil {
+		y.CIData.StableInstanceID = &[]bool{false}[0]
+	}
+	if y.CIData.Format == "" {
+		y.CIData.Format = CIDataFormatCloudInit
+	}
+	if y.CIData.Filesystem == "" {
+		y.CIData.Filesystem = CIDataFilesystemISO9660
+	}
 
 	if len(y.Network.VDEDeprecated) > 0 && len(y.Networks) == 0 {
 		for _, vde := range y.Network.VDEDeprecated {
@@ -7,24 +7,39 @@ import (
 )
 
 type LimaYAML struct {
-	Arch            Arch              `yaml:"arch,omitempty" json:"arch,omitempty"`
-	Images          []File            `yaml:"images" json:"images"` // REQUIRED
-	CPUs            int               `yaml:"cpus,omitempty" json:"cpus,omitempty"`
-	Memory          string            `yaml:"memory,omitempty" json:"memory,omitempty"` // go-units.RAMInBytes
-	Disk            string            `yaml:"disk,omitempty" json:"disk,omitempty"`     // go-units.RAMInBytes
-	Mounts          []Mount           `yaml:"mounts,omitempty" json:"mounts,omitempty"`
-	SSH             SSH               `yaml:"ssh,omitempty" json:"ssh,omitempty"` // REQUIRED (FIXME)
-	Firmware        Firmware          `yaml:"firmware,omitempty" json:"firmware,omitempty"`
-	Video           Video             `yaml:"video,omitempty" json:"video,omitempty"`
-	Provision       []Provision       `yaml:"provision,omitempty" json:"provision,omitempty"`
-	Containerd      Containerd        `yaml:"containerd,omitempty" json:"containerd,omitempty"`
-	Probes          []Probe           `yaml:"probes,omitempty" json:"probes,omitempty"`
-	PortForwards    []PortForward     `yaml:"portForwards,omitempty" json:"portForwards,omitempty"`
-	Networks        []Network         `yaml:"networks,omitempty" json:"networks,omitempty"`
-	Network         NetworkDeprecated `yaml:"network,omitempty" json:"network,omitempty"` // DEPRECATED, use `networks` instead
-	Env             map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
-	DNS             []net.IP          `yaml:"dns,omitempty" json:"dns,omitempty"`
-	UseHostResolver *bool             `yaml:"useHostResolver,omitempty" json:"useHostResolver,omitempty"`
+	Arch         Arch              `yaml:"arch,omitempty" json:"arch,omitempty"`
+	Distro       string            `yaml:"distro,omitempty" json:"distro,omitempty"`     // the ID of os-release(5), e.g., "ubuntu"
+	Hostname     string            `yaml:"hostname,omitempty" json:"hostname,omitempty"` // default: "lima-<instance name>"
+	Timezone     string            `yaml:"timezone,omitempty" json:"timezone,omitempty"` // tz database name, e.g., "Asia/Tokyo"
+	Locale       string            `yaml:"locale,omitempty" json:"locale,omitempty"`     // e.g., "en_US.UTF-8"
+	Images       []File            `yaml:"images" json:"images"`                         // REQUIRED
+	CPUs         int               `yaml:"cpus,omitempty" json:"cpus,omitempty"`
+	Memory       string            `yaml:"memory,omitempty" json:"memory,omitempty"` // go-units.RAMInBytes
+	Disk         string            `yaml:"disk,omitempty" json:"disk,omitempty"`     // go-units.RAMInBytes
+	Mounts       []Mount           `yaml:"mounts,omitempty" json:"mounts,omitempty"`
+	SSH          SSH               `yaml:"ssh,omitempty" json:"ssh,omitempty"` // REQUIRED (FIXME)
+	User         User              `yaml:"user,omitempty" json:"user,omitempty"`
+	Firmware     Firmware          `yaml:"firmware,omitempty" json:"firmware,omitempty"`
+	Video        Video             `yaml:"video,omitempty" json:"video,omitempty"`
+	Provision    []Provision       `yaml:"provision,omitempty" json:"provision,omitempty"`
+	Packages     []string          `yaml:"packages,omitempty" json:"packages,omitempty"`
+	CopyToGuest  []CopyToGuest     `yaml:"copyToGuest,omitempty" json:"copyToGuest,omitempty"`
+	Containerd   Containerd        `yaml:"containerd,omitempty" json:"containerd,omitempty"`
+	Probes       []Probe           `yaml:"probes,omitempty" json:"probes,omitempty"`
+	PortForwards []PortForward     `yaml:"portForwards,omitempty" json:"portForwards,omitempty"`
+	Networks     []Network         `yaml:"networks,omitempty" json:"networks,omitempty"`
+	Network      NetworkDeprecated `yaml:"network,omitempty" json:"network,omitempty"` // DEPRECATED, use `networks` instead
+	Env          map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	EnvFiles     []string          `yaml:"envFiles,omitempty" json:"envFiles,omitempty"`
+	CACerts      []string          `yaml:"caCerts,omitempty" json:"caCerts,omitempty"` // file paths or inline PEM
+	DNS          []net.IP          `yaml:"dns,omitempty" json:"dns,omitempty"`
+	// DNSSearchDomains are the search domains of the guest, used with or without the host resolver
+	DNSSearchDomains []string      `yaml:"dnsSearchDomains,omitempty" json:"dnsSearchDomains,omitempty"`
+	DNSOptions       []string      `yaml:"dnsOptions,omitempty" json:"dnsOptions,omitempty"` // resolv.conf(5) options, see ParseDNSOption
+	UseHostResolver  *bool         `yaml:"useHostResolver,omitempty" json:"useHostResolver,omitempty"`
+	DNSPrecedence    DNSPrecedence `yaml:"dnsPrecedence,omitempty" json:"dnsPrecedence,omitempty"` // default: "auto"
+	HostResolver     HostResolver  `yaml:"hostResolver,omitempty" json:"hostResolver,omitempty"`
+	CIData           CIData        `yaml:"cidata,omitempty" json:"cidata,omitempty"`
 }
 
 type Arch = string
@@ -43,6 +58,16 @@ type File struct {
 type Mount struct {
 	Location string `yaml:"location" json:"location"` // REQUIRED
 	Writable bool   `yaml:"writable,omitempty" json:"writable,omitempty"`
+	// Options are passed to sshfs as additional `-o` options, e.g. "cache=no".
+	// Use Writable instead of "ro" and "rw".
+	Options []string `yaml:"options,omitempty" json:"options,omitempty"`
+}
+
+// User is the user of the guest. The fields that are not set default to the ones of the user of the host,
+// see GuestUser.
+type User struct {
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	UID  *int   `yaml:"uid,omitempty" json:"uid,omitempty"`
 }
 
 type SSH struct {
@@ -51,6 +76,10 @@ type SSH struct {
 	// LoadDotSSHPubKeys loads ~/.ssh/*.pub in addition to $LIMA_HOME/_config/user.pub .
 	// Default: true
 	LoadDotSSHPubKeys *bool `yaml:"loadDotSSHPubKeys,omitempty" json:"loadDotSSHPubKeys,omitempty"`
+
+	// AllowWeakPubKeys includes the DSA keys and the RSA keys shorter than 3072 bits.
+	// Default: false
+	AllowWeakPubKeys *bool `yaml:"allowWeakPubKeys,omitempty" json:"allowWeakPubKeys,omitempty"`
 }
 
 type Firmware struct {
@@ -69,11 +98,61 @@ type ProvisionMode = string
 const (
 	ProvisionModeSystem ProvisionMode = "system"
 	ProvisionModeUser   ProvisionMode = "user"
+	// ProvisionModeDependency scripts are executed with the root privilege before the other scripts.
+	// When any of them fails, the other scripts are not executed.
+	ProvisionModeDependency ProvisionMode = "dependency"
 )
 
 type Provision struct {
 	Mode   ProvisionMode `yaml:"mode" json:"mode"` // default: "system"
-	Script string        `yaml:"script" json:"script"`
+	Script string        `yaml:"script,omitempty" json:"script,omitempty"`
+	// File is the path of the script on the host, as an alternative to Script.
+	// The file is read when the cidata ISO is generated.
+	File string `yaml:"file,omitempty" json:"file,omitempty"`
+	// Order sorts the scripts of the same mode in ascending order.
+	// Scripts with the same order are executed in the list order.
+	// Default: 0
+	Order int `yaml:"order,omitempty" json:"order,omitempty"`
+	// Condition restricts the script to the guests it matches. The script is not embedded
+	// in the cidata ISO for the other guests.
+	// Default: none (the script is always embedded)
+	Condition *ProvisionCondition `yaml:"condition,omitempty" json:"condition,omitempty"`
+}
+
+// ProvisionCondition matches the guests with all of the fields that are set.
+type ProvisionCondition struct {
+	Arch   Arch   `yaml:"arch,omitempty" json:"arch,omitempty"`
+	Distro string `yaml:"distro,omitempty" json:"distro,omitempty"` // matches the top-level `distro`
+}
+
+// Matches returns whether the script is embedded for a guest with arch and distro.
+func (p Provision) Matches(arch Arch, distro string) bool {
+	c := p.Condition
+	if c == nil {
+		return true
+	}
+	return (c.Arch == "" || c.Arch == arch) && (c.Distro == "" || c.Distro == distro)
+}
+
+// MatchingProvision returns the provision scripts of y that match y.Arch and y.Distro, in the list order.
+func MatchingProvision(y *LimaYAML) []Provision {
+	var res []Provision
+	for _, p := range y.Provision {
+		if p.Matches(y.Arch, y.Distro) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+type CopyToGuest struct {
+	// Source is the path of the file on the host. The file is read when the cidata ISO is generated.
+	Source string `yaml:"source" json:"source"`
+	// Destination is the absolute path of the file in the guest.
+	Destination string `yaml:"destination" json:"destination"`
+	// Mode is the octal permission bits of the file in the guest.
+	// Default: "0644"
+	Mode string `yaml:"mode,omitempty" json:"mode,omitempty"`
 }
 
 type Containerd struct {
@@ -112,6 +191,162 @@ type PortForward struct {
 	Ignore         bool   `yaml:"ignore,omitempty" json:"ignore,omitempty"`
 }
 
+type CIData struct {
+	// StableInstanceID derives the cloud-init instance ID from the cidata content instead of
+	// changing it on every boot, so cloud-init only processes the config again when it has changed.
+	// Default: false
+	StableInstanceID *bool `yaml:"stableInstanceID,omitempty" json:"stableInstanceID,omitempty"`
+	// Format is the format of the guest config. Default: "cloud-init"
+	Format CIDataFormat `yaml:"format,omitempty" json:"format,omitempty"`
+	// UserDataTemplate is the path of a Go template that replaces the built-in cloud-init user-data template.
+	// Default: "" (the built-in template)
+	UserDataTemplate string `yaml:"userDataTemplate,omitempty" json:"userDataTemplate,omitempty"`
+	// Filesystem is the filesystem of the cidata image. Default: "iso9660"
+	Filesystem CIDataFilesystem `yaml:"filesystem,omitempty" json:"filesystem,omitempty"`
+}
+
+type CIDataFormat = string
+
+const (
+	CIDataFormatCloudInit CIDataFormat = "cloud-init"
+	// CIDataFormatIgnition is for the distros that are provisioned with Ignition instead of cloud-init,
+	// such as Fedora CoreOS and Flatcar Container Linux.
+	CIDataFormatIgnition CIDataFormat = "ignition"
+)
+
+type CIDataFilesystem = string
+
+const (
+	CIDataFilesystemISO9660 CIDataFilesystem = "iso9660"
+	// CIDataFilesystemVFAT is for the guest kernels without ISO9660 support.
+	// The image is attached as a virtio disk instead of a CD-ROM.
+	CIDataFilesystemVFAT CIDataFilesystem = "vfat"
+)
+
+type HostResolver struct {
+	Cache         HostResolverCache `yaml:"cache,omitempty" json:"cache,omitempty"`
+	NegativeCache HostResolverCache `yaml:"negativeCache,omitempty" json:"negativeCache,omitempty"`
+	Hosts         map[string]string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	Timeout       string            `yaml:"timeout,omitempty" json:"timeout,omitempty"`   // time.ParseDuration, default: "2s"
+	Retries       *int              `yaml:"retries,omitempty" json:"retries,omitempty"`   // default: 1
+	Parallel      *bool             `yaml:"parallel,omitempty" json:"parallel,omitempty"` // default: false
+	DoH           []string          `yaml:"doh,omitempty" json:"doh,omitempty"`
+	LogQueries    *bool             `yaml:"logQueries,omitempty" json:"logQueries,omitempty"`   // default: false
+	MetricsPort   int               `yaml:"metricsPort,omitempty" json:"metricsPort,omitempty"` // default: 0 (disabled)
+	Block         []string          `yaml:"block,omitempty" json:"block,omitempty"`
+	BlockResponse BlockResponse     `yaml:"blockResponse,omitempty" json:"blockResponse,omitempty"` // default: "nxdomain"
+	RoundRobin    *bool             `yaml:"roundRobin,omitempty" json:"roundRobin,omitempty"`       // default: false
+	// FailureThreshold is the number of consecutive failures after which an upstream nameserver is skipped
+	// for the Cooldown period. 0 disables skipping. Default: 0
+	FailureThreshold *int   `yaml:"failureThreshold,omitempty" json:"failureThreshold,omitempty"`
+	Cooldown         string `yaml:"cooldown,omitempty" json:"cooldown,omitempty"` // time.ParseDuration, default: "30s"
+	// Fallback is the list of the IP addresses of the nameservers used when the nameservers of the host
+	// cannot be detected. Default: 8.8.8.8 and 1.1.1.1
+	Fallback []string `yaml:"fallback,omitempty" json:"fallback,omitempty"`
+	// Order is the list of the IP addresses of the nameservers (of the host, Fallback, or DNS) that are tried first,
+	// in this order. The other nameservers are tried after them. Default: none
+	Order []string `yaml:"order,omitempty" json:"order,omitempty"`
+	// Forward is the list of the domains whose names are resolved by their own nameservers (split DNS),
+	// instead of the nameservers of the host.
+	Forward []HostResolverForward `yaml:"forward,omitempty" json:"forward,omitempty"`
+	DNS64   HostResolverDNS64     `yaml:"dns64,omitempty" json:"dns64,omitempty"`
+	// TLDs restricts the resolver of the host to the names of some top-level domains.
+	TLDs HostResolverTLDs `yaml:"tlds,omitempty" json:"tlds,omitempty"`
+	// MDNS decides how the queries for the names of .local (multicast DNS, RFC 6762) are answered.
+	MDNS HostResolverMDNS `yaml:"mdns,omitempty" json:"mdns,omitempty"`
+	// UnixSocket makes the DNS server also listen on the "dns.sock" (stream) and "dns.dgram.sock" (datagram)
+	// Unix sockets of the instance directory. Default: false
+	UnixSocket *bool `yaml:"unixSocket,omitempty" json:"unixSocket,omitempty"`
+	// Records are the static TXT and SRV records, in the zone file format, see ParseHostResolverRecord.
+	Records []string `yaml:"records,omitempty" json:"records,omitempty"`
+	// Rewrite resolves the names of domains as the names of other domains.
+	Rewrite []HostResolverRewrite `yaml:"rewrite,omitempty" json:"rewrite,omitempty"`
+	// MaxUDPSize is the maximum size of the replies over UDP, in bytes; the larger replies are truncated.
+	// Default: 0 (the size advertised by the client with EDNS0, or 512 bytes)
+	MaxUDPSize int `yaml:"maxUDPSize,omitempty" json:"maxUDPSize,omitempty"`
+}
+
+// HostResolverRewrite resolves the names of From (and its subdomains) as the names of To, e.g.,
+// "db.staging.example.com" as "db.prod.example.com" for From "staging.example.com" and To "prod.example.com".
+// The answers are rewritten back to the names of From.
+type HostResolverRewrite struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+}
+
+// HostResolverDNS64 synthesizes AAAA records from A records (RFC 6147), for IPv6-only guests behind NAT64.
+type HostResolverDNS64 struct {
+	Enabled *bool  `yaml:"enabled,omitempty" json:"enabled,omitempty"` // default: false
+	Prefix  string `yaml:"prefix,omitempty" json:"prefix,omitempty"`   // default: "64:ff9b::/96"
+}
+
+// HostResolverTLDs decides by their top-level domains (e.g., "corp") which names are resolved by the resolver
+// of the host and its nameservers; the other names are resolved by Upstream. Allow and Deny are mutually exclusive,
+// and the filter is disabled when both are empty.
+// The names of "local" are never sent to Upstream, as they are only resolvable with multicast DNS:
+// they are answered with NXDOMAIN unless "local" is resolved by the host.
+type HostResolverTLDs struct {
+	Allow    []string `yaml:"allow,omitempty" json:"allow,omitempty"`       // only these TLDs are resolved by the host
+	Deny     []string `yaml:"deny,omitempty" json:"deny,omitempty"`         // all the TLDs but these are resolved by the host
+	Upstream []string `yaml:"upstream,omitempty" json:"upstream,omitempty"` // IP addresses, default: the fallback nameservers
+}
+
+type HostResolverForward struct {
+	Domain      string   `yaml:"domain" json:"domain"`           // e.g., "corp.example.com", including the subdomains
+	Nameservers []string `yaml:"nameservers" json:"nameservers"` // IP addresses
+	// Types restricts the nameservers to the queries of these types, e.g., "SRV". Default: all the types
+	Types []string `yaml:"types,omitempty" json:"types,omitempty"`
+}
+
+// DNSPrecedence decides how the nameservers of the guest are chosen from `useHostResolver`, `dns`,
+// and the nameservers of the host.
+type DNSPrecedence = string
+
+const (
+	// DNSPrecedenceAuto uses the host resolver when `useHostResolver` is true (`dns` must then be empty),
+	// otherwise `dns`, otherwise the nameservers of the host.
+	DNSPrecedenceAuto DNSPrecedence = "auto"
+	// DNSPrecedenceHostResolver always uses the host resolver, which forwards the queries to `dns` when set,
+	// instead of the nameservers of the host. `useHostResolver` must be true.
+	DNSPrecedenceHostResolver DNSPrecedence = "hostResolver"
+	// DNSPrecedenceDNS always uses `dns`, which must not be empty. `useHostResolver` must be false.
+	DNSPrecedenceDNS DNSPrecedence = "dns"
+)
+
+// HostResolverMDNS decides how the queries for the names of .local are answered.
+type HostResolverMDNS struct {
+	Mode MDNSMode `yaml:"mode,omitempty" json:"mode,omitempty"` // default: "host"
+	// Responder is the "IP:port" address of the mDNS responder of the "forward" mode.
+	// Default: "224.0.0.251:5353" (the mDNS multicast group)
+	Responder string `yaml:"responder,omitempty" json:"responder,omitempty"`
+}
+
+type MDNSMode = string
+
+const (
+	// MDNSModeHost resolves the names of .local like the other names, e.g., with the resolver of the host.
+	MDNSModeHost MDNSMode = "host"
+	// MDNSModeRefuse answers REFUSED without forwarding the query.
+	MDNSModeRefuse MDNSMode = "refuse"
+	// MDNSModeNotImp answers NOTIMP without forwarding the query.
+	MDNSModeNotImp MDNSMode = "notimp"
+	// MDNSModeForward sends the query to the mDNS responder as a legacy unicast query (RFC 6762 section 6.7),
+	// and answers NXDOMAIN when no responder replied.
+	MDNSModeForward MDNSMode = "forward"
+)
+
+type BlockResponse = string
+
+const (
+	BlockResponseNXDomain BlockResponse = "nxdomain"
+	BlockResponseNull     BlockResponse = "null"
+)
+
+type HostResolverCache struct {
+	Enabled    *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`       // default: true
+	MaxEntries int   `yaml:"maxEntries,omitempty" json:"maxEntries,omitempty"` // default: 1000
+}
+
 type Network struct {
 	// `Lima` and `VNL` are mutually exclusive; exactly one is required
 	Lima string `yaml:"lima,omitempty" json:"lima,omitempty"`
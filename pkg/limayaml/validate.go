@@ -1,278 +1,911 @@
 package limayaml
 
 import (
+	_ "crypto/sha512" // register sha384 and sha512 for go-digest
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"errors"
 
 	"github.com/docker/go-units"
+	"github.com/hashicorp/go-multierror"
 	"github.com/lima-vm/lima/pkg/localpathutil"
 	"github.com/lima-vm/lima/pkg/networks"
-	"github.com/lima-vm/lima/pkg/osutil"
 	qemu "github.com/lima-vm/lima/pkg/qemu/const"
+	"github.com/miekg/dns"
+	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
 )
 
+// Validate returns an error listing every problem of y.
+// The problems of a single item, such as `mounts[0]`, are reported one at a time.
+//
+// When warn is true, the stricter checks for new instances are done as well, and the dubious settings are logged as warnings.
 func Validate(y LimaYAML, warn bool) error {
+	var merr *multierror.Error
+	add := func(err error) {
+		if err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+
 	switch y.Arch {
 	case X8664, AARCH64:
 	default:
-		return fmt.Errorf("field `arch` must be %q or %q , got %q", X8664, AARCH64, y.Arch)
+		add(fmt.Errorf("field `arch` must be %q or %q , got %q", X8664, AARCH64, y.Arch))
+	}
+
+	if y.Hostname != "" {
+		if err := validateHostname(y.Hostname); err != nil {
+			add(fmt.Errorf("field `hostname` is invalid: %w", err))
+		}
+	}
+
+	if y.Timezone != "" {
+		// time.LoadLocation accepts "Local", which is not a name of the tz database
+		if _, err := time.LoadLocation(y.Timezone); err != nil || y.Timezone == "Local" {
+			add(fmt.Errorf("field `timezone` must be a name of the tz database, such as \"Asia/Tokyo\", got %q", y.Timezone))
+		}
+	}
+	if y.Locale != "" && !localeRegexp.MatchString(y.Locale) {
+		add(fmt.Errorf("field `locale` must be in the form of \"language[_territory][.codeset][@modifier]\", such as \"en_US.UTF-8\", got %q", y.Locale))
 	}
 
 	if len(y.Images) == 0 {
-		return errors.New("field `images` must be set")
+		add(errors.New("field `images` must be set"))
 	}
 	for i, f := range y.Images {
-		if !strings.Contains(f.Location, "://") {
-			if _, err := localpathutil.Expand(f.Location); err != nil {
-				return fmt.Errorf("field `images[%d].location` refers to an invalid local file path: %q: %w", i, f.Location, err)
-			}
-			// f.Location does NOT need to be accessible, so we do NOT check os.Stat(f.Location)
-		}
-		switch f.Arch {
-		case X8664, AARCH64:
-		default:
-			return fmt.Errorf("field `images.arch` must be %q or %q, got %q", X8664, AARCH64, f.Arch)
-		}
-		if f.Digest != "" {
-			if !f.Digest.Algorithm().Available() {
-				return fmt.Errorf("field `images[%d].digest` refers to an unavailable digest algorithm", i)
-			}
-			if err := f.Digest.Validate(); err != nil {
-				return fmt.Errorf("field `images[%d].digest` is invalid: %s: %w", i, f.Digest.String(), err)
-			}
-		}
+		add(validateImage(i, f))
 	}
 
 	if y.CPUs == 0 {
-		return errors.New("field `cpus` must be set")
+		add(errors.New("field `cpus` must be set"))
 	}
 
 	if _, err := units.RAMInBytes(y.Memory); err != nil {
-		return fmt.Errorf("field `memory` has an invalid value: %w", err)
+		add(fmt.Errorf("field `memory` has an invalid value: %w", err))
 	}
 
 	if _, err := units.RAMInBytes(y.Disk); err != nil {
-		return fmt.Errorf("field `memory` has an invalid value: %w", err)
+		add(fmt.Errorf("field `memory` has an invalid value: %w", err))
 	}
 
-	u, err := osutil.LimaUser(false)
+	if y.User.Name != "" {
+		add(validateUsername(y.User.Name))
+	}
+	if y.User.UID != nil && *y.User.UID <= 0 {
+		add(fmt.Errorf("field `user.uid` must be a positive integer, got %d", *y.User.UID))
+	}
+	username, _, err := GuestUser(&y, false)
 	if err != nil {
 		return fmt.Errorf("internal error (not an error of YAML): %w", err)
 	}
 	// reservedHome is the home directory defined in "cidata.iso:/user-data"
-	reservedHome := fmt.Sprintf("/home/%s.linux", u.Username)
+	reservedHome := fmt.Sprintf("/home/%s.linux", username)
 
 	for i, f := range y.Mounts {
-		if !filepath.IsAbs(f.Location) && !strings.HasPrefix(f.Location, "~") {
-			return fmt.Errorf("field `mounts[%d].location` must be an absolute path, got %q",
-				i, f.Location)
-		}
-		loc, err := localpathutil.Expand(f.Location)
-		if err != nil {
-			return fmt.Errorf("field `mounts[%d].location` refers to an unexpandable path: %q: %w", i, f.Location, err)
+		add(validateMount(i, f, reservedHome, warn))
+	}
+
+	if y.SSH.LocalPort != 0 {
+		add(validatePort("ssh.localPort", y.SSH.LocalPort))
+	}
+
+	// y.Firmware.LegacyBIOS is ignored for aarch64, but not a fatal error.
+
+	for i, c := range y.CACerts {
+		// Inline PEM is validated when the cidata ISO is generated, along with the files
+		if strings.Contains(c, "-----BEGIN ") {
+			continue
 		}
-		switch loc {
-		case "/", "/bin", "/dev", "/etc", "/home", "/opt", "/sbin", "/tmp", "/usr", "/var":
-			return fmt.Errorf("field `mounts[%d].location` must not be a system path such as /etc or /usr", i)
-		case reservedHome:
-			return fmt.Errorf("field `mounts[%d].location` is internally reserved", i)
+		if !filepath.IsAbs(c) && !strings.HasPrefix(c, "~") {
+			add(fmt.Errorf("field `caCerts[%d]` must be an absolute path or an inline PEM, got %q", i, c))
 		}
+	}
 
-		st, err := os.Stat(loc)
-		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				return fmt.Errorf("field `mounts[%d].location` refers to an inaccessible path: %q: %w", i, f.Location, err)
-			}
-		} else if !st.IsDir() {
-			return fmt.Errorf("field `mounts[%d].location` refers to a non-directory path: %q: %w", i, f.Location, err)
+	for i, p := range y.Packages {
+		if !packageNameRegexp.MatchString(p) {
+			add(fmt.Errorf("field `packages[%d]` must be a package name, optionally with a version or an arch (such as \"curl=7.74.0-1\"), got %q", i, p))
 		}
 	}
 
-	if y.SSH.LocalPort != 0 {
-		if err := validatePort("ssh.localPort", y.SSH.LocalPort); err != nil {
-			return err
+	switch y.CIData.Format {
+	case CIDataFormatCloudInit:
+	case CIDataFormatIgnition:
+		// Ignition cannot install packages, and the distros using it typically do not have a package manager
+		if len(y.Packages) > 0 {
+			add(fmt.Errorf("field `packages` is not supported with `cidata.format: %s`", CIDataFormatIgnition))
 		}
+		if y.CIData.UserDataTemplate != "" {
+			add(fmt.Errorf("field `cidata.userDataTemplate` is not supported with `cidata.format: %s`", CIDataFormatIgnition))
+		}
+	default:
+		add(fmt.Errorf("field `cidata.format` must be %q or %q, got %q",
+			CIDataFormatCloudInit, CIDataFormatIgnition, y.CIData.Format))
+	}
+	switch y.CIData.Filesystem {
+	case CIDataFilesystemISO9660, CIDataFilesystemVFAT:
+	default:
+		add(fmt.Errorf("field `cidata.filesystem` must be %q or %q, got %q",
+			CIDataFilesystemISO9660, CIDataFilesystemVFAT, y.CIData.Filesystem))
 	}
 
-	// y.Firmware.LegacyBIOS is ignored for aarch64, but not a fatal error.
-
+	if y.Distro != "" && !distroRegexp.MatchString(y.Distro) {
+		add(fmt.Errorf("field `distro` must be the ID of os-release(5), such as \"ubuntu\", got %q", y.Distro))
+	}
 	for i, p := range y.Provision {
-		switch p.Mode {
-		case ProvisionModeSystem, ProvisionModeUser:
-		default:
-			return fmt.Errorf("field `provision[%d].mode` must be either %q or %q",
-				i, ProvisionModeSystem, ProvisionModeUser)
-		}
+		add(validateProvision(i, p, warn))
+		add(validateProvisionCondition(i, p.Condition, y.Distro))
+	}
+	if len(y.Provision) > 0 && len(MatchingProvision(&y)) == 0 {
+		add(fmt.Errorf("field `provision` must have a script matching arch %q and distro %q", y.Arch, y.Distro))
+	}
+	for i, f := range y.CopyToGuest {
+		add(validateCopyToGuest(i, f, warn))
 	}
 	needsContainerdArchives := (y.Containerd.User != nil && *y.Containerd.User) || (y.Containerd.System != nil && *y.Containerd.System)
 	if needsContainerdArchives && len(y.Containerd.Archives) == 0 {
-		return fmt.Errorf("field `containerd.archives` must be provided")
+		add(fmt.Errorf("field `containerd.archives` must be provided"))
+	}
+	for i, f := range y.Containerd.Archives {
+		add(validateDigest(fmt.Sprintf("containerd.archives[%d].digest", i), f.Digest))
 	}
 	for i, p := range y.Probes {
 		switch p.Mode {
 		case ProbeModeReadiness:
 		default:
-			return fmt.Errorf("field `probe[%d].mode` can only be %q",
-				i, ProbeModeReadiness)
+			add(fmt.Errorf("field `probe[%d].mode` can only be %q",
+				i, ProbeModeReadiness))
 		}
 	}
 	for i, rule := range y.PortForwards {
-		field := fmt.Sprintf("portForwards[%d]", i)
-		if rule.GuestPort != 0 {
-			if rule.GuestPort != rule.GuestPortRange[0] {
-				return fmt.Errorf("field `%s.guestPort` must match field `%s.guestPortRange[0]`", field, field)
-			}
-			// redundant validation to make sure the error contains the correct field name
-			if err := validatePort(field+".guestPort", rule.GuestPort); err != nil {
-				return err
-			}
+		add(validatePortForward(i, rule))
+	}
+
+	useHostResolver := y.UseHostResolver != nil && *y.UseHostResolver
+	switch y.DNSPrecedence {
+	case DNSPrecedenceAuto:
+		if useHostResolver && len(y.DNS) > 0 {
+			add(fmt.Errorf("field `dns` must be empty when field `useHostResolver` is true, unless field `dnsPrecedence` is %q",
+				DNSPrecedenceHostResolver))
 		}
-		if rule.HostPort != 0 {
-			if rule.HostPort != rule.HostPortRange[0] {
-				return fmt.Errorf("field `%s.hostPort` must match field `%s.hostPortRange[0]`", field, field)
-			}
-			// redundant validation to make sure the error contains the correct field name
-			if err := validatePort(field+".hostPort", rule.HostPort); err != nil {
-				return err
-			}
+	case DNSPrecedenceHostResolver:
+		if !useHostResolver {
+			add(fmt.Errorf("field `useHostResolver` must be true when field `dnsPrecedence` is %q", DNSPrecedenceHostResolver))
 		}
-		for j := 0; j < 2; j++ {
-			if err := validatePort(fmt.Sprintf("%s.guestPortRange[%d]", field, j), rule.GuestPortRange[j]); err != nil {
-				return err
-			}
-			if err := validatePort(fmt.Sprintf("%s.hostPortRange[%d]", field, j), rule.HostPortRange[j]); err != nil {
-				return err
-			}
+	case DNSPrecedenceDNS:
+		if useHostResolver {
+			add(fmt.Errorf("field `useHostResolver` must be false when field `dnsPrecedence` is %q", DNSPrecedenceDNS))
 		}
-		if rule.GuestPortRange[0] > rule.GuestPortRange[1] {
-			return fmt.Errorf("field `%s.guestPortRange[1]` must be greater than or equal to field `%s.guestPortRange[0]`", field, field)
+		if len(y.DNS) == 0 {
+			add(fmt.Errorf("field `dns` must not be empty when field `dnsPrecedence` is %q", DNSPrecedenceDNS))
 		}
-		if rule.HostPortRange[0] > rule.HostPortRange[1] {
-			return fmt.Errorf("field `%s.hostPortRange[1]` must be greater than or equal to field `%s.hostPortRange[0]`", field, field)
+	default:
+		add(fmt.Errorf("field `dnsPrecedence` must be %q, %q, or %q, got %q",
+			DNSPrecedenceAuto, DNSPrecedenceHostResolver, DNSPrecedenceDNS, y.DNSPrecedence))
+	}
+	for i, d := range y.DNSSearchDomains {
+		if err := validateHostname(d); err != nil {
+			add(fmt.Errorf("field `dnsSearchDomains[%d]` must be a valid DNS name: %w", i, err))
 		}
-		if rule.GuestPortRange[1]-rule.GuestPortRange[0] != rule.HostPortRange[1]-rule.HostPortRange[0] {
-			return fmt.Errorf("field `%s.hostPortRange` must specify the same number of ports as field `%s.guestPortRange`", field, field)
+	}
+	seenDNSOptions := make(map[string]int, len(y.DNSOptions))
+	for i, o := range y.DNSOptions {
+		name, _, err := ParseDNSOption(o)
+		if err != nil {
+			add(fmt.Errorf("field `dnsOptions[%d]` is invalid: %w", i, err))
+		} else if j, ok := seenDNSOptions[name]; ok {
+			add(fmt.Errorf("field `dnsOptions[%d]` duplicates field `dnsOptions[%d]` (%q)", i, j, name))
+		} else {
+			seenDNSOptions[name] = i
 		}
-		if rule.Proto != TCP {
-			return fmt.Errorf("field `%s.proto` must be %q", field, TCP)
+	}
+	for _, err := range validateHostResolver(y.HostResolver) {
+		add(err)
+	}
+
+	for _, err := range validateNetwork(y, warn) {
+		add(err)
+	}
+	return merr.ErrorOrNil()
+}
+
+func validateImage(i int, f File) error {
+	if !strings.Contains(f.Location, "://") {
+		if _, err := localpathutil.Expand(f.Location); err != nil {
+			return fmt.Errorf("field `images[%d].location` refers to an invalid local file path: %q: %w", i, f.Location, err)
 		}
-		// Not validating that the various GuestPortRanges and HostPortRanges are not overlapping. Rules will be
-		// processed sequentially and the first matching rule for a guest port determines forwarding behavior.
+		// f.Location does NOT need to be accessible, so we do NOT check os.Stat(f.Location)
 	}
+	switch f.Arch {
+	case X8664, AARCH64:
+	default:
+		return fmt.Errorf("field `images.arch` must be %q or %q, got %q", X8664, AARCH64, f.Arch)
+	}
+	return validateDigest(fmt.Sprintf("images[%d].digest", i), f.Digest)
+}
 
-	if y.UseHostResolver != nil && *y.UseHostResolver && len(y.DNS) > 0 {
-		return fmt.Errorf("field `dns` must be empty when field `useHostResolver` is true")
+func validateMount(i int, f Mount, reservedHome string, warn bool) error {
+	if !filepath.IsAbs(f.Location) && !strings.HasPrefix(f.Location, "~") {
+		return fmt.Errorf("field `mounts[%d].location` must be an absolute path, got %q",
+			i, f.Location)
+	}
+	loc, err := localpathutil.Expand(f.Location)
+	if err != nil {
+		return fmt.Errorf("field `mounts[%d].location` refers to an unexpandable path: %q: %w", i, f.Location, err)
+	}
+	switch loc {
+	case "/", "/bin", "/dev", "/etc", "/home", "/opt", "/sbin", "/tmp", "/usr", "/var":
+		return fmt.Errorf("field `mounts[%d].location` must not be a system path such as /etc or /usr, got %q", i, f.Location)
+	case reservedHome:
+		return fmt.Errorf("field `mounts[%d].location` is internally reserved: %q", i, f.Location)
 	}
 
-	if err := validateNetwork(y, warn); err != nil {
+	st, err := os.Stat(loc)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("field `mounts[%d].location` refers to an inaccessible path: %q: %w", i, f.Location, err)
+		}
+		// The host agent creates missing directories, which is useful for writable mounts,
+		// but a missing read-only mount is most likely a typo.
+		if warn && !f.Writable {
+			return fmt.Errorf("field `mounts[%d].location` refers to a non-existent path: %q (expanded to %q)", i, f.Location, loc)
+		}
+	} else if !st.IsDir() {
+		return fmt.Errorf("field `mounts[%d].location` refers to a non-directory path: %q (expanded to %q)", i, f.Location, loc)
+	}
+	for j, o := range f.Options {
+		switch {
+		case o == "":
+			return fmt.Errorf("field `mounts[%d].options[%d]` must not be empty", i, j)
+		case strings.ContainsAny(o, ", \t\n"):
+			return fmt.Errorf("field `mounts[%d].options[%d]` must be a single option, got %q", i, j, o)
+		case o == "ro" || o == "rw":
+			return fmt.Errorf("field `mounts[%d].options[%d]` must not be %q, use `mounts[%d].writable` instead", i, j, o, i)
+		}
+	}
+	if warn {
+		if home, err := os.UserHomeDir(); err == nil && !isUnder(loc, home) && !isUnder(loc, "/tmp") {
+			logrus.Warnf("field `mounts[%d].location` is outside of the home directory: %q", i, f.Location)
+		}
+	}
+	return nil
+}
+
+func validateProvision(i int, p Provision, warn bool) error {
+	switch p.Mode {
+	case ProvisionModeSystem, ProvisionModeUser, ProvisionModeDependency:
+	default:
+		return fmt.Errorf("field `provision[%d].mode` must be one of %q, %q, or %q",
+			i, ProvisionModeSystem, ProvisionModeUser, ProvisionModeDependency)
+	}
+	field, script := fmt.Sprintf("provision[%d].script", i), p.Script
+	if p.File != "" {
+		if p.Script != "" {
+			return fmt.Errorf("field `provision[%d].script` and field `provision[%d].file` are mutually exclusive", i, i)
+		}
+		if !filepath.IsAbs(p.File) && !strings.HasPrefix(p.File, "~") {
+			return fmt.Errorf("field `provision[%d].file` must be an absolute path, got %q", i, p.File)
+		}
+		if !warn {
+			// The file is not read here, so that existing instances can still be loaded after the file is gone.
+			return nil
+		}
+		b, err := ReadProvisionFile(p.File)
+		if err != nil {
+			return fmt.Errorf("field `provision[%d].file` refers to an unreadable file: %w", i, err)
+		}
+		field, script = fmt.Sprintf("provision[%d].file", i), string(b)
+	}
+	if strings.TrimSpace(script) == "" {
+		return fmt.Errorf("field `%s` (mode %q) must not be empty", field, p.Mode)
+	}
+	// The scripts are executed directly, so they need an interpreter directive.
+	// This is only checked when warn is set (on `limactl start`), so that existing instances can still be loaded.
+	if warn {
+		if !strings.HasPrefix(script, "#!") {
+			return fmt.Errorf("field `%s` (mode %q) must start with an interpreter directive, such as \"#!/bin/bash\"", field, p.Mode)
+		}
+		if strings.Contains(script, "\r\n") {
+			logrus.Warnf("field `%s` (mode %q) has CRLF line endings, which are converted to LF", field, p.Mode)
+		}
+	}
+	return nil
+}
+
+func validateHostResolverTLDs(tlds HostResolverTLDs) []error {
+	var errs []error
+	if len(tlds.Allow) > 0 && len(tlds.Deny) > 0 {
+		errs = append(errs, errors.New("field `hostResolver.tlds.allow` and field `hostResolver.tlds.deny` are mutually exclusive"))
+	}
+	if len(tlds.Upstream) > 0 && len(tlds.Allow) == 0 && len(tlds.Deny) == 0 {
+		errs = append(errs, errors.New("field `hostResolver.tlds.upstream` requires field `hostResolver.tlds.allow` or field `hostResolver.tlds.deny`"))
+	}
+	for _, list := range []struct {
+		field string
+		tlds  []string
+	}{
+		{"allow", tlds.Allow},
+		{"deny", tlds.Deny},
+	} {
+		seen := make(map[string]int, len(list.tlds))
+		for i, tld := range list.tlds {
+			normalized := NormalizeTLD(tld)
+			if err := validateHostname(normalized); err != nil || strings.Contains(normalized, ".") {
+				errs = append(errs, fmt.Errorf("field `hostResolver.tlds.%s[%d]` must be a top-level domain such as \"corp\", got %q", list.field, i, tld))
+				continue
+			}
+			if j, ok := seen[normalized]; ok {
+				errs = append(errs, fmt.Errorf("field `hostResolver.tlds.%s[%d]` duplicates field `hostResolver.tlds.%s[%d]` (%q)", list.field, i, list.field, j, tld))
+				continue
+			}
+			seen[normalized] = i
+		}
+	}
+	for i, addr := range tlds.Upstream {
+		if net.ParseIP(addr) == nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.tlds.upstream[%d]` must be an IP address, got %q", i, addr))
+		}
+	}
+	return errs
+}
+
+// ValidateMDNSResponder checks that responder is an "IP:port" address, e.g., "224.0.0.251:5353".
+func ValidateMDNSResponder(responder string) error {
+	host, portStr, err := net.SplitHostPort(responder)
+	if err != nil {
 		return err
 	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not an IP address", host)
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("%q is not a port number", portStr)
+	}
 	return nil
 }
 
-func validateNetwork(y LimaYAML, warn bool) error {
+// NormalizeTLD returns the lower-cased top-level domain without the dots, e.g., "corp" for ".CORP".
+func NormalizeTLD(tld string) string {
+	return strings.ToLower(strings.Trim(tld, "."))
+}
+
+func validateProvisionCondition(i int, c *ProvisionCondition, distro string) error {
+	if c == nil {
+		return nil
+	}
+	if c.Arch == "" && c.Distro == "" {
+		return fmt.Errorf("field `provision[%d].condition` must have `arch` or `distro`", i)
+	}
+	switch c.Arch {
+	case "", X8664, AARCH64:
+	default:
+		return fmt.Errorf("field `provision[%d].condition.arch` must be %q or %q, got %q", i, X8664, AARCH64, c.Arch)
+	}
+	if c.Distro != "" {
+		if !distroRegexp.MatchString(c.Distro) {
+			return fmt.Errorf("field `provision[%d].condition.distro` must be the ID of os-release(5), such as \"ubuntu\", got %q", i, c.Distro)
+		}
+		// Otherwise the script would silently never be embedded
+		if distro == "" {
+			return fmt.Errorf("field `provision[%d].condition.distro` requires field `distro` to be set", i)
+		}
+	}
+	return nil
+}
+
+func validateCopyToGuest(i int, f CopyToGuest, warn bool) error {
+	if !filepath.IsAbs(f.Source) && !strings.HasPrefix(f.Source, "~") {
+		return fmt.Errorf("field `copyToGuest[%d].source` must be an absolute path, got %q", i, f.Source)
+	}
+	// The destination is passed to the boot script in lima.env
+	if !path.IsAbs(f.Destination) || path.Clean(f.Destination) != f.Destination || f.Destination == "/" ||
+		strings.ContainsAny(f.Destination, " \t\r\n\"'\\`$;&|<>(){}*?[]!#") {
+		return fmt.Errorf("field `copyToGuest[%d].destination` must be a clean absolute file path without whitespace or shell metacharacters, got %q", i, f.Destination)
+	}
+	if perm, err := strconv.ParseUint(f.Mode, 8, 32); err != nil || perm > 07777 {
+		return fmt.Errorf("field `copyToGuest[%d].mode` must be octal permission bits such as \"0644\", got %q", i, f.Mode)
+	}
+	if !warn {
+		// The file is not checked here, so that existing instances can still be loaded after the file is gone.
+		return nil
+	}
+	expanded, err := localpathutil.Expand(f.Source)
+	if err != nil {
+		return fmt.Errorf("field `copyToGuest[%d].source` refers to an unexpandable path: %q: %w", i, f.Source, err)
+	}
+	st, err := os.Stat(expanded)
+	if err != nil {
+		return fmt.Errorf("field `copyToGuest[%d].source` refers to an inaccessible file: %w", i, err)
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("field `copyToGuest[%d].source` must be a regular file, got %q", i, f.Source)
+	}
+	return nil
+}
+
+func validatePortForward(i int, rule PortForward) error {
+	field := fmt.Sprintf("portForwards[%d]", i)
+	if rule.GuestPort != 0 {
+		if rule.GuestPort != rule.GuestPortRange[0] {
+			return fmt.Errorf("field `%s.guestPort` must match field `%s.guestPortRange[0]`", field, field)
+		}
+		// redundant validation to make sure the error contains the correct field name
+		if err := validatePort(field+".guestPort", rule.GuestPort); err != nil {
+			return err
+		}
+	}
+	if rule.HostPort != 0 {
+		if rule.HostPort != rule.HostPortRange[0] {
+			return fmt.Errorf("field `%s.hostPort` must match field `%s.hostPortRange[0]`", field, field)
+		}
+		// redundant validation to make sure the error contains the correct field name
+		if err := validatePort(field+".hostPort", rule.HostPort); err != nil {
+			return err
+		}
+	}
+	for j := 0; j < 2; j++ {
+		if err := validatePort(fmt.Sprintf("%s.guestPortRange[%d]", field, j), rule.GuestPortRange[j]); err != nil {
+			return err
+		}
+		if err := validatePort(fmt.Sprintf("%s.hostPortRange[%d]", field, j), rule.HostPortRange[j]); err != nil {
+			return err
+		}
+	}
+	if rule.GuestPortRange[0] > rule.GuestPortRange[1] {
+		return fmt.Errorf("field `%s.guestPortRange[1]` must be greater than or equal to field `%s.guestPortRange[0]`", field, field)
+	}
+	if rule.HostPortRange[0] > rule.HostPortRange[1] {
+		return fmt.Errorf("field `%s.hostPortRange[1]` must be greater than or equal to field `%s.hostPortRange[0]`", field, field)
+	}
+	if rule.GuestPortRange[1]-rule.GuestPortRange[0] != rule.HostPortRange[1]-rule.HostPortRange[0] {
+		return fmt.Errorf("field `%s.hostPortRange` must specify the same number of ports as field `%s.guestPortRange`", field, field)
+	}
+	if rule.Proto != TCP {
+		return fmt.Errorf("field `%s.proto` must be %q", field, TCP)
+	}
+	// Not validating that the various GuestPortRanges and HostPortRanges are not overlapping. Rules will be
+	// processed sequentially and the first matching rule for a guest port determines forwarding behavior.
+	return nil
+}
+
+func validateHostResolver(hr HostResolver) []error {
+	var errs []error
+	if hr.Cache.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("field `hostResolver.cache.maxEntries` must be >= 0, got %d", hr.Cache.MaxEntries))
+	}
+	if hr.NegativeCache.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("field `hostResolver.negativeCache.maxEntries` must be >= 0, got %d", hr.NegativeCache.MaxEntries))
+	}
+	if err := ValidateDNS64Prefix(hr.DNS64.Prefix); err != nil {
+		errs = append(errs, fmt.Errorf("field `hostResolver.dns64.prefix` is invalid: %w", err))
+	}
+	if timeout, err := time.ParseDuration(hr.Timeout); err != nil {
+		errs = append(errs, fmt.Errorf("field `hostResolver.timeout` has an invalid value: %w", err))
+	} else if timeout <= 0 {
+		errs = append(errs, fmt.Errorf("field `hostResolver.timeout` must be positive, got %q", hr.Timeout))
+	}
+	if hr.Retries != nil && *hr.Retries < 0 {
+		errs = append(errs, fmt.Errorf("field `hostResolver.retries` must be >= 0, got %d", *hr.Retries))
+	}
+	if hr.FailureThreshold != nil && *hr.FailureThreshold < 0 {
+		errs = append(errs, fmt.Errorf("field `hostResolver.failureThreshold` must be >= 0, got %d", *hr.FailureThreshold))
+	}
+	if cooldown, err := time.ParseDuration(hr.Cooldown); err != nil {
+		errs = append(errs, fmt.Errorf("field `hostResolver.cooldown` has an invalid value: %w", err))
+	} else if cooldown <= 0 {
+		errs = append(errs, fmt.Errorf("field `hostResolver.cooldown` must be positive, got %q", hr.Cooldown))
+	}
+	if hr.MaxUDPSize != 0 && (hr.MaxUDPSize < dns.MinMsgSize || hr.MaxUDPSize > dns.MaxMsgSize) {
+		errs = append(errs, fmt.Errorf("field `hostResolver.maxUDPSize` must be 0 or between %d and %d, got %d",
+			dns.MinMsgSize, dns.MaxMsgSize, hr.MaxUDPSize))
+	}
+	if hr.MetricsPort != 0 {
+		if err := validatePort("hostResolver.metricsPort", hr.MetricsPort); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i, u := range hr.DoH {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.doh[%d]` has an invalid value: %w", i, err))
+		} else if parsed.Scheme != "https" || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("field `hostResolver.doh[%d]` must be an https URL, got %q", i, u))
+		}
+	}
+	for i, name := range hr.Block {
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok {
+			errs = append(errs, fmt.Errorf("field `hostResolver.block[%d]` has an invalid name %q", i, name))
+		}
+	}
+	switch hr.BlockResponse {
+	case BlockResponseNXDomain, BlockResponseNull:
+	default:
+		errs = append(errs, fmt.Errorf("field `hostResolver.blockResponse` must be %q or %q, got %q",
+			BlockResponseNXDomain, BlockResponseNull, hr.BlockResponse))
+	}
+	for i, addr := range hr.Fallback {
+		if net.ParseIP(addr) == nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.fallback[%d]` must be an IP address, got %q", i, addr))
+		}
+	}
+	seen := make(map[string]int, len(hr.Order))
+	for i, addr := range hr.Order {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.order[%d]` must be an IP address, got %q", i, addr))
+			continue
+		}
+		if j, ok := seen[ip.String()]; ok {
+			errs = append(errs, fmt.Errorf("field `hostResolver.order[%d]` duplicates field `hostResolver.order[%d]` (%q)", i, j, addr))
+			continue
+		}
+		seen[ip.String()] = i
+	}
+	for i, f := range hr.Forward {
+		if err := validateHostname(strings.TrimSuffix(f.Domain, ".")); err != nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.forward[%d].domain` must be a valid DNS name: %w", i, err))
+		}
+		if len(f.Nameservers) == 0 {
+			errs = append(errs, fmt.Errorf("field `hostResolver.forward[%d].nameservers` must not be empty", i))
+		}
+		for j, addr := range f.Nameservers {
+			if net.ParseIP(addr) == nil {
+				errs = append(errs, fmt.Errorf("field `hostResolver.forward[%d].nameservers[%d]` must be an IP address, got %q", i, j, addr))
+			}
+		}
+		for j, t := range f.Types {
+			if qtype, ok := dns.StringToType[strings.ToUpper(t)]; !ok || qtype == dns.TypeNone {
+				errs = append(errs, fmt.Errorf("field `hostResolver.forward[%d].types[%d]` must be a DNS record type such as \"SRV\", got %q", i, j, t))
+			}
+		}
+	}
+	errs = append(errs, validateHostResolverTLDs(hr.TLDs)...)
+	switch hr.MDNS.Mode {
+	case MDNSModeHost, MDNSModeRefuse, MDNSModeNotImp, MDNSModeForward:
+	default:
+		errs = append(errs, fmt.Errorf("field `hostResolver.mdns.mode` must be one of %q, %q, %q, or %q, got %q",
+			MDNSModeHost, MDNSModeRefuse, MDNSModeNotImp, MDNSModeForward, hr.MDNS.Mode))
+	}
+	if err := ValidateMDNSResponder(hr.MDNS.Responder); err != nil {
+		errs = append(errs, fmt.Errorf("field `hostResolver.mdns.responder` is invalid: %w", err))
+	}
+	rewriteFroms := make(map[string]int, len(hr.Rewrite))
+	for i, r := range hr.Rewrite {
+		from := strings.ToLower(strings.TrimSuffix(r.From, "."))
+		if err := validateHostname(from); err != nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.rewrite[%d].from` must be a valid DNS name: %w", i, err))
+		} else if j, ok := rewriteFroms[from]; ok {
+			errs = append(errs, fmt.Errorf("field `hostResolver.rewrite[%d].from` duplicates field `hostResolver.rewrite[%d].from` (%q)", i, j, r.From))
+		} else {
+			rewriteFroms[from] = i
+		}
+		to := strings.ToLower(strings.TrimSuffix(r.To, "."))
+		if err := validateHostname(to); err != nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.rewrite[%d].to` must be a valid DNS name: %w", i, err))
+		} else if to == from {
+			errs = append(errs, fmt.Errorf("field `hostResolver.rewrite[%d].to` must differ from field `hostResolver.rewrite[%d].from`", i, i))
+		}
+	}
+	for i, r := range hr.Records {
+		if _, err := ParseHostResolverRecord(r); err != nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.records[%d]` is invalid: %w", i, err))
+		}
+	}
+	names := make([]string, 0, len(hr.Hosts))
+	for name := range hr.Hosts {
+		names = append(names, name)
+	}
+	// Sorted so that the errors are reported in a stable order
+	sort.Strings(names)
+	for _, name := range names {
+		addr := hr.Hosts[name]
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok {
+			errs = append(errs, fmt.Errorf("field `hostResolver.hosts` has an invalid name %q", name))
+		} else if net.ParseIP(addr) == nil {
+			errs = append(errs, fmt.Errorf("field `hostResolver.hosts[%q]` must be an IP address, got %q", name, addr))
+		}
+	}
+	return errs
+}
+
+func validateNetwork(y LimaYAML, warn bool) []error {
+	var errs []error
 	if len(y.Network.VDEDeprecated) > 0 {
 		if y.Network.migrated {
 			if warn {
 				logrus.Warnf("field `network.VDE` is deprecated; please use `networks` instead")
 			}
 		} else {
-			return fmt.Errorf("you cannot use deprecated field `network.VDE` together with replacement field `networks`")
+			errs = append(errs, fmt.Errorf("you cannot use deprecated field `network.VDE` together with replacement field `networks`"))
 		}
 	}
 	interfaceName := make(map[string]int)
 	for i, nw := range y.Networks {
 		field := fmt.Sprintf("networks[%d]", i)
-		if nw.Lima != "" {
-			if runtime.GOOS != "darwin" {
-				return fmt.Errorf("field `%s.lima` is only supported on macOS right now", field)
-			}
-			if nw.VNL != "" {
-				return fmt.Errorf("field `%s.lima` and field `%s.vnl` are mutually exclusive", field, field)
-			}
-			if nw.SwitchPort != 0 {
-				return fmt.Errorf("field `%s.switchPort` cannot be used with field `%s.lima`", field, field)
-			}
-			config, err := networks.Config()
-			if err != nil {
-				return err
-			}
-			if config.Check(nw.Lima) != nil {
-				return fmt.Errorf("field `%s.lima` references network %q which is not defined in networks.yaml", field, nw.Lima)
-			}
-		} else {
-			if nw.VNL == "" {
-				return fmt.Errorf("field `%s.lima` or field `%s.vnl` must be set", field, field)
-			}
-			// The field is called VDE.VNL in anticipation of QEMU upgrading VDE2 to VDEplug4,
-			// but right now the only valid value on macOS is a path to the vde_switch socket directory,
-			// optionally with vde:// prefix.
-			if !strings.Contains(nw.VNL, "://") || strings.HasPrefix(nw.VNL, "vde://") {
-				vdeSwitch := strings.TrimPrefix(nw.VNL, "vde://")
-				if fi, err := os.Stat(vdeSwitch); err != nil {
-					// negligible when the instance is stopped
-					logrus.WithError(err).Debugf("field `%s.vnl` %q failed stat", field, vdeSwitch)
-				} else {
-					if fi.IsDir() {
-						/* Switch mode (vdeSwitch is dir, port != 65535) */
-						ctlSocket := filepath.Join(vdeSwitch, "ctl")
-						// ErrNotExist during os.Stat(ctlSocket) can be ignored. ctlSocket does not need to exist until actually starting the VM
-						if fi, err = os.Stat(ctlSocket); err == nil {
-							if fi.Mode()&os.ModeSocket == 0 {
-								return fmt.Errorf("field `%s.vnl` file %q is not a UNIX socket", field, ctlSocket)
-							}
-						}
-						if nw.SwitchPort == 65535 {
-							return fmt.Errorf("field `%s.vnl` points to a non-PTP switch, so the port number must not be 65535", field)
-						}
-					} else {
-						/* PTP mode (vdeSwitch is socket, port == 65535) */
+		if err := validateNetworkEntry(field, nw, warn); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if prev, ok := interfaceName[nw.Interface]; ok {
+			errs = append(errs, fmt.Errorf("field `%s.interface` value %q has already been used by field `network.vde[%d].name`", field, nw.Interface, prev))
+			continue
+		}
+		interfaceName[nw.Interface] = i
+	}
+	return errs
+}
+
+func validateNetworkEntry(field string, nw Network, warn bool) error {
+	if nw.Lima != "" {
+		if runtime.GOOS != "darwin" {
+			return fmt.Errorf("field `%s.lima` is only supported on macOS right now", field)
+		}
+		if nw.VNL != "" {
+			return fmt.Errorf("field `%s.lima` and field `%s.vnl` are mutually exclusive", field, field)
+		}
+		if nw.SwitchPort != 0 {
+			return fmt.Errorf("field `%s.switchPort` cannot be used with field `%s.lima`", field, field)
+		}
+		config, err := networks.Config()
+		if err != nil {
+			return err
+		}
+		if config.Check(nw.Lima) != nil {
+			return fmt.Errorf("field `%s.lima` references network %q which is not defined in networks.yaml", field, nw.Lima)
+		}
+	} else {
+		if nw.VNL == "" {
+			return fmt.Errorf("field `%s.lima` or field `%s.vnl` must be set", field, field)
+		}
+		// The field is called VDE.VNL in anticipation of QEMU upgrading VDE2 to VDEplug4,
+		// but right now the only valid value on macOS is a path to the vde_switch socket directory,
+		// optionally with vde:// prefix.
+		if !strings.Contains(nw.VNL, "://") || strings.HasPrefix(nw.VNL, "vde://") {
+			vdeSwitch := strings.TrimPrefix(nw.VNL, "vde://")
+			if fi, err := os.Stat(vdeSwitch); err != nil {
+				// negligible when the instance is stopped
+				logrus.WithError(err).Debugf("field `%s.vnl` %q failed stat", field, vdeSwitch)
+			} else {
+				if fi.IsDir() {
+					/* Switch mode (vdeSwitch is dir, port != 65535) */
+					ctlSocket := filepath.Join(vdeSwitch, "ctl")
+					// ErrNotExist during os.Stat(ctlSocket) can be ignored. ctlSocket does not need to exist until actually starting the VM
+					if fi, err = os.Stat(ctlSocket); err == nil {
 						if fi.Mode()&os.ModeSocket == 0 {
-							return fmt.Errorf("field `%s.vnl` %q is not a directory nor a UNIX socket", field, vdeSwitch)
-						}
-						if nw.SwitchPort != 65535 {
-							return fmt.Errorf("field `%s.vnl` points to a PTP (switchless) socket %q, so the port number has to be 65535 (got %d)",
-								field, vdeSwitch, nw.SwitchPort)
+							return fmt.Errorf("field `%s.vnl` file %q is not a UNIX socket", field, ctlSocket)
 						}
 					}
+					if nw.SwitchPort == 65535 {
+						return fmt.Errorf("field `%s.vnl` points to a non-PTP switch, so the port number must not be 65535", field)
+					}
+				} else {
+					/* PTP mode (vdeSwitch is socket, port == 65535) */
+					if fi.Mode()&os.ModeSocket == 0 {
+						return fmt.Errorf("field `%s.vnl` %q is not a directory nor a UNIX socket", field, vdeSwitch)
+					}
+					if nw.SwitchPort != 65535 {
+						return fmt.Errorf("field `%s.vnl` points to a PTP (switchless) socket %q, so the port number has to be 65535 (got %d)",
+							field, vdeSwitch, nw.SwitchPort)
+					}
 				}
-			} else if runtime.GOOS != "linux" {
-				if warn {
-					logrus.Warnf("field `%s.vnl` is unlikely to work for %s (unless libvdeplug4 has been ported to %s and is installed)",
-						field, runtime.GOOS, runtime.GOOS)
-				}
-			}
-		}
-		if nw.MACAddress != "" {
-			hw, err := net.ParseMAC(nw.MACAddress)
-			if err != nil {
-				return fmt.Errorf("field `vmnet.mac` invalid: %w", err)
 			}
-			if len(hw) != 6 {
-				return fmt.Errorf("field `%s.macAddress` must be a 48 bit (6 bytes) MAC address; actual length of %q is %d bytes", field, nw.MACAddress, len(hw))
+		} else if runtime.GOOS != "linux" {
+			if warn {
+				logrus.Warnf("field `%s.vnl` is unlikely to work for %s (unless libvdeplug4 has been ported to %s and is installed)",
+					field, runtime.GOOS, runtime.GOOS)
 			}
 		}
-		// FillDefault() will make sure that nw.Interface is not the empty string
-		if len(nw.Interface) >= 16 {
-			return fmt.Errorf("field `%s.interface` must be less than 16 bytes, but is %d bytes: %q", field, len(nw.Interface), nw.Interface)
+	}
+	if nw.MACAddress != "" {
+		hw, err := net.ParseMAC(nw.MACAddress)
+		if err != nil {
+			return fmt.Errorf("field `vmnet.mac` invalid: %w", err)
 		}
-		if strings.ContainsAny(nw.Interface, " \t\n/") {
-			return fmt.Errorf("field `%s.interface` must not contain whitespace or slashes", field)
+		if len(hw) != 6 {
+			return fmt.Errorf("field `%s.macAddress` must be a 48 bit (6 bytes) MAC address; actual length of %q is %d bytes", field, nw.MACAddress, len(hw))
 		}
-		if nw.Interface == qemu.SlirpNICName {
-			return fmt.Errorf("field `%s.interface` must not be set to %q because it is reserved for slirp", field, qemu.SlirpNICName)
+	}
+	// FillDefault() will make sure that nw.Interface is not the empty string
+	if len(nw.Interface) >= 16 {
+		return fmt.Errorf("field `%s.interface` must be less than 16 bytes, but is %d bytes: %q", field, len(nw.Interface), nw.Interface)
+	}
+	if strings.ContainsAny(nw.Interface, " \t\n/") {
+		return fmt.Errorf("field `%s.interface` must not contain whitespace or slashes", field)
+	}
+	if nw.Interface == qemu.SlirpNICName {
+		return fmt.Errorf("field `%s.interface` must not be set to %q because it is reserved for slirp", field, qemu.SlirpNICName)
+	}
+	return nil
+}
+
+// localeRegexp matches the locale names in the form of "language[_territory][.codeset][@modifier]",
+// as well as "C" and "POSIX".
+var localeRegexp = regexp.MustCompile(`^(?:(?:[a-z]{2,3}(?:_[A-Z]{2})?|C)(?:\.[A-Za-z0-9-]+)?(?:@[A-Za-z0-9]+)?|POSIX)$`)
+
+// packageNameRegexp matches the package names of the major distros, optionally with a version (e.g., "curl=7.74.0-1",
+// "curl-7.76.1") or an arch (e.g., "libc6:arm64"). The names are embedded in the cloud-init user-data,
+// so quotes, whitespace, and the shell metacharacters are never accepted.
+var packageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._:=~-]*$`)
+
+// distroRegexp matches the ID field of os-release(5): lower-case letters, digits, '.', '_', and '-'.
+var distroRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// DefaultHostResolverRecordTTL is the TTL of the records of `hostResolver.records` that do not specify one, in seconds.
+const DefaultHostResolverRecordTTL = 60
+
+// ParseHostResolverRecord parses a record of `hostResolver.records`, a single line in the zone file format
+// (RFC 1035 section 5.1), such as `_config.internal. TXT "key=value"`.
+// The names are relative to the root, the class defaults to IN, and the TTL to DefaultHostResolverRecordTTL.
+// Only the TXT and SRV records are supported; the A and AAAA records are configured with `hostResolver.hosts`.
+func ParseHostResolverRecord(s string) (dns.RR, error) {
+	if strings.ContainsAny(s, "\r\n") {
+		return nil, fmt.Errorf("record %q must be a single line", s)
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("$TTL %d\n%s", DefaultHostResolverRecordTTL, s))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, errors.New("record must not be empty")
+	}
+	if rr.Header().Class != dns.ClassINET {
+		return nil, fmt.Errorf("record %q must be of the class IN", s)
+	}
+	switch rr := rr.(type) {
+	case *dns.TXT:
+		if len(rr.Txt) == 0 {
+			return nil, fmt.Errorf("TXT record %q must have a string", s)
 		}
-		if prev, ok := interfaceName[nw.Interface]; ok {
-			return fmt.Errorf("field `%s.interface` value %q has already been used by field `network.vde[%d].name`", field, nw.Interface, prev)
+	case *dns.SRV:
+	default:
+		return nil, fmt.Errorf("record %q must be of the type TXT or SRV, got %s", s, dns.TypeToString[rr.Header().Rrtype])
+	}
+	return rr, nil
+}
+
+// usernameRegexp is the pattern of the user names accepted by `useradd`, see osutil.LimaUser.
+var usernameRegexp = regexp.MustCompile("^[a-z_][a-z0-9_-]*$")
+
+func validateUsername(name string) error {
+	if len(name) > 32 || !usernameRegexp.MatchString(name) {
+		return fmt.Errorf("field `user.name` must be a valid Linux user name (matching %q, at most 32 characters), got %q",
+			usernameRegexp.String(), name)
+	}
+	if name == "root" {
+		return errors.New("field `user.name` must not be \"root\"")
+	}
+	return nil
+}
+
+// dnsOptionRanges are the resolv.conf(5) options that take a value, with the range of the value.
+// The resolver of glibc silently caps the larger values.
+var dnsOptionRanges = map[string][2]int{
+	"ndots":    {0, 15},
+	"timeout":  {1, 30},
+	"attempts": {1, 5},
+}
+
+// dnsOptionFlags are the resolv.conf(5) options that do not take a value.
+var dnsOptionFlags = map[string]struct{}{
+	"debug":                 {},
+	"rotate":                {},
+	"no-check-names":        {},
+	"edns0":                 {},
+	"single-request":        {},
+	"single-request-reopen": {},
+	"no-tld-query":          {},
+	"use-vc":                {},
+	"no-reload":             {},
+	"trust-ad":              {},
+	"no-aaaa":               {},
+}
+
+// ParseDNSOption parses an option of `dnsOptions`, in the format of the "options" line of resolv.conf(5),
+// and returns its name and its value. The value is "" for the options that do not take one, such as "rotate".
+func ParseDNSOption(s string) (string, string, error) {
+	name, value := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, value = s[:i], s[i+1:]
+	}
+	if r, ok := dnsOptionRanges[name]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < r[0] || n > r[1] {
+			return "", "", fmt.Errorf("option %q must be %s:N with N between %d and %d", s, name, r[0], r[1])
 		}
-		interfaceName[nw.Interface] = i
+		return name, value, nil
+	}
+	if _, ok := dnsOptionFlags[name]; ok {
+		if value != "" {
+			return "", "", fmt.Errorf("option %q must not have a value", s)
+		}
+		return name, "", nil
+	}
+	return "", "", fmt.Errorf("unknown option %q", s)
+}
+
+// ValidateDNS64Prefix checks that prefix is an IPv6 prefix of one of the lengths defined in RFC 6052,
+// i.e., 32, 40, 48, 56, 64, or 96 bits.
+func ValidateDNS64Prefix(prefix string) error {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+	if ip.To4() != nil {
+		return fmt.Errorf("%q is not an IPv6 prefix", prefix)
+	}
+	if !ip.Equal(ipNet.IP) {
+		return fmt.Errorf("%q has bits set beyond the prefix length", prefix)
+	}
+	switch ones, _ := ipNet.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("the length of %q must be 32, 40, 48, 56, 64, or 96", prefix)
+	}
+	if ipNet.IP[8] != 0 {
+		// Bits 64 to 71 of the address are reserved (the "u" octet)
+		return fmt.Errorf("bits 64 to 71 of %q must be zero", prefix)
+	}
+	return nil
+}
+
+// validateHostname checks that hostname is a valid host name as defined in RFC 1123, i.e., dot-separated labels
+// of 1 to 63 letters, digits, and hyphens, neither starting nor ending with a hyphen.
+func validateHostname(hostname string) error {
+	if len(hostname) > 253 {
+		return fmt.Errorf("%q is longer than 253 characters", hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("%q must consist of labels of 1 to 63 characters", hostname)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q of %q must not start or end with a hyphen", label, hostname)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("label %q of %q must consist of letters, digits, and hyphens", label, hostname)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadProvisionFile reads the file of a provision script, i.e., `provision[].file`.
+func ReadProvisionFile(file string) ([]byte, error) {
+	expanded, err := localpathutil.Expand(file)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(expanded)
+}
+
+// isUnder returns whether path is dir or is inside dir.
+func isUnder(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+func validateDigest(field string, d digest.Digest) error {
+	if d == "" {
+		return nil
+	}
+	if !d.Algorithm().Available() {
+		return fmt.Errorf("field `%s` refers to an unavailable digest algorithm %q, must be one of %q, %q, or %q",
+			field, d.Algorithm(), digest.SHA256, digest.SHA384, digest.SHA512)
+	}
+	if err := d.Validate(); err != nil {
+		return fmt.Errorf("field `%s` is invalid: %s: %w", field, d.String(), err)
 	}
 	return nil
 }
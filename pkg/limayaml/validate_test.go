@@ -0,0 +1,547 @@
+package limayaml
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lima-vm/lima/pkg/osutil"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+func TestValidateHostname(t *testing.T) {
+	for _, hostname := range []string{"lima-default", "lima.example.com", "a", "0lima", strings.Repeat("a", 63)} {
+		assert.NilError(t, validateHostname(hostname), hostname)
+	}
+	for _, hostname := range []string{"", "lima_default", "-lima", "lima-", "lima..example.com", "lima.example.com.", strings.Repeat("a", 64)} {
+		assert.Assert(t, validateHostname(hostname) != nil, hostname)
+	}
+}
+
+func TestLocaleRegexp(t *testing.T) {
+	for _, locale := range []string{"C", "POSIX", "C.UTF-8", "en_US.UTF-8", "ja_JP.eucJP", "de_DE@euro", "ca_ES.UTF-8@valencia", "ast", "en"} {
+		assert.Assert(t, localeRegexp.MatchString(locale), locale)
+	}
+	for _, locale := range []string{"", "en_us.UTF-8", "EN_US", "en_US.", "en_US.UTF-8; rm -rf /", "en_US UTF-8"} {
+		assert.Assert(t, !localeRegexp.MatchString(locale), locale)
+	}
+}
+
+func TestPackageNameRegexp(t *testing.T) {
+	for _, p := range []string{"vim", "g++", "libc6:arm64", "curl=7.74.0-1", "curl-7.76.1", "python3.9"} {
+		assert.Assert(t, packageNameRegexp.MatchString(p), p)
+	}
+	for _, p := range []string{"", "-vim", "vim curl", "vim;reboot", "$(reboot)", `vim"`, "vim\ncurl"} {
+		assert.Assert(t, !packageNameRegexp.MatchString(p), p)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: "https://example.com/image.img"
+provision:
+- mode: system
+  script: "#!/bin/sh"
+- mode: foo
+  script: "#!/bin/sh"
+- mode: bar
+  script: "#!/bin/sh"
+packages:
+- "vim; reboot"
+hostResolver:
+  timeout: "-1s"
+`), "lima.yaml")
+	assert.NilError(t, err)
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "4 errors occurred")
+	assert.ErrorContains(t, err, "field `provision[1].mode` must be one of")
+	assert.ErrorContains(t, err, "field `provision[2].mode` must be one of")
+	assert.ErrorContains(t, err, "field `packages[0]` must be a package name")
+	assert.ErrorContains(t, err, "field `hostResolver.timeout` must be positive")
+}
+
+func TestValidateMountLocation(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+`), "lima.yaml")
+	assert.NilError(t, err)
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+	file := filepath.Join(dir, "file")
+	assert.NilError(t, os.WriteFile(file, nil, 0644))
+
+	// The host agent creates a missing writable mount, such as the default /tmp/lima
+	y.Mounts = []Mount{{Location: missing, Writable: true}}
+	assert.NilError(t, Validate(*y, true))
+
+	// A missing read-only mount would be mounted as an empty directory
+	y.Mounts = []Mount{{Location: missing}}
+	assert.NilError(t, Validate(*y, false))
+	assert.ErrorContains(t, Validate(*y, true), fmt.Sprintf("field `mounts[0].location` refers to a non-existent path: %q", missing))
+
+	for _, writable := range []bool{false, true} {
+		y.Mounts = []Mount{{Location: file, Writable: writable}}
+		assert.ErrorContains(t, Validate(*y, false), fmt.Sprintf("field `mounts[0].location` refers to a non-directory path: %q", file))
+	}
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+`), "lima.yaml")
+	assert.NilError(t, err)
+	dir := t.TempDir()
+
+	y.Mounts = []Mount{{Location: dir, Writable: true, Options: []string{"cache=no"}}}
+	assert.NilError(t, Validate(*y, false))
+
+	for o, expected := range map[string]string{
+		"":                "must not be empty",
+		"cache=no,follow": "must be a single option",
+		"rw":              "must not be \"rw\", use `mounts[0].writable` instead",
+		"ro":              "must not be \"ro\", use `mounts[0].writable` instead",
+	} {
+		y.Mounts = []Mount{{Location: dir, Options: []string{"cache=no", o}}}
+		assert.ErrorContains(t, Validate(*y, false), "field `mounts[0].options[1]` "+expected, o)
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+user:
+  name: Foo
+  uid: 0
+`), "lima.yaml")
+	assert.NilError(t, err)
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "2 errors occurred")
+	assert.ErrorContains(t, err, "field `user.name` must be a valid Linux user name")
+	assert.ErrorContains(t, err, "field `user.uid` must be a positive integer, got 0")
+
+	y.User = User{Name: "root"}
+	assert.ErrorContains(t, Validate(*y, false), "field `user.name` must not be \"root\"")
+
+	y.User = User{Name: "lima", UID: &[]int{1000}[0]}
+	assert.NilError(t, Validate(*y, false))
+	name, uid, err := GuestUser(y, false)
+	assert.NilError(t, err)
+	assert.Equal(t, name, "lima")
+	assert.Equal(t, uid, 1000)
+
+	// The fields that are not set default to the ones of the user of the host
+	u, err := osutil.LimaUser(false)
+	assert.NilError(t, err)
+	y.User = User{Name: "lima"}
+	name, uid, err = GuestUser(y, false)
+	assert.NilError(t, err)
+	assert.Equal(t, name, "lima")
+	assert.Equal(t, strconv.Itoa(uid), u.Uid)
+	y.User = User{UID: &[]int{1000}[0]}
+	name, uid, err = GuestUser(y, false)
+	assert.NilError(t, err)
+	assert.Equal(t, name, u.Username)
+	assert.Equal(t, uid, 1000)
+}
+
+func TestValidateProvisionCondition(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+arch: x86_64
+distro: ubuntu
+provision:
+- script: "#!/bin/sh"
+  condition:
+    arch: aarch64
+- script: "#!/bin/sh"
+  condition:
+    arch: x86_64
+    distro: ubuntu
+`), "lima.yaml")
+	assert.NilError(t, err)
+	assert.NilError(t, Validate(*y, false))
+	matching := MatchingProvision(y)
+	assert.Equal(t, len(matching), 1)
+	assert.Equal(t, matching[0].Condition.Arch, X8664)
+
+	y.Provision[1].Condition.Distro = "debian"
+	assert.ErrorContains(t, Validate(*y, false), "field `provision` must have a script matching arch \"x86_64\" and distro \"ubuntu\"")
+
+	y.Provision[1].Condition = &ProvisionCondition{}
+	assert.ErrorContains(t, Validate(*y, false), "field `provision[1].condition` must have `arch` or `distro`")
+
+	y.Provision[1].Condition = &ProvisionCondition{Arch: "amd64"}
+	assert.ErrorContains(t, Validate(*y, false), "field `provision[1].condition.arch` must be \"x86_64\" or \"aarch64\", got \"amd64\"")
+
+	y.Provision[1].Condition = &ProvisionCondition{Distro: "Ubuntu 22.04"}
+	assert.ErrorContains(t, Validate(*y, false), "field `provision[1].condition.distro` must be the ID of os-release(5)")
+
+	y.Provision[1].Condition = &ProvisionCondition{Distro: "ubuntu"}
+	y.Distro = ""
+	assert.ErrorContains(t, Validate(*y, false), "field `provision[1].condition.distro` requires field `distro` to be set")
+
+	y.Provision[1].Condition = nil
+	assert.NilError(t, Validate(*y, false))
+}
+
+func TestValidateProvisionScript(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+provision:
+- script: "#!/bin/sh\r\ntrue\r\n"
+`), "lima.yaml")
+	assert.NilError(t, err)
+	// CRLF line endings are only warned about
+	assert.NilError(t, Validate(*y, true))
+
+	y.Provision[0].Script = " \n"
+	assert.ErrorContains(t, Validate(*y, false), "field `provision[0].script` (mode \"system\") must not be empty")
+
+	// The interpreter directive is only required when warn is set, so that existing instances can still be loaded
+	y.Provision[0].Script = "apt-get install -y foo"
+	assert.NilError(t, Validate(*y, false))
+	assert.ErrorContains(t, Validate(*y, true), "field `provision[0].script` (mode \"system\") must start with an interpreter directive")
+}
+
+func TestValidateDigest(t *testing.T) {
+	for _, d := range []digest.Digest{
+		"",
+		digest.FromString("foo"),
+		digest.SHA384.FromString("foo"),
+		digest.SHA512.FromString("foo"),
+	} {
+		assert.NilError(t, validateDigest("containerd.archives[0].digest", d), d)
+	}
+	// BLAKE3 is not implemented by go-digest v1.0.0, and is reported as such rather than as a malformed digest
+	assert.ErrorContains(t, validateDigest("containerd.archives[0].digest", digest.NewDigestFromEncoded("blake3", digest.FromString("foo").Encoded())),
+		"field `containerd.archives[0].digest` refers to an unavailable digest algorithm \"blake3\", must be one of \"sha256\", \"sha384\", or \"sha512\"")
+	assert.ErrorContains(t, validateDigest("images[0].digest", "sha512:bogus"), "field `images[0].digest` is invalid")
+}
+
+func TestValidateCopyToGuest(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "foo.conf")
+	assert.NilError(t, os.WriteFile(source, nil, 0644))
+	f := CopyToGuest{Source: source, Destination: "/etc/foo.conf", Mode: "0644"}
+	assert.NilError(t, validateCopyToGuest(0, f, true))
+
+	for _, dest := range []string{"etc/foo.conf", "/etc/../foo.conf", "/", "/etc/foo bar.conf", "/etc/$(reboot)"} {
+		f := f
+		f.Destination = dest
+		assert.ErrorContains(t, validateCopyToGuest(0, f, false), "field `copyToGuest[0].destination`", dest)
+	}
+	for _, mode := range []string{"", "0999", "rw-r--r--", "10000"} {
+		f := f
+		f.Mode = mode
+		assert.ErrorContains(t, validateCopyToGuest(0, f, false), "field `copyToGuest[0].mode`", mode)
+	}
+
+	f.Source = filepath.Join(t.TempDir(), "non-existent.conf")
+	assert.NilError(t, validateCopyToGuest(0, f, false))
+	assert.ErrorContains(t, validateCopyToGuest(0, f, true), "field `copyToGuest[0].source` refers to an inaccessible file")
+}
+
+func TestValidateCIDataFormat(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+cidata:
+  format: ignition
+packages:
+- vim
+`), "lima.yaml")
+	assert.NilError(t, err)
+	assert.ErrorContains(t, Validate(*y, false), "field `packages` is not supported with `cidata.format: ignition`")
+
+	y.Packages = nil
+	assert.NilError(t, Validate(*y, false))
+
+	y.CIData.UserDataTemplate = "/user-data.tmpl"
+	assert.ErrorContains(t, Validate(*y, false), "field `cidata.userDataTemplate` is not supported with `cidata.format: ignition`")
+
+	y.CIData.UserDataTemplate = ""
+	y.CIData.Format = "cloud-config"
+	assert.ErrorContains(t, Validate(*y, false), "field `cidata.format` must be")
+}
+
+func TestValidateCIDataFilesystem(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+cidata:
+  filesystem: vfat
+`), "lima.yaml")
+	assert.NilError(t, err)
+	assert.NilError(t, Validate(*y, false))
+
+	y.CIData.Filesystem = "ext4"
+	assert.ErrorContains(t, Validate(*y, false), "field `cidata.filesystem` must be \"iso9660\" or \"vfat\", got \"ext4\"")
+}
+
+func TestValidateDNSSearchDomains(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+dnsSearchDomains:
+- corp.example.com
+- "-bad.example.com"
+- "example.com nameserver 1.2.3.4"
+`), "lima.yaml")
+	assert.NilError(t, err)
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "2 errors occurred")
+	assert.ErrorContains(t, err, "field `dnsSearchDomains[1]` must be a valid DNS name")
+	assert.ErrorContains(t, err, "field `dnsSearchDomains[2]` must be a valid DNS name")
+}
+
+func TestValidateHostResolverForward(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+hostResolver:
+  forward:
+  - domain: corp.example.com
+    types: ["SRV", "txt", "BOGUS"]
+    nameservers:
+    - 10.0.0.53
+  - domain: "bad domain"
+    nameservers: []
+  - domain: example.org
+    nameservers:
+    - ns.example.org
+`), "lima.yaml")
+	assert.NilError(t, err)
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "4 errors occurred")
+	assert.ErrorContains(t, err, "field `hostResolver.forward[0].types[2]` must be a DNS record type")
+	assert.ErrorContains(t, err, "field `hostResolver.forward[1].domain` must be a valid DNS name")
+	assert.ErrorContains(t, err, "field `hostResolver.forward[1].nameservers` must not be empty")
+	assert.ErrorContains(t, err, "field `hostResolver.forward[2].nameservers[0]` must be an IP address")
+}
+
+func TestValidateHostResolverOrder(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+hostResolver:
+  order:
+  - 10.0.0.53
+  - ns.example.org
+  - "::ffff:10.0.0.53"
+`), "lima.yaml")
+	assert.NilError(t, err)
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "2 errors occurred")
+	assert.ErrorContains(t, err, "field `hostResolver.order[1]` must be an IP address")
+	assert.ErrorContains(t, err, "field `hostResolver.order[2]` duplicates field `hostResolver.order[0]`")
+}
+
+func TestValidateHostResolverFallback(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+hostResolver:
+  fallback:
+  - 10.0.0.53
+  - dns.example.org
+  - 2001:db8::53
+`), "lima.yaml")
+	assert.NilError(t, err)
+	assert.ErrorContains(t, Validate(*y, false), "field `hostResolver.fallback[1]` must be an IP address, got \"dns.example.org\"")
+
+	y.HostResolver.Fallback = []string{"10.0.0.53", "2001:db8::53"}
+	assert.NilError(t, Validate(*y, false))
+}
+
+func TestValidateHostResolverRewrite(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+hostResolver:
+  rewrite:
+  - from: staging.example.com
+    to: prod.example.com
+  - from: Staging.Example.com.
+    to: other.example.com
+  - from: "bad domain"
+    to: prod.example.com
+  - from: dev.example.com
+    to: dev.example.com
+`), "lima.yaml")
+	assert.NilError(t, err)
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "3 errors occurred")
+	assert.ErrorContains(t, err, "field `hostResolver.rewrite[1].from` duplicates field `hostResolver.rewrite[0].from`")
+	assert.ErrorContains(t, err, "field `hostResolver.rewrite[2].from` must be a valid DNS name")
+	assert.ErrorContains(t, err, "field `hostResolver.rewrite[3].to` must differ from field `hostResolver.rewrite[3].from`")
+}
+
+func TestValidateHostResolverTLDs(t *testing.T) {
+	assert.Equal(t, len(validateHostResolverTLDs(HostResolverTLDs{Allow: []string{"corp", ".local"}, Upstream: []string{"1.1.1.1"}})), 0)
+	assert.Equal(t, len(validateHostResolverTLDs(HostResolverTLDs{Deny: []string{"com"}})), 0)
+
+	errs := validateHostResolverTLDs(HostResolverTLDs{
+		Allow:    []string{"corp", "example.com", "CORP"},
+		Deny:     []string{"-bad"},
+		Upstream: []string{"dns.google"},
+	})
+	assert.Equal(t, len(errs), 5)
+	assert.Error(t, errs[0], "field `hostResolver.tlds.allow` and field `hostResolver.tlds.deny` are mutually exclusive")
+	assert.Error(t, errs[1], "field `hostResolver.tlds.allow[1]` must be a top-level domain such as \"corp\", got \"example.com\"")
+	assert.Error(t, errs[2], "field `hostResolver.tlds.allow[2]` duplicates field `hostResolver.tlds.allow[0]` (\"CORP\")")
+	assert.Error(t, errs[3], "field `hostResolver.tlds.deny[0]` must be a top-level domain such as \"corp\", got \"-bad\"")
+	assert.Error(t, errs[4], "field `hostResolver.tlds.upstream[0]` must be an IP address, got \"dns.google\"")
+
+	errs = validateHostResolverTLDs(HostResolverTLDs{Upstream: []string{"1.1.1.1"}})
+	assert.Equal(t, len(errs), 1)
+	assert.ErrorContains(t, errs[0], "field `hostResolver.tlds.upstream` requires")
+}
+
+func TestValidateHostResolverMDNS(t *testing.T) {
+	y, err := Load([]byte(`
+images:
+- location: /image
+hostResolver:
+  mdns:
+    mode: forward
+    responder: "127.0.0.1:5353"
+`), "lima.yaml")
+	assert.NilError(t, err)
+	assert.NilError(t, Validate(*y, false))
+
+	y.HostResolver.MDNS = HostResolverMDNS{Mode: "multicast", Responder: "224.0.0.251"}
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "field `hostResolver.mdns.mode` must be one of \"host\", \"refuse\", \"notimp\", or \"forward\", got \"multicast\"")
+	assert.ErrorContains(t, err, "field `hostResolver.mdns.responder` is invalid")
+
+	assert.NilError(t, ValidateMDNSResponder("[ff02::fb]:5353"))
+	assert.ErrorContains(t, ValidateMDNSResponder("mdns.local:5353"), "is not an IP address")
+	assert.ErrorContains(t, ValidateMDNSResponder("224.0.0.251:0"), "is not a port number")
+}
+
+func TestValidateHostResolverMaxUDPSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int
+		ok   bool
+	}{{0, true}, {512, true}, {1232, true}, {65535, true}, {511, false}, {65536, false}, {-1, false}} {
+		y, err := Load([]byte(fmt.Sprintf("images: [{location: /image}]\nhostResolver: {maxUDPSize: %d}\n", tc.size)), "lima.yaml")
+		assert.NilError(t, err)
+		err = Validate(*y, false)
+		if tc.ok {
+			assert.NilError(t, err, tc.size)
+		} else {
+			assert.ErrorContains(t, err, "field `hostResolver.maxUDPSize` must be 0 or between 512 and 65535", tc.size)
+		}
+	}
+}
+
+func TestParseHostResolverRecord(t *testing.T) {
+	rr, err := ParseHostResolverRecord(`_config.internal TXT "key=value"`)
+	assert.NilError(t, err)
+	assert.Equal(t, rr.Header().Name, "_config.internal.")
+	assert.Equal(t, rr.Header().Ttl, uint32(DefaultHostResolverRecordTTL))
+
+	rr, err = ParseHostResolverRecord("_ldap._tcp.corp.internal. 300 IN SRV 0 0 389 ldap.corp.internal.")
+	assert.NilError(t, err)
+	assert.Equal(t, rr.Header().Ttl, uint32(300))
+
+	for s, expected := range map[string]string{
+		"":                               "must not be empty",
+		"_config.internal. TXT":          "must have a string",
+		"db.internal. A 192.0.2.1":       "must be of the type TXT or SRV, got A",
+		"_config.internal. CH TXT \"a\"": "must be of the class IN",
+		"_config.internal. SRV 0 0":      "dns:",
+		"a. TXT \"a\"\nb. TXT \"b\"":     "must be a single line",
+	} {
+		_, err := ParseHostResolverRecord(s)
+		assert.ErrorContains(t, err, expected, s)
+	}
+}
+
+func TestParseDNSOption(t *testing.T) {
+	for _, tc := range []struct {
+		s, name, value string
+	}{
+		{"ndots:2", "ndots", "2"},
+		{"ndots:0", "ndots", "0"},
+		{"timeout:30", "timeout", "30"},
+		{"attempts:1", "attempts", "1"},
+		{"rotate", "rotate", ""},
+		{"single-request-reopen", "single-request-reopen", ""},
+	} {
+		name, value, err := ParseDNSOption(tc.s)
+		assert.NilError(t, err, tc.s)
+		assert.Equal(t, name, tc.name, tc.s)
+		assert.Equal(t, value, tc.value, tc.s)
+	}
+	for _, tc := range []struct {
+		s, err string
+	}{
+		{"ndots", "must be ndots:N with N between 0 and 15"},
+		{"ndots:16", "must be ndots:N with N between 0 and 15"},
+		{"timeout:0", "must be timeout:N with N between 1 and 30"},
+		{"attempts:x", "must be attempts:N with N between 1 and 5"},
+		{"rotate:1", "must not have a value"},
+		{"ndots 2", "unknown option"},
+		{"inet6", "unknown option"},
+	} {
+		_, _, err := ParseDNSOption(tc.s)
+		assert.ErrorContains(t, err, tc.err, tc.s)
+	}
+
+	y, err := Load([]byte(`
+images:
+- location: /image
+dnsOptions: ["ndots:2", "rotate", "ndots:3", "bogus"]
+`), "lima.yaml")
+	assert.NilError(t, err)
+	err = Validate(*y, false)
+	assert.ErrorContains(t, err, "2 errors occurred")
+	assert.ErrorContains(t, err, "field `dnsOptions[2]` duplicates field `dnsOptions[0]` (\"ndots\")")
+	assert.ErrorContains(t, err, "field `dnsOptions[3]` is invalid: unknown option \"bogus\"")
+}
+
+func TestValidateDNS64Prefix(t *testing.T) {
+	for _, prefix := range []string{"64:ff9b::/96", "2001:db8::/32", "2001:db8:100::/40", "2001:db8:122::/48", "2001:db8:122:300::/56", "2001:db8:122:344::/64"} {
+		assert.NilError(t, ValidateDNS64Prefix(prefix), prefix)
+	}
+	for _, prefix := range []string{"", "64:ff9b::", "192.0.2.0/24", "64:ff9b::/80", "64:ff9b::1/96", "2001:db8:0:0:ff00::/96"} {
+		assert.Assert(t, ValidateDNS64Prefix(prefix) != nil, prefix)
+	}
+}
+
+func TestValidateDNSPrecedence(t *testing.T) {
+	testCases := []struct {
+		yaml     string
+		expected string // empty for no error
+	}{
+		{"useHostResolver: true", ""},
+		{"useHostResolver: false\ndns: [1.1.1.1]", ""},
+		{"useHostResolver: true\ndns: [1.1.1.1]", "field `dns` must be empty when field `useHostResolver` is true"},
+		{"dnsPrecedence: hostResolver\nuseHostResolver: true\ndns: [1.1.1.1]", ""},
+		{"dnsPrecedence: hostResolver\nuseHostResolver: false", "field `useHostResolver` must be true"},
+		{"dnsPrecedence: dns\nuseHostResolver: false\ndns: [1.1.1.1]", ""},
+		{"dnsPrecedence: dns\nuseHostResolver: true\ndns: [1.1.1.1]", "field `useHostResolver` must be false"},
+		{"dnsPrecedence: dns\nuseHostResolver: false", "field `dns` must not be empty"},
+		{"dnsPrecedence: host", "field `dnsPrecedence` must be"},
+	}
+	for _, tc := range testCases {
+		y, err := Load([]byte("images: [{location: /image}]\n"+tc.yaml), "lima.yaml")
+		assert.NilError(t, err)
+		err = Validate(*y, false)
+		if tc.expected == "" {
+			assert.NilError(t, err, tc.yaml)
+		} else {
+			assert.ErrorContains(t, err, tc.expected, tc.yaml)
+		}
+	}
+}
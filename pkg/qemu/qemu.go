@@ -255,7 +255,17 @@ func Cmdline(cfg Config) (string, []string, error) {
 		args = append(args, "-drive", fmt.Sprintf("file=%s,if=virtio", baseDisk))
 	}
 	// cloud-init
-	args = append(args, "-cdrom", filepath.Join(cfg.InstanceDir, filenames.CIDataISO))
+	cidataPath := filepath.Join(cfg.InstanceDir, filenames.CIDataISO)
+	if y.CIData.Filesystem == limayaml.CIDataFilesystemVFAT {
+		// The guests without ISO9660 support typically lack the CD-ROM drivers too
+		args = append(args, "-drive", fmt.Sprintf("file=%s,if=virtio,format=raw,readonly=on", cidataPath))
+	} else {
+		args = append(args, "-cdrom", cidataPath)
+	}
+	if y.CIData.Format == limayaml.CIDataFormatIgnition {
+		// Ignition (Fedora CoreOS, Flatcar) reads the config from the firmware config device
+		args = append(args, "-fw_cfg", "name=opt/com.coreos/config,file="+filepath.Join(cfg.InstanceDir, filenames.IgnitionConfig))
+	}
 
 	// Network
 	args = append(args, "-netdev", fmt.Sprintf("user,id=net0,net=%s,dhcpstart=%s,hostfwd=tcp:127.0.0.1:%d-:22",
@@ -1,12 +1,15 @@
 package sshutil
 
 import (
+	"bytes"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/lima-vm/lima/pkg/lockutil"
@@ -14,6 +17,7 @@ import (
 	"github.com/lima-vm/lima/pkg/store/dirnames"
 	"github.com/lima-vm/lima/pkg/store/filenames"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
 type PubKey struct {
@@ -34,6 +38,86 @@ func readPublicKey(f string) (PubKey, error) {
 	return entry, err
 }
 
+// minRSAKeyBits is the minimum recommended length of RSA keys.
+const minRSAKeyBits = 3072
+
+// checkPubKey parses the authorized_keys line of a public key, and returns the comment of the key.
+// An error is returned for malformed and unsupported keys.
+// For a weak key, weakness describes why the key is weak.
+func checkPubKey(content string) (comment, weakness string, err error) {
+	pk, comment, _, rest, err := ssh.ParseAuthorizedKey([]byte(content))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse the key: %w", err)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return comment, "", errors.New("expected a single key")
+	}
+	switch pk.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoSKECDSA256:
+		return comment, "", nil
+	case ssh.KeyAlgoRSA:
+		cpk, ok := pk.(ssh.CryptoPublicKey)
+		if !ok {
+			return comment, "", fmt.Errorf("unexpected RSA key %T", pk)
+		}
+		rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			return comment, "", fmt.Errorf("unexpected RSA key %T", cpk.CryptoPublicKey())
+		}
+		if bits := rsaKey.N.BitLen(); bits < minRSAKeyBits {
+			return comment, fmt.Sprintf("RSA key of %d bits is shorter than the recommended %d bits", bits, minRSAKeyBits), nil
+		}
+		return comment, "", nil
+	case ssh.KeyAlgoDSA:
+		return comment, "DSA keys are deprecated and disabled by default since OpenSSH 7.0", nil
+	default:
+		return comment, "", fmt.Errorf("unsupported key type %q", pk.Type())
+	}
+}
+
+// FilterPubKeys returns the keys that can be used as the authorized keys of the guest.
+// Malformed and unsupported keys are skipped with a warning.
+// Weak keys (DSA keys, and RSA keys shorter than 3072 bits) are skipped with a warning too, unless allowWeak is true.
+func FilterPubKeys(keys []PubKey, allowWeak bool) []PubKey {
+	return filterPubKeys(keys, allowWeak, true)
+}
+
+// UsablePubKeys is like FilterPubKeys, but does not log the skipped keys.
+func UsablePubKeys(keys []PubKey, allowWeak bool) []PubKey {
+	return filterPubKeys(keys, allowWeak, false)
+}
+
+func filterPubKeys(keys []PubKey, allowWeak, verbose bool) []PubKey {
+	var res []PubKey
+	for _, key := range keys {
+		comment, weakness, err := checkPubKey(key.Content)
+		desc := strconv.Quote(key.Filename)
+		if comment != "" {
+			desc += fmt.Sprintf(" (%s)", comment)
+		}
+		if err != nil {
+			if verbose {
+				logrus.WithError(err).Warnf("skipping the SSH public key %s", desc)
+			}
+			continue
+		}
+		if weakness != "" {
+			if !allowWeak {
+				if verbose {
+					logrus.Warnf("skipping the weak SSH public key %s: %s (set `ssh.allowWeakPubKeys` to include it)", desc, weakness)
+				}
+				continue
+			}
+			if verbose {
+				logrus.Warnf("including the weak SSH public key %s: %s", desc, weakness)
+			}
+		}
+		res = append(res, key)
+	}
+	return res
+}
+
 // DefaultPubKeys returns the public key from $LIMA_HOME/_config/user.pub.
 // The key will be created if it does not yet exist.
 //
@@ -173,21 +257,19 @@ func CommonArgs(useDotSSH bool) ([]string, error) {
 	return args, nil
 }
 
-func SSHArgs(instDir string, useDotSSH bool) ([]string, error) {
+// SSHArgs returns the arguments of ssh for logging in to the instance of instDir as user, the user of the guest
+// (see limayaml.GuestUser).
+func SSHArgs(instDir, user string, useDotSSH bool) ([]string, error) {
 	controlSock := filepath.Join(instDir, filenames.SSHSock)
 	if len(controlSock) >= osutil.UnixPathMax {
 		return nil, fmt.Errorf("socket path %q is too long: >= UNIX_PATH_MAX=%d", controlSock, osutil.UnixPathMax)
 	}
-	u, err := osutil.LimaUser(false)
-	if err != nil {
-		return nil, err
-	}
 	args, err := CommonArgs(useDotSSH)
 	if err != nil {
 		return nil, err
 	}
 	args = append(args,
-		"-o", fmt.Sprintf("User=%s", u.Username), // guest and host have the same username, but we should specify the username explicitly (#85)
+		"-o", fmt.Sprintf("User=%s", user), // the user of the guest may differ from the user of the host (`user.name`), so it is always specified (#85)
 		"-o", "ControlMaster=auto",
 		"-o", fmt.Sprintf("ControlPath=\"%s\"", controlSock),
 		"-o", "ControlPersist=5m",
@@ -1,6 +1,18 @@
 package sshutil
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"gotest.tools/v3/assert"
+)
 
 func TestDefaultPubKeys(t *testing.T) {
 	keys, _ := DefaultPubKeys(true)
@@ -9,3 +21,58 @@ func TestDefaultPubKeys(t *testing.T) {
 		t.Logf("%s: %q", key.Filename, key.Content)
 	}
 }
+
+func authorizedKey(t *testing.T, key interface{}, comment string) string {
+	pk, err := ssh.NewPublicKey(key)
+	assert.NilError(t, err)
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))) + " " + comment
+}
+
+// rsaPublicKey returns an RSA public key of the specified length, without the cost of generating a private key.
+func rsaPublicKey(bits int) *rsa.PublicKey {
+	n := new(big.Int).Lsh(big.NewInt(1), uint(bits-1))
+	return &rsa.PublicKey{N: n.Add(n, big.NewInt(1)), E: 65537}
+}
+
+func TestCheckPubKey(t *testing.T) {
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NilError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	comment, weakness, err := checkPubKey(authorizedKey(t, ed25519Key, "foo@example.com"))
+	assert.NilError(t, err)
+	assert.Equal(t, comment, "foo@example.com")
+	assert.Equal(t, weakness, "")
+
+	_, weakness, err = checkPubKey(authorizedKey(t, &ecdsaKey.PublicKey, "ecdsa"))
+	assert.NilError(t, err)
+	assert.Equal(t, weakness, "")
+
+	_, weakness, err = checkPubKey(authorizedKey(t, rsaPublicKey(3072), "rsa3072"))
+	assert.NilError(t, err)
+	assert.Equal(t, weakness, "")
+
+	comment, weakness, err = checkPubKey(authorizedKey(t, rsaPublicKey(2048), "rsa2048"))
+	assert.NilError(t, err)
+	assert.Equal(t, comment, "rsa2048")
+	assert.Equal(t, weakness, "RSA key of 2048 bits is shorter than the recommended 3072 bits")
+
+	_, _, err = checkPubKey("ssh-ed25519 garbage")
+	assert.ErrorContains(t, err, "failed to parse the key")
+
+	_, _, err = checkPubKey(authorizedKey(t, ed25519Key, "a") + "\n" + authorizedKey(t, ed25519Key, "b"))
+	assert.ErrorContains(t, err, "expected a single key")
+}
+
+func TestFilterPubKeys(t *testing.T) {
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NilError(t, err)
+	keys := []PubKey{
+		{Filename: "ed25519.pub", Content: authorizedKey(t, ed25519Key, "ed25519")},
+		{Filename: "rsa.pub", Content: authorizedKey(t, rsaPublicKey(1024), "rsa")},
+		{Filename: "broken.pub", Content: "ssh-rsa broken"},
+	}
+	assert.DeepEqual(t, FilterPubKeys(keys, false), keys[:1])
+	assert.DeepEqual(t, FilterPubKeys(keys, true), keys[:2])
+}
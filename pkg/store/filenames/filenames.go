@@ -25,6 +25,8 @@ const (
 const (
 	LimaYAML           = "lima.yaml"
 	CIDataISO          = "cidata.iso"
+	CIDataISODigest    = "cidata.iso.digest"
+	IgnitionConfig     = "ignition.json"
 	BaseDisk           = "basedisk"
 	DiffDisk           = "diffdisk"
 	QemuPID            = "qemu.pid"
@@ -35,6 +37,9 @@ const (
 	GuestAgentSock     = "ga.sock"
 	HostAgentPID       = "ha.pid"
 	HostAgentSock      = "ha.sock"
+	DNSSock            = "dns.sock"
+	DNSDgramSock       = "dns.dgram.sock"
+	DNSLocalPorts      = "dns.ports"
 	HostAgentStdoutLog = "ha.stdout.log"
 	HostAgentStderrLog = "ha.stderr.log"
 )